@@ -0,0 +1,264 @@
+// Command import bulk-loads users with existing password hashes into an
+// application through the POST /api/applications/{id}/users/import endpoint.
+//
+// Input is either JSON (an array of user records, or one record per line) or
+// CSV with the header
+//
+//	email,first_name,last_name,hash_algorithm,password_hash,salt,iterations,salt_position,hash_encoding
+//
+// JSON records use the same shape as the endpoint:
+//
+//	{"email": "...", "firstName": "...", "lastName": "...",
+//	 "password": {"algorithm": "pbkdf2-sha256", "hash": "...", "salt": "...", "iterations": 310000}}
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type password struct {
+	Algorithm    string `json:"algorithm"`
+	Hash         string `json:"hash"`
+	Salt         string `json:"salt,omitempty"`
+	Iterations   int    `json:"iterations,omitempty"`
+	SaltPosition string `json:"saltPosition,omitempty"`
+	Encoding     string `json:"encoding,omitempty"`
+}
+
+type userRecord struct {
+	Email     string   `json:"email"`
+	FirstName string   `json:"firstName"`
+	LastName  string   `json:"lastName"`
+	Password  password `json:"password"`
+}
+
+type firebaseConfig struct {
+	SignerKey     string `json:"signerKey"`
+	SaltSeparator string `json:"saltSeparator"`
+	Rounds        int    `json:"rounds"`
+	MemCost       int    `json:"memCost"`
+}
+
+type importRequest struct {
+	Users    []userRecord    `json:"users"`
+	Firebase *firebaseConfig `json:"firebase,omitempty"`
+}
+
+type importError struct {
+	Index   int    `json:"index"`
+	Email   string `json:"email"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type importResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Data    struct {
+		Imported int           `json:"imported"`
+		Skipped  int           `json:"skipped"`
+		Errors   []importError `json:"errors"`
+	} `json:"data"`
+}
+
+func main() {
+	var (
+		baseURL   = flag.String("url", envOr("AUTH_SERVICE_URL", "http://localhost:8080"), "auth service base URL")
+		token     = flag.String("token", os.Getenv("AUTH_SERVICE_TOKEN"), "developer JWT")
+		appID     = flag.String("app", "", "application ID to import into")
+		file      = flag.String("file", "", "JSON or CSV file of users")
+		format    = flag.String("format", "", "input format: json or csv (default: from file extension)")
+		batchSize = flag.Int("batch", 500, "users per request (max 1000)")
+
+		fbSignerKey = flag.String("firebase-signer-key", "", "Firebase scrypt signer key (base64)")
+		fbSeparator = flag.String("firebase-salt-separator", "", "Firebase scrypt salt separator (base64)")
+		fbRounds    = flag.Int("firebase-rounds", 0, "Firebase scrypt rounds")
+		fbMemCost   = flag.Int("firebase-mem-cost", 0, "Firebase scrypt memory cost")
+	)
+	flag.Parse()
+
+	if *token == "" || *appID == "" || *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*file)), ".")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("failed to open %s: %v", *file, err)
+	}
+	defer f.Close()
+
+	var users []userRecord
+	switch *format {
+	case "json", "jsonl", "ndjson":
+		users, err = readJSON(f)
+	case "csv":
+		users, err = readCSV(f)
+	default:
+		log.Fatalf("unsupported format %q", *format)
+	}
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", *file, err)
+	}
+
+	var firebase *firebaseConfig
+	if *fbSignerKey != "" {
+		firebase = &firebaseConfig{
+			SignerKey:     *fbSignerKey,
+			SaltSeparator: *fbSeparator,
+			Rounds:        *fbRounds,
+			MemCost:       *fbMemCost,
+		}
+	}
+
+	endpoint := strings.TrimRight(*baseURL, "/") + "/api/applications/" + *appID + "/users/import"
+	client := &http.Client{Timeout: 5 * time.Minute}
+
+	var imported, skipped int
+	for start := 0; start < len(users); start += *batchSize {
+		end := min(start+*batchSize, len(users))
+		resp, err := postBatch(client, endpoint, *token, importRequest{Users: users[start:end], Firebase: firebase})
+		if err != nil {
+			log.Fatalf("batch starting at record %d failed: %v", start, err)
+		}
+		imported += resp.Data.Imported
+		skipped += resp.Data.Skipped
+		for _, e := range resp.Data.Errors {
+			fmt.Printf("record %d (%s): %s: %s\n", start+e.Index, e.Email, e.Code, e.Message)
+		}
+		log.Printf("imported %d/%d users", end, len(users))
+	}
+
+	fmt.Printf("done: %d imported, %d skipped\n", imported, skipped)
+}
+
+func postBatch(client *http.Client, endpoint, token string, batch importRequest) (*importResponse, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp importResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("unexpected response (%s): %w", res.Status, err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("%s: %s", res.Status, resp.Error)
+	}
+	return &resp, nil
+}
+
+// readJSON accepts a JSON array of records or a stream of records, such as
+// one object per line
+func readJSON(r io.Reader) ([]userRecord, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+
+	first, err := br.Peek(1)
+	for err == nil && strings.TrimSpace(string(first)) == "" {
+		br.ReadByte()
+		first, err = br.Peek(1)
+	}
+	if err == nil && first[0] == '[' {
+		var users []userRecord
+		return users, dec.Decode(&users)
+	}
+
+	var users []userRecord
+	for {
+		var u userRecord
+		if err := dec.Decode(&u); err == io.EOF {
+			return users, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(users), err)
+		}
+		users = append(users, u)
+	}
+}
+
+func readCSV(r io.Reader) ([]userRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, fmt.Errorf("missing email column")
+	}
+
+	var users []userRecord
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		var iterations int
+		if v := field("iterations"); v != "" {
+			if iterations, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("line %d: invalid iterations %q", line, v)
+			}
+		}
+		users = append(users, userRecord{
+			Email:     field("email"),
+			FirstName: field("first_name"),
+			LastName:  field("last_name"),
+			Password: password{
+				Algorithm:    field("hash_algorithm"),
+				Hash:         field("password_hash"),
+				Salt:         field("salt"),
+				Iterations:   iterations,
+				SaltPosition: field("salt_position"),
+				Encoding:     field("hash_encoding"),
+			},
+		})
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
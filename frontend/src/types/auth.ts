@@ -42,10 +42,18 @@ export interface UpdateApplicationRequest {
   domain: string;
 }
 
+export interface FieldError {
+  field: string;
+  code: string;
+  message: string;
+}
+
 export interface APIResponse<T> {
   success: boolean;
   error?: string;
+  code?: string;
   data?: T;
+  errors?: FieldError[];
 }
 
 // Response data types
@@ -61,6 +69,8 @@ export interface ApplicationsListResponse {
 export interface UsersListResponse {
   users: User[];
   count: number;
+  total: number;
+  nextCursor: string;
 }
 
 export interface User {
@@ -70,4 +80,8 @@ export interface User {
   firstName: string;
   lastName: string;
   createdAt: string;
+  emailVerified: boolean;
+  status: string;
+  publicMetadata: Record<string, unknown>;
+  privateMetadata?: Record<string, unknown>;
 }
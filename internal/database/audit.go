@@ -0,0 +1,230 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one mutating action taken through the developer API.
+// The entries of a developer account form a hash chain: Hash covers the
+// entry's fields and the Hash of the entry before it, so editing, inserting
+// or deleting an entry breaks every later link. Entries are also indexed by
+// the application and team acted on, so that a team's admins can read what
+// each of its members did.
+type AuditEntry struct {
+	Seq int64  `json:"seq"`
+	ID  string `json:"id"`
+	// DeveloperID is the account whose chain the entry belongs to, ActorID
+	// the developer who acted
+	DeveloperID   string `json:"developerId"`
+	ActorID       string `json:"actorId"`
+	ApplicationID string `json:"applicationId,omitempty"`
+	TeamID        string `json:"teamId,omitempty"`
+	Action        string `json:"action"`
+	TargetType    string `json:"targetType"`
+	TargetID      string `json:"targetId,omitempty"`
+	IP            string `json:"ip"`
+	UserAgent     string `json:"userAgent"`
+	// Changes maps each changed field to its before and after values
+	Changes   json.RawMessage `json:"changes,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	PrevHash  string          `json:"prevHash"`
+	Hash      string          `json:"hash"`
+}
+
+// auditTimeFormat is how CreatedAt is stored and hashed. The fixed width
+// keeps text comparisons in time order.
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// ComputeHash returns the hash chaining e to PrevHash. Each field is length
+// prefixed so that no two entries hash the same input. TeamID is only
+// hashed when set, which keeps entries written before it existed valid.
+func (e *AuditEntry) ComputeHash() string {
+	h := sha256.New()
+	fields := []string{
+		e.PrevHash, e.ID, e.DeveloperID, e.ActorID, e.ApplicationID, e.Action,
+		e.TargetType, e.TargetID, e.IP, e.UserAgent, string(e.Changes),
+		e.CreatedAt.UTC().Format(auditTimeFormat),
+	}
+	if e.TeamID != "" {
+		fields = append(fields, e.TeamID)
+	}
+	for _, field := range fields {
+		h.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditFilter selects a page of the audit log, newest first. Zero-valued
+// fields are not applied, so callers must set DeveloperID, ApplicationID or
+// TeamID.
+type AuditFilter struct {
+	DeveloperID   string
+	ApplicationID string
+	TeamID        string
+	ActorID       string
+	Action        string
+	TargetID      string
+	Since         time.Time
+	Until         time.Time
+	// BeforeSeq continues from the last entry of the previous page
+	BeforeSeq int64
+	Limit     int
+}
+
+func (f AuditFilter) where() (string, []any) {
+	var clauses []string
+	var args []any
+
+	if f.DeveloperID != "" {
+		clauses = append(clauses, "developer_id = ?")
+		args = append(args, f.DeveloperID)
+	}
+	if f.TeamID != "" {
+		clauses = append(clauses, "team_id = ?")
+		args = append(args, f.TeamID)
+	}
+	if f.ApplicationID != "" {
+		clauses = append(clauses, "application_id = ?")
+		args = append(args, f.ApplicationID)
+	}
+	if f.ActorID != "" {
+		clauses = append(clauses, "actor_id = ?")
+		args = append(args, f.ActorID)
+	}
+	if f.Action != "" {
+		clauses = append(clauses, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.TargetID != "" {
+		clauses = append(clauses, "target_id = ?")
+		args = append(args, f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		clauses = append(clauses, "created_at >= ?")
+		args = append(args, f.Since.UTC().Format(auditTimeFormat))
+	}
+	if !f.Until.IsZero() {
+		clauses = append(clauses, "created_at < ?")
+		args = append(args, f.Until.UTC().Format(auditTimeFormat))
+	}
+	if f.BeforeSeq > 0 {
+		clauses = append(clauses, "seq < ?")
+		args = append(args, f.BeforeSeq)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+const auditColumns = `seq, id, developer_id, actor_id, application_id, team_id, action, target_type,
+	target_id, ip, user_agent, changes, created_at, prev_hash, hash`
+
+func scanAuditEntry(row rowScanner) (*AuditEntry, error) {
+	var e AuditEntry
+	var changes, createdAt string
+	err := row.Scan(&e.Seq, &e.ID, &e.DeveloperID, &e.ActorID, &e.ApplicationID, &e.TeamID, &e.Action,
+		&e.TargetType, &e.TargetID, &e.IP, &e.UserAgent, &changes, &createdAt, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if changes != "" {
+		e.Changes = json.RawMessage(changes)
+	}
+	if e.CreatedAt, err = time.Parse(auditTimeFormat, createdAt); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// AppendAuditEntry links e to the end of its developer's chain and stores
+// it, setting Seq, PrevHash and Hash. Appends racing for the same link are
+// caught by the unique prev_hash and retried.
+func (s *service) AppendAuditEntry(e *AuditEntry) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = s.appendAuditEntry(e); err == nil || !strings.Contains(err.Error(), "UNIQUE") {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *service) appendAuditEntry(e *AuditEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e.PrevHash = ""
+	err = tx.QueryRow(
+		`SELECT hash FROM audit_log WHERE developer_id = ? ORDER BY seq DESC LIMIT 1`,
+		e.DeveloperID).Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	e.Hash = e.ComputeHash()
+
+	err = tx.QueryRow(
+		`INSERT INTO audit_log (id, developer_id, actor_id, application_id, team_id, action, target_type,
+		                        target_id, ip, user_agent, changes, created_at, prev_hash, hash)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING seq`,
+		e.ID, e.DeveloperID, e.ActorID, e.ApplicationID, e.TeamID, e.Action, e.TargetType,
+		e.TargetID, e.IP, e.UserAgent, string(e.Changes), e.CreatedAt.UTC().Format(auditTimeFormat),
+		e.PrevHash, e.Hash).Scan(&e.Seq)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAuditEntries returns one page of entries matching filter, newest first
+func (s *service) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	where, args := filter.where()
+	args = append(args, filter.Limit)
+	rows, err := s.db.Query(
+		`SELECT `+auditColumns+` FROM audit_log WHERE `+where+` ORDER BY seq DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// StreamAuditEntries calls fn for each entry matching filter, oldest first,
+// without loading the whole log into memory. Limit and BeforeSeq are
+// ignored.
+func (s *service) StreamAuditEntries(filter AuditFilter, fn func(*AuditEntry) error) error {
+	filter.BeforeSeq = 0
+	where, args := filter.where()
+	rows, err := s.db.Query(
+		`SELECT `+auditColumns+` FROM audit_log WHERE `+where+` ORDER BY seq`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -19,38 +20,245 @@ type Service interface {
 	InitSchema() error
 	CreateDeveloper(dev *Developer) error
 	GetDeveloperByEmail(email string) (*Developer, error)
+	GetDeveloperByID(id string) (*Developer, error)
+	UpdateDeveloperProfile(dev *Developer) error
+	CreateDeveloperEmailChange(change *DeveloperEmailChange) error
+	ConsumeDeveloperEmailChange(developerID, tokenHash string) (*DeveloperEmailChange, error)
+	ScheduleDeveloperDeletion(id string, at *time.Time) error
+	GetDevelopersDueForDeletion() ([]string, error)
+	CountSoleOwnedTeams(developerID string) (int, error)
+	DeleteDeveloper(id string) error
+	UpdateDeveloperTOTP(id, secret string, enabled bool) error
+	UpdateDeveloperRecoveryCodes(id string, codeHashes []string) error
+	UseDeveloperTOTPStep(id string, step int64) error
+	UseDeveloperRecoveryCode(id, codeHash string) error
+	CreateDeveloperSession(session *DeveloperSession) error
+	GetDeveloperSession(developerID, id string) (*DeveloperSession, error)
+	GetDeveloperSessionByRefreshToken(tokenHash string) (*DeveloperSession, error)
+	GetDeveloperSessions(developerID string) ([]DeveloperSession, error)
+	RotateDeveloperSession(session *DeveloperSession, oldTokenHash string) error
+	DeleteDeveloperSession(developerID, id string) error
+	DeleteExpiredDeveloperSessions() (int, error)
+	RevokeToken(jti string, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
+	DeleteExpiredRevokedTokens() (int, error)
+	CreateDeveloperPasskey(passkey *DeveloperPasskey) error
+	GetDeveloperPasskeys(developerID string) ([]DeveloperPasskey, error)
+	GetDeveloperPasskeyByCredentialID(developerID, credentialID string) (*DeveloperPasskey, error)
+	UpdateDeveloperPasskeyUse(id string, signCount uint32) error
+	DeleteDeveloperPasskey(developerID, id string) error
+	CreateDeveloperAPIToken(token *DeveloperAPIToken) error
+	GetDeveloperAPITokens(developerID string) ([]DeveloperAPIToken, error)
+	GetDeveloperAPITokenByHash(tokenHash string) (*DeveloperAPIToken, error)
+	UpdateDeveloperAPITokenUse(id, ip string) error
+	DeleteDeveloperAPIToken(developerID, id string) error
 	CreateApplication(app *Application) error
 	GetApplicationsByDeveloperID(developerID string) ([]Application, error)
 	UpdateApplication(app *Application) error
-	DeleteApplication(id string, developerID string) error
+	UpdateApplicationKeys(id, publicKey, secretKey string) error
+	DeleteApplication(id string) error
 	GetApplicationByID(id string, developerID string) (*Application, error)
-	CreateUser(user *User) error
+	CreateUser(user *User, events ...OutboxEvent) error
 	GetUserByEmail(applicationID, email string) (*User, error)
-	CreateSession(session *Session) error
+	CreateSession(session *Session, events ...OutboxEvent) error
 	GetSessionByToken(token string) (*Session, error)
 	DeleteSession(id string) error
+	UpdateSessionAuth(id string, authTime time.Time, methods []string) error
 	GetApplicationByPublicKey(publicKey string) (*Application, error)
-	GetUsersByApplicationID(applicationID string) ([]User, error)
+	ListUsers(filter UserFilter) ([]User, *UserCursor, error)
+	CountUsers(filter UserFilter) (int, error)
 	GetUserByID(id string) (*User, error)
+	UpdateApplicationPasswordPolicy(id string, developerID string, policy *PasswordPolicy) error
+	UpdateDeveloperPasswordHash(id, hash string) error
+	UpdateUserPasswordHash(id, hash string) error
+	ImportUsers(users []User) ([]bool, error)
+	GetApplicationUser(applicationID, id string) (*User, error)
+	GetSessionsByUserID(userID string) ([]Session, error)
+	StreamUsersByApplicationID(applicationID string, fn func(*User) error) error
+	EraseUser(record *ErasureRecord, events ...OutboxEvent) error
+	GetErasureRecords(applicationID string) ([]ErasureRecord, error)
+	UpdateUserProfile(user *User, events ...OutboxEvent) error
+	SetUserStatus(applicationID, id, status, reason string, events ...OutboxEvent) error
+	SetPasswordResetRequired(applicationID, id string, events ...OutboxEvent) error
+	CompletePasswordReset(token *VerificationToken, hash string) error
+	DeleteUserSessions(userID string) (int, error)
+	ChangeUserPassword(userID, hash, keepSessionID string, events ...OutboxEvent) (int, error)
+	UpdateUserProfileAndMetadata(user *User, events ...OutboxEvent) error
+	UpdateApplicationMetadataSchema(id string, developerID string, schema *MetadataSchema) error
+	CreateRole(role *Role) error
+	GetRoles(applicationID string) ([]Role, error)
+	GetRole(applicationID, id string) (*Role, error)
+	UpdateRole(role *Role) error
+	DeleteRole(applicationID, id string) error
+	GetUserRoles(userID string) ([]Role, error)
+	AssignRole(applicationID, userID, roleID string) error
+	UnassignRole(applicationID, userID, roleID string) error
+	CreateOrganization(org *Organization, creator *OrganizationMember) error
+	GetOrganizations(applicationID string) ([]Organization, error)
+	GetOrganization(applicationID, id string) (*Organization, error)
+	GetOrganizationBySlug(applicationID, slug string) (*Organization, error)
+	UpdateOrganization(org *Organization) error
+	DeleteOrganization(applicationID, id string) error
+	GetOrganizationMembers(organizationID string) ([]OrganizationMember, error)
+	GetOrganizationMember(organizationID, userID string) (*OrganizationMember, error)
+	GetUserOrganizations(userID string) ([]UserOrganization, error)
+	SetOrganizationMember(member *OrganizationMember) error
+	DeleteOrganizationMember(organizationID, userID string) error
+	CreateOrganizationInvitation(invitation *OrganizationInvitation) error
+	GetOrganizationInvitations(organizationID string) ([]OrganizationInvitation, error)
+	GetOrganizationInvitationByToken(tokenHash string) (*OrganizationInvitation, error)
+	AcceptOrganizationInvitation(invitation *OrganizationInvitation, userID string) error
+	DeleteOrganizationInvitation(organizationID, id string) error
+	SetSessionActiveOrganization(sessionID, organizationID string) error
+	UpdateApplicationSignupPolicy(id string, developerID string, policy *SignupPolicy) error
+	UpdateApplicationRateLimits(id string, developerID string, limits map[string]RateLimit) error
+	CreateInviteCode(code *InviteCode) error
+	GetInviteCodes(applicationID string) ([]InviteCode, error)
+	GetInviteCodeByHash(applicationID, codeHash string) (*InviteCode, error)
+	CreateInvitedUser(user *User, inviteCodeID string, events ...OutboxEvent) error
+	DeleteInviteCode(applicationID, id string) error
+	GetAccountLockout(subjectID string) (*AccountLockout, error)
+	ReserveLoginAttempt(lockout *AccountLockout, resetBefore time.Time, allow func(before *AccountLockout) bool) (*AccountLockout, error)
+	RecordFailedLogin(lockout *AccountLockout, lockAfter int, lockedUntil time.Time, events ...OutboxEvent) (*AccountLockout, bool, error)
+	DeleteAccountLockout(subjectID string) error
+	GetApplicationLockouts(applicationID string) ([]AccountLockout, error)
+	CreateWebhookEndpoint(endpoint *WebhookEndpoint) error
+	GetWebhookEndpoints(applicationID string) ([]WebhookEndpoint, error)
+	GetWebhookEndpoint(applicationID, id string) (*WebhookEndpoint, error)
+	UpdateWebhookEndpoint(endpoint *WebhookEndpoint) error
+	DeleteWebhookEndpoint(applicationID, id string) error
+	CreateWebhookDeliveries(deliveries []WebhookDelivery) error
+	GetWebhookDeliveries(endpointID string, limit int) ([]WebhookDelivery, error)
+	GetWebhookDelivery(endpointID, id string) (*WebhookDelivery, error)
+	GetDueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	UpdateWebhookDelivery(delivery *WebhookDelivery) error
+	DeleteWebhookDeliveriesBefore(before time.Time) (int, error)
+	GetPendingOutboxEvents(limit int) ([]OutboxEvent, error)
+	GetDueOutboxEvents(now time.Time, limit int) ([]OutboxEvent, error)
+	UpdateOutboxEvent(event *OutboxEvent) error
+	DeleteDispatchedOutboxEvents(before time.Time) (int, error)
+	AppendAuditEntry(entry *AuditEntry) error
+	GetAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+	StreamAuditEntries(filter AuditFilter, fn func(*AuditEntry) error) error
+	UpdateApplicationLoginHistoryPolicy(id string, developerID string, policy *LoginHistoryPolicy) error
+	RecordLoginAttempt(attempt *LoginAttempt, maxPerUser int) error
+	GetLoginAttempts(userID string, beforeSeq int64, limit int) ([]LoginAttempt, error)
+	DeleteExpiredLoginAttempts(defaultRetentionDays int) (int, error)
+	UpdateApplicationRiskPolicy(id string, developerID string, policy *RiskPolicy) error
+	GetKnownDevices(userID string) ([]KnownDevice, error)
+	SaveKnownDevice(device *KnownDevice, maxPerUser int) error
+	CreateTeam(team *Team, owner *TeamMember) error
+	GetTeam(id string) (*Team, error)
+	GetDeveloperTeams(developerID string) ([]DeveloperTeam, error)
+	UpdateTeam(team *Team) error
+	DeleteTeam(id string) error
+	CountTeamApplications(teamID string) (int, error)
+	GetTeamMembers(teamID string) ([]TeamMember, error)
+	GetTeamMember(teamID, developerID string) (*TeamMember, error)
+	CountTeamOwners(teamID string) (int, error)
+	SetTeamMember(member *TeamMember) error
+	DeleteTeamMember(teamID, developerID string) error
+	CreateTeamInvitation(inv *TeamInvitation) error
+	GetTeamInvitations(teamID string) ([]TeamInvitation, error)
+	GetTeamInvitationByToken(tokenHash string) (*TeamInvitation, error)
+	AcceptTeamInvitation(inv *TeamInvitation, developerID string) error
+	DeleteTeamInvitation(teamID, id string) error
+	SetApplicationOwner(applicationID, developerID, teamID string) error
+	CreateVerificationToken(token *VerificationToken) error
+	GetVerificationToken(purpose, tokenHash string) (*VerificationToken, error)
+	ConsumeVerificationToken(purpose, tokenHash string) (*VerificationToken, error)
 }
 
 type Developer struct {
-	ID           string    `json:"id"`
-	FirstName    string    `json:"firstName"`
-	LastName     string    `json:"lastName"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	CreatedAt    time.Time `json:"createdAt"`
+	ID           string `json:"id"`
+	FirstName    string `json:"firstName"`
+	LastName     string `json:"lastName"`
+	Email        string `json:"email"`
+	PasswordHash string `json:"-"`
+	// TOTPSecret is the base32 authenticator app secret, set once setup
+	// starts; it is only checked at login once TOTPEnabled
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totpEnabled"`
+	// TOTPLastStep is the time step of the last accepted code, which cannot
+	// be used again
+	TOTPLastStep int64 `json:"-"`
+	// RecoveryCodes are the hashes of the unused single-use codes that
+	// replace a second factor
+	RecoveryCodes []string `json:"-"`
+	// DeletionScheduledAt is when the account will be deleted, if its
+	// developer asked for that
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt,omitempty"`
+	CreatedAt           time.Time  `json:"createdAt"`
 }
 
 type Application struct {
-	ID          string    `json:"id"`
-	DeveloperID string    `json:"developerId"`
-	Name        string    `json:"name"`
-	Domain      string    `json:"domain"`
-	PublicKey   string    `json:"publicKey"`
-	SecretKey   string    `json:"secretKey"`
-	CreatedAt   time.Time `json:"createdAt"`
+	ID string `json:"id"`
+	// DeveloperID is the developer who created the application. It owns the
+	// application unless TeamID is set.
+	DeveloperID string `json:"developerId"`
+	TeamID      string `json:"teamId,omitempty"`
+	// Role is what the developer who loaded the application may do with it:
+	// a team role, or owner for their personal applications
+	Role      string    `json:"role,omitempty"`
+	Name      string    `json:"name"`
+	Domain    string    `json:"domain"`
+	PublicKey string    `json:"publicKey"`
+	SecretKey string    `json:"secretKey"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	PasswordPolicy *PasswordPolicy `json:"passwordPolicy,omitempty"`
+	// MetadataSchema optionally constrains user metadata writes; see
+	// MetadataSchema for its shape
+	MetadataSchema *MetadataSchema `json:"metadataSchema,omitempty"`
+	SignupPolicy   *SignupPolicy   `json:"signupPolicy,omitempty"`
+	// RateLimits overrides the server's default limits, keyed by route group
+	RateLimits         map[string]RateLimit `json:"rateLimits,omitempty"`
+	LoginHistoryPolicy *LoginHistoryPolicy  `json:"loginHistoryPolicy,omitempty"`
+	RiskPolicy         *RiskPolicy          `json:"riskPolicy,omitempty"`
+}
+
+// RateLimit allows Requests requests per Window seconds, with bursts of up
+// to Requests
+type RateLimit struct {
+	Requests int `json:"requests"`
+	Window   int `json:"window"`
+}
+
+// Signup modes of an application
+const (
+	SignupModeOpen       = "open"
+	SignupModeDisabled   = "disabled"
+	SignupModeInviteOnly = "invite_only"
+	SignupModeWaitlist   = "waitlist"
+)
+
+// SignupPolicy controls who can register as a user of an application. A nil
+// policy means open signup. Domains apply to the email address in every
+// mode; an empty AllowedDomains allows any domain not blocked.
+type SignupPolicy struct {
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowedDomains"`
+	BlockedDomains []string `json:"blockedDomains"`
+}
+
+// MetadataSchema holds the JSON Schemas that an application's public and
+// private user metadata must satisfy. Either may be empty.
+type MetadataSchema struct {
+	Public  json.RawMessage `json:"public,omitempty"`
+	Private json.RawMessage `json:"private,omitempty"`
+}
+
+// PasswordPolicy holds the password rules for an application's users. A nil
+// policy means the server defaults apply.
+type PasswordPolicy struct {
+	MinLength        int  `json:"minLength"`
+	MaxLength        int  `json:"maxLength"`
+	RequireUppercase bool `json:"requireUppercase"`
+	RequireLowercase bool `json:"requireLowercase"`
+	RequireDigit     bool `json:"requireDigit"`
+	RequireSymbol    bool `json:"requireSymbol"`
+	DisallowEmail    bool `json:"disallowEmail"`
+	CheckBreached    bool `json:"checkBreached"`
 }
 
 type User struct {
@@ -61,8 +269,27 @@ type User struct {
 	LastName      string    `json:"lastName"`
 	PasswordHash  string    `json:"-"`
 	CreatedAt     time.Time `json:"createdAt"`
+	EmailVerified bool      `json:"emailVerified"`
+	Status        string    `json:"status"`
+	StatusReason  string    `json:"statusReason,omitempty"`
+
+	PasswordResetRequired bool `json:"passwordResetRequired"`
+
+	// PublicMetadata is readable by the user; PrivateMetadata only by the
+	// application's developer. Both are JSON objects.
+	PublicMetadata  json.RawMessage `json:"publicMetadata"`
+	PrivateMetadata json.RawMessage `json:"privateMetadata,omitempty"`
 }
 
+// User statuses. Only active users can log in. Pending users registered
+// through a waitlist and await the developer's approval.
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+	UserStatusBanned   = "banned"
+	UserStatusPending  = "pending"
+)
+
 type Session struct {
 	ID            string    `json:"id"`
 	UserID        string    `json:"userId"`
@@ -70,6 +297,55 @@ type Session struct {
 	Token         string    `json:"token"`
 	ExpiresAt     time.Time `json:"expiresAt"`
 	CreatedAt     time.Time `json:"createdAt"`
+	// ActiveOrganizationID is the organization the user is acting in, if any
+	ActiveOrganizationID string `json:"activeOrganizationId,omitempty"`
+	// AuthTime is when the user last proved who they are in this session,
+	// by logging in or re-authenticating, and AuthMethods how
+	AuthTime    time.Time `json:"authTime"`
+	AuthMethods []string  `json:"authMethods"`
+}
+
+// Ways a user can prove who they are
+const (
+	AuthMethodPassword = "password"
+	AuthMethodTOTP     = "totp"
+	AuthMethodPasskey  = "passkey"
+	// AuthMethodEmail is following a link sent to the user's email address
+	AuthMethodEmail = "email"
+	// AuthMethodRecoveryCode is a single-use code replacing a second factor
+	AuthMethodRecoveryCode = "recovery_code"
+)
+
+// VerificationToken is a single-use token emailed to a user, such as the
+// confirmation link for an email change. Only a hash of the token is stored.
+type VerificationToken struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"userId"`
+	ApplicationID string    `json:"applicationId"`
+	Purpose       string    `json:"purpose"`
+	TokenHash     string    `json:"-"`
+	Payload       string    `json:"payload"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Verification token purposes
+const (
+	TokenPurposeEmailChange    = "email_change"
+	TokenPurposeLoginChallenge = "login_challenge"
+	TokenPurposePasswordReset  = "password_reset"
+)
+
+// ErasureRecord is kept after a user's data is erased so the erasure itself
+// can be demonstrated. It holds no personal data beyond a hash of the email.
+type ErasureRecord struct {
+	ID              string    `json:"id"`
+	ApplicationID   string    `json:"applicationId"`
+	UserID          string    `json:"userId"`
+	EmailHash       string    `json:"emailHash"`
+	ErasedBy        string    `json:"erasedBy"`
+	SessionsDeleted int       `json:"sessionsDeleted"`
+	ErasedAt        time.Time `json:"erasedAt"`
 }
 
 type service struct {
@@ -103,6 +379,12 @@ func New() Service {
 	return dbInstance
 }
 
+// NewWithDB returns a Service using db instead of the Turso database New
+// connects to, such as an in-memory database in tests
+func NewWithDB(db *sql.DB) Service {
+	return &service{db: db}
+}
+
 func (s *service) Health() map[string]string {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -141,12 +423,47 @@ func (s *service) CreateDeveloper(dev *Developer) error {
 	return err
 }
 
+const developerColumns = `id, first_name, last_name, email, password_hash,
+	totp_secret, totp_enabled, totp_last_step, recovery_codes, deletion_scheduled_at, created_at`
+
+func scanDeveloper(row rowScanner) (*Developer, error) {
+	var dev Developer
+	var recoveryCodes string
+	var deletionScheduledAt sql.NullTime
+	err := row.Scan(&dev.ID, &dev.FirstName, &dev.LastName, &dev.Email, &dev.PasswordHash,
+		&dev.TOTPSecret, &dev.TOTPEnabled, &dev.TOTPLastStep, &recoveryCodes, &deletionScheduledAt, &dev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if deletionScheduledAt.Valid {
+		dev.DeletionScheduledAt = &deletionScheduledAt.Time
+	}
+	dev.RecoveryCodes = []string{}
+	if recoveryCodes != "" {
+		if err := json.Unmarshal([]byte(recoveryCodes), &dev.RecoveryCodes); err != nil {
+			return nil, fmt.Errorf("decode recovery codes of developer %s: %w", dev.ID, err)
+		}
+	}
+	return &dev, nil
+}
+
 func (s *service) GetDeveloperByEmail(email string) (*Developer, error) {
-	dev := &Developer{}
-	err := s.db.QueryRow(
-		`SELECT id, first_name, last_name, email, password_hash, created_at 
-		 FROM developers WHERE email = ?`, email).
-		Scan(&dev.ID, &dev.FirstName, &dev.LastName, &dev.Email, &dev.PasswordHash, &dev.CreatedAt)
+	dev, err := scanDeveloper(s.db.QueryRow(
+		`SELECT `+developerColumns+` FROM developers WHERE email = ?`, email))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return dev, err
+}
+
+func (s *service) UpdateDeveloperPasswordHash(id, hash string) error {
+	_, err := s.db.Exec("UPDATE developers SET password_hash = ? WHERE id = ?", hash, id)
+	return err
+}
+
+func (s *service) GetDeveloperByID(id string) (*Developer, error) {
+	dev, err := scanDeveloper(s.db.QueryRow(
+		`SELECT `+developerColumns+` FROM developers WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -155,16 +472,28 @@ func (s *service) GetDeveloperByEmail(email string) (*Developer, error) {
 
 func (s *service) CreateApplication(app *Application) error {
 	_, err := s.db.Exec(
-		`INSERT INTO applications (id, developer_id, name, domain, public_key, secret_key) 
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		app.ID, app.DeveloperID, app.Name, app.Domain, app.PublicKey, app.SecretKey)
+		`INSERT INTO applications (id, developer_id, team_id, name, domain, public_key, secret_key) 
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		app.ID, app.DeveloperID, app.TeamID, app.Name, app.Domain, app.PublicKey, app.SecretKey)
 	return err
 }
 
+// applicationAccessRole selects the role of a developer, given twice as
+// arguments, for an application: their team role if a team owns it, owner
+// if it is their personal application, and an empty string otherwise
+const applicationAccessRole = `COALESCE(
+	(SELECT m.role FROM team_members m
+	 WHERE applications.team_id != '' AND m.team_id = applications.team_id AND m.developer_id = ?),
+	CASE WHEN applications.team_id = '' AND applications.developer_id = ? THEN 'owner' ELSE '' END)`
+
+// GetApplicationsByDeveloperID returns the applications the developer can
+// access, personally or through a team, with their role for each
 func (s *service) GetApplicationsByDeveloperID(developerID string) ([]Application, error) {
 	rows, err := s.db.Query(
-		`SELECT id, developer_id, name, domain, public_key, secret_key, created_at 
-		 FROM applications WHERE developer_id = ?`, developerID)
+		`SELECT * FROM (
+		     SELECT `+applicationColumns+`, `+applicationAccessRole+` AS access_role
+		     FROM applications)
+		 WHERE access_role != '' ORDER BY created_at`, developerID, developerID)
 	if err != nil {
 		return nil, err
 	}
@@ -172,37 +501,143 @@ func (s *service) GetApplicationsByDeveloperID(developerID string) ([]Applicatio
 
 	var apps []Application
 	for rows.Next() {
-		var app Application
-		err := rows.Scan(
-			&app.ID, &app.DeveloperID, &app.Name, &app.Domain,
-			&app.PublicKey, &app.SecretKey, &app.CreatedAt)
+		var role string
+		app, err := scanApplication(rows, &role)
 		if err != nil {
 			return nil, err
 		}
-		apps = append(apps, app)
+		app.Role = role
+		apps = append(apps, *app)
 	}
 	return apps, rows.Err()
 }
 
+// GetApplicationByID returns the application with the developer's role for
+// it, or sql.ErrNoRows if the developer cannot access it
 func (s *service) GetApplicationByID(id string, developerID string) (*Application, error) {
+	var role string
+	app, err := scanApplication(s.db.QueryRow(
+		`SELECT * FROM (
+		     SELECT `+applicationColumns+`, `+applicationAccessRole+` AS access_role
+		     FROM applications WHERE id = ?)
+		 WHERE access_role != ''`,
+		developerID, developerID, id), &role)
+	if err != nil {
+		return nil, err
+	}
+	app.Role = role
+	return app, nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// applicationColumns lists the columns read by scanApplication, in order
+const applicationColumns = `id, developer_id, team_id, name, domain, public_key, secret_key, created_at,
+	password_policy, metadata_schema, signup_policy, rate_limits, login_history_policy, risk_policy`
+
+// scanApplication reads a row selected with applicationColumns followed by
+// any extra columns, which are scanned into extra
+func scanApplication(row rowScanner, extra ...any) (*Application, error) {
 	var app Application
-	err := s.db.QueryRow(
-		`SELECT id, developer_id, name, domain, public_key, secret_key, created_at 
-		 FROM applications 
-		 WHERE id = ? AND developer_id = ?`,
-		id, developerID).
-		Scan(&app.ID, &app.DeveloperID, &app.Name, &app.Domain, &app.PublicKey, &app.SecretKey, &app.CreatedAt)
+	var policy, metadataSchema, signupPolicy, rateLimits, loginHistoryPolicy, riskPolicy string
+	dest := append([]any{&app.ID, &app.DeveloperID, &app.TeamID, &app.Name, &app.Domain,
+		&app.PublicKey, &app.SecretKey, &app.CreatedAt, &policy, &metadataSchema, &signupPolicy, &rateLimits,
+		&loginHistoryPolicy, &riskPolicy}, extra...)
+	err := row.Scan(dest...)
 	if err != nil {
 		return nil, err
 	}
+	if riskPolicy != "" {
+		app.RiskPolicy = &RiskPolicy{}
+		if err := json.Unmarshal([]byte(riskPolicy), app.RiskPolicy); err != nil {
+			return nil, fmt.Errorf("decode risk policy for application %s: %w", app.ID, err)
+		}
+	}
+	if loginHistoryPolicy != "" {
+		app.LoginHistoryPolicy = &LoginHistoryPolicy{}
+		if err := json.Unmarshal([]byte(loginHistoryPolicy), app.LoginHistoryPolicy); err != nil {
+			return nil, fmt.Errorf("decode login history policy for application %s: %w", app.ID, err)
+		}
+	}
+	if rateLimits != "" {
+		if err := json.Unmarshal([]byte(rateLimits), &app.RateLimits); err != nil {
+			return nil, fmt.Errorf("decode rate limits for application %s: %w", app.ID, err)
+		}
+	}
+	if signupPolicy != "" {
+		app.SignupPolicy = &SignupPolicy{}
+		if err := json.Unmarshal([]byte(signupPolicy), app.SignupPolicy); err != nil {
+			return nil, fmt.Errorf("decode signup policy for application %s: %w", app.ID, err)
+		}
+	}
+	if metadataSchema != "" {
+		app.MetadataSchema = &MetadataSchema{}
+		if err := json.Unmarshal([]byte(metadataSchema), app.MetadataSchema); err != nil {
+			return nil, fmt.Errorf("decode metadata schema for application %s: %w", app.ID, err)
+		}
+	}
+	if policy != "" {
+		app.PasswordPolicy = &PasswordPolicy{}
+		if err := json.Unmarshal([]byte(policy), app.PasswordPolicy); err != nil {
+			return nil, fmt.Errorf("decode password policy for application %s: %w", app.ID, err)
+		}
+	}
 	return &app, nil
 }
 
 func (s *service) UpdateApplication(app *Application) error {
 	result, err := s.db.Exec(
 		`UPDATE applications SET name = ?, domain = ? 
+		 WHERE id = ?`,
+		app.Name, app.Domain, app.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateApplicationKeys replaces the application's API key pair
+func (s *service) UpdateApplicationKeys(id, publicKey, secretKey string) error {
+	result, err := s.db.Exec("UPDATE applications SET public_key = ?, secret_key = ? WHERE id = ?",
+		publicKey, secretKey, id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateApplicationPasswordPolicy stores policy for the application; a nil
+// policy resets it to the server defaults.
+func (s *service) UpdateApplicationPasswordPolicy(id string, developerID string, policy *PasswordPolicy) error {
+	var encoded string
+	if policy != nil {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	result, err := s.db.Exec(
+		`UPDATE applications SET password_policy = ? 
 		 WHERE id = ? AND developer_id = ?`,
-		app.Name, app.Domain, app.ID, app.DeveloperID)
+		encoded, id, developerID)
 	if err != nil {
 		return err
 	}
@@ -216,10 +651,21 @@ func (s *service) UpdateApplication(app *Application) error {
 	return nil
 }
 
-func (s *service) DeleteApplication(id string, developerID string) error {
+// UpdateApplicationSignupPolicy stores policy for the application; a nil
+// policy makes signup open.
+func (s *service) UpdateApplicationSignupPolicy(id string, developerID string, policy *SignupPolicy) error {
+	var encoded string
+	if policy != nil {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
 	result, err := s.db.Exec(
-		"DELETE FROM applications WHERE id = ? AND developer_id = ?",
-		id, developerID)
+		`UPDATE applications SET signup_policy = ? 
+		 WHERE id = ? AND developer_id = ?`,
+		encoded, id, developerID)
 	if err != nil {
 		return err
 	}
@@ -233,62 +679,237 @@ func (s *service) DeleteApplication(id string, developerID string) error {
 	return nil
 }
 
-func (s *service) CreateUser(user *User) error {
-	_, err := s.db.Exec(
-		`INSERT INTO users (id, application_id, email, password_hash, first_name, last_name) 
-		 VALUES (?, ?, ?, ?, ?, ?)`,
+// UpdateApplicationRateLimits stores the application's rate limit overrides;
+// an empty map resets it to the server defaults.
+func (s *service) UpdateApplicationRateLimits(id string, developerID string, limits map[string]RateLimit) error {
+	var encoded string
+	if len(limits) > 0 {
+		b, err := json.Marshal(limits)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	result, err := s.db.Exec(
+		`UPDATE applications SET rate_limits = ? 
+		 WHERE id = ? AND developer_id = ?`,
+		encoded, id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *service) DeleteApplication(id string) error {
+	result, err := s.db.Exec("DELETE FROM applications WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ApplyDefaults fills in the status and metadata of a new user where they
+// are not set. CreateUser calls it; callers building events that include
+// the user call it first so the event matches what is stored.
+func (u *User) ApplyDefaults() {
+	if u.Status == "" {
+		u.Status = UserStatusActive
+	}
+	if len(u.PublicMetadata) == 0 {
+		u.PublicMetadata = json.RawMessage("{}")
+	}
+	if len(u.PrivateMetadata) == 0 {
+		u.PrivateMetadata = json.RawMessage("{}")
+	}
+}
+
+func (s *service) CreateUser(user *User, events ...OutboxEvent) error {
+	user.ApplyDefaults()
+	return s.withEvents(events, func(tx *sql.Tx) error {
+		return insertUser(tx, user)
+	})
+}
+
+func insertUser(tx *sql.Tx, user *User) error {
+	_, err := tx.Exec(
+		`INSERT INTO users (id, application_id, email, password_hash, first_name, last_name,
+		                    email_verified, status, password_reset_required,
+		                    public_metadata, private_metadata) 
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		user.ID, user.ApplicationID, user.Email, user.PasswordHash,
-		user.FirstName, user.LastName)
+		user.FirstName, user.LastName,
+		user.EmailVerified, user.Status, user.PasswordResetRequired,
+		string(user.PublicMetadata), string(user.PrivateMetadata))
 	return err
 }
 
-func (s *service) GetUserByEmail(applicationID, email string) (*User, error) {
+// ImportUsers inserts users in a single transaction, skipping any whose email
+// is already registered for the application. The returned slice reports
+// which users were inserted.
+func (s *service) ImportUsers(users []User) ([]bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(
+		`INSERT OR IGNORE INTO users (id, application_id, email, password_hash, first_name, last_name) 
+		 VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	inserted := make([]bool, len(users))
+	for i, user := range users {
+		result, err := stmt.Exec(user.ID, user.ApplicationID, user.Email, user.PasswordHash,
+			user.FirstName, user.LastName)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		inserted[i] = rows > 0
+	}
+	return inserted, tx.Commit()
+}
+
+// userColumns lists the columns read by scanUser, in order
+const userColumns = `id, application_id, email, password_hash, first_name, last_name, created_at,
+	email_verified, status, status_reason, password_reset_required, public_metadata, private_metadata`
+
+// scanUser reads the userColumns of a row, followed by any extra columns
+func scanUser(row rowScanner, extra ...any) (*User, error) {
 	var user User
-	err := s.db.QueryRow(
-		`SELECT id, application_id, email, password_hash, first_name, last_name, created_at 
+	var public, private string
+	dest := append([]any{&user.ID, &user.ApplicationID, &user.Email, &user.PasswordHash,
+		&user.FirstName, &user.LastName, &user.CreatedAt, &user.EmailVerified, &user.Status,
+		&user.StatusReason, &user.PasswordResetRequired, &public, &private}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	user.PublicMetadata = json.RawMessage(public)
+	user.PrivateMetadata = json.RawMessage(private)
+	return &user, nil
+}
+
+func (s *service) GetUserByEmail(applicationID, email string) (*User, error) {
+	user, err := scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+`
 		 FROM users WHERE application_id = ? AND email = ?`,
-		applicationID, email).
-		Scan(&user.ID, &user.ApplicationID, &user.Email, &user.PasswordHash,
-			&user.FirstName, &user.LastName, &user.CreatedAt)
+		applicationID, email))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &user, err
+	return user, err
 }
 
 func (s *service) GetUserByID(id string) (*User, error) {
-	var user User
-	err := s.db.QueryRow(
-		`SELECT id, application_id, email, first_name, last_name, created_at 
-		 FROM users WHERE id = ?`, id).
-		Scan(&user.ID, &user.ApplicationID, &user.Email,
-			&user.FirstName, &user.LastName, &user.CreatedAt)
+	user, err := scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+`
+		 FROM users WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &user, err
+	return user, err
 }
 
-func (s *service) CreateSession(session *Session) error {
-	_, err := s.db.Exec(
-		`INSERT INTO sessions (id, user_id, application_id, token, expires_at) 
-		 VALUES (?, ?, ?, ?, ?)`,
-		session.ID, session.UserID, session.ApplicationID,
-		session.Token, session.ExpiresAt)
+func (s *service) UpdateUserPasswordHash(id, hash string) error {
+	_, err := s.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, id)
 	return err
 }
 
-func (s *service) GetSessionByToken(token string) (*Session, error) {
+func (s *service) CreateSession(session *Session, events ...OutboxEvent) error {
+	methods, err := json.Marshal(session.AuthMethods)
+	if err != nil {
+		return err
+	}
+	return s.withEvents(events, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO sessions (id, user_id, application_id, token, expires_at, auth_time, auth_methods) 
+			 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			session.ID, session.UserID, session.ApplicationID,
+			session.Token, session.ExpiresAt, session.AuthTime.UTC(), string(methods))
+		return err
+	})
+}
+
+const sessionColumns = `id, user_id, application_id, token, expires_at, created_at, active_organization_id,
+	auth_time, auth_methods`
+
+// scanSession reads a row selected with sessionColumns. Sessions created
+// before authentication was recorded count as authenticated when created,
+// by unknown methods.
+func scanSession(row rowScanner) (*Session, error) {
 	var session Session
-	err := s.db.QueryRow(
-		`SELECT id, user_id, application_id, token, expires_at, created_at 
-		 FROM sessions WHERE token = ?`, token).
-		Scan(&session.ID, &session.UserID, &session.ApplicationID,
-			&session.Token, &session.ExpiresAt, &session.CreatedAt)
+	var authTime sql.NullTime
+	var methods string
+	err := row.Scan(&session.ID, &session.UserID, &session.ApplicationID,
+		&session.Token, &session.ExpiresAt, &session.CreatedAt, &session.ActiveOrganizationID,
+		&authTime, &methods)
+	if err != nil {
+		return nil, err
+	}
+	session.AuthTime = session.CreatedAt
+	if authTime.Valid {
+		session.AuthTime = authTime.Time
+	}
+	session.AuthMethods = []string{}
+	if methods != "" {
+		if err := json.Unmarshal([]byte(methods), &session.AuthMethods); err != nil {
+			return nil, fmt.Errorf("decode auth methods of session %s: %w", session.ID, err)
+		}
+	}
+	return &session, nil
+}
+
+func (s *service) GetSessionByToken(token string) (*Session, error) {
+	session, err := scanSession(s.db.QueryRow(
+		`SELECT `+sessionColumns+`
+		 FROM sessions WHERE token = ?`, token))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &session, err
+	return session, err
+}
+
+// UpdateSessionAuth records that the session's user re-authenticated at
+// authTime with methods
+func (s *service) UpdateSessionAuth(id string, authTime time.Time, methods []string) error {
+	encoded, err := json.Marshal(methods)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE sessions SET auth_time = ?, auth_methods = ? WHERE id = ?",
+		authTime.UTC(), string(encoded), id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 func (s *service) DeleteSession(id string) error {
@@ -297,37 +918,471 @@ func (s *service) DeleteSession(id string) error {
 }
 
 func (s *service) GetApplicationByPublicKey(publicKey string) (*Application, error) {
-	var app Application
-	err := s.db.QueryRow(
-		`SELECT id, developer_id, name, domain, public_key, secret_key, created_at 
-		 FROM applications WHERE public_key = ?`, publicKey).
-		Scan(&app.ID, &app.DeveloperID, &app.Name, &app.Domain,
-			&app.PublicKey, &app.SecretKey, &app.CreatedAt)
+	app, err := scanApplication(s.db.QueryRow(
+		`SELECT `+applicationColumns+`
+		 FROM applications WHERE public_key = ?`, publicKey))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &app, err
+	return app, err
 }
 
-func (s *service) GetUsersByApplicationID(applicationID string) ([]User, error) {
+// GetApplicationUser returns the user only if it belongs to the application
+func (s *service) GetApplicationUser(applicationID, id string) (*User, error) {
+	user, err := scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+`
+		 FROM users WHERE id = ? AND application_id = ?`, id, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return user, err
+}
+
+func (s *service) GetSessionsByUserID(userID string) ([]Session, error) {
 	rows, err := s.db.Query(
-		`SELECT id, application_id, email, first_name, last_name, created_at 
-		 FROM users WHERE application_id = ?`, applicationID)
+		`SELECT `+sessionColumns+`
+		 FROM sessions WHERE user_id = ? ORDER BY created_at`, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []User
+	var sessions []Session
 	for rows.Next() {
-		var user User
-		err := rows.Scan(
-			&user.ID, &user.ApplicationID, &user.Email,
-			&user.FirstName, &user.LastName, &user.CreatedAt)
+		session, err := scanSession(rows)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, user)
+		sessions = append(sessions, *session)
 	}
-	return users, rows.Err()
+	return sessions, rows.Err()
+}
+
+// StreamUsersByApplicationID calls fn for each user of the application in
+// creation order without loading them all into memory
+func (s *service) StreamUsersByApplicationID(applicationID string, fn func(*User) error) error {
+	rows, err := s.db.Query(
+		`SELECT `+userColumns+`
+		 FROM users WHERE application_id = ? ORDER BY created_at, id`, applicationID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EraseUser deletes the user and everything tied to it, and stores record in
+// the same transaction. Invitations to or from the user are deleted, and the
+// data of events about them is reduced to their ID. Returns sql.ErrNoRows if
+// the user does not belong to record.ApplicationID.
+func (s *service) EraseUser(record *ErasureRecord, events ...OutboxEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow("SELECT email FROM users WHERE id = ? AND application_id = ?",
+		record.UserID, record.ApplicationID).Scan(&email)
+	if err != nil {
+		return err
+	}
+
+	// Dependent rows are deleted explicitly rather than relying on ON DELETE
+	// CASCADE, which only applies when foreign key enforcement is enabled
+	result, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", record.UserID)
+	if err != nil {
+		return err
+	}
+	sessions, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	record.SessionsDeleted = int(sessions)
+
+	if _, err := tx.Exec("DELETE FROM verification_tokens WHERE user_id = ?", record.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ?", record.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM organization_members WHERE user_id = ?", record.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM account_lockouts WHERE subject_id = ?", record.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE user_id = ?", record.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM known_devices WHERE user_id = ?", record.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM organization_invitations WHERE application_id = ? AND (email = ? OR invited_by = ?)",
+		record.ApplicationID, email, record.UserID); err != nil {
+		return err
+	}
+	// Event payloads are envelopes whose data names the user by ID
+	for _, table := range []string{"outbox_events", "webhook_deliveries"} {
+		_, err := tx.Exec(
+			`UPDATE `+table+` SET payload = json_set(payload, '$.data', json_object('userId', ?))
+			 WHERE application_id = ? AND instr(payload, ?) > 0 AND json_valid(payload)`,
+			record.UserID, record.ApplicationID, `"`+record.UserID+`"`)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err = tx.Exec("DELETE FROM users WHERE id = ? AND application_id = ?",
+		record.UserID, record.ApplicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO erasure_records (id, application_id, user_id, email_hash, erased_by, sessions_deleted) 
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		record.ID, record.ApplicationID, record.UserID, record.EmailHash,
+		record.ErasedBy, record.SessionsDeleted)
+	if err != nil {
+		return err
+	}
+	if err := insertOutboxEvents(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *service) GetErasureRecords(applicationID string) ([]ErasureRecord, error) {
+	rows, err := s.db.Query(
+		`SELECT id, application_id, user_id, email_hash, erased_by, sessions_deleted, erased_at 
+		 FROM erasure_records WHERE application_id = ? ORDER BY erased_at DESC`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ErasureRecord
+	for rows.Next() {
+		var record ErasureRecord
+		err := rows.Scan(&record.ID, &record.ApplicationID, &record.UserID, &record.EmailHash,
+			&record.ErasedBy, &record.SessionsDeleted, &record.ErasedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// UpdateUserProfile saves the email, names and verification flag of a user
+// of user.ApplicationID
+func (s *service) UpdateUserProfile(user *User, events ...OutboxEvent) error {
+	return s.withEvents(events, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`UPDATE users SET email = ?, first_name = ?, last_name = ?, email_verified = ? 
+			 WHERE id = ? AND application_id = ?`,
+			user.Email, user.FirstName, user.LastName, user.EmailVerified,
+			user.ID, user.ApplicationID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// SetUserStatus changes a user's status. Any status other than active also
+// ends all of the user's sessions.
+func (s *service) SetUserStatus(applicationID, id, status, reason string, events ...OutboxEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE users SET status = ?, status_reason = ? 
+		 WHERE id = ? AND application_id = ?`,
+		status, reason, id, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	if status != UserStatusActive {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+			return err
+		}
+	}
+	if err := insertOutboxEvents(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPasswordResetRequired flags the user to choose a new password on their
+// next login and ends all of their sessions
+func (s *service) SetPasswordResetRequired(applicationID, id string, events ...OutboxEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE users SET password_reset_required = 1 
+		 WHERE id = ? AND application_id = ?`,
+		id, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	if err := insertOutboxEvents(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CompletePasswordReset stores a new password hash for the user of a
+// password reset token and clears the reset flag, using up the token. It
+// returns sql.ErrNoRows if the token was used in the meantime.
+func (s *service) CompletePasswordReset(token *VerificationToken, hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM verification_tokens WHERE id = ?", token.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users SET password_hash = ?, password_reset_required = 0 WHERE id = ?",
+		hash, token.UserID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUserSessions ends every session of the user, returning how many
+func (s *service) DeleteUserSessions(userID string) (int, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// ChangeUserPassword stores a new password hash and ends every session of
+// the user except keepSessionID, returning how many ended. events are only
+// recorded if any did.
+func (s *service) ChangeUserPassword(userID, hash, keepSessionID string, events ...OutboxEvent) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, userID)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	result, err = tx.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		if err := insertOutboxEvents(tx, events); err != nil {
+			return 0, err
+		}
+	}
+	return int(deleted), tx.Commit()
+}
+
+// CreateVerificationToken stores token, replacing any outstanding token the
+// user has for the same purpose
+func (s *service) CreateVerificationToken(token *VerificationToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM verification_tokens WHERE user_id = ? AND purpose = ?",
+		token.UserID, token.Purpose)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO verification_tokens (id, user_id, application_id, purpose, token_hash, payload, expires_at) 
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		token.ID, token.UserID, token.ApplicationID, token.Purpose,
+		token.TokenHash, token.Payload, token.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const verificationTokenColumns = `id, user_id, application_id, purpose, token_hash, payload, expires_at, created_at`
+
+func scanVerificationToken(row rowScanner) (*VerificationToken, error) {
+	var token VerificationToken
+	err := row.Scan(&token.ID, &token.UserID, &token.ApplicationID, &token.Purpose,
+		&token.TokenHash, &token.Payload, &token.ExpiresAt, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetVerificationToken returns the token with the given hash and purpose,
+// or nil if there is none, leaving it in place
+func (s *service) GetVerificationToken(purpose, tokenHash string) (*VerificationToken, error) {
+	return scanVerificationToken(s.db.QueryRow(
+		`SELECT `+verificationTokenColumns+` 
+		 FROM verification_tokens WHERE token_hash = ? AND purpose = ?`, tokenHash, purpose))
+}
+
+// ConsumeVerificationToken deletes and returns the token with the given hash
+// and purpose, or nil if there is none. Expiry is left to the caller.
+func (s *service) ConsumeVerificationToken(purpose, tokenHash string) (*VerificationToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token, err := scanVerificationToken(tx.QueryRow(
+		`SELECT `+verificationTokenColumns+` 
+		 FROM verification_tokens WHERE token_hash = ? AND purpose = ?`, tokenHash, purpose))
+	if token == nil || err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM verification_tokens WHERE id = ?", token.ID); err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// UpdateUserProfileAndMetadata saves the user's profile and metadata in one
+// statement, for updates that change both
+func (s *service) UpdateUserProfileAndMetadata(user *User, events ...OutboxEvent) error {
+	return s.withEvents(events, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`UPDATE users SET email = ?, first_name = ?, last_name = ?, email_verified = ?,
+			                  public_metadata = ?, private_metadata = ? 
+			 WHERE id = ? AND application_id = ?`,
+			user.Email, user.FirstName, user.LastName, user.EmailVerified,
+			string(user.PublicMetadata), string(user.PrivateMetadata),
+			user.ID, user.ApplicationID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// UpdateApplicationMetadataSchema stores schema for the application; a nil
+// schema removes it
+func (s *service) UpdateApplicationMetadataSchema(id string, developerID string, schema *MetadataSchema) error {
+	var encoded string
+	if schema != nil {
+		b, err := json.Marshal(schema)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	result, err := s.db.Exec(
+		`UPDATE applications SET metadata_schema = ? 
+		 WHERE id = ? AND developer_id = ?`,
+		encoded, id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
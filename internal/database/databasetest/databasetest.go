@@ -0,0 +1,33 @@
+//go:build cgo
+
+// Package databasetest opens in-memory SQLite databases with the full schema,
+// so that tests can run handlers against real queries and transactions
+package databasetest
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"auth-server/internal/database"
+)
+
+// New returns a Service backed by an empty in-memory database that is closed
+// when t ends. Foreign keys are left off, as they are in production.
+func New(t testing.TB) database.Service {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	s := database.NewWithDB(db)
+	if err := s.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrSoleTeamOwner is returned when deleting a developer who is the only
+// owner of a team
+var ErrSoleTeamOwner = errors.New("developer is the only owner of a team")
+
+// UpdateDeveloperProfile stores the developer's names and email
+func (s *service) UpdateDeveloperProfile(dev *Developer) error {
+	result, err := s.db.Exec("UPDATE developers SET first_name = ?, last_name = ?, email = ? WHERE id = ?",
+		dev.FirstName, dev.LastName, dev.Email, dev.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeveloperEmailChange is a developer's request to use a new email, applied
+// once the link sent to that address is followed
+type DeveloperEmailChange struct {
+	DeveloperID string
+	NewEmail    string
+	TokenHash   string
+	ExpiresAt   time.Time
+	CreatedAt   time.Time
+}
+
+// CreateDeveloperEmailChange stores an email change, replacing any earlier
+// one of the developer
+func (s *service) CreateDeveloperEmailChange(change *DeveloperEmailChange) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO developer_email_changes (developer_id, new_email, token_hash, expires_at) 
+		 VALUES (?, ?, ?, ?)`,
+		change.DeveloperID, change.NewEmail, change.TokenHash, change.ExpiresAt)
+	return err
+}
+
+// ConsumeDeveloperEmailChange deletes and returns the developer's email
+// change with the given token hash, or nil if there is none. Expiry is left
+// to the caller.
+func (s *service) ConsumeDeveloperEmailChange(developerID, tokenHash string) (*DeveloperEmailChange, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var change DeveloperEmailChange
+	err = tx.QueryRow(
+		`SELECT developer_id, new_email, token_hash, expires_at, created_at 
+		 FROM developer_email_changes WHERE developer_id = ? AND token_hash = ?`, developerID, tokenHash).
+		Scan(&change.DeveloperID, &change.NewEmail, &change.TokenHash, &change.ExpiresAt, &change.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM developer_email_changes WHERE developer_id = ?", change.DeveloperID); err != nil {
+		return nil, err
+	}
+	return &change, tx.Commit()
+}
+
+// ScheduleDeveloperDeletion sets when the developer's account is deleted; a
+// nil time cancels the deletion
+func (s *service) ScheduleDeveloperDeletion(id string, at *time.Time) error {
+	var scheduledAt interface{}
+	if at != nil {
+		scheduledAt = at.UTC()
+	}
+	result, err := s.db.Exec("UPDATE developers SET deletion_scheduled_at = ? WHERE id = ?", scheduledAt, id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetDevelopersDueForDeletion returns the IDs of developers whose scheduled
+// deletion time has passed
+func (s *service) GetDevelopersDueForDeletion() ([]string, error) {
+	rows, err := s.db.Query(
+		"SELECT id FROM developers WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= ?",
+		time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+const soleOwnedTeamsQuery = `SELECT COUNT(*) FROM team_members m
+	WHERE m.developer_id = ? AND m.role = ? AND NOT EXISTS (
+	    SELECT 1 FROM team_members o
+	    WHERE o.team_id = m.team_id AND o.role = m.role AND o.developer_id != m.developer_id)`
+
+// CountSoleOwnedTeams returns how many teams have the developer as their
+// only owner
+func (s *service) CountSoleOwnedTeams(developerID string) (int, error) {
+	var n int
+	err := s.db.QueryRow(soleOwnedTeamsQuery, developerID, TeamRoleOwner).Scan(&n)
+	return n, err
+}
+
+// applicationTables are the tables holding an application's data, keyed by
+// application_id, in the order they are emptied when it is deleted
+var applicationTables = []string{
+	"sessions",
+	"verification_tokens",
+	"erasure_records",
+	"user_roles",
+	"roles",
+	"organization_invitations",
+	"organization_members",
+	"organizations",
+	"signup_invite_codes",
+	"account_lockouts",
+	"webhook_deliveries",
+	"webhook_endpoints",
+	"outbox_events",
+	"login_attempts",
+}
+
+// deleteApplicationData deletes an application with its users and
+// everything else tied to it. Rows are deleted explicitly rather than
+// relying on ON DELETE CASCADE, which only applies when foreign key
+// enforcement is enabled.
+func deleteApplicationData(tx *sql.Tx, applicationID string) error {
+	if _, err := tx.Exec(
+		"DELETE FROM known_devices WHERE user_id IN (SELECT id FROM users WHERE application_id = ?)",
+		applicationID); err != nil {
+		return err
+	}
+	for _, table := range applicationTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE application_id = ?", applicationID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE application_id = ?", applicationID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM applications WHERE id = ?", applicationID)
+	return err
+}
+
+// developerTables are the tables holding a developer's own data, with the
+// column naming the developer
+var developerTables = []struct{ table, column string }{
+	{"developer_sessions", "developer_id"},
+	{"developer_passkeys", "developer_id"},
+	{"developer_api_tokens", "developer_id"},
+	{"developer_email_changes", "developer_id"},
+	{"team_members", "developer_id"},
+	{"account_lockouts", "subject_id"},
+}
+
+// DeleteDeveloper deletes a developer with their sessions, passkeys, API
+// tokens and team memberships, and their personal applications with those
+// applications' users. Team applications they created are handed to
+// another owner of the team first. The audit log is kept. It returns
+// ErrSoleTeamOwner if the developer is the only owner of a team.
+func (s *service) DeleteDeveloper(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow(soleOwnedTeamsQuery, id, TeamRoleOwner).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrSoleTeamOwner
+	}
+
+	_, err = tx.Exec(
+		`UPDATE applications SET developer_id = (
+		     SELECT m.developer_id FROM team_members m
+		     WHERE m.team_id = applications.team_id AND m.role = ? AND m.developer_id != ?
+		     ORDER BY m.created_at LIMIT 1)
+		 WHERE developer_id = ? AND team_id != ''`,
+		TeamRoleOwner, id, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id FROM applications WHERE developer_id = ?", id)
+	if err != nil {
+		return err
+	}
+	var appIDs []string
+	for rows.Next() {
+		var appID string
+		if err := rows.Scan(&appID); err != nil {
+			rows.Close()
+			return err
+		}
+		appIDs = append(appIDs, appID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, appID := range appIDs {
+		if err := deleteApplicationData(tx, appID); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range developerTables {
+		if _, err := tx.Exec("DELETE FROM "+t.table+" WHERE "+t.column+" = ?", id); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM developers WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,166 @@
+//go:build cgo
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestService opens an in-memory SQLite database with the full schema.
+// Foreign keys are left off, as they are in production.
+func newTestService(t *testing.T) *service {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	s := &service{db: db}
+	if err := s.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustExec(t *testing.T, s *service, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := s.db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func countRows(t *testing.T, s *service, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := s.db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// seedDeveloper inserts a developer with a personal application holding one
+// user and a row in every table keyed by application or developer
+func seedDeveloper(t *testing.T, s *service, devID, appID string) {
+	t.Helper()
+	userID := appID + "-user"
+	mustExec(t, s, "INSERT INTO developers (id, first_name, last_name, email, password_hash) VALUES (?, 'A', 'B', ?, 'x')",
+		devID, devID+"@example.com")
+	mustExec(t, s, "INSERT INTO applications (id, developer_id, name, domain, public_key, secret_key) VALUES (?, ?, 'App', 'example.com', ?, ?)",
+		appID, devID, "pk_"+appID, "sk_"+appID)
+	mustExec(t, s, "INSERT INTO users (id, application_id, email, password_hash, first_name, last_name) VALUES (?, ?, 'u@example.com', 'x', 'U', 'V')",
+		userID, appID)
+	mustExec(t, s, "INSERT INTO sessions (id, user_id, application_id, token, expires_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		appID+"-session", userID, appID, appID+"-token")
+	mustExec(t, s, "INSERT INTO verification_tokens (id, user_id, application_id, purpose, token_hash, expires_at) VALUES (?, ?, ?, 'email', ?, CURRENT_TIMESTAMP)",
+		appID+"-vt", userID, appID, appID+"-vt")
+	mustExec(t, s, "INSERT INTO erasure_records (id, application_id, user_id, email_hash, erased_by) VALUES (?, ?, 'gone', 'h', ?)",
+		appID+"-erasure", appID, devID)
+	mustExec(t, s, "INSERT INTO roles (id, application_id, name) VALUES (?, ?, 'admin')", appID+"-role", appID)
+	mustExec(t, s, "INSERT INTO user_roles (user_id, role_id, application_id) VALUES (?, ?, ?)", userID, appID+"-role", appID)
+	mustExec(t, s, "INSERT INTO organizations (id, application_id, name, slug) VALUES (?, ?, 'Org', 'org')", appID+"-org", appID)
+	mustExec(t, s, "INSERT INTO organization_members (organization_id, user_id, application_id, role) VALUES (?, ?, ?, 'owner')",
+		appID+"-org", userID, appID)
+	mustExec(t, s, "INSERT INTO organization_invitations (id, organization_id, application_id, email, role, token_hash, invited_by, expires_at) VALUES (?, ?, ?, 'i@example.com', 'member', ?, ?, CURRENT_TIMESTAMP)",
+		appID+"-inv", appID+"-org", appID, appID+"-inv", userID)
+	mustExec(t, s, "INSERT INTO signup_invite_codes (id, application_id, code_hash) VALUES (?, ?, ?)", appID+"-code", appID, appID+"-code")
+	mustExec(t, s, "INSERT INTO account_lockouts (subject_id, subject_type, application_id, last_failed_at) VALUES (?, 'user', ?, CURRENT_TIMESTAMP)",
+		userID, appID)
+	mustExec(t, s, "INSERT INTO webhook_endpoints (id, application_id, url, secret) VALUES (?, ?, 'https://example.com/hook', 's')",
+		appID+"-hook", appID)
+	mustExec(t, s, "INSERT INTO webhook_deliveries (id, endpoint_id, application_id, event_id, event_type, payload) VALUES (?, ?, ?, 'e', 'user.created', '{}')",
+		appID+"-delivery", appID+"-hook", appID)
+	mustExec(t, s, "INSERT INTO outbox_events (id, application_id, type, payload) VALUES (?, ?, 'user.created', '{}')", appID+"-event", appID)
+	mustExec(t, s, "INSERT INTO login_attempts (application_id, user_id, success, method) VALUES (?, ?, 1, 'password')", appID, userID)
+	mustExec(t, s, "INSERT INTO known_devices (user_id, device_hash, application_id, last_seen_at) VALUES (?, 'd', ?, CURRENT_TIMESTAMP)",
+		userID, appID)
+
+	mustExec(t, s, "INSERT INTO developer_sessions (id, developer_id, refresh_token_hash, access_token_id, last_used_at, expires_at) VALUES (?, ?, ?, 'jti', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+		devID+"-session", devID, devID+"-refresh")
+	mustExec(t, s, "INSERT INTO developer_passkeys (id, developer_id, credential_id, public_key, name) VALUES (?, ?, 'cred', x'00', 'Key')",
+		devID+"-passkey", devID)
+	mustExec(t, s, "INSERT INTO developer_api_tokens (id, developer_id, name, token_hash, prefix) VALUES (?, ?, 'CI', ?, 'dpat_')",
+		devID+"-token", devID, devID+"-token")
+	mustExec(t, s, "INSERT INTO developer_email_changes (developer_id, new_email, token_hash, expires_at) VALUES (?, 'new@example.com', ?, CURRENT_TIMESTAMP)",
+		devID, devID+"-email")
+	mustExec(t, s, "INSERT INTO account_lockouts (subject_id, subject_type, last_failed_at) VALUES (?, 'developer', CURRENT_TIMESTAMP)", devID)
+	mustExec(t, s, "INSERT INTO audit_log (id, developer_id, actor_id, action, target_type, created_at, prev_hash, hash) VALUES (?, ?, ?, 'application.create', 'application', '', '', 'h')",
+		devID+"-audit", devID, devID)
+}
+
+var applicationDataTables = append([]string{"users", "applications"}, applicationTables...)
+
+func TestDeleteDeveloper(t *testing.T) {
+	s := newTestService(t)
+	seedDeveloper(t, s, "dev-1", "app-1")
+	seedDeveloper(t, s, "dev-2", "app-2")
+
+	// dev-1 created a team application in a team dev-2 also owns
+	mustExec(t, s, "INSERT INTO teams (id, name) VALUES ('team-1', 'Team')")
+	mustExec(t, s, "INSERT INTO team_members (team_id, developer_id, role) VALUES ('team-1', 'dev-1', ?), ('team-1', 'dev-2', ?)",
+		TeamRoleOwner, TeamRoleOwner)
+	mustExec(t, s, "INSERT INTO applications (id, developer_id, team_id, name, domain, public_key, secret_key) VALUES ('app-team', 'dev-1', 'team-1', 'Team App', 'example.com', 'pk_team', 'sk_team')")
+
+	if err := s.DeleteDeveloper("dev-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range applicationDataTables {
+		column := "application_id"
+		if table == "applications" {
+			column = "id"
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM "+table+" WHERE "+column+" = 'app-1'"); n != 0 {
+			t.Errorf("expected no %s rows left for app-1; got %d", table, n)
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM "+table+" WHERE "+column+" = 'app-2'"); n == 0 {
+			t.Errorf("expected dev-2's %s rows to be kept", table)
+		}
+	}
+	if n := countRows(t, s, "SELECT COUNT(*) FROM known_devices WHERE application_id = 'app-1'"); n != 0 {
+		t.Errorf("expected no known devices left for app-1; got %d", n)
+	}
+	for _, d := range append(developerTables, struct{ table, column string }{"developers", "id"}) {
+		if n := countRows(t, s, "SELECT COUNT(*) FROM "+d.table+" WHERE "+d.column+" = 'dev-1'"); n != 0 {
+			t.Errorf("expected no %s rows left for dev-1; got %d", d.table, n)
+		}
+		if n := countRows(t, s, "SELECT COUNT(*) FROM "+d.table+" WHERE "+d.column+" = 'dev-2'"); n == 0 {
+			t.Errorf("expected dev-2's %s rows to be kept", d.table)
+		}
+	}
+
+	var owner string
+	if err := s.db.QueryRow("SELECT developer_id FROM applications WHERE id = 'app-team'").Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != "dev-2" {
+		t.Errorf("expected the team application to pass to dev-2; got %q", owner)
+	}
+	if n := countRows(t, s, "SELECT COUNT(*) FROM audit_log WHERE developer_id = 'dev-1'"); n != 1 {
+		t.Errorf("expected the audit log to be kept; got %d rows", n)
+	}
+
+	if err := s.DeleteDeveloper("dev-1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows deleting twice; got %v", err)
+	}
+}
+
+func TestDeleteDeveloperSoleTeamOwner(t *testing.T) {
+	s := newTestService(t)
+	seedDeveloper(t, s, "dev-1", "app-1")
+	mustExec(t, s, "INSERT INTO teams (id, name) VALUES ('team-1', 'Team')")
+	mustExec(t, s, "INSERT INTO team_members (team_id, developer_id, role) VALUES ('team-1', 'dev-1', ?)", TeamRoleOwner)
+
+	if err := s.DeleteDeveloper("dev-1"); !errors.Is(err, ErrSoleTeamOwner) {
+		t.Fatalf("expected ErrSoleTeamOwner; got %v", err)
+	}
+	if n := countRows(t, s, "SELECT COUNT(*) FROM users WHERE application_id = 'app-1'"); n != 1 {
+		t.Errorf("expected nothing to be deleted; got %d users", n)
+	}
+}
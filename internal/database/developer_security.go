@@ -0,0 +1,381 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DeveloperSession is a developer's signed-in client. Its access tokens
+// name it in their sid claim, and its refresh token is replaced on every
+// use. Only the current access token's ID is kept, so revoking the session
+// can deny it. AuthTime is when the developer signed in, which refreshing
+// keeps.
+type DeveloperSession struct {
+	ID               string    `json:"id"`
+	DeveloperID      string    `json:"-"`
+	RefreshTokenHash string    `json:"-"`
+	AccessTokenID    string    `json:"-"`
+	AuthMethods      []string  `json:"authMethods"`
+	AuthTime         time.Time `json:"authTime"`
+	IP               string    `json:"ip"`
+	UserAgent        string    `json:"userAgent"`
+	CreatedAt        time.Time `json:"createdAt"`
+	LastUsedAt       time.Time `json:"lastUsedAt"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
+
+// DeveloperPasskey is a WebAuthn credential a developer registered as a
+// second factor
+type DeveloperPasskey struct {
+	ID          string `json:"id"`
+	DeveloperID string `json:"-"`
+	// CredentialID is the base64url credential ID chosen by the authenticator
+	CredentialID string `json:"credentialId"`
+	// PublicKey is the credential's COSE_Key
+	PublicKey  []byte     `json:"-"`
+	SignCount  uint32     `json:"-"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// UpdateDeveloperTOTP sets a developer's authenticator app secret and
+// whether it is enabled
+func (s *service) UpdateDeveloperTOTP(id, secret string, enabled bool) error {
+	result, err := s.db.Exec("UPDATE developers SET totp_secret = ?, totp_enabled = ? WHERE id = ?",
+		secret, enabled, id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateDeveloperRecoveryCodes replaces a developer's recovery codes with
+// the given hashes
+func (s *service) UpdateDeveloperRecoveryCodes(id string, codeHashes []string) error {
+	codes, err := json.Marshal(codeHashes)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE developers SET recovery_codes = ? WHERE id = ?", string(codes), id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseDeveloperTOTPStep records that the code for step was accepted. It
+// returns sql.ErrNoRows if a code for that or a later step already was.
+func (s *service) UseDeveloperTOTPStep(id string, step int64) error {
+	result, err := s.db.Exec(
+		"UPDATE developers SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, id, step)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseDeveloperRecoveryCode removes the recovery code with codeHash from the
+// developer's unused codes. It returns sql.ErrNoRows if it is not one of
+// them.
+func (s *service) UseDeveloperRecoveryCode(id, codeHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var encoded string
+	err = tx.QueryRow("SELECT recovery_codes FROM developers WHERE id = ?", id).Scan(&encoded)
+	if err != nil {
+		return err
+	}
+	var codes []string
+	if encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &codes); err != nil {
+			return fmt.Errorf("decode recovery codes of developer %s: %w", id, err)
+		}
+	}
+	i := slices.Index(codes, codeHash)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	remaining, err := json.Marshal(slices.Delete(codes, i, i+1))
+	if err != nil {
+		return err
+	}
+
+	// Compare with the codes read so two logins cannot spend the same code
+	result, err := tx.Exec("UPDATE developers SET recovery_codes = ? WHERE id = ? AND recovery_codes = ?",
+		string(remaining), id, encoded)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+const developerSessionColumns = `id, developer_id, refresh_token_hash, access_token_id, auth_methods,
+	ip, user_agent, created_at, last_used_at, expires_at, auth_time`
+
+// scanDeveloperSession reads a row selected with developerSessionColumns.
+// Sessions created before the sign-in time was recorded count as signed in
+// when created.
+func scanDeveloperSession(row rowScanner) (*DeveloperSession, error) {
+	var session DeveloperSession
+	var methods string
+	var authTime sql.NullTime
+	err := row.Scan(&session.ID, &session.DeveloperID, &session.RefreshTokenHash, &session.AccessTokenID,
+		&methods, &session.IP, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+		&authTime)
+	if err != nil {
+		return nil, err
+	}
+	session.AuthTime = session.CreatedAt
+	if authTime.Valid {
+		session.AuthTime = authTime.Time
+	}
+	session.AuthMethods = []string{}
+	if err := json.Unmarshal([]byte(methods), &session.AuthMethods); err != nil {
+		return nil, fmt.Errorf("decode auth methods of developer session %s: %w", session.ID, err)
+	}
+	return &session, nil
+}
+
+func (s *service) CreateDeveloperSession(session *DeveloperSession) error {
+	methods, err := json.Marshal(session.AuthMethods)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO developer_sessions (id, developer_id, refresh_token_hash, access_token_id, auth_methods,
+		                                 ip, user_agent, last_used_at, expires_at, auth_time)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.DeveloperID, session.RefreshTokenHash, session.AccessTokenID, string(methods),
+		session.IP, session.UserAgent, session.LastUsedAt.UTC(), session.ExpiresAt.UTC(), session.AuthTime.UTC())
+	return err
+}
+
+func (s *service) GetDeveloperSession(developerID, id string) (*DeveloperSession, error) {
+	session, err := scanDeveloperSession(s.db.QueryRow(
+		`SELECT `+developerSessionColumns+` FROM developer_sessions WHERE id = ? AND developer_id = ?`,
+		id, developerID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+func (s *service) GetDeveloperSessionByRefreshToken(tokenHash string) (*DeveloperSession, error) {
+	session, err := scanDeveloperSession(s.db.QueryRow(
+		`SELECT `+developerSessionColumns+` FROM developer_sessions WHERE refresh_token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// GetDeveloperSessions returns a developer's unexpired sessions, most
+// recently used first
+func (s *service) GetDeveloperSessions(developerID string) ([]DeveloperSession, error) {
+	rows, err := s.db.Query(
+		`SELECT `+developerSessionColumns+` FROM developer_sessions
+		 WHERE developer_id = ? AND expires_at > ? ORDER BY last_used_at DESC`,
+		developerID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []DeveloperSession{}
+	for rows.Next() {
+		session, err := scanDeveloperSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// RotateDeveloperSession stores the session's new refresh token hash,
+// access token ID and client details. It returns sql.ErrNoRows if the
+// refresh token with oldTokenHash was already used.
+func (s *service) RotateDeveloperSession(session *DeveloperSession, oldTokenHash string) error {
+	result, err := s.db.Exec(
+		`UPDATE developer_sessions
+		 SET refresh_token_hash = ?, access_token_id = ?, ip = ?, user_agent = ?, last_used_at = ?
+		 WHERE id = ? AND refresh_token_hash = ?`,
+		session.RefreshTokenHash, session.AccessTokenID, session.IP, session.UserAgent,
+		session.LastUsedAt.UTC(), session.ID, oldTokenHash)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *service) DeleteDeveloperSession(developerID, id string) error {
+	result, err := s.db.Exec("DELETE FROM developer_sessions WHERE id = ? AND developer_id = ?", id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteExpiredDeveloperSessions deletes sessions whose refresh token has
+// expired, returning how many it deleted
+func (s *service) DeleteExpiredDeveloperSessions() (int, error) {
+	result, err := s.db.Exec("DELETE FROM developer_sessions WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// RevokeToken denies the token with ID jti until it expires anyway
+func (s *service) RevokeToken(jti string, expiresAt time.Time) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)",
+		jti, expiresAt.UTC())
+	return err
+}
+
+func (s *service) IsTokenRevoked(jti string) (bool, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?", jti).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteExpiredRevokedTokens forgets revoked tokens that have expired,
+// returning how many it deleted
+func (s *service) DeleteExpiredRevokedTokens() (int, error) {
+	result, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+const developerPasskeyColumns = `id, developer_id, credential_id, public_key, sign_count, name,
+	created_at, last_used_at`
+
+func scanDeveloperPasskey(row rowScanner) (*DeveloperPasskey, error) {
+	var passkey DeveloperPasskey
+	var lastUsedAt sql.NullTime
+	err := row.Scan(&passkey.ID, &passkey.DeveloperID, &passkey.CredentialID, &passkey.PublicKey,
+		&passkey.SignCount, &passkey.Name, &passkey.CreatedAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	if lastUsedAt.Valid {
+		passkey.LastUsedAt = &lastUsedAt.Time
+	}
+	return &passkey, nil
+}
+
+func (s *service) CreateDeveloperPasskey(passkey *DeveloperPasskey) error {
+	_, err := s.db.Exec(
+		`INSERT INTO developer_passkeys (id, developer_id, credential_id, public_key, sign_count, name)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		passkey.ID, passkey.DeveloperID, passkey.CredentialID, passkey.PublicKey, passkey.SignCount, passkey.Name)
+	return err
+}
+
+// GetDeveloperPasskeys returns a developer's passkeys, oldest first
+func (s *service) GetDeveloperPasskeys(developerID string) ([]DeveloperPasskey, error) {
+	rows, err := s.db.Query(
+		`SELECT `+developerPasskeyColumns+` FROM developer_passkeys
+		 WHERE developer_id = ? ORDER BY created_at`, developerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []DeveloperPasskey{}
+	for rows.Next() {
+		passkey, err := scanDeveloperPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, *passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func (s *service) GetDeveloperPasskeyByCredentialID(developerID, credentialID string) (*DeveloperPasskey, error) {
+	passkey, err := scanDeveloperPasskey(s.db.QueryRow(
+		`SELECT `+developerPasskeyColumns+` FROM developer_passkeys
+		 WHERE developer_id = ? AND credential_id = ?`, developerID, credentialID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return passkey, err
+}
+
+// UpdateDeveloperPasskeyUse records a successful sign-in with a passkey and
+// the authenticator's new signature counter
+func (s *service) UpdateDeveloperPasskeyUse(id string, signCount uint32) error {
+	_, err := s.db.Exec("UPDATE developer_passkeys SET sign_count = ?, last_used_at = ? WHERE id = ?",
+		signCount, time.Now().UTC(), id)
+	return err
+}
+
+func (s *service) DeleteDeveloperPasskey(developerID, id string) error {
+	result, err := s.db.Exec("DELETE FROM developer_passkeys WHERE id = ? AND developer_id = ?", id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
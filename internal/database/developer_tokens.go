@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DeveloperAPIToken is a long-lived personal access token a developer
+// created for scripts and CI. Only its hash is stored.
+type DeveloperAPIToken struct {
+	ID          string `json:"id"`
+	DeveloperID string `json:"-"`
+	Name        string `json:"name"`
+	TokenHash   string `json:"-"`
+	// Prefix is the start of the token, shown so it can be recognised
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// AllowedIPs are the addresses and CIDR ranges the token may be used
+	// from; empty allows any
+	AllowedIPs []string   `json:"allowedIps"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+}
+
+const developerAPITokenColumns = `id, developer_id, name, token_hash, prefix, scopes, allowed_ips,
+	expires_at, created_at, last_used_at, last_used_ip`
+
+func scanDeveloperAPIToken(row rowScanner) (*DeveloperAPIToken, error) {
+	var token DeveloperAPIToken
+	var scopes, allowedIPs string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.DeveloperID, &token.Name, &token.TokenHash, &token.Prefix,
+		&scopes, &allowedIPs, &expiresAt, &token.CreatedAt, &lastUsedAt, &token.LastUsedIP)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = []string{}
+	if err := json.Unmarshal([]byte(scopes), &token.Scopes); err != nil {
+		return nil, fmt.Errorf("decode scopes of developer API token %s: %w", token.ID, err)
+	}
+	token.AllowedIPs = []string{}
+	if err := json.Unmarshal([]byte(allowedIPs), &token.AllowedIPs); err != nil {
+		return nil, fmt.Errorf("decode allowed IPs of developer API token %s: %w", token.ID, err)
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return &token, nil
+}
+
+func (s *service) CreateDeveloperAPIToken(token *DeveloperAPIToken) error {
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return err
+	}
+	allowedIPs, err := json.Marshal(token.AllowedIPs)
+	if err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.UTC()
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO developer_api_tokens (id, developer_id, name, token_hash, prefix, scopes, allowed_ips, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		token.ID, token.DeveloperID, token.Name, token.TokenHash, token.Prefix,
+		string(scopes), string(allowedIPs), expiresAt)
+	return err
+}
+
+// GetDeveloperAPITokens returns a developer's API tokens, including expired
+// ones, newest first
+func (s *service) GetDeveloperAPITokens(developerID string) ([]DeveloperAPIToken, error) {
+	rows, err := s.db.Query(
+		`SELECT `+developerAPITokenColumns+` FROM developer_api_tokens
+		 WHERE developer_id = ? ORDER BY created_at DESC`, developerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []DeveloperAPIToken{}
+	for rows.Next() {
+		token, err := scanDeveloperAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *service) GetDeveloperAPITokenByHash(tokenHash string) (*DeveloperAPIToken, error) {
+	token, err := scanDeveloperAPIToken(s.db.QueryRow(
+		`SELECT `+developerAPITokenColumns+` FROM developer_api_tokens WHERE token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return token, err
+}
+
+// UpdateDeveloperAPITokenUse records that the token was just used from ip
+func (s *service) UpdateDeveloperAPITokenUse(id, ip string) error {
+	_, err := s.db.Exec("UPDATE developer_api_tokens SET last_used_at = ?, last_used_ip = ? WHERE id = ?",
+		time.Now().UTC(), ip, id)
+	return err
+}
+
+func (s *service) DeleteDeveloperAPIToken(developerID, id string) error {
+	result, err := s.db.Exec("DELETE FROM developer_api_tokens WHERE id = ? AND developer_id = ?", id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
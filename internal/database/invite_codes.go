@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// InviteCode lets someone register while an application's signup is
+// invite-only. Only a hash of the code is stored; Code is set only when the
+// code is created.
+type InviteCode struct {
+	ID            string `json:"id"`
+	ApplicationID string `json:"applicationId"`
+	Code          string `json:"code,omitempty"`
+	CodeHash      string `json:"-"`
+	// Email restricts the code to one address when not empty
+	Email     string     `json:"email,omitempty"`
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+const inviteCodeColumns = `id, application_id, code_hash, email, max_uses, uses, expires_at, created_at`
+
+func scanInviteCode(row rowScanner) (*InviteCode, error) {
+	var code InviteCode
+	var expiresAt sql.NullTime
+	err := row.Scan(&code.ID, &code.ApplicationID, &code.CodeHash, &code.Email,
+		&code.MaxUses, &code.Uses, &expiresAt, &code.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		code.ExpiresAt = &expiresAt.Time
+	}
+	return &code, nil
+}
+
+func (s *service) CreateInviteCode(code *InviteCode) error {
+	var expiresAt any
+	if code.ExpiresAt != nil {
+		expiresAt = *code.ExpiresAt
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO signup_invite_codes (id, application_id, code_hash, email, max_uses, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		code.ID, code.ApplicationID, code.CodeHash, code.Email, code.MaxUses, expiresAt)
+	return err
+}
+
+func (s *service) GetInviteCodes(applicationID string) ([]InviteCode, error) {
+	rows, err := s.db.Query(
+		`SELECT `+inviteCodeColumns+` FROM signup_invite_codes
+		 WHERE application_id = ? ORDER BY created_at DESC`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []InviteCode{}
+	for rows.Next() {
+		code, err := scanInviteCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, *code)
+	}
+	return codes, rows.Err()
+}
+
+func (s *service) GetInviteCodeByHash(applicationID, codeHash string) (*InviteCode, error) {
+	code, err := scanInviteCode(s.db.QueryRow(
+		`SELECT `+inviteCodeColumns+` FROM signup_invite_codes
+		 WHERE code_hash = ? AND application_id = ?`, codeHash, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return code, err
+}
+
+// CreateInvitedUser uses up one use of the invite code and inserts user in
+// the same transaction. It returns sql.ErrNoRows without creating the user if
+// the code has no uses left, which can happen when two registrations race.
+func (s *service) CreateInvitedUser(user *User, inviteCodeID string, events ...OutboxEvent) error {
+	user.ApplyDefaults()
+	return s.withEvents(events, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			"UPDATE signup_invite_codes SET uses = uses + 1 WHERE id = ? AND uses < max_uses", inviteCodeID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+		return insertUser(tx, user)
+	})
+}
+
+func (s *service) DeleteInviteCode(applicationID, id string) error {
+	result, err := s.db.Exec("DELETE FROM signup_invite_codes WHERE id = ? AND application_id = ?",
+		id, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
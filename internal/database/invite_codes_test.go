@@ -0,0 +1,49 @@
+//go:build cgo
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestCreateInvitedUser(t *testing.T) {
+	s := newTestService(t)
+	mustExec(t, s, "INSERT INTO signup_invite_codes (id, application_id, code_hash, max_uses) VALUES ('code-1', 'app-1', 'h', 2)")
+	uses := func() int {
+		return countRows(t, s, "SELECT uses FROM signup_invite_codes WHERE id = 'code-1'")
+	}
+	newUser := func(id, email string) *User {
+		return &User{ID: id, ApplicationID: "app-1", Email: email, PasswordHash: "x", Status: UserStatusActive}
+	}
+
+	if err := s.CreateInvitedUser(newUser("user-1", "ada@example.com"), "code-1"); err != nil {
+		t.Fatal(err)
+	}
+	if uses() != 1 {
+		t.Errorf("expected one use; got %d", uses())
+	}
+
+	// A failed insert gives the use back
+	if err := s.CreateInvitedUser(newUser("user-2", "ada@example.com"), "code-1"); err == nil {
+		t.Fatal("expected a duplicate email to fail")
+	}
+	if uses() != 1 {
+		t.Errorf("expected the use to be returned; got %d", uses())
+	}
+
+	if err := s.CreateInvitedUser(newUser("user-3", "grace@example.com"), "code-1"); err != nil {
+		t.Fatal(err)
+	}
+	err := s.CreateInvitedUser(newUser("user-4", "ida@example.com"), "code-1")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows once the code is used up; got %v", err)
+	}
+	if n := countRows(t, s, "SELECT COUNT(*) FROM users WHERE id = 'user-4'"); n != 0 {
+		t.Error("expected no user without a use of the code")
+	}
+	if uses() != 2 {
+		t.Errorf("expected two uses; got %d", uses())
+	}
+}
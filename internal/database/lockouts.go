@@ -0,0 +1,183 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Kinds of account tracked by AccountLockout
+const (
+	LockoutSubjectUser      = "user"
+	LockoutSubjectDeveloper = "developer"
+)
+
+// AccountLockout counts recent failed logins to one account. ApplicationID
+// is empty for developer accounts.
+type AccountLockout struct {
+	SubjectID      string     `json:"subjectId"`
+	SubjectType    string     `json:"subjectType"`
+	ApplicationID  string     `json:"applicationId,omitempty"`
+	FailedAttempts int        `json:"failedAttempts"`
+	LastFailedAt   time.Time  `json:"lastFailedAt"`
+	LockedUntil    *time.Time `json:"lockedUntil,omitempty"`
+}
+
+const lockoutColumns = `subject_id, subject_type, application_id, failed_attempts, last_failed_at, locked_until`
+
+func scanLockout(row rowScanner) (*AccountLockout, error) {
+	var l AccountLockout
+	var lockedUntil sql.NullTime
+	err := row.Scan(&l.SubjectID, &l.SubjectType, &l.ApplicationID, &l.FailedAttempts,
+		&l.LastFailedAt, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		l.LockedUntil = &lockedUntil.Time
+	}
+	return &l, nil
+}
+
+func (s *service) GetAccountLockout(subjectID string) (*AccountLockout, error) {
+	l, err := scanLockout(s.db.QueryRow(
+		`SELECT `+lockoutColumns+` FROM account_lockouts WHERE subject_id = ?`, subjectID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return l, err
+}
+
+// ReserveLoginAttempt counts a login attempt to l's account as failed
+// before its credentials are checked, so that concurrent attempts all see
+// each other. allow is called with the state before this attempt, nil if
+// there were no failures that still count, and the attempt is only counted
+// if it returns true; it returns the new state, or nil if it was not
+// allowed. Earlier failures are forgotten first if the account's lock has
+// expired or its last failure was before resetBefore, and then the attempt
+// counts from l.LastFailedAt. RecordFailedLogin or DeleteAccountLockout
+// settles the attempt.
+func (s *service) ReserveLoginAttempt(l *AccountLockout, resetBefore time.Time,
+	allow func(before *AccountLockout) bool) (*AccountLockout, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// SET expressions see the row as it was before the update
+	now := l.LastFailedAt.UTC()
+	state, err := scanLockout(tx.QueryRow(
+		`INSERT INTO account_lockouts (`+lockoutColumns+`)
+		 VALUES (?, ?, ?, 1, ?, NULL)
+		 ON CONFLICT (subject_id) DO UPDATE SET
+		     failed_attempts = CASE WHEN `+staleLockout+` THEN 1 ELSE failed_attempts + 1 END,
+		     locked_until = CASE WHEN `+staleLockout+` THEN NULL ELSE locked_until END,
+		     last_failed_at = CASE WHEN `+staleLockout+` THEN excluded.last_failed_at ELSE last_failed_at END
+		 RETURNING `+lockoutColumns,
+		l.SubjectID, l.SubjectType, l.ApplicationID, now,
+		now, resetBefore.UTC(), now, resetBefore.UTC(), now, resetBefore.UTC()))
+	if err != nil {
+		return nil, err
+	}
+
+	var before *AccountLockout
+	if state.FailedAttempts > 1 {
+		copied := *state
+		copied.FailedAttempts--
+		before = &copied
+	}
+	if !allow(before) {
+		return nil, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// RecordFailedLogin settles an attempt counted by ReserveLoginAttempt as
+// failed at l.LastFailedAt. If the count has reached lockAfter the account
+// is locked until lockedUntil and events are recorded with the lock. It
+// returns the new state and whether this failure locked the account.
+func (s *service) RecordFailedLogin(l *AccountLockout, lockAfter int,
+	lockedUntil time.Time, events ...OutboxEvent) (*AccountLockout, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// The row is gone if a concurrent login succeeded, and the failure then
+	// counts on its own
+	state, err := scanLockout(tx.QueryRow(
+		`INSERT INTO account_lockouts (`+lockoutColumns+`)
+		 VALUES (?, ?, ?, 1, ?, NULL)
+		 ON CONFLICT (subject_id) DO UPDATE SET last_failed_at = excluded.last_failed_at
+		 RETURNING `+lockoutColumns,
+		l.SubjectID, l.SubjectType, l.ApplicationID, l.LastFailedAt.UTC()))
+	if err != nil {
+		return nil, false, err
+	}
+
+	locked := false
+	if state.LockedUntil == nil && state.FailedAttempts >= lockAfter {
+		until := lockedUntil.UTC()
+		if _, err := tx.Exec("UPDATE account_lockouts SET locked_until = ? WHERE subject_id = ?",
+			until, l.SubjectID); err != nil {
+			return nil, false, err
+		}
+		if err := insertOutboxEvents(tx, events); err != nil {
+			return nil, false, err
+		}
+		state.LockedUntil = &until
+		locked = true
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return state, locked, nil
+}
+
+// staleLockout matches a lockout row whose failures no longer count, given
+// the time of the new failure and the reset cutoff as arguments
+const staleLockout = `((locked_until IS NOT NULL AND locked_until <= ?) OR
+		     (locked_until IS NULL AND last_failed_at <= ?))`
+
+// DeleteAccountLockout clears the failed attempts of an account. It returns
+// sql.ErrNoRows if there were none.
+func (s *service) DeleteAccountLockout(subjectID string) error {
+	result, err := s.db.Exec("DELETE FROM account_lockouts WHERE subject_id = ?", subjectID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetApplicationLockouts returns the failed login state of the application's
+// users, most recent failure first
+func (s *service) GetApplicationLockouts(applicationID string) ([]AccountLockout, error) {
+	rows, err := s.db.Query(
+		`SELECT `+lockoutColumns+` FROM account_lockouts
+		 WHERE application_id = ? ORDER BY last_failed_at DESC`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []AccountLockout{}
+	for rows.Next() {
+		l, err := scanLockout(rows)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, *l)
+	}
+	return lockouts, rows.Err()
+}
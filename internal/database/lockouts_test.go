@@ -0,0 +1,120 @@
+//go:build cgo
+
+package database
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveLoginAttempt(t *testing.T) {
+	s := newTestService(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	const lockAfter = 3
+	lockedUntil := now.Add(15 * time.Minute)
+	account := func(at time.Time) *AccountLockout {
+		return &AccountLockout{SubjectID: "user-1", SubjectType: LockoutSubjectUser, ApplicationID: "app-1", LastFailedAt: at}
+	}
+	reserve := func(at time.Time, allow func(before *AccountLockout) bool) *AccountLockout {
+		t.Helper()
+		state, err := s.ReserveLoginAttempt(account(at), at.Add(-time.Hour), allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	allowAll := func(*AccountLockout) bool { return true }
+	failure := func(at time.Time, events ...OutboxEvent) (*AccountLockout, bool) {
+		t.Helper()
+		reserve(at, allowAll)
+		state, locked, err := s.RecordFailedLogin(account(at), lockAfter, lockedUntil, events...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state, locked
+	}
+	event := OutboxEvent{ID: "evt-1", ApplicationID: "app-1", Type: "user.locked", Payload: []byte("{}")}
+
+	for i := 1; i < lockAfter; i++ {
+		if state, locked := failure(now, event); locked || state.FailedAttempts != i || state.LockedUntil != nil {
+			t.Fatalf("failure %d: expected %d unlocked failures; got %+v locked=%v", i, i, state, locked)
+		}
+	}
+	if n := countRows(t, s, "SELECT COUNT(*) FROM outbox_events"); n != 0 {
+		t.Errorf("expected no events before the lock; got %d", n)
+	}
+
+	// An attempt that is not allowed is not counted
+	var seen *AccountLockout
+	if state := reserve(now, func(before *AccountLockout) bool { seen = before; return false }); state != nil {
+		t.Errorf("expected no state for a refused attempt; got %+v", state)
+	}
+	if seen == nil || seen.FailedAttempts != lockAfter-1 {
+		t.Errorf("expected allow to see %d failures; got %+v", lockAfter-1, seen)
+	}
+
+	state, locked := failure(now, event)
+	if !locked || state.LockedUntil == nil || !state.LockedUntil.Equal(lockedUntil) {
+		t.Fatalf("expected the account to lock; got %+v locked=%v", state, locked)
+	}
+	if n := countRows(t, s, "SELECT COUNT(*) FROM outbox_events"); n != 1 {
+		t.Errorf("expected the lock event to be recorded; got %d", n)
+	}
+
+	// A failure racing past the lock does not lock again
+	if state, locked, err := s.RecordFailedLogin(account(now.Add(time.Minute)), lockAfter, lockedUntil); err != nil || locked ||
+		!state.LastFailedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected a recorded failure without a new lock; got %+v locked=%v %v", state, locked, err)
+	}
+
+	// Once the lock expires the account starts over
+	if state := reserve(lockedUntil, func(before *AccountLockout) bool { seen = before; return true }); state.FailedAttempts != 1 ||
+		state.LockedUntil != nil || seen != nil {
+		t.Errorf("expected the count to reset after the lock; got %+v, allowed from %+v", state, seen)
+	}
+
+	// So it does once the last failure is older than the reset cutoff
+	failure(lockedUntil)
+	if state, _ := failure(lockedUntil.Add(2 * time.Hour)); state.FailedAttempts != 1 {
+		t.Errorf("expected old failures to be forgotten; got %+v", state)
+	}
+}
+
+func TestReserveLoginAttemptConcurrent(t *testing.T) {
+	s := newTestService(t)
+	now := time.Now().UTC()
+	const attempts, allowed = 20, 5
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := &AccountLockout{SubjectID: "dev-1", SubjectType: LockoutSubjectDeveloper, LastFailedAt: now}
+			state, err := s.ReserveLoginAttempt(l, now.Add(-time.Hour), func(before *AccountLockout) bool {
+				return before == nil || before.FailedAttempts < allowed
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if state != nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	l, err := s.GetAccountLockout("dev-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.FailedAttempts != allowed || reserved != allowed {
+		t.Errorf("expected %d attempts; got %d counted and %d reserved", allowed, l.FailedAttempts, reserved)
+	}
+}
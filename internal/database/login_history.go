@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Methods a user can log in with
+const (
+	LoginMethodPassword      = "password"
+	LoginMethodPasswordReset = "password_reset"
+)
+
+// LoginAttempt is one attempt to log in as a user, successful or not.
+// FailureReason is the error code returned to the client. RiskSignals and
+// RiskAction record what suspicious-login detection found and did.
+type LoginAttempt struct {
+	Seq           int64     `json:"seq"`
+	ApplicationID string    `json:"applicationId"`
+	UserID        string    `json:"userId"`
+	Success       bool      `json:"success"`
+	FailureReason string    `json:"failureReason,omitempty"`
+	Method        string    `json:"method"`
+	MFA           bool      `json:"mfa"`
+	IP            string    `json:"ip"`
+	UserAgent     string    `json:"userAgent"`
+	SessionID     string    `json:"sessionId,omitempty"`
+	RiskSignals   []string  `json:"riskSignals,omitempty"`
+	RiskAction    string    `json:"riskAction,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// LoginHistoryPolicy limits how long, and how many, login attempts are
+// kept for each user of an application. Zero values use the server
+// defaults.
+type LoginHistoryPolicy struct {
+	RetentionDays int `json:"retentionDays"`
+	MaxPerUser    int `json:"maxPerUser"`
+}
+
+func (s *service) UpdateApplicationLoginHistoryPolicy(id string, developerID string, policy *LoginHistoryPolicy) error {
+	var encoded string
+	if policy != nil {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	result, err := s.db.Exec(
+		`UPDATE applications SET login_history_policy = ?
+		 WHERE id = ? AND developer_id = ?`,
+		encoded, id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RecordLoginAttempt stores attempt, then deletes the user's oldest
+// attempts beyond the newest maxPerUser
+func (s *service) RecordLoginAttempt(attempt *LoginAttempt, maxPerUser int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var signals string
+	if len(attempt.RiskSignals) > 0 {
+		b, err := json.Marshal(attempt.RiskSignals)
+		if err != nil {
+			return err
+		}
+		signals = string(b)
+	}
+	_, err = tx.Exec(
+		`INSERT INTO login_attempts (application_id, user_id, success, failure_reason, method, mfa,
+		                             ip, user_agent, session_id, risk_signals, risk_action)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		attempt.ApplicationID, attempt.UserID, attempt.Success, attempt.FailureReason, attempt.Method,
+		attempt.MFA, attempt.IP, attempt.UserAgent, attempt.SessionID, signals, attempt.RiskAction)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`DELETE FROM login_attempts WHERE user_id = ? AND seq <= (
+		     SELECT seq FROM login_attempts WHERE user_id = ?
+		     ORDER BY seq DESC LIMIT 1 OFFSET ?)`,
+		attempt.UserID, attempt.UserID, maxPerUser)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetLoginAttempts returns up to limit of the user's attempts, newest first,
+// starting before beforeSeq if it is set
+func (s *service) GetLoginAttempts(userID string, beforeSeq int64, limit int) ([]LoginAttempt, error) {
+	query := `SELECT seq, application_id, user_id, success, failure_reason, method, mfa,
+		        ip, user_agent, session_id, risk_signals, risk_action, created_at
+		 FROM login_attempts WHERE user_id = ?`
+	args := []any{userID}
+	if beforeSeq > 0 {
+		query += ` AND seq < ?`
+		args = append(args, beforeSeq)
+	}
+	query += ` ORDER BY seq DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		var signals string
+		err := rows.Scan(&a.Seq, &a.ApplicationID, &a.UserID, &a.Success, &a.FailureReason, &a.Method,
+			&a.MFA, &a.IP, &a.UserAgent, &a.SessionID, &signals, &a.RiskAction, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if signals != "" {
+			if err := json.Unmarshal([]byte(signals), &a.RiskSignals); err != nil {
+				return nil, fmt.Errorf("decode risk signals of login attempt %d: %w", a.Seq, err)
+			}
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// DeleteExpiredLoginAttempts deletes attempts older than their
+// application's retention, or defaultRetentionDays where the application
+// sets none, returning how many were deleted
+func (s *service) DeleteExpiredLoginAttempts(defaultRetentionDays int) (int, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM login_attempts WHERE created_at < datetime('now', '-' || COALESCE(
+		     (SELECT NULLIF(json_extract(a.login_history_policy, '$.retentionDays'), 0)
+		      FROM applications a
+		      WHERE a.id = login_attempts.application_id AND a.login_history_policy != ''),
+		     ?) || ' days')`,
+		strconv.Itoa(defaultRetentionDays))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
@@ -0,0 +1,402 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Roles a user can hold within an organization. Admins manage the
+// organization's members and invitations.
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// Organization groups users of an application, such as the employees of one
+// customer of a B2B application
+type Organization struct {
+	ID            string    `json:"id"`
+	ApplicationID string    `json:"applicationId"`
+	Name          string    `json:"name"`
+	Slug          string    `json:"slug"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// OrganizationMember is a user's membership of an organization. The user
+// fields are filled in when listing an organization's members.
+type OrganizationMember struct {
+	OrganizationID string    `json:"organizationId"`
+	UserID         string    `json:"userId"`
+	ApplicationID  string    `json:"applicationId"`
+	Role           string    `json:"role"`
+	CreatedAt      time.Time `json:"createdAt"`
+	Email          string    `json:"email,omitempty"`
+	FirstName      string    `json:"firstName,omitempty"`
+	LastName       string    `json:"lastName,omitempty"`
+}
+
+// UserOrganization is an organization together with the role a particular
+// user has in it
+type UserOrganization struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// OrganizationInvitation asks the owner of Email to join an organization.
+// Only a hash of the invite token is stored.
+type OrganizationInvitation struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organizationId"`
+	ApplicationID  string    `json:"applicationId"`
+	Email          string    `json:"email"`
+	Role           string    `json:"role"`
+	TokenHash      string    `json:"-"`
+	InvitedBy      string    `json:"invitedBy"`
+	Accepted       bool      `json:"accepted"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+const organizationColumns = `id, application_id, name, slug, created_at`
+
+func scanOrganization(row rowScanner) (*Organization, error) {
+	var org Organization
+	err := row.Scan(&org.ID, &org.ApplicationID, &org.Name, &org.Slug, &org.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+const invitationColumns = `id, organization_id, application_id, email, role, token_hash, invited_by,
+	accepted, expires_at, created_at`
+
+func scanInvitation(row rowScanner) (*OrganizationInvitation, error) {
+	var inv OrganizationInvitation
+	err := row.Scan(&inv.ID, &inv.OrganizationID, &inv.ApplicationID, &inv.Email, &inv.Role,
+		&inv.TokenHash, &inv.InvitedBy, &inv.Accepted, &inv.ExpiresAt, &inv.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// CreateOrganization stores org and, if creator is not nil, its first member
+func (s *service) CreateOrganization(org *Organization, creator *OrganizationMember) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO organizations (id, application_id, name, slug) VALUES (?, ?, ?, ?)`,
+		org.ID, org.ApplicationID, org.Name, org.Slug)
+	if err != nil {
+		return err
+	}
+	if creator != nil {
+		_, err = tx.Exec(
+			`INSERT INTO organization_members (organization_id, user_id, application_id, role)
+			 VALUES (?, ?, ?, ?)`,
+			creator.OrganizationID, creator.UserID, creator.ApplicationID, creator.Role)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *service) GetOrganizations(applicationID string) ([]Organization, error) {
+	rows, err := s.db.Query(
+		`SELECT `+organizationColumns+` FROM organizations WHERE application_id = ? ORDER BY name`,
+		applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		org, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, *org)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *service) GetOrganization(applicationID, id string) (*Organization, error) {
+	org, err := scanOrganization(s.db.QueryRow(
+		`SELECT `+organizationColumns+` FROM organizations WHERE id = ? AND application_id = ?`,
+		id, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return org, err
+}
+
+func (s *service) GetOrganizationBySlug(applicationID, slug string) (*Organization, error) {
+	org, err := scanOrganization(s.db.QueryRow(
+		`SELECT `+organizationColumns+` FROM organizations WHERE slug = ? AND application_id = ?`,
+		slug, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return org, err
+}
+
+func (s *service) UpdateOrganization(org *Organization) error {
+	result, err := s.db.Exec(
+		`UPDATE organizations SET name = ?, slug = ? WHERE id = ? AND application_id = ?`,
+		org.Name, org.Slug, org.ID, org.ApplicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteOrganization deletes an organization with its memberships and
+// invitations, and clears it from any session that had it active
+func (s *service) DeleteOrganization(applicationID, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM organizations WHERE id = ? AND application_id = ?", id, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	for _, stmt := range []string{
+		"DELETE FROM organization_members WHERE organization_id = ?",
+		"DELETE FROM organization_invitations WHERE organization_id = ?",
+		"UPDATE sessions SET active_organization_id = '' WHERE active_organization_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetOrganizationMembers returns the members of an organization with their
+// email and names, ordered by email
+func (s *service) GetOrganizationMembers(organizationID string) ([]OrganizationMember, error) {
+	rows, err := s.db.Query(
+		`SELECT m.organization_id, m.user_id, m.application_id, m.role, m.created_at,
+		        u.email, u.first_name, u.last_name
+		 FROM organization_members m JOIN users u ON u.id = m.user_id
+		 WHERE m.organization_id = ? ORDER BY u.email`, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []OrganizationMember{}
+	for rows.Next() {
+		var m OrganizationMember
+		err := rows.Scan(&m.OrganizationID, &m.UserID, &m.ApplicationID, &m.Role, &m.CreatedAt,
+			&m.Email, &m.FirstName, &m.LastName)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *service) GetOrganizationMember(organizationID, userID string) (*OrganizationMember, error) {
+	var m OrganizationMember
+	err := s.db.QueryRow(
+		`SELECT organization_id, user_id, application_id, role, created_at
+		 FROM organization_members WHERE organization_id = ? AND user_id = ?`,
+		organizationID, userID).
+		Scan(&m.OrganizationID, &m.UserID, &m.ApplicationID, &m.Role, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &m, err
+}
+
+// GetUserOrganizations returns the organizations a user belongs to, ordered
+// by name
+func (s *service) GetUserOrganizations(userID string) ([]UserOrganization, error) {
+	rows, err := s.db.Query(
+		`SELECT o.id, o.application_id, o.name, o.slug, o.created_at, m.role
+		 FROM organizations o JOIN organization_members m ON m.organization_id = o.id
+		 WHERE m.user_id = ? ORDER BY o.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []UserOrganization{}
+	for rows.Next() {
+		var org UserOrganization
+		err := rows.Scan(&org.ID, &org.ApplicationID, &org.Name, &org.Slug, &org.CreatedAt, &org.Role)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+// SetOrganizationMember adds a member or changes the role of an existing one
+func (s *service) SetOrganizationMember(member *OrganizationMember) error {
+	_, err := s.db.Exec(
+		`INSERT INTO organization_members (organization_id, user_id, application_id, role)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT (organization_id, user_id) DO UPDATE SET role = excluded.role`,
+		member.OrganizationID, member.UserID, member.ApplicationID, member.Role)
+	return err
+}
+
+// DeleteOrganizationMember removes a user from an organization and clears it
+// from their sessions that had it active
+func (s *service) DeleteOrganizationMember(organizationID, userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM organization_members WHERE organization_id = ? AND user_id = ?",
+		organizationID, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET active_organization_id = '' WHERE user_id = ? AND active_organization_id = ?",
+		userID, organizationID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *service) CreateOrganizationInvitation(inv *OrganizationInvitation) error {
+	_, err := s.db.Exec(
+		`INSERT INTO organization_invitations (id, organization_id, application_id, email, role,
+		                                       token_hash, invited_by, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		inv.ID, inv.OrganizationID, inv.ApplicationID, inv.Email, inv.Role,
+		inv.TokenHash, inv.InvitedBy, inv.ExpiresAt)
+	return err
+}
+
+func (s *service) GetOrganizationInvitations(organizationID string) ([]OrganizationInvitation, error) {
+	rows, err := s.db.Query(
+		`SELECT `+invitationColumns+` FROM organization_invitations
+		 WHERE organization_id = ? ORDER BY created_at DESC`, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []OrganizationInvitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *inv)
+	}
+	return invitations, rows.Err()
+}
+
+func (s *service) GetOrganizationInvitationByToken(tokenHash string) (*OrganizationInvitation, error) {
+	inv, err := scanInvitation(s.db.QueryRow(
+		`SELECT `+invitationColumns+` FROM organization_invitations WHERE token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+// AcceptOrganizationInvitation marks the invitation accepted and makes the
+// user a member with the invited role. It returns sql.ErrNoRows if the
+// invitation was already accepted or revoked.
+func (s *service) AcceptOrganizationInvitation(inv *OrganizationInvitation, userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE organization_invitations SET accepted = 1 WHERE id = ? AND accepted = 0", inv.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	// An existing member keeps the higher of their current and invited role
+	_, err = tx.Exec(
+		`INSERT INTO organization_members (organization_id, user_id, application_id, role)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT (organization_id, user_id) DO UPDATE SET role =
+		     CASE WHEN excluded.role = ? THEN excluded.role ELSE organization_members.role END`,
+		inv.OrganizationID, userID, inv.ApplicationID, inv.Role, OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *service) DeleteOrganizationInvitation(organizationID, id string) error {
+	result, err := s.db.Exec("DELETE FROM organization_invitations WHERE id = ? AND organization_id = ?",
+		id, organizationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetSessionActiveOrganization records the organization a session acts in;
+// an empty organizationID clears it
+func (s *service) SetSessionActiveOrganization(sessionID, organizationID string) error {
+	_, err := s.db.Exec("UPDATE sessions SET active_organization_id = ? WHERE id = ?",
+		organizationID, sessionID)
+	return err
+}
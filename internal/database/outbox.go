@@ -0,0 +1,174 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Statuses of an outbox event
+const (
+	OutboxPending    = "pending"
+	OutboxDispatched = "dispatched"
+	OutboxFailed     = "failed"
+)
+
+// OutboxEvent is an event recorded in the same transaction as the change it
+// describes, waiting to be dispatched. Seq orders events as they were
+// recorded.
+type OutboxEvent struct {
+	Seq           int64           `json:"seq"`
+	ID            string          `json:"id"`
+	ApplicationID string          `json:"applicationId"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty"`
+	LastError     string          `json:"lastError,omitempty"`
+	DispatchedAt  *time.Time      `json:"dispatchedAt,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+// insertOutboxEvents records events as part of tx
+func insertOutboxEvents(tx *sql.Tx, events []OutboxEvent) error {
+	for _, e := range events {
+		_, err := tx.Exec(
+			`INSERT INTO outbox_events (id, application_id, type, payload) VALUES (?, ?, ?, ?)`,
+			e.ID, e.ApplicationID, e.Type, string(e.Payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withEvents runs fn in a transaction that also records events in the
+// outbox, so that the events exist exactly when fn's changes do
+func (s *service) withEvents(events []OutboxEvent, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := insertOutboxEvents(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const outboxColumns = `seq, id, application_id, type, payload, status, attempts,
+	next_attempt_at, last_error, dispatched_at, created_at`
+
+func scanOutboxEvent(row rowScanner) (*OutboxEvent, error) {
+	var e OutboxEvent
+	var payload string
+	var nextAttemptAt, dispatchedAt sql.NullTime
+	err := row.Scan(&e.Seq, &e.ID, &e.ApplicationID, &e.Type, &payload, &e.Status, &e.Attempts,
+		&nextAttemptAt, &e.LastError, &dispatchedAt, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.Payload = json.RawMessage(payload)
+	if nextAttemptAt.Valid {
+		e.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if dispatchedAt.Valid {
+		e.DispatchedAt = &dispatchedAt.Time
+	}
+	return &e, nil
+}
+
+// GetPendingOutboxEvents returns the oldest pending events in the order they
+// were recorded, including those waiting for a retry
+func (s *service) GetPendingOutboxEvents(limit int) ([]OutboxEvent, error) {
+	rows, err := s.db.Query(
+		`SELECT `+outboxColumns+` FROM outbox_events
+		 WHERE status = ? ORDER BY seq LIMIT ?`, OutboxPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		e, err := scanOutboxEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+	return events, rows.Err()
+}
+
+// GetDueOutboxEvents returns the oldest pending events in the order they
+// were recorded, leaving out every application whose earliest pending event
+// is waiting for a retry, so that it cannot hold back other applications
+func (s *service) GetDueOutboxEvents(now time.Time, limit int) ([]OutboxEvent, error) {
+	rows, err := s.db.Query(
+		`SELECT `+outboxColumns+` FROM outbox_events e
+		 WHERE status = ? AND NOT EXISTS (
+		     SELECT 1 FROM outbox_events w
+		     WHERE w.application_id = e.application_id AND w.status = ? AND w.seq <= e.seq
+		       AND w.next_attempt_at > ?)
+		 ORDER BY seq LIMIT ?`, OutboxPending, OutboxPending, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		e, err := scanOutboxEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+	return events, rows.Err()
+}
+
+// UpdateOutboxEvent saves the outcome of a dispatch attempt
+func (s *service) UpdateOutboxEvent(e *OutboxEvent) error {
+	var nextAttemptAt, dispatchedAt any
+	if e.NextAttemptAt != nil {
+		nextAttemptAt = e.NextAttemptAt.UTC()
+	}
+	if e.DispatchedAt != nil {
+		dispatchedAt = e.DispatchedAt.UTC()
+	}
+	result, err := s.db.Exec(
+		`UPDATE outbox_events SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?,
+		                          dispatched_at = ?
+		 WHERE seq = ?`,
+		e.Status, e.Attempts, nextAttemptAt, e.LastError, dispatchedAt, e.Seq)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteDispatchedOutboxEvents deletes events dispatched before the given
+// time, returning how many were deleted. Failed events are kept for
+// inspection.
+func (s *service) DeleteDispatchedOutboxEvents(before time.Time) (int, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM outbox_events WHERE status = ? AND created_at < ?`,
+		OutboxDispatched, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// RiskPolicy sets what an application does when a login shows each risk
+// signal: allow, notify, challenge or block. Empty fields use the server
+// defaults.
+type RiskPolicy struct {
+	NewDevice        string `json:"newDevice,omitempty"`
+	NewIP            string `json:"newIp,omitempty"`
+	ImpossibleTravel string `json:"impossibleTravel,omitempty"`
+	FailureSpike     string `json:"failureSpike,omitempty"`
+}
+
+// KnownDevice is a device a user has logged in from. Devices are
+// identified by the hash of the device ID the client presents.
+type KnownDevice struct {
+	UserID        string    `json:"-"`
+	ApplicationID string    `json:"-"`
+	DeviceHash    string    `json:"-"`
+	LastIP        string    `json:"lastIp"`
+	UserAgent     string    `json:"userAgent"`
+	FirstSeenAt   time.Time `json:"firstSeenAt"`
+	LastSeenAt    time.Time `json:"lastSeenAt"`
+}
+
+func (s *service) UpdateApplicationRiskPolicy(id string, developerID string, policy *RiskPolicy) error {
+	var encoded string
+	if policy != nil {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	result, err := s.db.Exec(
+		`UPDATE applications SET risk_policy = ?
+		 WHERE id = ? AND developer_id = ?`,
+		encoded, id, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetKnownDevices returns the user's devices, most recently seen first
+func (s *service) GetKnownDevices(userID string) ([]KnownDevice, error) {
+	rows, err := s.db.Query(
+		`SELECT user_id, application_id, device_hash, last_ip, user_agent, first_seen_at, last_seen_at
+		 FROM known_devices WHERE user_id = ? ORDER BY last_seen_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []KnownDevice{}
+	for rows.Next() {
+		var d KnownDevice
+		err := rows.Scan(&d.UserID, &d.ApplicationID, &d.DeviceHash, &d.LastIP, &d.UserAgent,
+			&d.FirstSeenAt, &d.LastSeenAt)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// SaveKnownDevice adds the device or updates when and from where it was
+// last seen, then forgets the user's least recently seen devices beyond
+// maxPerUser
+func (s *service) SaveKnownDevice(device *KnownDevice, maxPerUser int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO known_devices (user_id, device_hash, application_id, last_ip, user_agent, last_seen_at)
+		 VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (user_id, device_hash) DO UPDATE
+		 SET last_ip = excluded.last_ip, user_agent = excluded.user_agent, last_seen_at = excluded.last_seen_at`,
+		device.UserID, device.DeviceHash, device.ApplicationID, device.LastIP, device.UserAgent,
+		device.LastSeenAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`DELETE FROM known_devices WHERE user_id = ? AND device_hash NOT IN (
+		     SELECT device_hash FROM known_devices WHERE user_id = ?
+		     ORDER BY last_seen_at DESC LIMIT ?)`,
+		device.UserID, device.UserID, maxPerUser)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
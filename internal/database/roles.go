@@ -0,0 +1,193 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrRoleExists is returned when another role of the application already has
+// the name, ignoring case
+var ErrRoleExists = errors.New("role name already exists")
+
+// Role is a named set of permissions defined by an application. Permissions
+// are opaque strings such as "posts:write" that only the application
+// interprets.
+type Role struct {
+	ID            string    `json:"id"`
+	ApplicationID string    `json:"applicationId"`
+	Name          string    `json:"name"`
+	Description   string    `json:"description"`
+	Permissions   []string  `json:"permissions"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+const roleColumns = `id, application_id, name, description, permissions, created_at`
+
+func scanRole(row rowScanner) (*Role, error) {
+	var role Role
+	var permissions string
+	err := row.Scan(&role.ID, &role.ApplicationID, &role.Name, &role.Description,
+		&permissions, &role.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(permissions), &role.Permissions); err != nil {
+		return nil, fmt.Errorf("decode permissions for role %s: %w", role.ID, err)
+	}
+	return &role, nil
+}
+
+func scanRoles(rows *sql.Rows) ([]Role, error) {
+	defer rows.Close()
+	roles := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, *role)
+	}
+	return roles, rows.Err()
+}
+
+func encodePermissions(permissions []string) (string, error) {
+	if permissions == nil {
+		permissions = []string{}
+	}
+	b, err := json.Marshal(permissions)
+	return string(b), err
+}
+
+// roleNameError maps a violation of the unique role name index to
+// ErrRoleExists
+func roleNameError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return ErrRoleExists
+	}
+	return err
+}
+
+func (s *service) CreateRole(role *Role) error {
+	permissions, err := encodePermissions(role.Permissions)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO roles (id, application_id, name, description, permissions)
+		 VALUES (?, ?, ?, ?, ?)`,
+		role.ID, role.ApplicationID, role.Name, role.Description, permissions)
+	return roleNameError(err)
+}
+
+func (s *service) GetRoles(applicationID string) ([]Role, error) {
+	rows, err := s.db.Query(
+		`SELECT `+roleColumns+` FROM roles WHERE application_id = ? ORDER BY name`,
+		applicationID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoles(rows)
+}
+
+func (s *service) GetRole(applicationID, id string) (*Role, error) {
+	role, err := scanRole(s.db.QueryRow(
+		`SELECT `+roleColumns+` FROM roles WHERE id = ? AND application_id = ?`,
+		id, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return role, err
+}
+
+// UpdateRole saves the name, description and permissions of a role of
+// role.ApplicationID
+func (s *service) UpdateRole(role *Role) error {
+	permissions, err := encodePermissions(role.Permissions)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec(
+		`UPDATE roles SET name = ?, description = ?, permissions = ?
+		 WHERE id = ? AND application_id = ?`,
+		role.Name, role.Description, permissions, role.ID, role.ApplicationID)
+	if err != nil {
+		return roleNameError(err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteRole deletes a role and removes it from every user that had it
+func (s *service) DeleteRole(applicationID, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE role_id = ? AND application_id = ?", id, applicationID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM roles WHERE id = ? AND application_id = ?", id, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// GetUserRoles returns the roles assigned to a user, ordered by name
+func (s *service) GetUserRoles(userID string) ([]Role, error) {
+	rows, err := s.db.Query(
+		`SELECT r.id, r.application_id, r.name, r.description, r.permissions, r.created_at
+		 FROM roles r JOIN user_roles ur ON ur.role_id = r.id
+		 WHERE ur.user_id = ? ORDER BY r.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoles(rows)
+}
+
+// AssignRole gives a user a role; assigning a role the user already has is
+// not an error. The caller must check that both belong to applicationID.
+func (s *service) AssignRole(applicationID, userID, roleID string) error {
+	_, err := s.db.Exec(
+		`INSERT OR IGNORE INTO user_roles (user_id, role_id, application_id) VALUES (?, ?, ?)`,
+		userID, roleID, applicationID)
+	return err
+}
+
+func (s *service) UnassignRole(applicationID, userID, roleID string) error {
+	result, err := s.db.Exec(
+		"DELETE FROM user_roles WHERE user_id = ? AND role_id = ? AND application_id = ?",
+		userID, roleID, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build cgo
+
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRoleNamesUniqueIgnoringCase(t *testing.T) {
+	s := newTestService(t)
+	if err := s.CreateRole(&Role{ID: "role-1", ApplicationID: "app-1", Name: "Admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateRole(&Role{ID: "role-2", ApplicationID: "app-1", Name: "admin"}); !errors.Is(err, ErrRoleExists) {
+		t.Errorf("expected ErrRoleExists creating a name in another case; got %v", err)
+	}
+	if err := s.CreateRole(&Role{ID: "role-3", ApplicationID: "app-2", Name: "admin"}); err != nil {
+		t.Errorf("expected another application to reuse the name; got %v", err)
+	}
+
+	editor := &Role{ID: "role-4", ApplicationID: "app-1", Name: "editor"}
+	if err := s.CreateRole(editor); err != nil {
+		t.Fatal(err)
+	}
+	editor.Name = "ADMIN"
+	if err := s.UpdateRole(editor); !errors.Is(err, ErrRoleExists) {
+		t.Errorf("expected ErrRoleExists renaming to a name in another case; got %v", err)
+	}
+	admin := &Role{ID: "role-1", ApplicationID: "app-1", Name: "ADMIN"}
+	if err := s.UpdateRole(admin); err != nil {
+		t.Errorf("expected a role to change the case of its own name; got %v", err)
+	}
+}
+
+func TestMigrateRoleNamesReportsConflicts(t *testing.T) {
+	s := newTestService(t)
+	// A database from before the index could hold names differing in case
+	mustExec(t, s, "DROP INDEX idx_roles_name")
+	mustExec(t, s, "INSERT INTO roles (id, application_id, name) VALUES ('role-1', 'app-1', 'Admin'), ('role-2', 'app-1', 'admin'), ('role-3', 'app-2', 'admin')")
+
+	err := s.InitSchema()
+	if err == nil || !strings.Contains(err.Error(), "application app-1: ") || !strings.Contains(err.Error(), "'Admin' (role-1)") ||
+		!strings.Contains(err.Error(), "'admin' (role-2)") || strings.Contains(err.Error(), "app-2") {
+		t.Fatalf("expected the conflicting roles of app-1 to be reported; got %v", err)
+	}
+
+	mustExec(t, s, "UPDATE roles SET name = 'admin-old' WHERE id = 'role-2'")
+	if err := s.InitSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateRole(&Role{ID: "role-4", ApplicationID: "app-1", Name: "ADMIN"}); !errors.Is(err, ErrRoleExists) {
+		t.Errorf("expected the index to be in place; got %v", err)
+	}
+}
@@ -1,5 +1,10 @@
 package database
 
+import (
+	"fmt"
+	"strings"
+)
+
 const schema = `
 CREATE TABLE IF NOT EXISTS developers (
     id TEXT PRIMARY KEY,
@@ -33,6 +38,8 @@ CREATE TABLE IF NOT EXISTS users (
     UNIQUE(application_id, email)
 );
 
+CREATE INDEX IF NOT EXISTS idx_users_application_created ON users(application_id, created_at, id);
+
 CREATE TABLE IF NOT EXISTS sessions (
     id TEXT PRIMARY KEY,
     user_id TEXT NOT NULL,
@@ -43,9 +50,379 @@ CREATE TABLE IF NOT EXISTS sessions (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS verification_tokens (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    application_id TEXT NOT NULL,
+    purpose TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    payload TEXT NOT NULL DEFAULT '',
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS erasure_records (
+    id TEXT PRIMARY KEY,
+    application_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    email_hash TEXT NOT NULL,
+    erased_by TEXT NOT NULL,
+    sessions_deleted INTEGER NOT NULL DEFAULT 0,
+    erased_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id TEXT PRIMARY KEY,
+    application_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    permissions TEXT NOT NULL DEFAULT '[]',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE,
+    UNIQUE(application_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id TEXT NOT NULL,
+    role_id TEXT NOT NULL,
+    application_id TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_roles_role ON user_roles(role_id);
+
+CREATE TABLE IF NOT EXISTS organizations (
+    id TEXT PRIMARY KEY,
+    application_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    slug TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE,
+    UNIQUE(application_id, slug)
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+    organization_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    application_id TEXT NOT NULL,
+    role TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (organization_id, user_id),
+    FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_members_user ON organization_members(user_id);
+
+CREATE TABLE IF NOT EXISTS organization_invitations (
+    id TEXT PRIMARY KEY,
+    organization_id TEXT NOT NULL,
+    application_id TEXT NOT NULL,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    invited_by TEXT NOT NULL,
+    accepted BOOLEAN NOT NULL DEFAULT 0,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS signup_invite_codes (
+    id TEXT PRIMARY KEY,
+    application_id TEXT NOT NULL,
+    code_hash TEXT UNIQUE NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    max_uses INTEGER NOT NULL DEFAULT 1,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS account_lockouts (
+    subject_id TEXT PRIMARY KEY,
+    subject_type TEXT NOT NULL,
+    application_id TEXT NOT NULL DEFAULT '',
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    last_failed_at DATETIME NOT NULL,
+    locked_until DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_lockouts_application ON account_lockouts(application_id);
+
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id TEXT PRIMARY KEY,
+    application_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT '[]',
+    enabled BOOLEAN NOT NULL DEFAULT 1,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (application_id) REFERENCES applications(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_application ON webhook_endpoints(application_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id TEXT PRIMARY KEY,
+    endpoint_id TEXT NOT NULL,
+    application_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME,
+    response_status INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    delivered_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL,
+    application_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME,
+    last_error TEXT NOT NULL DEFAULT '',
+    dispatched_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_events_status ON outbox_events(status, seq);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_application ON outbox_events(application_id, status, seq);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT UNIQUE NOT NULL,
+    developer_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    application_id TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    changes TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    UNIQUE(developer_id, prev_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_application ON audit_log(developer_id, application_id, seq);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    application_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    success BOOLEAN NOT NULL,
+    failure_reason TEXT NOT NULL DEFAULT '',
+    method TEXT NOT NULL,
+    mfa BOOLEAN NOT NULL DEFAULT 0,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    session_id TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id, seq);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_created ON login_attempts(created_at);
+
+CREATE TABLE IF NOT EXISTS teams (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS team_members (
+    team_id TEXT NOT NULL,
+    developer_id TEXT NOT NULL,
+    role TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (team_id, developer_id),
+    FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+    FOREIGN KEY (developer_id) REFERENCES developers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_team_members_developer ON team_members(developer_id);
+
+CREATE TABLE IF NOT EXISTS team_invitations (
+    id TEXT PRIMARY KEY,
+    team_id TEXT NOT NULL,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    invited_by TEXT NOT NULL,
+    accepted INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS known_devices (
+    user_id TEXT NOT NULL,
+    device_hash TEXT NOT NULL,
+    application_id TEXT NOT NULL,
+    last_ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    first_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, device_hash)
+);
+
+CREATE TABLE IF NOT EXISTS developer_sessions (
+    id TEXT PRIMARY KEY,
+    developer_id TEXT NOT NULL,
+    refresh_token_hash TEXT UNIQUE NOT NULL,
+    access_token_id TEXT NOT NULL,
+    auth_methods TEXT NOT NULL DEFAULT '[]',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (developer_id) REFERENCES developers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_developer_sessions_developer ON developer_sessions(developer_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti TEXT PRIMARY KEY,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS developer_passkeys (
+    id TEXT PRIMARY KEY,
+    developer_id TEXT NOT NULL,
+    credential_id TEXT NOT NULL,
+    public_key BLOB NOT NULL,
+    sign_count INTEGER NOT NULL DEFAULT 0,
+    name TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    UNIQUE (developer_id, credential_id),
+    FOREIGN KEY (developer_id) REFERENCES developers(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS developer_api_tokens (
+    id TEXT PRIMARY KEY,
+    developer_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    prefix TEXT NOT NULL,
+    scopes TEXT NOT NULL DEFAULT '[]',
+    allowed_ips TEXT NOT NULL DEFAULT '[]',
+    expires_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    last_used_ip TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY (developer_id) REFERENCES developers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_developer_api_tokens_developer ON developer_api_tokens(developer_id);
+
+CREATE TABLE IF NOT EXISTS developer_email_changes (
+    developer_id TEXT PRIMARY KEY,
+    new_email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (developer_id) REFERENCES developers(id) ON DELETE CASCADE
+);
 `
 
+// migrations add columns to tables created by earlier versions of the schema.
+// SQLite has no ADD COLUMN IF NOT EXISTS, so duplicate column errors are
+// treated as already applied.
+var migrations = []string{
+	`ALTER TABLE applications ADD COLUMN password_policy TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active'`,
+	`ALTER TABLE users ADD COLUMN status_reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN password_reset_required BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN public_metadata TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE users ADD COLUMN private_metadata TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE applications ADD COLUMN metadata_schema TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN active_organization_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE applications ADD COLUMN signup_policy TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE applications ADD COLUMN rate_limits TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE applications ADD COLUMN login_history_policy TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE applications ADD COLUMN risk_policy TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE login_attempts ADD COLUMN risk_signals TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE login_attempts ADD COLUMN risk_action TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sessions ADD COLUMN auth_time DATETIME`,
+	`ALTER TABLE sessions ADD COLUMN auth_methods TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE applications ADD COLUMN team_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_applications_team ON applications(team_id)`,
+	`ALTER TABLE developers ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE developers ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE developers ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE developers ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE developers ADD COLUMN deletion_scheduled_at DATETIME`,
+	`ALTER TABLE developer_sessions ADD COLUMN auth_time DATETIME`,
+	`ALTER TABLE audit_log ADD COLUMN team_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_log_app ON audit_log(application_id, seq)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_log_team ON audit_log(team_id, seq)`,
+}
+
 func (s *service) InitSchema() error {
-	_, err := s.db.Exec(schema)
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, err := s.db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return fmt.Errorf("migration %q: %w", m, err)
+		}
+	}
+	return s.migrateRoleNames()
+}
+
+// migrateRoleNames adds the index keeping role names unique per application
+// regardless of case. Databases created before it may hold names differing
+// only in case. Those are not merged, since each role carries its own
+// permissions and assignments; they are reported so they can be renamed.
+func (s *service) migrateRoleNames() error {
+	rows, err := s.db.Query(
+		`SELECT application_id, group_concat(quote(name) || ' (' || id || ')', ', ')
+		 FROM roles GROUP BY application_id, name COLLATE NOCASE HAVING COUNT(*) > 1`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var conflicts []string
+	for rows.Next() {
+		var applicationID, roles string
+		if err := rows.Scan(&applicationID, &roles); err != nil {
+			return err
+		}
+		conflicts = append(conflicts, "application "+applicationID+": "+roles)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("rename roles whose names differ only in case before upgrading: %s",
+			strings.Join(conflicts, "; "))
+	}
+
+	_, err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_roles_name ON roles(application_id, name COLLATE NOCASE)`)
 	return err
 }
@@ -0,0 +1,359 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Roles a developer can hold within a team, from most to least privileged.
+// Owners manage the team itself and its other owners, admins manage members
+// and delete applications, members configure applications and their users,
+// and read-only members can only look.
+const (
+	TeamRoleOwner    = "owner"
+	TeamRoleAdmin    = "admin"
+	TeamRoleMember   = "member"
+	TeamRoleReadOnly = "read_only"
+)
+
+// sqlTeamRoleRank orders the team role expr in SQL, higher being more
+// privileged
+func sqlTeamRoleRank(expr string) string {
+	return "(CASE " + expr + " WHEN 'owner' THEN 3 WHEN 'admin' THEN 2 WHEN 'member' THEN 1 ELSE 0 END)"
+}
+
+// Team is a group of developers sharing access to its applications
+type Team struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DeveloperTeam is a team together with the role a particular developer
+// has in it
+type DeveloperTeam struct {
+	Team
+	Role string `json:"role"`
+}
+
+// TeamMember is a developer's membership of a team. The developer fields
+// are filled in when listing a team's members.
+type TeamMember struct {
+	TeamID      string    `json:"teamId"`
+	DeveloperID string    `json:"developerId"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Email       string    `json:"email,omitempty"`
+	FirstName   string    `json:"firstName,omitempty"`
+	LastName    string    `json:"lastName,omitempty"`
+}
+
+// TeamInvitation asks the developer with Email to join a team. Only a hash
+// of the invite token is stored.
+type TeamInvitation struct {
+	ID        string    `json:"id"`
+	TeamID    string    `json:"teamId"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	TokenHash string    `json:"-"`
+	InvitedBy string    `json:"invitedBy"`
+	Accepted  bool      `json:"accepted"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const teamInvitationColumns = `id, team_id, email, role, token_hash, invited_by, accepted, expires_at, created_at`
+
+func scanTeamInvitation(row rowScanner) (*TeamInvitation, error) {
+	var inv TeamInvitation
+	err := row.Scan(&inv.ID, &inv.TeamID, &inv.Email, &inv.Role, &inv.TokenHash, &inv.InvitedBy,
+		&inv.Accepted, &inv.ExpiresAt, &inv.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// CreateTeam stores team with owner as its first member
+func (s *service) CreateTeam(team *Team, owner *TeamMember) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO teams (id, name) VALUES (?, ?)`, team.ID, team.Name); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO team_members (team_id, developer_id, role) VALUES (?, ?, ?)`,
+		owner.TeamID, owner.DeveloperID, owner.Role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *service) GetTeam(id string) (*Team, error) {
+	var team Team
+	err := s.db.QueryRow(`SELECT id, name, created_at FROM teams WHERE id = ?`, id).
+		Scan(&team.ID, &team.Name, &team.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &team, err
+}
+
+// GetDeveloperTeams returns the teams a developer belongs to, ordered by name
+func (s *service) GetDeveloperTeams(developerID string) ([]DeveloperTeam, error) {
+	rows, err := s.db.Query(
+		`SELECT t.id, t.name, t.created_at, m.role
+		 FROM teams t JOIN team_members m ON m.team_id = t.id
+		 WHERE m.developer_id = ? ORDER BY t.name`, developerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	teams := []DeveloperTeam{}
+	for rows.Next() {
+		var team DeveloperTeam
+		if err := rows.Scan(&team.ID, &team.Name, &team.CreatedAt, &team.Role); err != nil {
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+func (s *service) UpdateTeam(team *Team) error {
+	result, err := s.db.Exec(`UPDATE teams SET name = ? WHERE id = ?`, team.Name, team.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTeam deletes a team with its memberships and invitations. The team
+// should own no applications.
+func (s *service) DeleteTeam(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM teams WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	for _, stmt := range []string{
+		"DELETE FROM team_members WHERE team_id = ?",
+		"DELETE FROM team_invitations WHERE team_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CountTeamApplications returns how many applications the team owns
+func (s *service) CountTeamApplications(teamID string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM applications WHERE team_id = ?", teamID).Scan(&n)
+	return n, err
+}
+
+// GetTeamMembers returns the members of a team with their email and names,
+// ordered by email
+func (s *service) GetTeamMembers(teamID string) ([]TeamMember, error) {
+	rows, err := s.db.Query(
+		`SELECT m.team_id, m.developer_id, m.role, m.created_at, d.email, d.first_name, d.last_name
+		 FROM team_members m JOIN developers d ON d.id = m.developer_id
+		 WHERE m.team_id = ? ORDER BY d.email`, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []TeamMember{}
+	for rows.Next() {
+		var m TeamMember
+		err := rows.Scan(&m.TeamID, &m.DeveloperID, &m.Role, &m.CreatedAt, &m.Email, &m.FirstName, &m.LastName)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *service) GetTeamMember(teamID, developerID string) (*TeamMember, error) {
+	var m TeamMember
+	err := s.db.QueryRow(
+		`SELECT team_id, developer_id, role, created_at
+		 FROM team_members WHERE team_id = ? AND developer_id = ?`,
+		teamID, developerID).
+		Scan(&m.TeamID, &m.DeveloperID, &m.Role, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &m, err
+}
+
+// CountTeamOwners returns how many owners the team has
+func (s *service) CountTeamOwners(teamID string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM team_members WHERE team_id = ? AND role = ?",
+		teamID, TeamRoleOwner).Scan(&n)
+	return n, err
+}
+
+// SetTeamMember adds a member or changes the role of an existing one
+func (s *service) SetTeamMember(member *TeamMember) error {
+	_, err := s.db.Exec(
+		`INSERT INTO team_members (team_id, developer_id, role) VALUES (?, ?, ?)
+		 ON CONFLICT (team_id, developer_id) DO UPDATE SET role = excluded.role`,
+		member.TeamID, member.DeveloperID, member.Role)
+	return err
+}
+
+func (s *service) DeleteTeamMember(teamID, developerID string) error {
+	result, err := s.db.Exec("DELETE FROM team_members WHERE team_id = ? AND developer_id = ?",
+		teamID, developerID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *service) CreateTeamInvitation(inv *TeamInvitation) error {
+	_, err := s.db.Exec(
+		`INSERT INTO team_invitations (id, team_id, email, role, token_hash, invited_by, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		inv.ID, inv.TeamID, inv.Email, inv.Role, inv.TokenHash, inv.InvitedBy, inv.ExpiresAt)
+	return err
+}
+
+func (s *service) GetTeamInvitations(teamID string) ([]TeamInvitation, error) {
+	rows, err := s.db.Query(
+		`SELECT `+teamInvitationColumns+` FROM team_invitations
+		 WHERE team_id = ? ORDER BY created_at DESC`, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []TeamInvitation{}
+	for rows.Next() {
+		inv, err := scanTeamInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *inv)
+	}
+	return invitations, rows.Err()
+}
+
+func (s *service) GetTeamInvitationByToken(tokenHash string) (*TeamInvitation, error) {
+	inv, err := scanTeamInvitation(s.db.QueryRow(
+		`SELECT `+teamInvitationColumns+` FROM team_invitations WHERE token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+// AcceptTeamInvitation marks the invitation accepted and makes the
+// developer a member with the invited role. It returns sql.ErrNoRows if the
+// invitation was already accepted or revoked.
+func (s *service) AcceptTeamInvitation(inv *TeamInvitation, developerID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE team_invitations SET accepted = 1 WHERE id = ? AND accepted = 0", inv.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	// An existing member keeps the higher of their current and invited role
+	_, err = tx.Exec(
+		`INSERT INTO team_members (team_id, developer_id, role) VALUES (?, ?, ?)
+		 ON CONFLICT (team_id, developer_id) DO UPDATE SET role =
+		     CASE WHEN `+sqlTeamRoleRank("excluded.role")+` > `+sqlTeamRoleRank("team_members.role")+`
+		          THEN excluded.role ELSE team_members.role END`,
+		inv.TeamID, developerID, inv.Role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *service) DeleteTeamInvitation(teamID, id string) error {
+	result, err := s.db.Exec("DELETE FROM team_invitations WHERE id = ? AND team_id = ?", id, teamID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetApplicationOwner moves an application into a team, or into the
+// personal applications of developerID when teamID is empty. developerID
+// stays the application's creator while a team owns it.
+func (s *service) SetApplicationOwner(applicationID, developerID, teamID string) error {
+	result, err := s.db.Exec("UPDATE applications SET developer_id = ?, team_id = ? WHERE id = ?",
+		developerID, teamID, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
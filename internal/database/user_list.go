@@ -0,0 +1,143 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// UserSort is a column users can be ordered by
+type UserSort string
+
+const (
+	UserSortCreatedAt UserSort = "created_at"
+	UserSortEmail     UserSort = "email"
+	UserSortFirstName UserSort = "first_name"
+	UserSortLastName  UserSort = "last_name"
+)
+
+// UserCursor marks the last row of a page: its sort column value and ID
+type UserCursor struct {
+	SortValue string `json:"v"`
+	ID        string `json:"id"`
+}
+
+// UserFilter selects a page of an application's users. Zero-valued fields
+// are not applied.
+type UserFilter struct {
+	ApplicationID string
+	// Search matches a prefix of the email, first name or last name
+	Search        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	EmailVerified *bool
+	Status        string
+
+	SortBy     UserSort
+	Descending bool
+	// After continues from the cursor of the previous page
+	After *UserCursor
+	Limit int
+}
+
+// sqliteTimeFormat matches the text stored by CURRENT_TIMESTAMP
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// where builds the WHERE clause shared by ListUsers and CountUsers. The
+// cursor is not included since it does not affect the total.
+func (f UserFilter) where() (string, []any) {
+	clauses := []string{"application_id = ?"}
+	args := []any{f.ApplicationID}
+
+	if f.Search != "" {
+		pattern := escapeLike(f.Search) + "%"
+		clauses = append(clauses,
+			`(email LIKE ? ESCAPE '\' OR first_name LIKE ? ESCAPE '\' OR last_name LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if !f.CreatedAfter.IsZero() {
+		clauses = append(clauses, "created_at >= ?")
+		args = append(args, f.CreatedAfter.UTC().Format(sqliteTimeFormat))
+	}
+	if !f.CreatedBefore.IsZero() {
+		clauses = append(clauses, "created_at < ?")
+		args = append(args, f.CreatedBefore.UTC().Format(sqliteTimeFormat))
+	}
+	if f.EmailVerified != nil {
+		clauses = append(clauses, "email_verified = ?")
+		args = append(args, *f.EmailVerified)
+	}
+	if f.Status != "" {
+		clauses = append(clauses, "status = ?")
+		args = append(args, f.Status)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// escapeLike escapes the LIKE wildcards in s using a backslash
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListUsers returns one page of users matching filter, ordered by the sort
+// column and then ID so pages are stable. next is nil on the last page.
+func (s *service) ListUsers(filter UserFilter) (users []User, next *UserCursor, err error) {
+	sortBy := filter.SortBy
+	switch sortBy {
+	case UserSortCreatedAt, UserSortEmail, UserSortFirstName, UserSortLastName:
+	default:
+		sortBy = UserSortCreatedAt
+	}
+	column := string(sortBy)
+
+	where, args := filter.where()
+	op, dir := ">", "ASC"
+	if filter.Descending {
+		op, dir = "<", "DESC"
+	}
+	if filter.After != nil {
+		where += " AND (" + column + " " + op + " ? OR (" + column + " = ? AND id " + op + " ?))"
+		args = append(args, filter.After.SortValue, filter.After.SortValue, filter.After.ID)
+	}
+
+	query := `SELECT ` + userColumns + `, CAST(` + column + ` AS TEXT)
+		 FROM users WHERE ` + where + `
+		 ORDER BY ` + column + ` ` + dir + `, id ` + dir + `
+		 LIMIT ?`
+	// Fetch one extra row to learn whether another page follows
+	args = append(args, filter.Limit+1)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var cursors []UserCursor
+	for rows.Next() {
+		var sortValue string
+		user, err := scanUser(rows, &sortValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		users = append(users, *user)
+		cursors = append(cursors, UserCursor{SortValue: sortValue, ID: user.ID})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(users) > filter.Limit {
+		users = users[:filter.Limit]
+		next = &cursors[filter.Limit-1]
+	}
+	return users, next, nil
+}
+
+// CountUsers returns the number of users matching filter, ignoring its
+// cursor and limit
+func (s *service) CountUsers(filter UserFilter) (int, error) {
+	where, args := filter.where()
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE `+where, args...).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,289 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// WebhookEndpoint is a URL that receives the events of an application it is
+// subscribed to. Payloads are signed with Secret.
+type WebhookEndpoint struct {
+	ID            string    `json:"id"`
+	ApplicationID string    `json:"applicationId"`
+	URL           string    `json:"url"`
+	Secret        string    `json:"secret"`
+	Events        []string  `json:"events"`
+	Enabled       bool      `json:"enabled"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Statuses of a webhook delivery
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event sent, or to be sent, to one endpoint.
+// Pending deliveries are attempted once NextAttemptAt has passed.
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpointId"`
+	ApplicationID  string          `json:"applicationId"`
+	EventID        string          `json:"eventId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	ResponseStatus int             `json:"responseStatus,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+}
+
+const webhookEndpointColumns = `id, application_id, url, secret, events, enabled, created_at`
+
+func scanWebhookEndpoint(row rowScanner) (*WebhookEndpoint, error) {
+	var endpoint WebhookEndpoint
+	var events string
+	err := row.Scan(&endpoint.ID, &endpoint.ApplicationID, &endpoint.URL, &endpoint.Secret,
+		&events, &endpoint.Enabled, &endpoint.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(events), &endpoint.Events); err != nil {
+		return nil, fmt.Errorf("decode events for webhook %s: %w", endpoint.ID, err)
+	}
+	return &endpoint, nil
+}
+
+func (s *service) CreateWebhookEndpoint(endpoint *WebhookEndpoint) error {
+	events, err := encodePermissions(endpoint.Events)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO webhook_endpoints (id, application_id, url, secret, events, enabled)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		endpoint.ID, endpoint.ApplicationID, endpoint.URL, endpoint.Secret, events, endpoint.Enabled)
+	return err
+}
+
+func (s *service) GetWebhookEndpoints(applicationID string) ([]WebhookEndpoint, error) {
+	rows, err := s.db.Query(
+		`SELECT `+webhookEndpointColumns+` FROM webhook_endpoints
+		 WHERE application_id = ? ORDER BY created_at`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, *endpoint)
+	}
+	return endpoints, rows.Err()
+}
+
+func (s *service) GetWebhookEndpoint(applicationID, id string) (*WebhookEndpoint, error) {
+	endpoint, err := scanWebhookEndpoint(s.db.QueryRow(
+		`SELECT `+webhookEndpointColumns+` FROM webhook_endpoints
+		 WHERE id = ? AND application_id = ?`, id, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return endpoint, err
+}
+
+// UpdateWebhookEndpoint saves the URL, secret, events and enabled flag of an
+// endpoint of endpoint.ApplicationID
+func (s *service) UpdateWebhookEndpoint(endpoint *WebhookEndpoint) error {
+	events, err := encodePermissions(endpoint.Events)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec(
+		`UPDATE webhook_endpoints SET url = ?, secret = ?, events = ?, enabled = ?
+		 WHERE id = ? AND application_id = ?`,
+		endpoint.URL, endpoint.Secret, events, endpoint.Enabled, endpoint.ID, endpoint.ApplicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteWebhookEndpoint deletes an endpoint together with its deliveries
+func (s *service) DeleteWebhookEndpoint(applicationID, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webhook_endpoints WHERE id = ? AND application_id = ?",
+		id, applicationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE endpoint_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, application_id, event_id, event_type, payload, status,
+	attempts, next_attempt_at, response_status, last_error, delivered_at, created_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.EndpointID, &d.ApplicationID, &d.EventID, &d.EventType, &payload,
+		&d.Status, &d.Attempts, &nextAttemptAt, &d.ResponseStatus, &d.LastError, &deliveredAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return &d, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// CreateWebhookDeliveries inserts deliveries in a single transaction
+func (s *service) CreateWebhookDeliveries(deliveries []WebhookDelivery) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range deliveries {
+		var nextAttemptAt any
+		if d.NextAttemptAt != nil {
+			nextAttemptAt = d.NextAttemptAt.UTC()
+		}
+		_, err := tx.Exec(
+			`INSERT INTO webhook_deliveries (id, endpoint_id, application_id, event_id, event_type,
+			                                 payload, status, next_attempt_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			d.ID, d.EndpointID, d.ApplicationID, d.EventID, d.EventType,
+			string(d.Payload), d.Status, nextAttemptAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetWebhookDeliveries returns the latest deliveries to an endpoint, newest
+// first
+func (s *service) GetWebhookDeliveries(endpointID string, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		 WHERE endpoint_id = ? ORDER BY created_at DESC, id LIMIT ?`, endpointID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (s *service) GetWebhookDelivery(endpointID, id string) (*WebhookDelivery, error) {
+	d, err := scanWebhookDelivery(s.db.QueryRow(
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		 WHERE id = ? AND endpoint_id = ?`, id, endpointID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+// GetDueWebhookDeliveries returns pending deliveries whose next attempt is
+// at or before now, oldest first
+func (s *service) GetDueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		 WHERE status = ? AND next_attempt_at <= ?
+		 ORDER BY next_attempt_at LIMIT ?`, WebhookDeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// UpdateWebhookDelivery saves the outcome of an attempt
+func (s *service) UpdateWebhookDelivery(d *WebhookDelivery) error {
+	var nextAttemptAt, deliveredAt any
+	if d.NextAttemptAt != nil {
+		nextAttemptAt = d.NextAttemptAt.UTC()
+	}
+	if d.DeliveredAt != nil {
+		deliveredAt = d.DeliveredAt.UTC()
+	}
+	result, err := s.db.Exec(
+		`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?,
+		                              response_status = ?, last_error = ?, delivered_at = ?
+		 WHERE id = ?`,
+		d.Status, d.Attempts, nextAttemptAt, d.ResponseStatus, d.LastError, deliveredAt, d.ID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteWebhookDeliveriesBefore deletes finished deliveries created before
+// the given time, returning how many were deleted
+func (s *service) DeleteWebhookDeliveriesBefore(before time.Time) (int, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM webhook_deliveries WHERE status != ? AND created_at < ?`,
+		WebhookDeliveryPending, before.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
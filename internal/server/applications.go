@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -25,39 +26,95 @@ func generateKey(prefix string, length int) (string, error) {
 	return prefix + base64.URLEncoding.EncodeToString(b)[:length], nil
 }
 
+// ownedApplication loads the {id} application if it belongs to the
+// authenticated developer or one of their teams, writing an error response
+// and returning false if not. Read-only team members may only make GET
+// requests.
+func (s *Server) ownedApplication(w http.ResponseWriter, r *http.Request) (*database.Application, bool) {
+	developerID := r.Context().Value("developerID").(string)
+	appID := chi.URLParam(r, "id")
+
+	app, err := s.db.GetApplicationByID(appID, developerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return nil, false
+		}
+		writeError(w, r, internalError("Failed to verify application"))
+		return nil, false
+	}
+
+	required := database.TeamRoleMember
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		required = database.TeamRoleReadOnly
+	}
+	if !teamRoleAtLeast(app.Role, required) {
+		writeError(w, r, errTeamRoleRequired)
+		return nil, false
+	}
+	auditTeam(r, app.TeamID)
+	return app, true
+}
+
+// redactApplication hides the secret key from read-only team members
+func redactApplication(app *database.Application) {
+	if app.Role == database.TeamRoleReadOnly {
+		app.SecretKey = ""
+	}
+}
+
+// createApplicationRequest is an applicationRequest that may also place the
+// new application in a team
+type createApplicationRequest struct {
+	applicationRequest
+	TeamID string `json:"teamId"`
+}
+
 func (s *Server) handleCreateApplication(w http.ResponseWriter, r *http.Request) {
-	var req applicationRequest
+	var req createApplicationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid request format",
-		})
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
 		return
 	}
 
 	developerID := r.Context().Value("developerID").(string)
 
+	if req.TeamID != "" {
+		member, err := s.db.GetTeamMember(req.TeamID, developerID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check team membership"))
+			return
+		}
+		if member == nil {
+			writeError(w, r, errTeamNotFound)
+			return
+		}
+		if !teamRoleAtLeast(member.Role, database.TeamRoleMember) {
+			writeError(w, r, errTeamRoleRequired)
+			return
+		}
+	}
+
 	publicKey, err := generateKey("pk_", 32)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to generate public key",
-		})
+		writeError(w, r, internalError("Failed to generate public key"))
 		return
 	}
 
 	secretKey, err := generateKey("sk_", 32)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to generate secret key",
-		})
+		writeError(w, r, internalError("Failed to generate secret key"))
 		return
 	}
 
 	app := &database.Application{
 		ID:          uuid.New().String(),
 		DeveloperID: developerID,
+		TeamID:      req.TeamID,
 		Name:        req.Name,
 		Domain:      req.Domain,
 		PublicKey:   publicKey,
@@ -65,17 +122,12 @@ func (s *Server) handleCreateApplication(w http.ResponseWriter, r *http.Request)
 	}
 
 	if err := s.db.CreateApplication(app); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to create application",
-		})
+		writeError(w, r, internalError("Failed to create application"))
 		return
 	}
+	auditAfter(r, app)
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    app,
-	})
+	writeData(w, http.StatusCreated, app)
 }
 
 func (s *Server) handleGetApplications(w http.ResponseWriter, r *http.Request) {
@@ -83,143 +135,163 @@ func (s *Server) handleGetApplications(w http.ResponseWriter, r *http.Request) {
 
 	apps, err := s.db.GetApplicationsByDeveloperID(developerID)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to fetch applications",
-		})
+		writeError(w, r, internalError("Failed to fetch applications"))
 		return
 	}
+	for i := range apps {
+		redactApplication(&apps[i])
+	}
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data: map[string]interface{}{
-			"applications": apps,
-			"count":        len(apps),
-		},
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"applications": apps,
+		"count":        len(apps),
 	})
 }
 
 func (s *Server) handleGetApplication(w http.ResponseWriter, r *http.Request) {
-	developerID := r.Context().Value("developerID").(string)
-	appID := chi.URLParam(r, "id")
-
-	app, err := s.db.GetApplicationByID(appID, developerID)
-	if err != nil {
-		status := http.StatusInternalServerError
-		errMsg := "Failed to fetch application"
-		if err == sql.ErrNoRows {
-			status = http.StatusNotFound
-			errMsg = "Application not found"
-		}
-		w.WriteHeader(status)
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   errMsg,
-		})
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
 		return
 	}
+	redactApplication(app)
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    app,
-	})
+	writeData(w, http.StatusOK, app)
 }
 
 func (s *Server) handleUpdateApplication(w http.ResponseWriter, r *http.Request) {
 	var req applicationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid request format",
-		})
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
 		return
 	}
 
-	developerID := r.Context().Value("developerID").(string)
-	appID := chi.URLParam(r, "id")
-
-	app := &database.Application{
-		ID:          appID,
-		DeveloperID: developerID,
-		Name:        req.Name,
-		Domain:      req.Domain,
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
 	}
+	auditBefore(r, app)
 
+	app.Name = req.Name
+	app.Domain = req.Domain
 	if err := s.db.UpdateApplication(app); err != nil {
-		errMsg := "Failed to update application"
-		if err == sql.ErrNoRows {
-			errMsg = "Application not found"
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
 		}
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   errMsg,
-		})
+		writeError(w, r, internalError("Failed to update application"))
 		return
 	}
+	auditAfter(r, app)
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    app,
-	})
+	writeData(w, http.StatusOK, app)
 }
 
 func (s *Server) handleDeleteApplication(w http.ResponseWriter, r *http.Request) {
-	developerID := r.Context().Value("developerID").(string)
-	appID := chi.URLParam(r, "id")
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	if !teamRoleAtLeast(app.Role, database.TeamRoleAdmin) {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+	auditBefore(r, app)
 
-	if err := s.db.DeleteApplication(appID, developerID); err != nil {
-		errMsg := "Failed to delete application"
-		if err == sql.ErrNoRows {
-			errMsg = "Application not found"
+	if err := s.db.DeleteApplication(app.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
 		}
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   errMsg,
-		})
+		writeError(w, r, internalError("Failed to delete application"))
 		return
 	}
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-	})
+	writeData(w, http.StatusOK, nil)
 }
 
-func (s *Server) handleGetApplicationUsers(w http.ResponseWriter, r *http.Request) {
-	developerID := r.Context().Value("developerID").(string)
-	appID := chi.URLParam(r, "id")
+// handleRotateApplicationKeys replaces the application's key pair. Requests
+// signed with the old keys are rejected from then on.
+func (s *Server) handleRotateApplicationKeys(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	if !teamRoleAtLeast(app.Role, database.TeamRoleAdmin) {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+	auditBefore(r, app)
 
-	// First verify the app belongs to this developer
-	_, err := s.db.GetApplicationByID(appID, developerID)
+	publicKey, err := generateKey("pk_", 32)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate public key"))
+		return
+	}
+	secretKey, err := generateKey("sk_", 32)
 	if err != nil {
-		status := http.StatusInternalServerError
-		errMsg := "Failed to verify application"
-		if err == sql.ErrNoRows {
-			status = http.StatusNotFound
-			errMsg = "Application not found"
+		writeError(w, r, internalError("Failed to generate secret key"))
+		return
+	}
+
+	if err := s.db.UpdateApplicationKeys(app.ID, publicKey, secretKey); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
 		}
-		w.WriteHeader(status)
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   errMsg,
-		})
+		writeError(w, r, internalError("Failed to rotate keys"))
+		return
+	}
+	app.PublicKey = publicKey
+	app.SecretKey = secretKey
+	auditAfter(r, app)
+
+	writeData(w, http.StatusOK, app)
+}
+
+// handleGetApplicationUsers returns one page of the application's users.
+// See parseUserFilter for the supported query parameters.
+func (s *Server) handleGetApplicationUsers(w http.ResponseWriter, r *http.Request) {
+	// First verify the app belongs to this developer
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
 		return
 	}
 
-	// Get users for this app
-	users, err := s.db.GetUsersByApplicationID(appID)
+	filter, sort, order, errs := parseUserFilter(app.ID, r.URL.Query())
+	if len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	// Get one page of users for this app
+	users, next, err := s.db.ListUsers(filter)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch users"))
+		return
+	}
+
+	total, err := s.db.CountUsers(filter)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to fetch users",
-		})
+		writeError(w, r, internalError("Failed to count users"))
 		return
 	}
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data: map[string]interface{}{
-			"users": users,
-			"count": len(users),
-		},
+	var nextCursor string
+	if next != nil {
+		nextCursor = encodeUserCursor(userPageCursor{Sort: sort, Order: order, UserCursor: *next})
+	}
+
+	if users == nil {
+		users = []database.User{}
+	}
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"users":      users,
+		"count":      len(users),
+		"total":      total,
+		"nextCursor": nextCursor,
 	})
 }
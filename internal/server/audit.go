@@ -0,0 +1,523 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+	maxUserAgentBytes    = 512
+)
+
+// auditAction names a route's action in the log and says what it acts on.
+// The target ID is read from the param URL parameter, or from the id field
+// of the handler's after state for routes that create their target.
+type auditAction struct {
+	name       string
+	targetType string
+	param      string
+}
+
+// auditActions covers the mutating developer API routes. A route missing
+// here is still logged, under its method and pattern.
+var auditActions = map[string]auditAction{
+	"PATCH /api/auth/me":                                                                 {"developer.update", "developer", ""},
+	"POST /api/auth/me/email/confirm":                                                    {"developer.email.confirm", "developer", ""},
+	"POST /api/auth/me/password":                                                         {"developer.password.change", "developer", ""},
+	"POST /api/auth/me/deletion":                                                         {"developer.deletion.schedule", "developer", ""},
+	"DELETE /api/auth/me/deletion":                                                       {"developer.deletion.cancel", "developer", ""},
+	"POST /api/auth/logout":                                                              {"developer.logout", "developer_session", ""},
+	"DELETE /api/auth/sessions/{sessionId}":                                              {"developer.session.revoke", "developer_session", "sessionId"},
+	"POST /api/auth/mfa/totp/setup":                                                      {"developer.totp.setup", "developer", ""},
+	"POST /api/auth/mfa/totp/enable":                                                     {"developer.totp.enable", "developer", ""},
+	"POST /api/auth/mfa/totp/disable":                                                    {"developer.totp.disable", "developer", ""},
+	"POST /api/auth/mfa/recovery-codes":                                                  {"developer.recovery_codes.regenerate", "developer", ""},
+	"POST /api/auth/passkeys/register/begin":                                             {"developer.passkey.challenge", "developer", ""},
+	"POST /api/auth/passkeys/register/finish":                                            {"developer.passkey.create", "developer_passkey", ""},
+	"DELETE /api/auth/passkeys/{passkeyId}":                                              {"developer.passkey.delete", "developer_passkey", "passkeyId"},
+	"POST /api/auth/tokens":                                                              {"developer.api_token.create", "developer_api_token", ""},
+	"DELETE /api/auth/tokens/{tokenId}":                                                  {"developer.api_token.delete", "developer_api_token", "tokenId"},
+	"POST /api/applications":                                                             {"application.create", "application", ""},
+	"PUT /api/applications/{id}":                                                         {"application.update", "application", "id"},
+	"DELETE /api/applications/{id}":                                                      {"application.delete", "application", "id"},
+	"POST /api/applications/{id}/keys/rotate":                                            {"application.keys.rotate", "application", "id"},
+	"PUT /api/applications/{id}/password-policy":                                         {"application.password_policy.update", "application", "id"},
+	"PUT /api/applications/{id}/metadata-schema":                                         {"application.metadata_schema.update", "application", "id"},
+	"PUT /api/applications/{id}/signup-policy":                                           {"application.signup_policy.update", "application", "id"},
+	"PUT /api/applications/{id}/rate-limits":                                             {"application.rate_limits.update", "application", "id"},
+	"PUT /api/applications/{id}/login-history-policy":                                    {"application.login_history_policy.update", "application", "id"},
+	"PUT /api/applications/{id}/risk-policy":                                             {"application.risk_policy.update", "application", "id"},
+	"POST /api/applications/{id}/users/import":                                           {"user.import", "application", "id"},
+	"POST /api/applications/{id}/users":                                                  {"user.create", "user", ""},
+	"PATCH /api/applications/{id}/users/{userId}":                                        {"user.update", "user", "userId"},
+	"DELETE /api/applications/{id}/users/{userId}":                                       {"user.erase", "user", "userId"},
+	"POST /api/applications/{id}/users/{userId}/disable":                                 {"user.disable", "user", "userId"},
+	"POST /api/applications/{id}/users/{userId}/enable":                                  {"user.enable", "user", "userId"},
+	"POST /api/applications/{id}/users/{userId}/require-password-reset":                  {"user.require_password_reset", "user", "userId"},
+	"POST /api/applications/{id}/users/{userId}/approve":                                 {"user.approve", "user", "userId"},
+	"DELETE /api/applications/{id}/users/{userId}/lockout":                               {"user.lockout.clear", "user", "userId"},
+	"PUT /api/applications/{id}/users/{userId}/roles/{roleId}":                           {"user.role.assign", "user", "userId"},
+	"DELETE /api/applications/{id}/users/{userId}/roles/{roleId}":                        {"user.role.unassign", "user", "userId"},
+	"POST /api/applications/{id}/invite-codes":                                           {"invite_code.create", "invite_code", ""},
+	"DELETE /api/applications/{id}/invite-codes/{codeId}":                                {"invite_code.delete", "invite_code", "codeId"},
+	"POST /api/applications/{id}/webhooks":                                               {"webhook.create", "webhook", ""},
+	"PATCH /api/applications/{id}/webhooks/{webhookId}":                                  {"webhook.update", "webhook", "webhookId"},
+	"DELETE /api/applications/{id}/webhooks/{webhookId}":                                 {"webhook.delete", "webhook", "webhookId"},
+	"POST /api/applications/{id}/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver": {"webhook.redeliver", "webhook", "webhookId"},
+	"POST /api/applications/{id}/roles":                                                  {"role.create", "role", ""},
+	"PUT /api/applications/{id}/roles/{roleId}":                                          {"role.update", "role", "roleId"},
+	"DELETE /api/applications/{id}/roles/{roleId}":                                       {"role.delete", "role", "roleId"},
+	"POST /api/applications/{id}/organizations":                                          {"organization.create", "organization", ""},
+	"PATCH /api/applications/{id}/organizations/{orgId}":                                 {"organization.update", "organization", "orgId"},
+	"DELETE /api/applications/{id}/organizations/{orgId}":                                {"organization.delete", "organization", "orgId"},
+	"PUT /api/applications/{id}/organizations/{orgId}/members/{userId}":                  {"organization.member.set", "organization", "orgId"},
+	"DELETE /api/applications/{id}/organizations/{orgId}/members/{userId}":               {"organization.member.remove", "organization", "orgId"},
+	"POST /api/applications/{id}/organizations/{orgId}/invitations":                      {"organization.invitation.create", "organization", "orgId"},
+	"DELETE /api/applications/{id}/organizations/{orgId}/invitations/{invitationId}":     {"organization.invitation.revoke", "organization", "orgId"},
+	"PUT /api/applications/{id}/team":                                                    {"application.team.update", "application", "id"},
+	"POST /api/teams":                                                                    {"team.create", "team", ""},
+	"PATCH /api/teams/{teamId}":                                                          {"team.update", "team", "teamId"},
+	"DELETE /api/teams/{teamId}":                                                         {"team.delete", "team", "teamId"},
+	"PUT /api/teams/{teamId}/members/{developerId}":                                      {"team.member.set", "team", "teamId"},
+	"DELETE /api/teams/{teamId}/members/{developerId}":                                   {"team.member.remove", "team", "teamId"},
+	"POST /api/teams/{teamId}/invitations":                                               {"team.invitation.create", "team", "teamId"},
+	"DELETE /api/teams/{teamId}/invitations/{invitationId}":                              {"team.invitation.revoke", "team", "teamId"},
+	"POST /api/teams/invitations/accept":                                                 {"team.invitation.accept", "team", ""},
+}
+
+// auditRedactedFields are never written to the log. A change to one is
+// still recorded, with both values redacted.
+var auditRedactedFields = map[string]bool{
+	"secretKey":    true,
+	"secret":       true,
+	"code":         true,
+	"token":        true,
+	"passwordHash": true,
+}
+
+// auditPersonalFields hold personal data of an application's users. They
+// are redacted whenever the target is a user, since the log is kept after a
+// user is erased.
+var auditPersonalFields = map[string]bool{
+	"email":           true,
+	"firstName":       true,
+	"lastName":        true,
+	"publicMetadata":  true,
+	"privateMetadata": true,
+}
+
+const auditRedacted = "[redacted]"
+
+// errStopStream ends a stream early without it being a failure
+var errStopStream = errors.New("stop stream")
+
+// auditRecord collects what a handler reports about the state it changed
+type auditRecord struct {
+	before interface{}
+	after  interface{}
+	// teamID is the team of the application acted on, set by
+	// ownedApplication
+	teamID string
+}
+
+// auditBefore records the state of the target before the handler changes
+// it. v is copied at once, so it may be modified afterwards.
+func auditBefore(r *http.Request, v interface{}) {
+	if rec, ok := r.Context().Value("audit").(*auditRecord); ok {
+		rec.before = auditSnapshot(v)
+	}
+}
+
+// auditTeam records the team of the application a handler acts on, so the
+// entry shows in that team's log
+func auditTeam(r *http.Request, teamID string) {
+	if rec, ok := r.Context().Value("audit").(*auditRecord); ok {
+		rec.teamID = teamID
+	}
+}
+
+// auditAfter records the state of the target after the change. v is copied
+// once the handler returns.
+func auditAfter(r *http.Request, v interface{}) {
+	if rec, ok := r.Context().Value("audit").(*auditRecord); ok {
+		rec.after = v
+	}
+}
+
+// auditSnapshot returns the JSON object form of v, or nil for nil. Values
+// that are not objects are wrapped under "value".
+func auditSnapshot(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(b, &m) != nil {
+		var value interface{}
+		json.Unmarshal(b, &value)
+		if value == nil {
+			return nil
+		}
+		return map[string]interface{}{"value": value}
+	}
+	return m
+}
+
+// auditFieldChange is one changed field in an audit entry
+type auditFieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// auditDiff returns the fields that differ between two snapshots of a
+// target of targetType, with redacted fields masked
+func auditDiff(targetType string, before, after map[string]interface{}) map[string]auditFieldChange {
+	changes := make(map[string]auditFieldChange)
+	for key, b := range before {
+		if a, ok := after[key]; !ok || !reflect.DeepEqual(a, b) {
+			changes[key] = auditFieldChange{Before: b, After: after[key]}
+		}
+	}
+	for key, a := range after {
+		if _, ok := before[key]; !ok {
+			changes[key] = auditFieldChange{After: a}
+		}
+	}
+	for key, c := range changes {
+		if auditRedactedFields[key] || (targetType == "user" && auditPersonalFields[key]) {
+			if c.Before != nil {
+				c.Before = auditRedacted
+			}
+			if c.After != nil {
+				c.After = auditRedacted
+			}
+			changes[key] = c
+		}
+	}
+	return changes
+}
+
+// auditMiddleware appends an entry to the audit log for each mutating
+// request that succeeds. Handlers add the before and after state of their
+// target with auditBefore and auditAfter.
+func (s *Server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &auditRecord{}
+		r = r.WithContext(context.WithValue(r.Context(), "audit", rec))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		if status := ww.Status(); status != 0 && status >= http.StatusBadRequest {
+			return
+		}
+		s.recordAudit(r, rec)
+	})
+}
+
+// recordAudit builds the entry for a request handled by auditMiddleware and
+// appends it. A failure is logged, since the change has already been made.
+func (s *Server) recordAudit(r *http.Request, rec *auditRecord) {
+	developerID, _ := r.Context().Value("developerID").(string)
+	rctx := chi.RouteContext(r.Context())
+	pattern := ""
+	if rctx != nil {
+		pattern = rctx.RoutePattern()
+	}
+
+	action, ok := auditActions[r.Method+" "+pattern]
+	if !ok {
+		action = auditAction{name: r.Method + " " + pattern, targetType: "route"}
+	}
+
+	before, _ := rec.before.(map[string]interface{})
+	after := auditSnapshot(rec.after)
+
+	entry := &database.AuditEntry{
+		ID:            uuid.New().String(),
+		DeveloperID:   developerID,
+		ActorID:       developerID,
+		ApplicationID: chi.URLParam(r, "id"),
+		TeamID:        chi.URLParam(r, "teamId"),
+		Action:        action.name,
+		TargetType:    action.targetType,
+		IP:            s.clientIP(r),
+		UserAgent:     truncate(r.UserAgent(), maxUserAgentBytes),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if action.param != "" {
+		entry.TargetID = chi.URLParam(r, action.param)
+	} else if id, ok := after["id"].(string); ok {
+		entry.TargetID = id
+	}
+	switch action.targetType {
+	case "application":
+		if entry.ApplicationID == "" {
+			entry.ApplicationID = entry.TargetID
+		}
+		// An application created in or moved into a team is logged there,
+		// one moved out of a team in the team it left
+		if teamID, ok := after["teamId"].(string); ok && teamID != "" {
+			entry.TeamID = teamID
+		}
+	case "team":
+		if entry.TeamID == "" {
+			entry.TeamID = entry.TargetID
+		}
+	}
+	if entry.TeamID == "" {
+		entry.TeamID = rec.teamID
+	}
+	if before != nil || after != nil {
+		changes, err := json.Marshal(auditDiff(action.targetType, before, after))
+		if err == nil {
+			entry.Changes = changes
+		}
+	}
+
+	if err := s.db.AppendAuditEntry(entry); err != nil {
+		log.Printf("failed to append %s to audit log of developer %s: %v", entry.Action, developerID, err)
+	}
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// parseAuditFilter reads the audit log query parameters:
+//
+//	applicationId, actorId, action, targetId, since, until, limit, before
+//	(the nextBefore of the previous page)
+func parseAuditFilter(developerID string, q url.Values) (database.AuditFilter, []FieldError) {
+	var v validator
+	filter := database.AuditFilter{
+		DeveloperID:   developerID,
+		ApplicationID: q.Get("applicationId"),
+		ActorID:       q.Get("actorId"),
+		Action:        q.Get("action"),
+		TargetID:      q.Get("targetId"),
+		Limit:         defaultAuditPageSize,
+	}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAuditPageSize {
+			v.add("limit", codeOutOfRange, "limit must be between 1 and "+strconv.Itoa(maxAuditPageSize))
+		} else {
+			filter.Limit = n
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if s := q.Get(p.name); s != "" {
+			t, ok := parseTimeParam(s)
+			if !ok {
+				v.add(p.name, "invalid_time", p.name+" must be an RFC 3339 timestamp or YYYY-MM-DD date")
+			}
+			*p.dst = t
+		}
+	}
+
+	if s := q.Get("before"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			v.add("before", "invalid_cursor", "before must be the nextBefore of a previous page")
+		} else {
+			filter.BeforeSeq = n
+		}
+	}
+
+	return filter, v.errors
+}
+
+// auditChain checks entries of one developer's log, fed to it oldest first
+type auditChain struct {
+	prevHash string
+	count    int
+}
+
+// check verifies that e links to the entry before it and that its hash
+// matches its contents
+func (c *auditChain) check(e *database.AuditEntry) error {
+	if e.PrevHash != c.prevHash {
+		return fmt.Errorf("entry %d does not link to the entry before it", e.Seq)
+	}
+	if e.ComputeHash() != e.Hash {
+		return fmt.Errorf("entry %d does not match its hash", e.Seq)
+	}
+	c.prevHash = e.Hash
+	c.count++
+	return nil
+}
+
+// handleGetAuditLog returns one page of the developer's audit log, newest
+// first. See parseAuditFilter for the supported query parameters.
+func (s *Server) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	filter, errs := parseAuditFilter(developerID, r.URL.Query())
+	if len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	s.writeAuditPage(w, r, filter)
+}
+
+// handleGetApplicationAuditLog returns one page of the entries about the
+// {id} application, whoever acted, newest first. It takes admin rights over
+// the application.
+func (s *Server) handleGetApplicationAuditLog(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	if !teamRoleAtLeast(app.Role, database.TeamRoleAdmin) {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+
+	filter, errs := parseAuditFilter("", r.URL.Query())
+	if len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	filter.ApplicationID = app.ID
+	s.writeAuditPage(w, r, filter)
+}
+
+// handleGetTeamAuditLog returns one page of the entries about the {teamId}
+// team and its applications, newest first. It takes admin rights over the
+// team; applicationId narrows it to one of them.
+func (s *Server) handleGetTeamAuditLog(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := s.developerTeam(w, r, database.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+
+	filter, errs := parseAuditFilter("", r.URL.Query())
+	if len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	filter.TeamID = team.ID
+	s.writeAuditPage(w, r, filter)
+}
+
+// writeAuditPage writes the page of entries matching filter
+func (s *Server) writeAuditPage(w http.ResponseWriter, r *http.Request, filter database.AuditFilter) {
+	entries, err := s.db.GetAuditEntries(filter)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch audit log"))
+		return
+	}
+
+	var nextBefore int64
+	if len(entries) == filter.Limit {
+		nextBefore = entries[len(entries)-1].Seq
+	}
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"entries":    entries,
+		"count":      len(entries),
+		"nextBefore": nextBefore,
+	})
+}
+
+// handleExportAuditLog streams the entries matching the filters as JSON
+// lines, oldest first. An unfiltered export can be verified offline by
+// recomputing each hash.
+func (s *Server) handleExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	filter, errs := parseAuditFilter(developerID, r.URL.Query())
+	if len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-log.jsonl"`)
+
+	enc := json.NewEncoder(w)
+	count := 0
+	err := s.db.StreamAuditEntries(filter, func(e *database.AuditEntry) error {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushInterval == 0 {
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("audit log export for developer %s failed after %d entries: %v", developerID, count, err)
+		return
+	}
+	rc.Flush()
+}
+
+// handleVerifyAuditLog walks the developer's whole audit log and reports
+// the first entry that was altered, or whose predecessor was removed
+func (s *Server) handleVerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	var chain auditChain
+	var broken *database.AuditEntry
+	var reason string
+	err := s.db.StreamAuditEntries(database.AuditFilter{DeveloperID: developerID}, func(e *database.AuditEntry) error {
+		if err := chain.check(e); err != nil {
+			broken, reason = e, err.Error()
+			return errStopStream
+		}
+		return nil
+	})
+	if err != nil && err != errStopStream {
+		writeError(w, r, internalError("Failed to verify audit log"))
+		return
+	}
+
+	result := map[string]interface{}{
+		"valid":    broken == nil,
+		"verified": chain.count,
+	}
+	if broken != nil {
+		result["brokenAt"] = broken.Seq
+		result["reason"] = reason
+	}
+	writeData(w, http.StatusOK, result)
+}
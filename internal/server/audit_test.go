@@ -0,0 +1,219 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before := auditSnapshot(&database.Application{ID: "app-1", Name: "Old", Domain: "example.com", SecretKey: "sk_1"})
+	after := auditSnapshot(&database.Application{ID: "app-1", Name: "New", Domain: "example.com", SecretKey: "sk_2"})
+
+	changes := auditDiff("application", before, after)
+	if len(changes) != 2 {
+		t.Fatalf("expected name and secretKey to change; got %v", changes)
+	}
+	if c := changes["name"]; c.Before != "Old" || c.After != "New" {
+		t.Errorf("unexpected name change %+v", c)
+	}
+	if c := changes["secretKey"]; c.Before != auditRedacted || c.After != auditRedacted {
+		t.Errorf("expected secretKey to be redacted; got %+v", c)
+	}
+
+	created := auditDiff("role", nil, map[string]interface{}{"id": "role-1"})
+	if c := created["id"]; c.Before != nil || c.After != "role-1" {
+		t.Errorf("unexpected change for a created target %+v", c)
+	}
+	deleted := auditDiff("role", map[string]interface{}{"id": "role-1"}, nil)
+	if c := deleted["id"]; c.Before != "role-1" || c.After != nil {
+		t.Errorf("unexpected change for a deleted target %+v", c)
+	}
+}
+
+func TestAuditDiffRedactsUserPersonalData(t *testing.T) {
+	user := auditSnapshot(&database.User{ID: "user-1", Email: "ada@example.com", FirstName: "Ada", LastName: "Lovelace",
+		PublicMetadata: []byte(`{"plan":"pro"}`), PrivateMetadata: []byte(`{"stripeId":"cus_1"}`), Status: database.UserStatusActive})
+
+	changes := auditDiff("user", user, nil)
+	b, err := json.Marshal(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"ada@example.com", "Ada", "Lovelace", "pro", "cus_1"} {
+		if strings.Contains(string(b), leaked) {
+			t.Errorf("expected %q to be redacted; got %s", leaked, b)
+		}
+	}
+	if c := changes["id"]; c.Before != "user-1" {
+		t.Errorf("expected the user ID to be kept; got %+v", c)
+	}
+	if c := changes["email"]; c.Before != auditRedacted {
+		t.Errorf("expected the email change to be recorded as redacted; got %+v", c)
+	}
+
+	// Other targets keep these fields
+	org := auditDiff("organization", nil, map[string]interface{}{"email": "billing@example.com"})
+	if c := org["email"]; c.After != "billing@example.com" {
+		t.Errorf("expected fields of other targets to be kept; got %+v", c)
+	}
+}
+
+func TestAuditSnapshot(t *testing.T) {
+	if got := auditSnapshot((*database.Role)(nil)); got != nil {
+		t.Errorf("expected nil for a nil pointer; got %v", got)
+	}
+	if got := auditSnapshot([]string{"a"}); got == nil || got["value"] == nil {
+		t.Errorf("expected a list to be wrapped under value; got %v", got)
+	}
+
+	// The before state is copied when it is recorded
+	role := &database.Role{Name: "admin"}
+	rec := &auditRecord{}
+	r := httptest.NewRequest(http.MethodPut, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "audit", rec))
+	auditBefore(r, role)
+	role.Name = "owner"
+	if got := rec.before.(map[string]interface{})["name"]; got != "admin" {
+		t.Errorf("expected the before state to keep the old name; got %v", got)
+	}
+}
+
+func auditTestChain(n int) []database.AuditEntry {
+	var entries []database.AuditEntry
+	prev := ""
+	for i := 0; i < n; i++ {
+		e := database.AuditEntry{
+			Seq: int64(i + 1), ID: "entry-" + string(rune('a'+i)), DeveloperID: "dev-1", ActorID: "dev-1",
+			Action: "role.update", TargetType: "role", TargetID: "role-1",
+			Changes:   json.RawMessage(`{"name":{"before":"a","after":"b"}}`),
+			CreatedAt: time.Date(2024, 1, 1, 0, 0, i, 0, time.UTC), PrevHash: prev,
+		}
+		e.Hash = e.ComputeHash()
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func([]database.AuditEntry) []database.AuditEntry
+		wantBad int64
+	}{
+		{"intact", func(e []database.AuditEntry) []database.AuditEntry { return e }, 0},
+		{"edited", func(e []database.AuditEntry) []database.AuditEntry {
+			e[1].Action = "role.delete"
+			return e
+		}, 2},
+		{"deleted", func(e []database.AuditEntry) []database.AuditEntry {
+			return append(e[:1], e[2:]...)
+		}, 3},
+		{"rehashed without relinking", func(e []database.AuditEntry) []database.AuditEntry {
+			e[1].IP = "10.0.0.1"
+			e[1].Hash = e[1].ComputeHash()
+			return e
+		}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chain auditChain
+			var bad int64
+			for _, e := range tt.tamper(auditTestChain(4)) {
+				if err := chain.check(&e); err != nil {
+					bad = e.Seq
+					break
+				}
+			}
+			if bad != tt.wantBad {
+				t.Errorf("chain broke at %d; want %d", bad, tt.wantBad)
+			}
+		})
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	filter, errs := parseAuditFilter("dev-1", url.Values{
+		"applicationId": {"app-1"}, "since": {"2024-01-01"}, "limit": {"10"}, "before": {"42"},
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if filter.DeveloperID != "dev-1" || filter.ApplicationID != "app-1" || filter.Limit != 10 ||
+		filter.BeforeSeq != 42 || filter.Since.IsZero() {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+
+	for _, q := range []url.Values{
+		{"limit": {"0"}}, {"limit": {"1000"}}, {"since": {"yesterday"}}, {"before": {"x"}},
+	} {
+		if _, errs := parseAuditFilter("dev-1", q); len(errs) == 0 {
+			t.Errorf("expected %v to be rejected", q)
+		}
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	s := newTestServer(t)
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "developerID", "dev-1")))
+		})
+	})
+	r.Use(s.auditMiddleware)
+	r.Put("/api/applications/{id}/roles/{roleId}", func(w http.ResponseWriter, r *http.Request) {
+		role := &database.Role{ID: chi.URLParam(r, "roleId"), Name: "admin"}
+		auditBefore(r, role)
+		auditAfter(r, role)
+		role.Name = "owner"
+		writeData(w, http.StatusOK, role)
+	})
+	r.Delete("/api/applications/{id}/roles/{roleId}", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, errRoleNotFound)
+	})
+	r.Get("/api/applications/{id}/roles", func(w http.ResponseWriter, r *http.Request) {
+		writeData(w, http.StatusOK, nil)
+	})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPut, "/api/applications/app-1/roles/role-1", strings.NewReader("{}")),
+		httptest.NewRequest(http.MethodDelete, "/api/applications/app-1/roles/role-1", nil),
+		httptest.NewRequest(http.MethodGet, "/api/applications/app-1/roles", nil),
+	} {
+		req.Header.Set("User-Agent", "test-agent")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries, err := s.db.GetAuditEntries(database.AuditFilter{DeveloperID: "dev-1", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the successful update to be logged; got %+v", entries)
+	}
+	e := entries[0]
+	if e.Action != "role.update" || e.TargetType != "role" || e.TargetID != "role-1" ||
+		e.ApplicationID != "app-1" || e.ActorID != "dev-1" || e.UserAgent != "test-agent" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if want := `{"name":{"before":"admin","after":"owner"}}`; string(e.Changes) != want {
+		t.Errorf("changes = %s; want %s", e.Changes, want)
+	}
+	if e.Seq == 0 || e.PrevHash != "" || e.Hash != e.ComputeHash() {
+		t.Errorf("expected the entry to start dev-1's chain; got %+v", e)
+	}
+}
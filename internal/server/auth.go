@@ -3,12 +3,12 @@ package server
 import (
 	"auth-server/internal/database"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type registerRequest struct {
@@ -26,19 +26,31 @@ type loginRequest struct {
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req registerRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid request format",
-		})
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	if errs := s.checkPassword(nil, req.Email, req.Password); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	existing, err := s.db.GetDeveloperByEmail(req.Email)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to hash password",
-		})
+		writeError(w, r, internalError("Error checking for existing developer"))
+		return
+	}
+	if existing != nil {
+		writeError(w, r, errEmailTaken)
+		return
+	}
+
+	hash, err := s.hashPassword(req.Password)
+	if err != nil {
+		writeError(w, r, internalError("Failed to hash password"))
 		return
 	}
 
@@ -47,64 +59,106 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		FirstName:    req.FirstName,
 		LastName:     req.LastName,
 		Email:        req.Email,
-		PasswordHash: string(hash),
+		PasswordHash: hash,
 	}
 
 	if err := s.db.CreateDeveloper(dev); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to create developer",
-		})
+		writeError(w, r, internalError("Failed to create developer"))
 		return
 	}
 
-	token := s.generateJWT(dev)
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"token": token},
-	})
+	s.startDeveloperSession(w, r, http.StatusCreated, dev, database.AuthMethodPassword)
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req loginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid request format",
-		})
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	if !s.checkLoginThrottle(w, r) {
 		return
 	}
 
 	dev, err := s.db.GetDeveloperByEmail(req.Email)
-	if err != nil || dev == nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid credentials",
-		})
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up developer"))
+		return
+	}
+	if dev == nil {
+		s.loginFailed(r, nil)
+		writeError(w, r, errInvalidCredentials)
+		return
+	}
+
+	lockout, ok := s.checkAccountLockout(w, r, developerLockoutSubject(dev))
+	if !ok {
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(dev.PasswordHash), []byte(req.Password)); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid credentials",
+	ok, rehash, err := s.verifyPassword(req.Password, dev.PasswordHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify password"))
+		return
+	}
+	if !ok {
+		s.loginFailed(r, developerLockoutSubject(dev))
+		writeError(w, r, errInvalidCredentials)
+		return
+	}
+
+	// Upgrade the stored hash if it uses an outdated algorithm or parameters
+	if rehash {
+		if hash, err := s.hashPassword(req.Password); err == nil {
+			if err := s.db.UpdateDeveloperPasswordHash(dev.ID, hash); err != nil {
+				log.Printf("failed to rehash password for developer %s: %v", dev.ID, err)
+			}
+		}
+	}
+
+	// Developers with a second factor get a challenge token to complete
+	// signing in with it instead of a session. This attempt and failures so
+	// far still count towards the lockout until they do.
+	methods, err := s.developerMFAMethods(dev)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check second factors"))
+		return
+	}
+	if len(methods) > 0 {
+		token, expiresAt := s.issueChallengeToken(dev.ID, challengeTypeMFA, nil)
+		writeData(w, http.StatusOK, mfaChallengeResponse{
+			MFARequired: true,
+			MFAToken:    token,
+			ExpiresAt:   expiresAt.Format(time.RFC3339),
+			Methods:     methods,
 		})
 		return
 	}
+	s.loginSucceeded(lockout)
 
-	token := s.generateJWT(dev)
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    map[string]string{"token": token},
-	})
+	s.startDeveloperSession(w, r, http.StatusOK, dev, database.AuthMethodPassword)
 }
 
-func (s *Server) generateJWT(dev *database.Developer) string {
+// generateJWT signs an access token for the developer's session. Its jti is
+// the session's AccessTokenID, so revoking the session can deny it.
+func (s *Server) generateJWT(dev *database.Developer, session *database.DeveloperSession) (string, time.Time) {
+	now := time.Now()
+	expiresAt := now.Add(s.jwt.exp)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": dev.ID,
-		"exp": time.Now().Add(s.jwt.exp).Unix(),
+		"sub":       dev.ID,
+		"sid":       session.ID,
+		"jti":       session.AccessTokenID,
+		"amr":       session.AuthMethods,
+		"auth_time": session.AuthTime.Unix(),
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
 	})
 
 	signedToken, _ := token.SignedString(s.jwt.secret)
-	return signedToken
+	return signedToken, expiresAt
 }
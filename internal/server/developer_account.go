@@ -0,0 +1,429 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// developerDeletionGracePeriod is how long a developer has to change their
+// mind after asking for their account to be deleted
+const developerDeletionGracePeriod = 14 * 24 * time.Hour
+
+type updateDeveloperRequest struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+	Email     *string `json:"email"`
+	// Password is the current password, required to change the email
+	Password string `json:"password"`
+}
+
+func (r updateDeveloperRequest) validate() []FieldError {
+	var v validator
+	if r.FirstName != nil {
+		v.name("firstName", *r.FirstName)
+	}
+	if r.LastName != nil {
+		v.name("lastName", *r.LastName)
+	}
+	if r.Email != nil {
+		v.email("email", *r.Email)
+		v.required("password", r.Password)
+	}
+	return v.errors
+}
+
+type deleteDeveloperRequest struct {
+	Password string `json:"password"`
+	// ConfirmEmail must repeat the account's email
+	ConfirmEmail string `json:"confirmEmail"`
+}
+
+func (r deleteDeveloperRequest) validate() []FieldError {
+	var v validator
+	v.required("password", r.Password)
+	v.required("confirmEmail", r.ConfirmEmail)
+	return v.errors
+}
+
+// confirmDeveloperPassword checks password against the developer's current
+// hash, writing an error response and returning false if it does not match.
+// Wrong passwords count towards the lockout and IP throttle like failed
+// logins.
+func (s *Server) confirmDeveloperPassword(w http.ResponseWriter, r *http.Request, dev *database.Developer, password string) bool {
+	if !s.checkLoginThrottle(w, r) {
+		return false
+	}
+	lockout, ok := s.checkAccountLockout(w, r, developerLockoutSubject(dev))
+	if !ok {
+		return false
+	}
+	ok, _, err := s.verifyPassword(password, dev.PasswordHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify password"))
+		return false
+	}
+	if !ok {
+		s.loginFailed(r, developerLockoutSubject(dev))
+		writeError(w, r, errInvalidCredentials)
+		return false
+	}
+	s.loginSucceeded(lockout)
+	return true
+}
+
+func (s *Server) handleGetDeveloperAccount(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+
+	writeData(w, http.StatusOK, dev)
+}
+
+// developerEmailChangeTTL is how long a developer's email change
+// confirmation link stays valid
+const developerEmailChangeTTL = 24 * time.Hour
+
+// handleUpdateDeveloperAccount changes the developer's names. A new email
+// needs the current password, and a second factor if they have one, and
+// only takes effect once confirmed from the new address, since team
+// invitations are matched against it.
+func (s *Server) handleUpdateDeveloperAccount(w http.ResponseWriter, r *http.Request) {
+	var req updateDeveloperRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, dev)
+
+	changeEmail := req.Email != nil && !strings.EqualFold(*req.Email, dev.Email)
+	if changeEmail {
+		if !s.confirmDeveloperPassword(w, r, dev, req.Password) {
+			return
+		}
+		if !s.requireDeveloperStrongAuth(w, r, dev) {
+			return
+		}
+		existing, err := s.db.GetDeveloperByEmail(*req.Email)
+		if err != nil {
+			writeError(w, r, internalError("Error checking for existing developer"))
+			return
+		}
+		if existing != nil {
+			writeError(w, r, errEmailTaken)
+			return
+		}
+	}
+	if req.FirstName != nil {
+		dev.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		dev.LastName = *req.LastName
+	}
+
+	if err := s.db.UpdateDeveloperProfile(dev); err != nil {
+		writeError(w, r, internalError("Failed to update account"))
+		return
+	}
+	auditAfter(r, dev)
+
+	if !changeEmail {
+		writeData(w, http.StatusOK, dev)
+		return
+	}
+
+	token, err := generateKey("", 32)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate token"))
+		return
+	}
+	expiresAt := time.Now().Add(developerEmailChangeTTL)
+	err = s.db.CreateDeveloperEmailChange(&database.DeveloperEmailChange{
+		DeveloperID: dev.ID,
+		NewEmail:    *req.Email,
+		TokenHash:   hashToken(token),
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		writeError(w, r, internalError("Failed to create email change"))
+		return
+	}
+
+	confirm := "confirm it in the developer dashboard with this code:\n\n" + token
+	if link := s.dashboardLink("/account/confirm-email", url.Values{"token": {token}}); link != "" {
+		confirm = "confirm it here:\n\n" + link
+	}
+	body := "To use this address for your developer account, sign in and " + confirm +
+		"\n\nThe link expires in 24 hours. If you did not request this change, ignore this email."
+	if err := s.mailer.Send(*req.Email, "Confirm your new email address", body); err != nil {
+		log.Printf("failed to send email change confirmation for developer %s: %v", dev.ID, err)
+		writeError(w, r, internalError("Failed to send confirmation email"))
+		return
+	}
+
+	body = "Someone asked to change the email of your developer account to " + *req.Email +
+		". The change only takes effect once it is confirmed from that address.\n\n" +
+		"If this wasn't you, change your password and review your sessions."
+	if err := s.mailer.Send(dev.Email, "Your email address is being changed", body); err != nil {
+		log.Printf("failed to send email change notice to developer %s: %v", dev.ID, err)
+	}
+
+	writeData(w, http.StatusAccepted, map[string]interface{}{
+		"developer":    dev,
+		"pendingEmail": *req.Email,
+		"expiresAt":    expiresAt.Format(time.RFC3339),
+	})
+}
+
+// handleConfirmDeveloperEmailChange applies an email change using the token
+// sent to the new address, and tells the old address about it
+func (s *Server) handleConfirmDeveloperEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req confirmEmailChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, dev)
+
+	change, err := s.db.ConsumeDeveloperEmailChange(dev.ID, hashToken(req.Token))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up token"))
+		return
+	}
+	if change == nil || change.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidVerificationToken)
+		return
+	}
+
+	// The address may have been claimed since the change was requested
+	existing, err := s.db.GetDeveloperByEmail(change.NewEmail)
+	if err != nil {
+		writeError(w, r, internalError("Error checking for existing developer"))
+		return
+	}
+	if existing != nil && existing.ID != dev.ID {
+		writeError(w, r, errEmailTaken)
+		return
+	}
+
+	oldEmail := dev.Email
+	dev.Email = change.NewEmail
+	if err := s.db.UpdateDeveloperProfile(dev); err != nil {
+		writeError(w, r, internalError("Failed to update email"))
+		return
+	}
+	auditAfter(r, dev)
+
+	body := "The email of your developer account was changed to " + dev.Email + ".\n\n" +
+		"If this wasn't you, contact support, as you will no longer receive email at this address."
+	if err := s.mailer.Send(oldEmail, "Your email address was changed", body); err != nil {
+		log.Printf("failed to send email change notice to developer %s: %v", dev.ID, err)
+	}
+
+	writeData(w, http.StatusOK, dev)
+}
+
+// handleChangeDeveloperPassword sets a new password after checking the
+// current one, and signs out every other session of the developer
+func (s *Server) handleChangeDeveloperPassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	token := r.Context().Value("developerToken").(*developerToken)
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.confirmDeveloperPassword(w, r, dev, req.CurrentPassword) {
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		writeError(w, r, validationError([]FieldError{{
+			Field: "newPassword", Code: codePasswordReused, Message: "newPassword must differ from the current password",
+		}}))
+		return
+	}
+	if errs := s.checkPassword(nil, dev.Email, req.NewPassword); len(errs) > 0 {
+		for i := range errs {
+			errs[i].Field = "newPassword"
+		}
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	hash, err := s.hashPassword(req.NewPassword)
+	if err != nil {
+		writeError(w, r, internalError("Failed to hash password"))
+		return
+	}
+	if err := s.db.UpdateDeveloperPasswordHash(dev.ID, hash); err != nil {
+		writeError(w, r, internalError("Failed to update password"))
+		return
+	}
+
+	sessions, err := s.db.GetDeveloperSessions(dev.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch sessions"))
+		return
+	}
+	revoked := 0
+	for i := range sessions {
+		if sessions[i].ID == token.SessionID {
+			continue
+		}
+		if err := s.endDeveloperSession(&sessions[i]); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, internalError("Failed to revoke other sessions"))
+			return
+		}
+		revoked++
+	}
+
+	writeData(w, http.StatusOK, map[string]int{"sessionsRevoked": revoked})
+}
+
+// handleScheduleDeveloperDeletion schedules the developer's account for
+// deletion once developerDeletionGracePeriod has passed. The developer
+// confirms with their password and by repeating their email, and can
+// cancel until then.
+func (s *Server) handleScheduleDeveloperDeletion(w http.ResponseWriter, r *http.Request) {
+	var req deleteDeveloperRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(req.ConfirmEmail), dev.Email) {
+		writeError(w, r, validationError([]FieldError{{
+			Field: "confirmEmail", Code: "confirmation_mismatch", Message: "confirmEmail must match the account email",
+		}}))
+		return
+	}
+	if !s.confirmDeveloperPassword(w, r, dev, req.Password) {
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+	if dev.DeletionScheduledAt != nil {
+		writeError(w, r, errDeletionAlreadyScheduled)
+		return
+	}
+
+	n, err := s.db.CountSoleOwnedTeams(dev.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check teams"))
+		return
+	}
+	if n > 0 {
+		writeError(w, r, errSoleTeamOwner)
+		return
+	}
+	auditBefore(r, dev)
+
+	at := time.Now().Add(developerDeletionGracePeriod).UTC()
+	if err := s.db.ScheduleDeveloperDeletion(dev.ID, &at); err != nil {
+		writeError(w, r, internalError("Failed to schedule deletion"))
+		return
+	}
+	dev.DeletionScheduledAt = &at
+	auditAfter(r, dev)
+
+	body := "Your account will be deleted on " + at.Format("2 January 2006 at 15:04 MST") +
+		", together with all of your applications and their users.\n\n" +
+		"To keep your account, sign in and cancel the deletion before then."
+	if err := s.mailer.Send(dev.Email, "Your account is scheduled for deletion", body); err != nil {
+		log.Printf("failed to send deletion notice to developer %s: %v", dev.ID, err)
+	}
+
+	writeData(w, http.StatusAccepted, map[string]string{
+		"deletionScheduledAt": at.Format(time.RFC3339),
+	})
+}
+
+// handleCancelDeveloperDeletion keeps an account scheduled for deletion
+func (s *Server) handleCancelDeveloperDeletion(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if dev.DeletionScheduledAt == nil {
+		writeError(w, r, errDeletionNotScheduled)
+		return
+	}
+	auditBefore(r, dev)
+
+	if err := s.db.ScheduleDeveloperDeletion(dev.ID, nil); err != nil {
+		writeError(w, r, internalError("Failed to cancel deletion"))
+		return
+	}
+	dev.DeletionScheduledAt = nil
+	auditAfter(r, dev)
+
+	writeData(w, http.StatusOK, dev)
+}
+
+// deleteDueDevelopers deletes the accounts whose grace period has ended. A
+// developer who has since become the only owner of a team is kept until
+// they hand it over.
+func (s *Server) deleteDueDevelopers() (int, error) {
+	ids, err := s.db.GetDevelopersDueForDeletion()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		err := s.db.DeleteDeveloper(id)
+		switch {
+		case err == nil:
+			deleted++
+		case errors.Is(err, database.ErrSoleTeamOwner):
+			log.Printf("not deleting developer %s: they are the only owner of a team", id)
+		case errors.Is(err, sql.ErrNoRows):
+		default:
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,364 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDeveloperAccountServer seeds Ada, dev-1, who is signed in on session-1
+// to session-3 with access tokens token-1 to token-3, and dev-2, who uses
+// taken@example.com
+func newDeveloperAccountServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "ada@example.com")
+	seedDeveloper(t, s, "dev-2", "taken@example.com")
+	for _, n := range []string{"1", "2", "3"} {
+		session := &database.DeveloperSession{ID: "session-" + n, DeveloperID: "dev-1", RefreshTokenHash: hashToken(n),
+			AccessTokenID: "token-" + n, AuthMethods: []string{database.AuthMethodPassword},
+			LastUsedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := s.db.CreateDeveloperSession(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func loadDeveloper(t *testing.T, s *Server, id string) *database.Developer {
+	t.Helper()
+	dev, err := s.db.GetDeveloperByID(id)
+	if err != nil || dev == nil {
+		t.Fatalf("loading developer %s: %v", id, err)
+	}
+	return dev
+}
+
+// developerRequest builds a request authenticated as dev-1 on session-1,
+// signed in just now
+func developerRequest(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	ctx := context.WithValue(r.Context(), "developerID", "dev-1")
+	ctx = context.WithValue(ctx, "developerToken", &developerToken{
+		ID: "token-1", SessionID: "session-1", AuthMethods: []string{database.AuthMethodPassword}, AuthTime: time.Now(),
+	})
+	return r.WithContext(ctx)
+}
+
+func TestUpdateDeveloperAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		code    string
+		first   string
+		pending bool
+	}{
+		{"names", `{"firstName":"Augusta"}`, http.StatusOK, "", "Augusta", false},
+		{"email", `{"firstName":"Augusta","email":"countess@example.com","password":"` + testPassword + `"}`, http.StatusAccepted, "", "Augusta", true},
+		{"same email", `{"email":"ADA@example.com","password":"wrong"}`, http.StatusOK, "", "Ada", false},
+		{"email without password", `{"email":"countess@example.com"}`, http.StatusUnprocessableEntity, "validation_failed", "Ada", false},
+		{"email with wrong password", `{"email":"countess@example.com","password":"wrong"}`, http.StatusUnauthorized, "invalid_credentials", "Ada", false},
+		{"email taken", `{"email":"taken@example.com","password":"` + testPassword + `"}`, http.StatusConflict, "email_taken", "Ada", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDeveloperAccountServer(t)
+			w := httptest.NewRecorder()
+			s.handleUpdateDeveloperAccount(w, developerRequest(http.MethodPatch, "/api/auth/me", tt.body))
+
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+				t.Fatalf("expected %d %s; got %d: %s", tt.want, tt.code, w.Code, w.Body.String())
+			}
+			dev := loadDeveloper(t, s, "dev-1")
+			if dev.Email != "ada@example.com" || dev.FirstName != tt.first {
+				t.Errorf("expected %s with the email unchanged; got %s %s", tt.first, dev.FirstName, dev.Email)
+			}
+			mailer := sentMail(s)
+			if !tt.pending {
+				if len(mailer.to) != 0 {
+					t.Errorf("expected no email; got %v", mailer.to)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), `"pendingEmail":"countess@example.com"`) {
+				t.Errorf("expected the pending email; got %s", w.Body.String())
+			}
+			if strings.Join(mailer.to, ",") != "countess@example.com,ada@example.com" {
+				t.Errorf("expected a confirmation to the new address and a notice to the old one; got %v", mailer.to)
+			}
+		})
+	}
+}
+
+func TestConfirmDeveloperEmailChange(t *testing.T) {
+	s := newDeveloperAccountServer(t)
+	w := httptest.NewRecorder()
+	s.handleUpdateDeveloperAccount(w, developerRequest(http.MethodPatch, "/api/auth/me",
+		`{"email":"countess@example.com","password":"`+testPassword+`"}`))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", w.Code, w.Body.String())
+	}
+	// The confirmation goes out before the notice to the old address
+	mailer := sentMail(s)
+	token := (&recordingMailer{body: mailer.body[:1]}).token(t)
+
+	w = httptest.NewRecorder()
+	s.handleConfirmDeveloperEmailChange(w, developerRequest(http.MethodPost, "/api/auth/me/email/confirm", `{"token":"wrong"}`))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_verification_token") {
+		t.Fatalf("expected a wrong token to be rejected; got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.handleConfirmDeveloperEmailChange(w, developerRequest(http.MethodPost, "/api/auth/me/email/confirm", `{"token":"`+token+`"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if dev := loadDeveloper(t, s, "dev-1"); dev.Email != "countess@example.com" {
+		t.Errorf("expected the new email to be set; got %s", dev.Email)
+	}
+	if mailer.to[len(mailer.to)-1] != "ada@example.com" {
+		t.Errorf("expected a notice to the old address; got %v", mailer.to)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleConfirmDeveloperEmailChange(w, developerRequest(http.MethodPost, "/api/auth/me/email/confirm", `{"token":"`+token+`"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a used token to be rejected; got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestConfirmDeveloperEmailChangeRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *Server)
+		want  int
+		code  string
+	}{
+		{"expired", func(t *testing.T, s *Server) {
+			if err := s.db.CreateDeveloperEmailChange(&database.DeveloperEmailChange{DeveloperID: "dev-1",
+				NewEmail: "countess@example.com", TokenHash: hashToken("code"), ExpiresAt: time.Now().Add(-time.Minute)}); err != nil {
+				t.Fatal(err)
+			}
+		}, http.StatusBadRequest, "invalid_verification_token"},
+		{"other developer", func(t *testing.T, s *Server) {
+			if err := s.db.CreateDeveloperEmailChange(&database.DeveloperEmailChange{DeveloperID: "dev-2",
+				NewEmail: "countess@example.com", TokenHash: hashToken("code"), ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+		}, http.StatusBadRequest, "invalid_verification_token"},
+		{"address claimed since", func(t *testing.T, s *Server) {
+			if err := s.db.CreateDeveloperEmailChange(&database.DeveloperEmailChange{DeveloperID: "dev-1",
+				NewEmail: "countess@example.com", TokenHash: hashToken("code"), ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			seedDeveloper(t, s, "dev-3", "countess@example.com")
+		}, http.StatusConflict, "email_taken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDeveloperAccountServer(t)
+			tt.setup(t, s)
+
+			w := httptest.NewRecorder()
+			s.handleConfirmDeveloperEmailChange(w, developerRequest(http.MethodPost, "/api/auth/me/email/confirm", `{"token":"code"}`))
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected %d %s; got %d: %s", tt.want, tt.code, w.Code, w.Body.String())
+			}
+			if dev := loadDeveloper(t, s, "dev-1"); dev.Email != "ada@example.com" {
+				t.Errorf("expected the email to be left alone; got %s", dev.Email)
+			}
+		})
+	}
+}
+
+func TestConfirmDeveloperPasswordCountsFailures(t *testing.T) {
+	s := newDeveloperAccountServer(t)
+	wrong := `{"email":"countess@example.com","password":"wrong"}`
+	failures := s.lockout.FreeAttempts + 1
+	for i := 0; i < failures; i++ {
+		w := httptest.NewRecorder()
+		s.handleUpdateDeveloperAccount(w, developerRequest(http.MethodPatch, "/api/auth/me", wrong))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401; got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	lockout, err := s.db.GetAccountLockout("dev-1")
+	if err != nil || lockout == nil || lockout.FailedAttempts != failures {
+		t.Fatalf("expected %d failed attempts; got %+v %v", failures, lockout, err)
+	}
+
+	// Even the right password now has to wait
+	w := httptest.NewRecorder()
+	s.handleUpdateDeveloperAccount(w, developerRequest(http.MethodPatch, "/api/auth/me",
+		`{"email":"countess@example.com","password":"`+testPassword+`"}`))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected the attempt to be delayed; got %d: %s", w.Code, w.Body.String())
+	}
+	if len(sentMail(s).to) != 0 {
+		t.Error("expected no email change to start")
+	}
+}
+
+func TestChangeDeveloperPasswordEndsOtherSessions(t *testing.T) {
+	s := newDeveloperAccountServer(t)
+	oldHash := loadDeveloper(t, s, "dev-1").PasswordHash
+
+	w := httptest.NewRecorder()
+	s.handleChangeDeveloperPassword(w, developerRequest(http.MethodPost, "/api/auth/me/password",
+		`{"currentPassword":"`+testPassword+`","newPassword":"Another-Long-Passphrase-42"}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if loadDeveloper(t, s, "dev-1").PasswordHash == oldHash {
+		t.Error("expected the password hash to change")
+	}
+	sessions, err := s.db.GetDeveloperSessions("dev-1")
+	if err != nil || len(sessions) != 1 || sessions[0].ID != "session-1" {
+		t.Errorf("expected only the current session to be kept; got %+v %v", sessions, err)
+	}
+	for _, jti := range []string{"token-2", "token-3"} {
+		if revoked, _ := s.db.IsTokenRevoked(jti); !revoked {
+			t.Errorf("expected %s to be revoked", jti)
+		}
+	}
+	if revoked, _ := s.db.IsTokenRevoked("token-1"); revoked {
+		t.Error("expected the current access token to stay valid")
+	}
+	if !strings.Contains(w.Body.String(), `"sessionsRevoked":2`) {
+		t.Errorf("expected two revoked sessions; got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.handleChangeDeveloperPassword(w, developerRequest(http.MethodPost, "/api/auth/me/password",
+		`{"currentPassword":"`+testPassword+`","newPassword":"Yet-Another-Passphrase-43"}`))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old password to be rejected; got %d", w.Code)
+	}
+}
+
+// seedSoleOwnedTeam makes developerID the only owner of a new team
+func seedSoleOwnedTeam(t *testing.T, s *Server, teamID, developerID string) {
+	t.Helper()
+	err := s.db.CreateTeam(&database.Team{ID: teamID, Name: "Team"},
+		&database.TeamMember{TeamID: teamID, DeveloperID: developerID, Role: database.TeamRoleOwner})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduleDeveloperDeletion(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		soleOwner bool
+		scheduled bool
+		want      int
+		code      string
+	}{
+		{"scheduled", `{"password":"` + testPassword + `","confirmEmail":"ADA@example.com"}`, false, false, http.StatusAccepted, ""},
+		{"wrong email", `{"password":"` + testPassword + `","confirmEmail":"eve@example.com"}`, false, false, http.StatusUnprocessableEntity, "confirmation_mismatch"},
+		{"wrong password", `{"password":"wrong","confirmEmail":"ada@example.com"}`, false, false, http.StatusUnauthorized, "invalid_credentials"},
+		{"sole team owner", `{"password":"` + testPassword + `","confirmEmail":"ada@example.com"}`, true, false, http.StatusConflict, "sole_team_owner"},
+		{"already scheduled", `{"password":"` + testPassword + `","confirmEmail":"ada@example.com"}`, false, true, http.StatusConflict, "deletion_already_scheduled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDeveloperAccountServer(t)
+			if tt.soleOwner {
+				seedSoleOwnedTeam(t, s, "team-1", "dev-1")
+			}
+			var earlier *time.Time
+			if tt.scheduled {
+				at := time.Now().Add(time.Hour).UTC()
+				earlier = &at
+				if err := s.db.ScheduleDeveloperDeletion("dev-1", earlier); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			before := time.Now()
+			w := httptest.NewRecorder()
+			s.handleScheduleDeveloperDeletion(w, developerRequest(http.MethodPost, "/api/auth/me/deletion", tt.body))
+
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+				t.Fatalf("expected %d %s; got %d: %s", tt.want, tt.code, w.Code, w.Body.String())
+			}
+			scheduledAt := loadDeveloper(t, s, "dev-1").DeletionScheduledAt
+			if tt.want != http.StatusAccepted {
+				if (scheduledAt == nil) != (earlier == nil) || (scheduledAt != nil && !scheduledAt.Equal(*earlier)) {
+					t.Errorf("expected the schedule to be left alone; got %v", scheduledAt)
+				}
+				return
+			}
+			if scheduledAt == nil || scheduledAt.Before(before.Add(developerDeletionGracePeriod).Truncate(time.Second)) {
+				t.Errorf("expected deletion after the grace period; got %v", scheduledAt)
+			}
+		})
+	}
+}
+
+// failingDeleteDeveloperDB fails to delete the developers listed in errs
+type failingDeleteDeveloperDB struct {
+	database.Service
+	errs map[string]error
+}
+
+func (f failingDeleteDeveloperDB) DeleteDeveloper(id string) error {
+	if err := f.errs[id]; err != nil {
+		return err
+	}
+	return f.Service.DeleteDeveloper(id)
+}
+
+func TestDeleteDueDevelopers(t *testing.T) {
+	newServer := func(t *testing.T) *Server {
+		s := newTestServer(t)
+		past := time.Now().Add(-time.Hour).UTC()
+		for _, id := range []string{"dev-1", "dev-2", "dev-3"} {
+			seedDeveloper(t, s, id, id+"@example.com")
+			if err := s.db.ScheduleDeveloperDeletion(id, &past); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s
+	}
+	remaining := func(t *testing.T, s *Server) []string {
+		var ids []string
+		for _, id := range []string{"dev-1", "dev-2", "dev-3"} {
+			if dev, _ := s.db.GetDeveloperByID(id); dev != nil {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	s := newServer(t)
+	seedSoleOwnedTeam(t, s, "team-1", "dev-2")
+	n, err := s.deleteDueDevelopers()
+	if err != nil || n != 2 || strings.Join(remaining(t, s), ",") != "dev-2" {
+		t.Errorf("expected dev-1 and dev-3 to be deleted; got %d %v, left %v", n, err, remaining(t, s))
+	}
+
+	// Developers deleted in the meantime are skipped
+	s = newServer(t)
+	s.db = failingDeleteDeveloperDB{s.db, map[string]error{"dev-2": sql.ErrNoRows}}
+	if n, err := s.deleteDueDevelopers(); err != nil || n != 2 {
+		t.Errorf("expected dev-1 and dev-3 to be deleted; got %d %v", n, err)
+	}
+
+	s = newServer(t)
+	failed := errors.New("disk full")
+	s.db = failingDeleteDeveloperDB{s.db, map[string]error{"dev-1": failed, "dev-2": failed, "dev-3": failed}}
+	if n, err := s.deleteDueDevelopers(); !errors.Is(err, failed) || n != 0 || len(remaining(t, s)) != 3 {
+		t.Errorf("expected the failure to stop the task; got %d %v, left %v", n, err, remaining(t, s))
+	}
+}
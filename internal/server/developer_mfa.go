@@ -0,0 +1,742 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// mfaChallengeResponse answers a correct password from a developer with a
+// second factor. They finish signing in with the token and one of methods.
+type mfaChallengeResponse struct {
+	MFARequired bool     `json:"mfaRequired"`
+	MFAToken    string   `json:"mfaToken"`
+	ExpiresAt   string   `json:"expiresAt"`
+	Methods     []string `json:"methods"`
+}
+
+type mfaCodeRequest struct {
+	MFAToken string `json:"mfaToken"`
+	// Code is a TOTP code or a recovery code
+	Code string `json:"code"`
+}
+
+type mfaTokenRequest struct {
+	MFAToken string `json:"mfaToken"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type passkeyLoginRequest struct {
+	ChallengeToken string            `json:"challengeToken"`
+	Credential     passkeyCredential `json:"credential"`
+}
+
+type passkeyRegistrationRequest struct {
+	ChallengeToken string            `json:"challengeToken"`
+	Name           string            `json:"name"`
+	Credential     passkeyCredential `json:"credential"`
+}
+
+func (r mfaCodeRequest) validate() []FieldError {
+	var v validator
+	v.required("mfaToken", r.MFAToken)
+	v.required("code", r.Code)
+	return v.errors
+}
+
+func (r mfaTokenRequest) validate() []FieldError {
+	var v validator
+	v.required("mfaToken", r.MFAToken)
+	return v.errors
+}
+
+func (r totpCodeRequest) validate() []FieldError {
+	var v validator
+	v.required("code", r.Code)
+	return v.errors
+}
+
+func (r passkeyLoginRequest) validate() []FieldError {
+	var v validator
+	v.required("challengeToken", r.ChallengeToken)
+	v.required("credential.id", r.Credential.ID)
+	return v.errors
+}
+
+func (r passkeyRegistrationRequest) validate() []FieldError {
+	var v validator
+	v.required("challengeToken", r.ChallengeToken)
+	v.required("credential.id", r.Credential.ID)
+	if len(r.Name) > 100 {
+		v.add("name", codeOutOfRange, "name must be at most 100 characters")
+	}
+	return v.errors
+}
+
+// developerMFAMethods returns the second factors the developer has set up
+func (s *Server) developerMFAMethods(dev *database.Developer) ([]string, error) {
+	var methods []string
+	if dev.TOTPEnabled {
+		methods = append(methods, database.AuthMethodTOTP)
+	}
+	passkeys, err := s.db.GetDeveloperPasskeys(dev.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(passkeys) > 0 {
+		methods = append(methods, database.AuthMethodPasskey)
+	}
+	return methods, nil
+}
+
+// currentDeveloper loads the authenticated developer, writing an error
+// response and returning false if they no longer exist
+func (s *Server) currentDeveloper(w http.ResponseWriter, r *http.Request) (*database.Developer, bool) {
+	developerID := r.Context().Value("developerID").(string)
+	dev, err := s.db.GetDeveloperByID(developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch developer"))
+		return nil, false
+	}
+	if dev == nil {
+		writeError(w, r, errInvalidClaims)
+		return nil, false
+	}
+	return dev, true
+}
+
+// requireDeveloperStrongAuth writes an error response and returns false if
+// the developer has a second factor but did not use one to get the
+// request's token, so a stolen password alone cannot change second factors.
+// The session must also have signed in within recentAuthMaxAge, since
+// refreshing carries its sign-in forward.
+func (s *Server) requireDeveloperStrongAuth(w http.ResponseWriter, r *http.Request, dev *database.Developer) bool {
+	token := r.Context().Value("developerToken").(*developerToken)
+	if !hasStrongAuth(token.AuthMethods) {
+		methods, err := s.developerMFAMethods(dev)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check second factors"))
+			return false
+		}
+		if len(methods) > 0 {
+			writeError(w, r, errStrongAuthenticationRequired)
+			return false
+		}
+	}
+	if time.Since(token.AuthTime) > recentAuthMaxAge {
+		writeError(w, r, errReauthenticationRequired)
+		return false
+	}
+	return true
+}
+
+// checkSecondFactorCode checks a TOTP or recovery code, using it up. It
+// returns the method it matched, or "" if it matched none.
+func (s *Server) checkSecondFactorCode(dev *database.Developer, code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if dev.TOTPEnabled {
+		if step, ok := verifyTOTP(dev.TOTPSecret, code, time.Now()); ok {
+			err := s.db.UseDeveloperTOTPStep(dev.ID, step)
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			return database.AuthMethodTOTP, nil
+		}
+	}
+	if len(dev.RecoveryCodes) > 0 {
+		err := s.db.UseDeveloperRecoveryCode(dev.ID, hashRecoveryCode(code))
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return database.AuthMethodRecoveryCode, nil
+	}
+	return "", nil
+}
+
+// issueRecoveryCodes gives the developer new recovery codes, replacing any
+// they had, and returns them
+func (s *Server) issueRecoveryCodes(dev *database.Developer) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.UpdateDeveloperRecoveryCodes(dev.ID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// dropRecoveryCodesIfUnused deletes the developer's recovery codes once they
+// have no second factor left for the codes to replace
+func (s *Server) dropRecoveryCodesIfUnused(dev *database.Developer) {
+	methods, err := s.developerMFAMethods(dev)
+	if err == nil && len(methods) == 0 {
+		err = s.db.UpdateDeveloperRecoveryCodes(dev.ID, []string{})
+	}
+	if err != nil {
+		log.Printf("failed to drop recovery codes of developer %s: %v", dev.ID, err)
+	}
+}
+
+// handleVerifyDeveloperMFA finishes signing in with a TOTP or recovery code.
+// Wrong codes count towards the account lockout like wrong passwords.
+func (s *Server) handleVerifyDeveloperMFA(w http.ResponseWriter, r *http.Request) {
+	var req mfaCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	challenge, rejected := s.parseChallengeToken(req.MFAToken, challengeTypeMFA)
+	if rejected != nil {
+		writeError(w, r, rejected)
+		return
+	}
+	dev, err := s.db.GetDeveloperByID(challenge.DeveloperID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch developer"))
+		return
+	}
+	if dev == nil {
+		writeError(w, r, errInvalidChallengeToken)
+		return
+	}
+
+	lockout, ok := s.checkAccountLockout(w, r, developerLockoutSubject(dev))
+	if !ok {
+		return
+	}
+	method, err := s.checkSecondFactorCode(dev, req.Code)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify code"))
+		return
+	}
+	if method == "" {
+		s.loginFailed(r, developerLockoutSubject(dev))
+		writeError(w, r, errInvalidMFACode)
+		return
+	}
+	s.loginSucceeded(lockout)
+
+	if err := s.redeemChallengeToken(challenge); err != nil {
+		writeError(w, r, internalError("Failed to redeem token"))
+		return
+	}
+	s.startDeveloperSession(w, r, http.StatusOK, dev, database.AuthMethodPassword, method)
+}
+
+// newWebAuthnChallenge returns a random base64url WebAuthn challenge
+func newWebAuthnChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// handleBeginPasskeyLogin starts signing in with a passkey as the second
+// factor, returning the options for navigator.credentials.get and a token
+// to send back with the result to handleFinishPasskeyLogin
+func (s *Server) handleBeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var req mfaTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	if !s.webauthn.enabled() {
+		writeError(w, r, errPasskeysUnavailable)
+		return
+	}
+
+	mfa, rejected := s.parseChallengeToken(req.MFAToken, challengeTypeMFA)
+	if rejected != nil {
+		writeError(w, r, rejected)
+		return
+	}
+	passkeys, err := s.db.GetDeveloperPasskeys(mfa.DeveloperID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch passkeys"))
+		return
+	}
+	if len(passkeys) == 0 {
+		writeError(w, r, errNoPasskeys)
+		return
+	}
+
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate challenge"))
+		return
+	}
+	allow := make([]map[string]string, len(passkeys))
+	for i, passkey := range passkeys {
+		allow[i] = map[string]string{"type": "public-key", "id": passkey.CredentialID}
+	}
+	token, expiresAt := s.issueChallengeToken(mfa.DeveloperID, challengeTypePasskeyLogin,
+		jwt.MapClaims{"chal": challenge, "mfa": mfa.ID})
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"challengeToken": token,
+		"expiresAt":      expiresAt.Format(time.RFC3339),
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             s.webauthn.rpID,
+			"timeout":          challengeTokenDuration.Milliseconds(),
+			"userVerification": "preferred",
+			"allowCredentials": allow,
+		},
+	})
+}
+
+// handleFinishPasskeyLogin finishes signing in with the passkey assertion
+// for a handleBeginPasskeyLogin challenge
+func (s *Server) handleFinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var req passkeyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	if !s.webauthn.enabled() {
+		writeError(w, r, errPasskeysUnavailable)
+		return
+	}
+
+	challenge, rejected := s.parseChallengeToken(req.ChallengeToken, challengeTypePasskeyLogin)
+	if rejected != nil {
+		writeError(w, r, rejected)
+		return
+	}
+	// The MFA token the challenge was issued for must still be unused
+	mfaID, _ := challenge.Claims["mfa"].(string)
+	used, err := s.db.IsTokenRevoked(mfaID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check token"))
+		return
+	}
+	if used || mfaID == "" {
+		writeError(w, r, errInvalidChallengeToken)
+		return
+	}
+	dev, err := s.db.GetDeveloperByID(challenge.DeveloperID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch developer"))
+		return
+	}
+	if dev == nil {
+		writeError(w, r, errInvalidChallengeToken)
+		return
+	}
+
+	lockout, ok := s.checkAccountLockout(w, r, developerLockoutSubject(dev))
+	if !ok {
+		return
+	}
+	passkey, err := s.db.GetDeveloperPasskeyByCredentialID(dev.ID, strings.TrimRight(req.Credential.ID, "="))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch passkey"))
+		return
+	}
+	var signCount uint32
+	if passkey != nil {
+		expected, _ := challenge.Claims["chal"].(string)
+		signCount, err = s.webauthn.verifyAssertion(req.Credential, expected, passkey.PublicKey, passkey.SignCount)
+	}
+	if passkey == nil || err != nil {
+		if err != nil {
+			log.Printf("rejected passkey of developer %s: %v", dev.ID, err)
+		}
+		s.loginFailed(r, developerLockoutSubject(dev))
+		writeError(w, r, errPasskeyRejected)
+		return
+	}
+	s.loginSucceeded(lockout)
+
+	if err := s.db.UpdateDeveloperPasskeyUse(passkey.ID, signCount); err != nil {
+		log.Printf("failed to record use of passkey %s: %v", passkey.ID, err)
+	}
+	if err := s.redeemChallengeToken(challenge); err != nil {
+		writeError(w, r, internalError("Failed to redeem token"))
+		return
+	}
+	if err := s.db.RevokeToken(mfaID, challenge.ExpiresAt); err != nil {
+		writeError(w, r, internalError("Failed to redeem token"))
+		return
+	}
+	s.startDeveloperSession(w, r, http.StatusOK, dev, database.AuthMethodPassword, database.AuthMethodPasskey)
+}
+
+// handleGetDeveloperMFA describes the developer's second factors
+func (s *Server) handleGetDeveloperMFA(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	passkeys, err := s.db.GetDeveloperPasskeys(dev.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch passkeys"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"totpEnabled":            dev.TOTPEnabled,
+		"passkeys":               len(passkeys),
+		"recoveryCodesRemaining": len(dev.RecoveryCodes),
+	})
+}
+
+// handleSetupTOTP gives the developer a new authenticator app secret. It
+// takes effect once handleEnableTOTP sees a code generated from it.
+func (s *Server) handleSetupTOTP(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if dev.TOTPEnabled {
+		writeError(w, r, errTOTPAlreadyEnabled)
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate secret"))
+		return
+	}
+	if err := s.db.UpdateDeveloperTOTP(dev.ID, secret, false); err != nil {
+		writeError(w, r, internalError("Failed to save secret"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    totpURI(s.webauthn.rpName, dev.Email, secret),
+	})
+}
+
+// handleEnableTOTP turns on the authenticator app set up with
+// handleSetupTOTP, given a current code. A developer's first second factor
+// comes with recovery codes, which are only shown here.
+func (s *Server) handleEnableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if dev.TOTPEnabled {
+		writeError(w, r, errTOTPAlreadyEnabled)
+		return
+	}
+	if dev.TOTPSecret == "" {
+		writeError(w, r, errTOTPNotSetUp)
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+
+	step, valid := verifyTOTP(dev.TOTPSecret, strings.TrimSpace(req.Code), time.Now())
+	if valid {
+		if err := s.db.UseDeveloperTOTPStep(dev.ID, step); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				writeError(w, r, internalError("Failed to verify code"))
+				return
+			}
+			valid = false
+		}
+	}
+	if !valid {
+		writeError(w, r, errInvalidMFACode)
+		return
+	}
+	if err := s.db.UpdateDeveloperTOTP(dev.ID, dev.TOTPSecret, true); err != nil {
+		writeError(w, r, internalError("Failed to enable authenticator app"))
+		return
+	}
+	auditAfter(r, map[string]interface{}{"totpEnabled": true})
+
+	response := map[string]interface{}{"totpEnabled": true}
+	if len(dev.RecoveryCodes) == 0 {
+		codes, err := s.issueRecoveryCodes(dev)
+		if err != nil {
+			writeError(w, r, internalError("Failed to generate recovery codes"))
+			return
+		}
+		response["recoveryCodes"] = codes
+	}
+	writeData(w, http.StatusOK, response)
+}
+
+// handleDisableTOTP turns off the developer's authenticator app
+func (s *Server) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if !dev.TOTPEnabled {
+		writeError(w, r, errTOTPNotEnabled)
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+	auditBefore(r, map[string]interface{}{"totpEnabled": true})
+
+	if err := s.db.UpdateDeveloperTOTP(dev.ID, "", false); err != nil {
+		writeError(w, r, internalError("Failed to disable authenticator app"))
+		return
+	}
+	dev.TOTPEnabled = false
+	s.dropRecoveryCodesIfUnused(dev)
+	auditAfter(r, map[string]interface{}{"totpEnabled": false})
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// handleRegenerateRecoveryCodes replaces the developer's recovery codes
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	methods, err := s.developerMFAMethods(dev)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check second factors"))
+		return
+	}
+	if len(methods) == 0 {
+		writeError(w, r, errMFANotEnabled)
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+
+	codes, err := s.issueRecoveryCodes(dev)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate recovery codes"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+}
+
+func (s *Server) handleGetDeveloperPasskeys(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	passkeys, err := s.db.GetDeveloperPasskeys(developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch passkeys"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"passkeys": passkeys,
+		"count":    len(passkeys),
+	})
+}
+
+// handleBeginPasskeyRegistration returns the options for
+// navigator.credentials.create and a token to send back with the new
+// credential to handleFinishPasskeyRegistration
+func (s *Server) handleBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if !s.webauthn.enabled() {
+		writeError(w, r, errPasskeysUnavailable)
+		return
+	}
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+
+	passkeys, err := s.db.GetDeveloperPasskeys(dev.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch passkeys"))
+		return
+	}
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate challenge"))
+		return
+	}
+	exclude := make([]map[string]string, len(passkeys))
+	for i, passkey := range passkeys {
+		exclude[i] = map[string]string{"type": "public-key", "id": passkey.CredentialID}
+	}
+	token, expiresAt := s.issueChallengeToken(dev.ID, challengeTypePasskeyRegistration, jwt.MapClaims{"chal": challenge})
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"challengeToken": token,
+		"expiresAt":      expiresAt.Format(time.RFC3339),
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": s.webauthn.rpID, "name": s.webauthn.rpName},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString([]byte(dev.ID)),
+				"name":        dev.Email,
+				"displayName": strings.TrimSpace(dev.FirstName + " " + dev.LastName),
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"timeout":            challengeTokenDuration.Milliseconds(),
+			"attestation":        "none",
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "discouraged",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+// handleFinishPasskeyRegistration stores the passkey created for a
+// handleBeginPasskeyRegistration challenge. A developer's first second
+// factor comes with recovery codes, which are only shown here.
+func (s *Server) handleFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	var req passkeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	if !s.webauthn.enabled() {
+		writeError(w, r, errPasskeysUnavailable)
+		return
+	}
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+
+	challenge, rejected := s.parseChallengeToken(req.ChallengeToken, challengeTypePasskeyRegistration)
+	if rejected != nil {
+		writeError(w, r, rejected)
+		return
+	}
+	if challenge.DeveloperID != dev.ID {
+		writeError(w, r, errInvalidChallengeToken)
+		return
+	}
+	expected, _ := challenge.Claims["chal"].(string)
+	data, err := s.webauthn.verifyRegistration(req.Credential, expected)
+	if err != nil {
+		log.Printf("rejected new passkey of developer %s: %v", dev.ID, err)
+		writeError(w, r, errInvalidPasskeyResponse)
+		return
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(data.CredentialID)
+	existing, err := s.db.GetDeveloperPasskeyByCredentialID(dev.ID, credentialID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check passkeys"))
+		return
+	}
+	if existing != nil {
+		writeError(w, r, errPasskeyExists)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey := &database.DeveloperPasskey{
+		ID:           uuid.New().String(),
+		DeveloperID:  dev.ID,
+		CredentialID: credentialID,
+		PublicKey:    data.PublicKey,
+		SignCount:    data.SignCount,
+		Name:         name,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := s.db.CreateDeveloperPasskey(passkey); err != nil {
+		writeError(w, r, internalError("Failed to save passkey"))
+		return
+	}
+	if err := s.redeemChallengeToken(challenge); err != nil {
+		log.Printf("failed to redeem passkey registration token of developer %s: %v", dev.ID, err)
+	}
+	auditAfter(r, passkey)
+
+	response := map[string]interface{}{"passkey": passkey}
+	if len(dev.RecoveryCodes) == 0 {
+		codes, err := s.issueRecoveryCodes(dev)
+		if err != nil {
+			writeError(w, r, internalError("Failed to generate recovery codes"))
+			return
+		}
+		response["recoveryCodes"] = codes
+	}
+	writeData(w, http.StatusCreated, response)
+}
+
+func (s *Server) handleDeleteDeveloperPasskey(w http.ResponseWriter, r *http.Request) {
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+
+	if err := s.db.DeleteDeveloperPasskey(dev.ID, chi.URLParam(r, "passkeyId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errPasskeyNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete passkey"))
+		return
+	}
+	s.dropRecoveryCodesIfUnused(dev)
+
+	writeData(w, http.StatusOK, nil)
+}
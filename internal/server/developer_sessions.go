@@ -0,0 +1,311 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// developerAccessTokenDuration is how long a developer access token
+	// lasts; clients renew it with their refresh token
+	developerAccessTokenDuration = 15 * time.Minute
+	// developerSessionDuration is how long a developer stays signed in
+	developerSessionDuration = 30 * 24 * time.Hour
+	// challengeTokenDuration is how long a developer has to complete a
+	// second factor or passkey ceremony
+	challengeTokenDuration = 5 * time.Minute
+)
+
+// Types of challenge token. Access tokens have no typ claim, and
+// authMiddleware rejects tokens that do.
+const (
+	// challengeTypeMFA proves the password was checked and asks for a
+	// second factor
+	challengeTypeMFA = "mfa"
+	// challengeTypePasskeyLogin and challengeTypePasskeyRegistration carry
+	// the challenge of a WebAuthn ceremony
+	challengeTypePasskeyLogin        = "passkey_login"
+	challengeTypePasskeyRegistration = "passkey_registration"
+)
+
+// developerToken is the verified access token of a request, added to the
+// context by authMiddleware
+type developerToken struct {
+	ID          string
+	SessionID   string
+	AuthMethods []string
+	AuthTime    time.Time
+	ExpiresAt   time.Time
+}
+
+// challengeToken is a verified challenge token
+type challengeToken struct {
+	ID          string
+	DeveloperID string
+	ExpiresAt   time.Time
+	Claims      jwt.MapClaims
+}
+
+type developerTokenResponse struct {
+	Token                 string `json:"token"`
+	ExpiresAt             string `json:"expiresAt"`
+	RefreshToken          string `json:"refreshToken"`
+	RefreshTokenExpiresAt string `json:"refreshTokenExpiresAt"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func (r refreshTokenRequest) validate() []FieldError {
+	var v validator
+	v.required("refreshToken", r.RefreshToken)
+	return v.errors
+}
+
+// startDeveloperSession signs the developer in on a new session and writes
+// its tokens. methods are how the developer just authenticated.
+func (s *Server) startDeveloperSession(w http.ResponseWriter, r *http.Request, status int, dev *database.Developer, methods ...string) {
+	refreshToken, err := generateKey("drt_", 43)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate refresh token"))
+		return
+	}
+
+	now := time.Now()
+	session := &database.DeveloperSession{
+		ID:               uuid.New().String(),
+		DeveloperID:      dev.ID,
+		RefreshTokenHash: hashToken(refreshToken),
+		AccessTokenID:    uuid.New().String(),
+		AuthMethods:      methods,
+		AuthTime:         now,
+		IP:               s.clientIP(r),
+		UserAgent:        truncate(r.UserAgent(), maxUserAgentBytes),
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(developerSessionDuration),
+	}
+	if err := s.db.CreateDeveloperSession(session); err != nil {
+		writeError(w, r, internalError("Failed to create session"))
+		return
+	}
+
+	s.writeDeveloperTokens(w, status, dev, session, refreshToken)
+}
+
+func (s *Server) writeDeveloperTokens(w http.ResponseWriter, status int, dev *database.Developer, session *database.DeveloperSession, refreshToken string) {
+	token, expiresAt := s.generateJWT(dev, session)
+	writeData(w, status, developerTokenResponse{
+		Token:                 token,
+		ExpiresAt:             expiresAt.Format(time.RFC3339),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: session.ExpiresAt.Format(time.RFC3339),
+	})
+}
+
+// handleRefreshDeveloperToken exchanges a refresh token for a new access
+// token and refresh token. The old refresh token stops working, and so does
+// the session's previous access token.
+func (s *Server) handleRefreshDeveloperToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	oldHash := hashToken(req.RefreshToken)
+	session, err := s.db.GetDeveloperSessionByRefreshToken(oldHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up session"))
+		return
+	}
+	if session == nil || session.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidRefreshToken)
+		return
+	}
+	dev, err := s.db.GetDeveloperByID(session.DeveloperID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch developer"))
+		return
+	}
+	if dev == nil {
+		writeError(w, r, errInvalidRefreshToken)
+		return
+	}
+
+	refreshToken, err := generateKey("drt_", 43)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate refresh token"))
+		return
+	}
+	previousTokenID := session.AccessTokenID
+	session.RefreshTokenHash = hashToken(refreshToken)
+	session.AccessTokenID = uuid.New().String()
+	session.IP = s.clientIP(r)
+	session.UserAgent = truncate(r.UserAgent(), maxUserAgentBytes)
+	session.LastUsedAt = time.Now()
+	if err := s.db.RotateDeveloperSession(session, oldHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvalidRefreshToken)
+			return
+		}
+		writeError(w, r, internalError("Failed to update session"))
+		return
+	}
+	if err := s.db.RevokeToken(previousTokenID, time.Now().Add(s.jwt.exp)); err != nil {
+		log.Printf("failed to revoke access token of developer session %s: %v", session.ID, err)
+	}
+
+	s.writeDeveloperTokens(w, http.StatusOK, dev, session, refreshToken)
+}
+
+// endDeveloperSession deletes a session and denies its current access token
+func (s *Server) endDeveloperSession(session *database.DeveloperSession) error {
+	if err := s.db.DeleteDeveloperSession(session.DeveloperID, session.ID); err != nil {
+		return err
+	}
+	return s.db.RevokeToken(session.AccessTokenID, time.Now().Add(s.jwt.exp))
+}
+
+// handleDeveloperLogout ends the session of the request's access token
+func (s *Server) handleDeveloperLogout(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+	token := r.Context().Value("developerToken").(*developerToken)
+
+	session, err := s.db.GetDeveloperSession(developerID, token.SessionID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up session"))
+		return
+	}
+	if session != nil {
+		if err := s.endDeveloperSession(session); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, internalError("Failed to end session"))
+			return
+		}
+	}
+	// The token may predate a refresh, so deny it directly too
+	if err := s.db.RevokeToken(token.ID, token.ExpiresAt); err != nil {
+		writeError(w, r, internalError("Failed to revoke token"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// developerSessionResponse is a session as listed to its developer
+type developerSessionResponse struct {
+	database.DeveloperSession
+	// Current is set on the session of the request's access token
+	Current bool `json:"current"`
+}
+
+func (s *Server) handleGetDeveloperSessions(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+	token := r.Context().Value("developerToken").(*developerToken)
+
+	sessions, err := s.db.GetDeveloperSessions(developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch sessions"))
+		return
+	}
+
+	result := make([]developerSessionResponse, len(sessions))
+	for i, session := range sessions {
+		result[i] = developerSessionResponse{DeveloperSession: session, Current: session.ID == token.SessionID}
+	}
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"sessions": result,
+		"count":    len(result),
+	})
+}
+
+// handleRevokeDeveloperSession signs one of the developer's sessions out
+func (s *Server) handleRevokeDeveloperSession(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	session, err := s.db.GetDeveloperSession(developerID, chi.URLParam(r, "sessionId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up session"))
+		return
+	}
+	if session == nil {
+		writeError(w, r, errDeveloperSessionNotFound)
+		return
+	}
+	auditBefore(r, session)
+
+	if err := s.endDeveloperSession(session); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errDeveloperSessionNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to revoke session"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// issueChallengeToken signs a short-lived token of type typ for the
+// developer, with extra claims. Each is redeemed once.
+func (s *Server) issueChallengeToken(developerID, typ string, extra jwt.MapClaims) (string, time.Time) {
+	now := time.Now()
+	expiresAt := now.Add(challengeTokenDuration)
+	claims := jwt.MapClaims{
+		"sub": developerID,
+		"typ": typ,
+		"jti": uuid.New().String(),
+		"iat": now.Unix(),
+		"exp": expiresAt.Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.jwt.secret)
+	return signed, expiresAt
+}
+
+// parseChallengeToken verifies an unredeemed challenge token of type typ
+func (s *Server) parseChallengeToken(signed, typ string) (*challengeToken, *apiError) {
+	token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return s.jwt.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, errInvalidChallengeToken
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if claims["typ"] != typ || sub == "" || jti == "" || err != nil || exp == nil {
+		return nil, errInvalidChallengeToken
+	}
+
+	revoked, err := s.db.IsTokenRevoked(jti)
+	if err != nil {
+		return nil, internalError("Failed to check token")
+	}
+	if revoked {
+		return nil, errInvalidChallengeToken
+	}
+	return &challengeToken{ID: jti, DeveloperID: sub, ExpiresAt: exp.Time, Claims: claims}, nil
+}
+
+// redeemChallengeToken makes sure a challenge token cannot be used again
+func (s *Server) redeemChallengeToken(token *challengeToken) error {
+	return s.db.RevokeToken(token.ID, token.ExpiresAt)
+}
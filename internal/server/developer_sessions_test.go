@@ -0,0 +1,193 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newDeveloperSessionServer seeds dev-1
+func newDeveloperSessionServer(t *testing.T) (*Server, *database.Developer) {
+	s := newTestServer(t)
+	return s, seedDeveloper(t, s, "dev-1", "dev@example.com")
+}
+
+func TestAuthMiddlewareDeveloperTokens(t *testing.T) {
+	s, dev := newDeveloperSessionServer(t)
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	session := &database.DeveloperSession{ID: "session-1", AccessTokenID: "token-1",
+		AuthMethods: []string{database.AuthMethodPassword}, AuthTime: authTime}
+	valid, _ := s.generateJWT(dev, session)
+	revoked, _ := s.generateJWT(dev, &database.DeveloperSession{ID: "session-2", AccessTokenID: "token-2"})
+	if err := s.db.RevokeToken("token-2", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	challenge, _ := s.issueChallengeToken(dev.ID, challengeTypeMFA, nil)
+	noSession, _ := s.generateJWT(dev, &database.DeveloperSession{AccessTokenID: "token-3"})
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+		code  string
+	}{
+		{"valid", valid, http.StatusOK, ""},
+		{"revoked", revoked, http.StatusUnauthorized, "token_revoked"},
+		{"challenge token", challenge, http.StatusUnauthorized, "invalid_token_claims"},
+		{"no session", noSession, http.StatusUnauthorized, "invalid_token_claims"},
+		{"garbage", "not-a-token", http.StatusUnauthorized, "invalid_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *developerToken
+			h := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Context().Value("developerToken").(*developerToken)
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/api/applications", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected error %s; got %s", tt.code, w.Body.String())
+			}
+			if tt.want == http.StatusOK && (got.ID != "token-1" || got.SessionID != "session-1" ||
+				len(got.AuthMethods) != 1 || got.AuthMethods[0] != database.AuthMethodPassword || !got.AuthTime.Equal(authTime)) {
+				t.Errorf("unexpected developer token %+v", got)
+			}
+		})
+	}
+}
+
+func TestRefreshDeveloperToken(t *testing.T) {
+	s, dev := newDeveloperSessionServer(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	w := httptest.NewRecorder()
+	s.startDeveloperSession(w, r, http.StatusOK, dev, database.AuthMethodPassword)
+	var login struct {
+		Data developerTokenResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.Data.RefreshToken == "" {
+		t.Fatalf("expected tokens; got %s", w.Body.String())
+	}
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", strings.NewReader(`{"refreshToken":"`+token+`"}`))
+		w := httptest.NewRecorder()
+		s.handleRefreshDeveloperToken(w, r)
+		return w
+	}
+
+	w = refresh(login.Data.RefreshToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	var refreshed struct {
+		Data developerTokenResponse `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &refreshed)
+	if refreshed.Data.RefreshToken == login.Data.RefreshToken {
+		t.Error("expected the refresh token to rotate")
+	}
+	before, after := tokenClaims(t, s, login.Data.Token), tokenClaims(t, s, refreshed.Data.Token)
+	if before["auth_time"] == nil || after["auth_time"] != before["auth_time"] {
+		t.Errorf("expected the sign-in time to be carried forward; got %v then %v", before["auth_time"], after["auth_time"])
+	}
+	if revoked, _ := s.db.IsTokenRevoked(before["jti"].(string)); !revoked {
+		t.Error("expected the previous access token to be revoked")
+	}
+
+	if w := refresh(login.Data.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old refresh token to be rejected; got %d", w.Code)
+	}
+	if w := refresh(refreshed.Data.RefreshToken); w.Code != http.StatusOK {
+		t.Errorf("expected the new refresh token to work; got %d", w.Code)
+	}
+}
+
+func TestChallengeTokens(t *testing.T) {
+	s, _ := newDeveloperSessionServer(t)
+
+	signed, _ := s.issueChallengeToken("dev-1", challengeTypeMFA, nil)
+	if _, apiErr := s.parseChallengeToken(signed, challengeTypePasskeyLogin); apiErr == nil {
+		t.Error("expected a challenge of another type to be rejected")
+	}
+
+	token, apiErr := s.parseChallengeToken(signed, challengeTypeMFA)
+	if apiErr != nil {
+		t.Fatalf("parseChallengeToken() error = %v", apiErr)
+	}
+	if token.DeveloperID != "dev-1" {
+		t.Errorf("expected dev-1; got %s", token.DeveloperID)
+	}
+	if err := s.redeemChallengeToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, apiErr := s.parseChallengeToken(signed, challengeTypeMFA); apiErr == nil {
+		t.Error("expected a redeemed challenge to be rejected")
+	}
+}
+
+// tokenClaims returns the claims of a signed access token
+func tokenClaims(t *testing.T, s *Server, signed string) jwt.MapClaims {
+	t.Helper()
+	token, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return s.jwt.secret, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Claims.(jwt.MapClaims)
+}
+
+func TestRequireDeveloperStrongAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		totp     bool
+		methods  []string
+		signedIn time.Duration
+		want     int
+		code     string
+	}{
+		{"password without second factor", false, []string{database.AuthMethodPassword}, time.Minute, http.StatusOK, ""},
+		{"second factor", true, []string{database.AuthMethodPassword, database.AuthMethodTOTP}, time.Minute, http.StatusOK, ""},
+		{"password only", true, []string{database.AuthMethodPassword}, time.Minute, http.StatusUnauthorized, "strong_authentication_required"},
+		{"second factor long ago", true, []string{database.AuthMethodPassword, database.AuthMethodTOTP}, time.Hour, http.StatusUnauthorized, "reauthentication_required"},
+		{"password long ago", false, []string{database.AuthMethodPassword}, time.Hour, http.StatusUnauthorized, "reauthentication_required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dev := newDeveloperSessionServer(t)
+			if tt.totp {
+				if err := s.db.UpdateDeveloperTOTP(dev.ID, "JBSWY3DPEHPK3PXP", true); err != nil {
+					t.Fatal(err)
+				}
+				dev = loadDeveloper(t, s, dev.ID)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), "developerToken", &developerToken{
+				ID: "token-1", SessionID: "session-1", AuthMethods: tt.methods, AuthTime: time.Now().Add(-tt.signedIn),
+			}))
+			w := httptest.NewRecorder()
+			if ok := s.requireDeveloperStrongAuth(w, r, dev); ok != (tt.want == http.StatusOK) {
+				t.Fatalf("expected %v; got %v", tt.want == http.StatusOK, ok)
+			}
+			if tt.want != http.StatusOK && (w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code)) {
+				t.Errorf("expected %d %s; got %d: %s", tt.want, tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// apiTokenPrefix starts every developer API token, which tells
+	// authMiddleware it is not a JWT
+	apiTokenPrefix = "dpat_"
+	// apiTokenDisplayLength is how much of a token is kept to recognise it
+	apiTokenDisplayLength = len(apiTokenPrefix) + 6
+	maxAPITokenAllowedIPs = 20
+)
+
+// Scopes a developer API token can be granted. A write scope includes the
+// matching read scope.
+const (
+	scopeAppsRead   = "apps:read"
+	scopeAppsWrite  = "apps:write"
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	scopeKeysRotate = "keys:rotate"
+)
+
+var apiTokenScopes = []string{scopeAppsRead, scopeAppsWrite, scopeUsersRead, scopeUsersWrite, scopeKeysRotate}
+
+// apiTokenRouteScopes maps the routes API tokens may call to the scope each
+// needs. Routes missing here, such as account, session, token and team
+// management, need a developer login.
+var apiTokenRouteScopes = map[string]string{
+	"GET /api/applications":                                                              scopeAppsRead,
+	"POST /api/applications":                                                             scopeAppsWrite,
+	"GET /api/applications/{id}":                                                         scopeAppsRead,
+	"PUT /api/applications/{id}":                                                         scopeAppsWrite,
+	"DELETE /api/applications/{id}":                                                      scopeAppsWrite,
+	"POST /api/applications/{id}/keys/rotate":                                            scopeKeysRotate,
+	"PUT /api/applications/{id}/password-policy":                                         scopeAppsWrite,
+	"PUT /api/applications/{id}/metadata-schema":                                         scopeAppsWrite,
+	"PUT /api/applications/{id}/signup-policy":                                           scopeAppsWrite,
+	"PUT /api/applications/{id}/rate-limits":                                             scopeAppsWrite,
+	"PUT /api/applications/{id}/login-history-policy":                                    scopeAppsWrite,
+	"PUT /api/applications/{id}/risk-policy":                                             scopeAppsWrite,
+	"GET /api/applications/{id}/invite-codes":                                            scopeAppsRead,
+	"POST /api/applications/{id}/invite-codes":                                           scopeAppsWrite,
+	"DELETE /api/applications/{id}/invite-codes/{codeId}":                                scopeAppsWrite,
+	"GET /api/applications/{id}/webhooks":                                                scopeAppsRead,
+	"POST /api/applications/{id}/webhooks":                                               scopeAppsWrite,
+	"GET /api/applications/{id}/webhooks/{webhookId}":                                    scopeAppsRead,
+	"PATCH /api/applications/{id}/webhooks/{webhookId}":                                  scopeAppsWrite,
+	"DELETE /api/applications/{id}/webhooks/{webhookId}":                                 scopeAppsWrite,
+	"GET /api/applications/{id}/webhooks/{webhookId}/deliveries":                         scopeAppsRead,
+	"POST /api/applications/{id}/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver": scopeAppsWrite,
+	"GET /api/applications/{id}/roles":                                                   scopeAppsRead,
+	"POST /api/applications/{id}/roles":                                                  scopeAppsWrite,
+	"PUT /api/applications/{id}/roles/{roleId}":                                          scopeAppsWrite,
+	"DELETE /api/applications/{id}/roles/{roleId}":                                       scopeAppsWrite,
+	"GET /api/applications/{id}/users":                                                   scopeUsersRead,
+	"POST /api/applications/{id}/users":                                                  scopeUsersWrite,
+	"POST /api/applications/{id}/users/import":                                           scopeUsersWrite,
+	"GET /api/applications/{id}/users/export":                                            scopeUsersRead,
+	"GET /api/applications/{id}/users/{userId}":                                          scopeUsersRead,
+	"PATCH /api/applications/{id}/users/{userId}":                                        scopeUsersWrite,
+	"DELETE /api/applications/{id}/users/{userId}":                                       scopeUsersWrite,
+	"POST /api/applications/{id}/users/{userId}/disable":                                 scopeUsersWrite,
+	"POST /api/applications/{id}/users/{userId}/enable":                                  scopeUsersWrite,
+	"POST /api/applications/{id}/users/{userId}/require-password-reset":                  scopeUsersWrite,
+	"POST /api/applications/{id}/users/{userId}/approve":                                 scopeUsersWrite,
+	"GET /api/applications/{id}/users/{userId}/export":                                   scopeUsersRead,
+	"GET /api/applications/{id}/users/{userId}/security-events":                          scopeUsersRead,
+	"DELETE /api/applications/{id}/users/{userId}/lockout":                               scopeUsersWrite,
+	"GET /api/applications/{id}/users/{userId}/roles":                                    scopeUsersRead,
+	"PUT /api/applications/{id}/users/{userId}/roles/{roleId}":                           scopeUsersWrite,
+	"DELETE /api/applications/{id}/users/{userId}/roles/{roleId}":                        scopeUsersWrite,
+	"GET /api/applications/{id}/erasures":                                                scopeUsersRead,
+	"GET /api/applications/{id}/lockouts":                                                scopeUsersRead,
+	"GET /api/applications/{id}/organizations":                                           scopeUsersRead,
+	"POST /api/applications/{id}/organizations":                                          scopeUsersWrite,
+	"GET /api/applications/{id}/organizations/{orgId}":                                   scopeUsersRead,
+	"PATCH /api/applications/{id}/organizations/{orgId}":                                 scopeUsersWrite,
+	"DELETE /api/applications/{id}/organizations/{orgId}":                                scopeUsersWrite,
+	"GET /api/applications/{id}/organizations/{orgId}/members":                           scopeUsersRead,
+	"PUT /api/applications/{id}/organizations/{orgId}/members/{userId}":                  scopeUsersWrite,
+	"DELETE /api/applications/{id}/organizations/{orgId}/members/{userId}":               scopeUsersWrite,
+	"GET /api/applications/{id}/organizations/{orgId}/invitations":                       scopeUsersRead,
+	"POST /api/applications/{id}/organizations/{orgId}/invitations":                      scopeUsersWrite,
+	"DELETE /api/applications/{id}/organizations/{orgId}/invitations/{invitationId}":     scopeUsersWrite,
+}
+
+// hasScope reports whether scopes grant want, counting a write scope as
+// granting the matching read scope
+func hasScope(scopes []string, want string) bool {
+	implied := ""
+	if prefix, ok := strings.CutSuffix(want, ":read"); ok {
+		implied = prefix + ":write"
+	}
+	for _, s := range scopes {
+		if s == want || (implied != "" && s == implied) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed reports whether ip is one of the allowed addresses or ranges.
+// An empty list allows any address.
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, a := range allowed {
+		if prefix, err := netip.ParsePrefix(a); err == nil {
+			if prefix.Contains(addr) {
+				return true
+			}
+		} else if allowedAddr, err := netip.ParseAddr(a); err == nil && allowedAddr.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAPIToken is the part of authMiddleware for developer API
+// tokens. On success it adds the developer ID and the token to the
+// context, but no developerToken, since the routes that read one are not
+// open to API tokens.
+func (s *Server) authenticateAPIToken(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	token, err := s.db.GetDeveloperAPITokenByHash(hashToken(plaintext))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up token"))
+		return
+	}
+	if token == nil {
+		writeError(w, r, errInvalidToken)
+		return
+	}
+	if token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errAPITokenExpired)
+		return
+	}
+
+	// A token is only as good as the account it belongs to
+	dev, err := s.db.GetDeveloperByID(token.DeveloperID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up developer"))
+		return
+	}
+	if dev == nil {
+		writeError(w, r, errInvalidToken)
+		return
+	}
+
+	ip := s.clientIP(r)
+	if !ipAllowed(token.AllowedIPs, ip) {
+		writeError(w, r, errAPITokenIPNotAllowed)
+		return
+	}
+
+	pattern := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		pattern = rctx.RoutePattern()
+	}
+	scope, ok := apiTokenRouteScopes[r.Method+" "+pattern]
+	if !ok || !hasScope(token.Scopes, scope) {
+		writeError(w, r, errInsufficientScope)
+		return
+	}
+
+	if err := s.db.UpdateDeveloperAPITokenUse(token.ID, ip); err != nil {
+		log.Printf("failed to record use of developer API token %s: %v", token.ID, err)
+	}
+
+	ctx := context.WithValue(r.Context(), "developerID", token.DeveloperID)
+	ctx = context.WithValue(ctx, "apiToken", token)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+type createAPITokenRequest struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	AllowedIPs []string   `json:"allowedIps"`
+}
+
+func (r createAPITokenRequest) validate() []FieldError {
+	var v validator
+	v.name("name", r.Name)
+
+	if len(r.Scopes) == 0 {
+		v.add("scopes", codeRequired, "scopes must list at least one scope")
+	}
+	for _, scope := range r.Scopes {
+		if !isAPITokenScope(scope) {
+			v.add("scopes", "unknown_scope", "unknown scope "+strconv.Quote(scope))
+			break
+		}
+	}
+
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(time.Now()) {
+		v.add("expiresAt", codeOutOfRange, "expiresAt must be in the future")
+	}
+
+	if len(r.AllowedIPs) > maxAPITokenAllowedIPs {
+		v.add("allowedIps", codeOutOfRange, "allowedIps may list at most "+strconv.Itoa(maxAPITokenAllowedIPs)+" entries")
+	}
+	for _, a := range r.AllowedIPs {
+		if _, err := netip.ParsePrefix(a); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(a); err != nil {
+			v.add("allowedIps", "invalid_ip", strconv.Quote(a)+" is not an IP address or CIDR range")
+			break
+		}
+	}
+	return v.errors
+}
+
+func isAPITokenScope(scope string) bool {
+	for _, s := range apiTokenScopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+// createdAPITokenResponse includes the token itself, which is only shown
+// when it is created
+type createdAPITokenResponse struct {
+	database.DeveloperAPIToken
+	Token string `json:"token"`
+}
+
+// handleCreateAPIToken creates a personal access token. A token skips the
+// second factor, so developers who have one must have used it to sign in.
+func (s *Server) handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	var req createAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	dev, ok := s.currentDeveloper(w, r)
+	if !ok {
+		return
+	}
+	if !s.requireDeveloperStrongAuth(w, r, dev) {
+		return
+	}
+
+	plaintext, err := generateKey(apiTokenPrefix, 40)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate token"))
+		return
+	}
+
+	token := &database.DeveloperAPIToken{
+		ID:          uuid.New().String(),
+		DeveloperID: dev.ID,
+		Name:        strings.TrimSpace(req.Name),
+		TokenHash:   hashToken(plaintext),
+		Prefix:      plaintext[:apiTokenDisplayLength],
+		Scopes:      req.Scopes,
+		AllowedIPs:  req.AllowedIPs,
+		ExpiresAt:   req.ExpiresAt,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if token.AllowedIPs == nil {
+		token.AllowedIPs = []string{}
+	}
+	if err := s.db.CreateDeveloperAPIToken(token); err != nil {
+		writeError(w, r, internalError("Failed to create token"))
+		return
+	}
+	auditAfter(r, token)
+
+	writeData(w, http.StatusCreated, createdAPITokenResponse{DeveloperAPIToken: *token, Token: plaintext})
+}
+
+func (s *Server) handleGetAPITokens(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	tokens, err := s.db.GetDeveloperAPITokens(developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch tokens"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
+}
+
+func (s *Server) handleDeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	if err := s.db.DeleteDeveloperAPIToken(developerID, chi.URLParam(r, "tokenId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAPITokenNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete token"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
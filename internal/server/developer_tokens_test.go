@@ -0,0 +1,188 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   string
+		ok     bool
+	}{
+		{[]string{scopeAppsRead}, scopeAppsRead, true},
+		{[]string{scopeAppsWrite}, scopeAppsRead, true},
+		{[]string{scopeAppsRead}, scopeAppsWrite, false},
+		{[]string{scopeUsersWrite}, scopeAppsRead, false},
+		{[]string{scopeAppsWrite}, scopeKeysRotate, false},
+		{nil, scopeUsersRead, false},
+	}
+	for _, tt := range tests {
+		if got := hasScope(tt.scopes, tt.want); got != tt.ok {
+			t.Errorf("hasScope(%v, %s) = %v; want %v", tt.scopes, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		ip      string
+		want    bool
+	}{
+		{nil, "203.0.113.7", true},
+		{[]string{"203.0.113.7"}, "203.0.113.7", true},
+		{[]string{"203.0.113.7"}, "203.0.113.8", false},
+		{[]string{"203.0.113.0/24"}, "203.0.113.200", true},
+		{[]string{"203.0.113.0/24"}, "::ffff:203.0.113.5", true},
+		{[]string{"2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"203.0.113.0/24"}, "not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := ipAllowed(tt.allowed, tt.ip); got != tt.want {
+			t.Errorf("ipAllowed(%v, %s) = %v; want %v", tt.allowed, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCreateAPITokenRequestValidate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name  string
+		req   createAPITokenRequest
+		field string
+	}{
+		{"valid", createAPITokenRequest{Name: "CI", Scopes: []string{scopeAppsWrite}, AllowedIPs: []string{"10.0.0.0/8", "203.0.113.7"}}, ""},
+		{"no name", createAPITokenRequest{Scopes: []string{scopeAppsRead}}, "name"},
+		{"no scopes", createAPITokenRequest{Name: "CI"}, "scopes"},
+		{"unknown scope", createAPITokenRequest{Name: "CI", Scopes: []string{"admin"}}, "scopes"},
+		{"expired", createAPITokenRequest{Name: "CI", Scopes: []string{scopeAppsRead}, ExpiresAt: &past}, "expiresAt"},
+		{"bad IP", createAPITokenRequest{Name: "CI", Scopes: []string{scopeAppsRead}, AllowedIPs: []string{"10.0.0.300"}}, "allowedIps"},
+	}
+	for _, tt := range tests {
+		errs := tt.req.validate()
+		if tt.field == "" {
+			if len(errs) != 0 {
+				t.Errorf("%s: expected no errors; got %v", tt.name, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Field != tt.field {
+			t.Errorf("%s: expected one error on %s; got %v", tt.name, tt.field, errs)
+		}
+	}
+}
+
+func TestAuthMiddlewareAPITokens(t *testing.T) {
+	const plaintext = apiTokenPrefix + "secret"
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name       string
+		scopes     []string
+		allowedIPs []string
+		expiresAt  *time.Time
+		deleted    bool
+		method     string
+		path       string
+		token      string
+		want       int
+		code       string
+	}{
+		{"read", []string{scopeAppsRead}, nil, nil, false, http.MethodGet, "/api/applications/app-1", plaintext, http.StatusOK, ""},
+		{"write implies read", []string{scopeAppsWrite}, nil, nil, false, http.MethodGet, "/api/applications/app-1", plaintext, http.StatusOK, ""},
+		{"missing scope", []string{scopeAppsRead}, nil, nil, false, http.MethodPut, "/api/applications/app-1", plaintext, http.StatusForbidden, "insufficient_scope"},
+		{"users scope", []string{scopeAppsWrite}, nil, nil, false, http.MethodGet, "/api/applications/app-1/users", plaintext, http.StatusForbidden, "insufficient_scope"},
+		{"login only route", []string{scopeAppsWrite, scopeUsersWrite, scopeKeysRotate}, nil, nil, false, http.MethodGet, "/api/auth/sessions", plaintext, http.StatusForbidden, "insufficient_scope"},
+		{"expired", []string{scopeAppsRead}, nil, &past, false, http.MethodGet, "/api/applications/app-1", plaintext, http.StatusUnauthorized, "token_expired"},
+		{"allowed IP", []string{scopeAppsRead}, []string{"192.0.2.0/24"}, nil, false, http.MethodGet, "/api/applications/app-1", plaintext, http.StatusOK, ""},
+		{"other IP", []string{scopeAppsRead}, []string{"203.0.113.7"}, nil, false, http.MethodGet, "/api/applications/app-1", plaintext, http.StatusForbidden, "ip_not_allowed"},
+		{"deleted developer", []string{scopeAppsRead}, nil, nil, true, http.MethodGet, "/api/applications/app-1", plaintext, http.StatusUnauthorized, "invalid_token"},
+		{"unknown token", []string{scopeAppsRead}, nil, nil, false, http.MethodGet, "/api/applications/app-1", apiTokenPrefix + "other", http.StatusUnauthorized, "invalid_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			seedDeveloper(t, s, "dev-1", "dev@example.com")
+			token := &database.DeveloperAPIToken{
+				ID:          "token-1",
+				DeveloperID: "dev-1",
+				Name:        "CI",
+				TokenHash:   hashToken(plaintext),
+				Prefix:      plaintext[:len(apiTokenPrefix)+4],
+				Scopes:      tt.scopes,
+				AllowedIPs:  tt.allowedIPs,
+				ExpiresAt:   tt.expiresAt,
+			}
+			if tt.deleted {
+				// Left behind by a developer who no longer exists
+				token.DeveloperID = "dev-2"
+			}
+			if err := s.db.CreateDeveloperAPIToken(token); err != nil {
+				t.Fatal(err)
+			}
+
+			var developerID string
+			ok := func(w http.ResponseWriter, r *http.Request) {
+				developerID = r.Context().Value("developerID").(string)
+				w.WriteHeader(http.StatusOK)
+			}
+			router := chi.NewRouter()
+			router.Group(func(r chi.Router) {
+				r.Use(s.authMiddleware)
+				r.Get("/api/auth/sessions", ok)
+				r.Get("/api/applications/{id}", ok)
+				r.Put("/api/applications/{id}", ok)
+				r.Get("/api/applications/{id}/users", ok)
+			})
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected error %s; got %s", tt.code, w.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			used, err := s.db.GetDeveloperAPITokenByHash(token.TokenHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if developerID != "dev-1" || used.LastUsedAt == nil || used.LastUsedIP != "192.0.2.1" {
+				t.Errorf("expected the request to run as dev-1 and the use to be recorded; got %q, %+v", developerID, used)
+			}
+		})
+	}
+}
+
+func TestAPITokenRouteScopesAreRoutes(t *testing.T) {
+	routes := map[string]bool{}
+	s := &Server{}
+	chi.Walk(s.RegisterRoutes().(chi.Routes), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routes[method+" "+route] = true
+		return nil
+	})
+	for route, scope := range apiTokenRouteScopes {
+		if !routes[route] {
+			t.Errorf("%s is not a route", route)
+		}
+		if !isAPITokenScope(scope) {
+			t.Errorf("%s needs unknown scope %s", route, scope)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiError is a failure that can be written to the client. Code is a stable
+// machine-readable identifier; Message is meant for humans and may change.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+// Errors shared across handlers and middlewares
+var (
+	errInvalidRequest     = newAPIError(http.StatusBadRequest, "invalid_request", "Invalid request format")
+	errInvalidCredentials = newAPIError(http.StatusUnauthorized, "invalid_credentials", "Invalid credentials")
+	errEmailTaken         = newAPIError(http.StatusConflict, "email_taken", "An account with this email already exists")
+	errUserNotFound       = newAPIError(http.StatusNotFound, "user_not_found", "User not found")
+	errAppNotFound        = newAPIError(http.StatusNotFound, "app_not_found", "Application not found")
+
+	errAccountDisabled          = newAPIError(http.StatusForbidden, "account_disabled", "Account is disabled")
+	errPasswordResetRequired    = newAPIError(http.StatusForbidden, "password_reset_required", "Password reset required")
+	errPasswordResetNotRequired = newAPIError(http.StatusConflict, "password_reset_not_required", "Password reset is not required")
+	errTooManyAttempts          = newAPIError(http.StatusTooManyRequests, "too_many_attempts", "Too many failed login attempts, try again later")
+	errAccountLocked            = newAPIError(http.StatusLocked, "account_locked", "Account is temporarily locked after too many failed login attempts")
+	errRateLimited              = newAPIError(http.StatusTooManyRequests, "rate_limited", "Too many requests, slow down")
+	errLockoutNotFound          = newAPIError(http.StatusNotFound, "lockout_not_found", "User has no failed login attempts")
+	errAccountPending           = newAPIError(http.StatusForbidden, "account_pending", "Account is awaiting approval")
+	errUserNotPending           = newAPIError(http.StatusConflict, "user_not_pending", "User is not awaiting approval")
+	errLoginBlocked             = newAPIError(http.StatusForbidden, "login_blocked", "Login was blocked as suspicious")
+	errLoginChallengeRequired   = newAPIError(http.StatusUnauthorized, "login_challenge_required", "Confirm this login from the link sent to your email address")
+
+	errSignupDisabled        = newAPIError(http.StatusForbidden, "signup_disabled", "Signup is disabled for this application")
+	errEmailDomainNotAllowed = newAPIError(http.StatusForbidden, "email_domain_not_allowed", "Signup is not allowed for this email domain")
+	errInviteCodeRequired    = newAPIError(http.StatusForbidden, "invite_code_required", "An invite code is required to sign up")
+	errInvalidInviteCode     = newAPIError(http.StatusForbidden, "invalid_invite_code", "Invite code is invalid, expired or used up")
+	errInviteCodeNotFound    = newAPIError(http.StatusNotFound, "invite_code_not_found", "Invite code not found")
+
+	errSessionRequired = newAPIError(http.StatusUnauthorized, "session_required", "Session token required")
+	errInvalidSession  = newAPIError(http.StatusUnauthorized, "invalid_session", "Invalid session")
+	errSessionExpired  = newAPIError(http.StatusUnauthorized, "session_expired", "Session expired")
+
+	errInvalidRefreshToken      = newAPIError(http.StatusUnauthorized, "invalid_refresh_token", "Refresh token is invalid or expired")
+	errDeveloperSessionNotFound = newAPIError(http.StatusNotFound, "session_not_found", "Session not found")
+	errInvalidChallengeToken    = newAPIError(http.StatusUnauthorized, "invalid_challenge_token", "Challenge token is invalid, expired or already used")
+	errInvalidMFACode           = newAPIError(http.StatusUnauthorized, "invalid_mfa_code", "Invalid authentication code")
+	errTOTPAlreadyEnabled       = newAPIError(http.StatusConflict, "totp_already_enabled", "Authenticator app is already enabled")
+	errTOTPNotSetUp             = newAPIError(http.StatusConflict, "totp_not_set_up", "Set up an authenticator app first")
+	errTOTPNotEnabled           = newAPIError(http.StatusConflict, "totp_not_enabled", "Authenticator app is not enabled")
+	errMFANotEnabled            = newAPIError(http.StatusConflict, "mfa_not_enabled", "Set up a second factor first")
+	errPasskeysUnavailable      = newAPIError(http.StatusNotImplemented, "passkeys_unavailable", "Passkeys are not configured on this server")
+	errNoPasskeys               = newAPIError(http.StatusBadRequest, "no_passkeys", "No passkeys are registered")
+	errInvalidPasskeyResponse   = newAPIError(http.StatusBadRequest, "invalid_passkey_response", "Passkey response is invalid")
+	errPasskeyRejected          = newAPIError(http.StatusUnauthorized, "passkey_rejected", "Passkey was not accepted")
+	errPasskeyExists            = newAPIError(http.StatusConflict, "passkey_exists", "This passkey is already registered")
+	errPasskeyNotFound          = newAPIError(http.StatusNotFound, "passkey_not_found", "Passkey not found")
+
+	errDeletionAlreadyScheduled = newAPIError(http.StatusConflict, "deletion_already_scheduled", "Account deletion is already scheduled")
+	errDeletionNotScheduled     = newAPIError(http.StatusConflict, "deletion_not_scheduled", "Account deletion is not scheduled")
+	errSoleTeamOwner            = newAPIError(http.StatusConflict, "sole_team_owner", "Hand over or delete the teams you are the only owner of first")
+
+	errAPITokenNotFound     = newAPIError(http.StatusNotFound, "token_not_found", "Token not found")
+	errAPITokenExpired      = newAPIError(http.StatusUnauthorized, "token_expired", "Token has expired")
+	errAPITokenIPNotAllowed = newAPIError(http.StatusForbidden, "ip_not_allowed", "Token may not be used from this IP address")
+	errInsufficientScope    = newAPIError(http.StatusForbidden, "insufficient_scope", "Token scopes do not allow this request")
+
+	errReauthenticationRequired     = newAPIError(http.StatusUnauthorized, "reauthentication_required", "Re-authenticate to continue")
+	errStrongAuthenticationRequired = newAPIError(http.StatusUnauthorized, "strong_authentication_required", "Re-authenticate with a second factor to continue")
+
+	errInvalidVerificationToken = newAPIError(http.StatusBadRequest, "invalid_verification_token", "Verification token is invalid or expired")
+
+	errRoleNotFound    = newAPIError(http.StatusNotFound, "role_not_found", "Role not found")
+	errRoleExists      = newAPIError(http.StatusConflict, "role_exists", "A role with this name already exists")
+	errRoleNotAssigned = newAPIError(http.StatusNotFound, "role_not_assigned", "User does not have this role")
+
+	errOrganizationNotFound      = newAPIError(http.StatusNotFound, "organization_not_found", "Organization not found")
+	errSlugTaken                 = newAPIError(http.StatusConflict, "slug_taken", "An organization with this slug already exists")
+	errNotOrganizationMember     = newAPIError(http.StatusForbidden, "not_organization_member", "User is not a member of this organization")
+	errOrganizationAdminRequired = newAPIError(http.StatusForbidden, "organization_admin_required", "Organization admin role required")
+	errAlreadyMember             = newAPIError(http.StatusConflict, "already_member", "User is already a member of this organization")
+	errInvitationNotFound        = newAPIError(http.StatusNotFound, "invitation_not_found", "Invitation not found")
+	errInvalidInvitation         = newAPIError(http.StatusBadRequest, "invalid_invitation", "Invitation is invalid, expired or already accepted")
+	errInvitationEmailMismatch   = newAPIError(http.StatusForbidden, "invitation_email_mismatch", "Invitation was sent to a different email address")
+
+	errTeamNotFound        = newAPIError(http.StatusNotFound, "team_not_found", "Team not found")
+	errTeamMemberNotFound  = newAPIError(http.StatusNotFound, "team_member_not_found", "Developer is not a member of this team")
+	errTeamRoleRequired    = newAPIError(http.StatusForbidden, "insufficient_team_role", "Your team role does not allow this")
+	errAlreadyTeamMember   = newAPIError(http.StatusConflict, "already_team_member", "Developer is already a member of this team")
+	errLastTeamOwner       = newAPIError(http.StatusConflict, "last_team_owner", "A team must keep at least one owner")
+	errTeamHasApplications = newAPIError(http.StatusConflict, "team_has_applications", "Move or delete the team's applications first")
+
+	errWebhookNotFound         = newAPIError(http.StatusNotFound, "webhook_not_found", "Webhook not found")
+	errWebhookDeliveryNotFound = newAPIError(http.StatusNotFound, "webhook_delivery_not_found", "Webhook delivery not found")
+	errTooManyWebhooks         = newAPIError(http.StatusConflict, "too_many_webhooks", "Application has the maximum number of webhooks")
+
+	errAuthRequired       = newAPIError(http.StatusUnauthorized, "authorization_required", "Authorization header required")
+	errInvalidAuthHeader  = newAPIError(http.StatusUnauthorized, "invalid_authorization_header", "Invalid authorization header format")
+	errInvalidToken       = newAPIError(http.StatusUnauthorized, "invalid_token", "Invalid token")
+	errTokenRevoked       = newAPIError(http.StatusUnauthorized, "token_revoked", "Token has been revoked")
+	errInvalidClaims      = newAPIError(http.StatusUnauthorized, "invalid_token_claims", "Invalid token claims")
+	errMissingAuthHeaders = newAPIError(http.StatusUnauthorized, "missing_auth_headers", "Missing authentication headers")
+	errInvalidPublicKey   = newAPIError(http.StatusUnauthorized, "invalid_public_key", "Invalid public key")
+	errInvalidSignature   = newAPIError(http.StatusUnauthorized, "invalid_signature", "Invalid signature")
+)
+
+// internalError reports an unexpected server-side failure
+func internalError(message string) *apiError {
+	return newAPIError(http.StatusInternalServerError, "internal_error", message)
+}
+
+// validationError reports one or more invalid request fields
+func validationError(fields []FieldError) *apiError {
+	return &apiError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: "Validation failed",
+		Fields:  fields,
+	}
+}
+
+// problemDetails is the RFC 7807 representation of an apiError
+type problemDetails struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// wantsProblemJSON reports whether the client opted in to RFC 7807 bodies
+func wantsProblemJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/problem+json")
+}
+
+// writeError writes err as an APIResponse, or as application/problem+json
+// when the client asked for it in the Accept header
+func writeError(w http.ResponseWriter, r *http.Request, err *apiError) {
+	if wantsProblemJSON(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(err.Status)
+		json.NewEncoder(w).Encode(problemDetails{
+			Type:   "about:blank",
+			Title:  http.StatusText(err.Status),
+			Status: err.Status,
+			Detail: err.Message,
+			Code:   err.Code,
+			Errors: err.Fields,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: false,
+		Error:   err.Message,
+		Code:    err.Code,
+		Errors:  err.Fields,
+	})
+}
+
+// writeData writes a successful APIResponse with the given status
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/users/me", nil)
+	rec := httptest.NewRecorder()
+	writeError(rec, req, errSessionExpired)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401; got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json; got %q", ct)
+	}
+	var resp APIResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding response body. Err: %v", err)
+	}
+	if resp.Success || resp.Code != "session_expired" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestWriteErrorProblemJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/users/register", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	rec := httptest.NewRecorder()
+	writeError(rec, req, validationError([]FieldError{{Field: "email", Code: codeRequired, Message: "email is required"}}))
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422; got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected application/problem+json; got %q", ct)
+	}
+	var problem problemDetails
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatalf("error decoding response body. Err: %v", err)
+	}
+	if problem.Status != http.StatusUnprocessableEntity || problem.Code != "validation_failed" || len(problem.Errors) != 1 {
+		t.Errorf("unexpected problem %+v", problem)
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// exportFlushInterval is how many rows are written between flushes when
+// streaming a bulk export
+const exportFlushInterval = 500
+
+// exportSession is a session without its bearer token, which is a credential
+// rather than personal data
+type exportSession struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// userArchive is the full record of one user returned by the export endpoint
+type userArchive struct {
+	ExportedAt  time.Time       `json:"exportedAt"`
+	Application exportAppInfo   `json:"application"`
+	User        *database.User  `json:"user"`
+	Sessions    []exportSession `json:"sessions"`
+	Roles       []database.Role `json:"roles"`
+
+	Organizations []database.UserOrganization `json:"organizations"`
+	LoginHistory  []database.LoginAttempt     `json:"loginHistory"`
+	KnownDevices  []database.KnownDevice      `json:"knownDevices"`
+}
+
+type exportAppInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// emailHash identifies an erased user's address without retaining it
+func emailHash(email string) string {
+	return hashToken(strings.ToLower(email))
+}
+
+// applicationUser loads the {userId} user of app, writing an error response
+// and returning false if it does not exist
+func (s *Server) applicationUser(w http.ResponseWriter, r *http.Request, app *database.Application) (*database.User, bool) {
+	user, err := s.db.GetApplicationUser(app.ID, chi.URLParam(r, "userId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user"))
+		return nil, false
+	}
+	if user == nil {
+		writeError(w, r, errUserNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *Server) handleExportUser(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+
+	sessions, err := s.db.GetSessionsByUserID(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch sessions"))
+		return
+	}
+
+	roles, err := s.db.GetUserRoles(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user roles"))
+		return
+	}
+
+	orgs, err := s.db.GetUserOrganizations(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch organizations"))
+		return
+	}
+
+	history, err := s.db.GetLoginAttempts(user.ID, 0, maxLoginHistoryMaxPerUser)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch login history"))
+		return
+	}
+
+	devices, err := s.db.GetKnownDevices(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch known devices"))
+		return
+	}
+
+	archive := userArchive{
+		ExportedAt:  time.Now().UTC(),
+		Application: exportAppInfo{ID: app.ID, Name: app.Name},
+		User:        user,
+		Sessions:    []exportSession{},
+		Roles:       roles,
+
+		Organizations: orgs,
+		LoginHistory:  history,
+		KnownDevices:  devices,
+	}
+	for _, session := range sessions {
+		archive.Sessions = append(archive.Sessions, exportSession{
+			ID:        session.ID,
+			ExpiresAt: session.ExpiresAt,
+			CreatedAt: session.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="user-`+user.ID+`.json"`)
+	writeData(w, http.StatusOK, archive)
+}
+
+// handleExportUsers streams every user of the application as JSON lines
+// (the default) or CSV, selected with ?format=
+func (s *Server) handleExportUsers(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" {
+		writeError(w, r, validationError([]FieldError{{
+			Field: "format", Code: "invalid_format", Message: "format must be jsonl or csv",
+		}}))
+		return
+	}
+
+	// Large exports outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	filename := "users-" + app.ID + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var write func(*database.User) error
+	var flush func() error
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "email", "first_name", "last_name", "created_at"})
+		write = func(u *database.User) error {
+			return cw.Write([]string{u.ID, u.Email, u.FirstName, u.LastName, u.CreatedAt.UTC().Format(time.RFC3339)})
+		}
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(u *database.User) error { return enc.Encode(u) }
+		flush = rc.Flush
+	}
+
+	count := 0
+	err := s.db.StreamUsersByApplicationID(app.ID, func(u *database.User) error {
+		if err := write(u); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushInterval == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent, so the truncated body is all the client gets
+		log.Printf("user export for application %s failed after %d rows: %v", app.ID, count, err)
+		return
+	}
+	flush()
+}
+
+// handleEraseUser permanently deletes a user and their sessions, leaving an
+// erasure record behind
+func (s *Server) handleEraseUser(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, user)
+
+	record := &database.ErasureRecord{
+		ID:            uuid.New().String(),
+		ApplicationID: app.ID,
+		UserID:        user.ID,
+		EmailHash:     emailHash(user.Email),
+		ErasedBy:      r.Context().Value("developerID").(string),
+	}
+
+	if err := s.db.EraseUser(record, newEvent(app.ID, eventUserDeleted, newUserDeletedData(record))); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to erase user"))
+		return
+	}
+
+	record.ErasedAt = time.Now().UTC()
+	writeData(w, http.StatusOK, record)
+}
+
+func (s *Server) handleGetErasureRecords(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	records, err := s.db.GetErasureRecords(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch erasure records"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"erasures": records,
+		"count":    len(records),
+	})
+}
@@ -0,0 +1,242 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExportServer seeds app-1 of dev-1 with Ada, user-1, who has a session,
+// a role, an organization, a login and a known device, and Grace, user-2
+func newExportServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-1", "dev-1")
+	ada := seedUser(t, s, "app-1", "user-1", "Ada@Example.com")
+	grace := seedUser(t, s, "app-1", "user-2", "grace@example.com")
+	grace.FirstName, grace.LastName = "Grace", "Hopper"
+	if err := s.db.UpdateUserProfile(grace); err != nil {
+		t.Fatal(err)
+	}
+
+	seedSession(t, s, ada, "session-1")
+	if err := s.db.CreateRole(&database.Role{ID: "role-1", ApplicationID: "app-1", Name: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AssignRole("app-1", "user-1", "role-1"); err != nil {
+		t.Fatal(err)
+	}
+	err := s.db.CreateOrganization(&database.Organization{ID: "org-1", ApplicationID: "app-1", Name: "Org", Slug: "org"},
+		&database.OrganizationMember{OrganizationID: "org-1", UserID: "user-1", ApplicationID: "app-1", Role: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.RecordLoginAttempt(&database.LoginAttempt{ApplicationID: "app-1", UserID: "user-1", Success: true,
+		Method: database.AuthMethodPassword, IP: "203.0.113.7"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.SaveKnownDevice(&database.KnownDevice{UserID: "user-1", ApplicationID: "app-1", DeviceHash: "device",
+		LastIP: "203.0.113.7", FirstSeenAt: time.Now(), LastSeenAt: time.Now()}, 10); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestExportUser(t *testing.T) {
+	s := newExportServer(t)
+	w := serveAs(s.handleExportUser, "/api/applications/{id}/users/{userId}/export", http.MethodGet,
+		"/api/applications/app-1/users/user-1/export", "", "dev-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="user-user-1.json"` {
+		t.Errorf("unexpected Content-Disposition %q", got)
+	}
+	if strings.Contains(w.Body.String(), "session-1-token") {
+		t.Error("expected session tokens to be left out of the export")
+	}
+
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"exportedAt", "application", "user", "sessions", "roles", "organizations", "loginHistory", "knownDevices"} {
+		if len(resp.Data[section]) == 0 || string(resp.Data[section]) == "null" || string(resp.Data[section]) == "[]" {
+			t.Errorf("expected the %s section to be filled; got %s", section, resp.Data[section])
+		}
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	s := newExportServer(t)
+	created := loadUser(t, s, "user-1").CreatedAt.UTC().Format(time.RFC3339)
+
+	w := serveAs(s.handleExportUsers, "/api/applications/{id}/users/export", http.MethodGet,
+		"/api/applications/app-1/users/export", "", "dev-1")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected a JSON lines export; got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per user; got %q", w.Body.String())
+	}
+	var user database.User
+	if err := json.Unmarshal([]byte(lines[1]), &user); err != nil || user.ID != "user-2" {
+		t.Errorf("expected the second line to be user-2; got %q, %v", lines[1], err)
+	}
+
+	w = serveAs(s.handleExportUsers, "/api/applications/{id}/users/export", http.MethodGet,
+		"/api/applications/app-1/users/export?format=csv", "", "dev-1")
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user-1", "Ada@Example.com", "Ada", "Lovelace", created}
+	if len(rows) != 3 || rows[0][0] != "id" || strings.Join(rows[1], ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected CSV export %v", rows)
+	}
+
+	w = serveAs(s.handleExportUsers, "/api/applications/{id}/users/export", http.MethodGet,
+		"/api/applications/app-1/users/export?format=xml", "", "dev-1")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid_format") {
+		t.Errorf("expected an unknown format to be rejected; got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	s := newExportServer(t)
+	ada := loadUser(t, s, "user-1")
+	grace := loadUser(t, s, "user-2")
+	for _, inv := range []*database.OrganizationInvitation{
+		{ID: "inv-to", Email: ada.Email, InvitedBy: "user-2"},
+		{ID: "inv-from", Email: "charles@example.com", InvitedBy: "user-1"},
+		{ID: "inv-other", Email: "charles@example.com", InvitedBy: "user-2"},
+	} {
+		inv.OrganizationID, inv.ApplicationID, inv.Role = "org-1", "app-1", "member"
+		inv.TokenHash, inv.ExpiresAt = hashToken(inv.ID), time.Now().Add(time.Hour)
+		if err := s.db.CreateOrganizationInvitation(inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Events about both users, one of which was already queued for a webhook
+	if err := s.db.UpdateUserProfile(ada, newEvent("app-1", eventUserUpdated, ada)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.UpdateUserProfile(grace, newEvent("app-1", eventUserUpdated, grace)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.CreateWebhookEndpoint(&database.WebhookEndpoint{ID: "hook-1", ApplicationID: "app-1",
+		URL: "https://app.example.com/hook", Secret: "secret", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	queued := pendingEvents(t, s)[0]
+	if err := s.db.CreateWebhookDeliveries([]database.WebhookDelivery{{ID: "delivery-1", EndpointID: "hook-1",
+		ApplicationID: "app-1", EventID: queued.ID, EventType: queued.Type, Payload: queued.Payload,
+		Status: database.WebhookDeliveryPending}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveAs(s.handleEraseUser, "/api/applications/{id}/users/{userId}", http.MethodDelete,
+		"/api/applications/app-1/users/user-1", "", "dev-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+
+	records, err := s.db.GetErasureRecords("app-1")
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected an erasure record to be written; got %v %v", records, err)
+	}
+	record := records[0]
+	if record.UserID != "user-1" || record.ErasedBy != "dev-1" || record.ID == "" || record.SessionsDeleted != 1 {
+		t.Errorf("unexpected erasure record %+v", record)
+	}
+	if record.EmailHash != hashToken("ada@example.com") {
+		t.Errorf("expected the hash of the lowercased email; got %s", record.EmailHash)
+	}
+	if strings.Contains(w.Body.String(), "Ada@Example.com") {
+		t.Error("expected the email to be left out of the erasure record")
+	}
+	if u, _ := s.db.GetUserByID("user-1"); u != nil {
+		t.Error("expected the user to be deleted")
+	}
+
+	invitations, err := s.db.GetOrganizationInvitations("org-1")
+	if err != nil || len(invitations) != 1 || invitations[0].ID != "inv-other" {
+		t.Errorf("expected only the invitation not involving the user to be kept; got %+v %v", invitations, err)
+	}
+
+	events := pendingEvents(t, s)
+	if got := eventTypes(events); got != "user.updated,user.updated,user.deleted" {
+		t.Fatalf("expected the earlier events to be kept and a user.deleted event; got %s", got)
+	}
+	if strings.Contains(string(events[0].Payload), "Ada") || !strings.Contains(string(events[0].Payload), `"data":{"userId":"user-1"}`) {
+		t.Errorf("expected the event about the user to keep only their ID; got %s", events[0].Payload)
+	}
+	if !strings.Contains(string(events[1].Payload), "grace@example.com") {
+		t.Errorf("expected events about other users to be left alone; got %s", events[1].Payload)
+	}
+	delivery, err := s.db.GetWebhookDelivery("hook-1", "delivery-1")
+	if err != nil || delivery == nil || strings.Contains(string(delivery.Payload), "Ada") {
+		t.Errorf("expected the queued webhook payload to be scrubbed; got %+v %v", delivery, err)
+	}
+}
+
+func TestExportAndEraseNotFound(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*Server) http.HandlerFunc
+		pattern string
+		method  string
+		path    string
+		code    string
+	}{
+		{"export unknown user", func(s *Server) http.HandlerFunc { return s.handleExportUser },
+			"/api/applications/{id}/users/{userId}/export", http.MethodGet, "/api/applications/app-1/users/user-9/export", "user_not_found"},
+		{"export unknown application", func(s *Server) http.HandlerFunc { return s.handleExportUser },
+			"/api/applications/{id}/users/{userId}/export", http.MethodGet, "/api/applications/app-9/users/user-1/export", "app_not_found"},
+		{"bulk export unknown application", func(s *Server) http.HandlerFunc { return s.handleExportUsers },
+			"/api/applications/{id}/users/export", http.MethodGet, "/api/applications/app-9/users/export", "app_not_found"},
+		{"erase unknown user", func(s *Server) http.HandlerFunc { return s.handleEraseUser },
+			"/api/applications/{id}/users/{userId}", http.MethodDelete, "/api/applications/app-1/users/user-9", "user_not_found"},
+		{"erasures of unknown application", func(s *Server) http.HandlerFunc { return s.handleGetErasureRecords },
+			"/api/applications/{id}/erasures", http.MethodGet, "/api/applications/app-9/erasures", "app_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newExportServer(t)
+			w := serveAs(tt.handler(s), tt.pattern, tt.method, tt.path, "", "dev-1")
+			if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected 404 %s; got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+			if records, _ := s.db.GetErasureRecords("app-1"); len(records) != 0 {
+				t.Error("expected nothing to be erased")
+			}
+		})
+	}
+}
+
+func TestGetErasureRecords(t *testing.T) {
+	s := newExportServer(t)
+	user := seedUser(t, s, "app-1", "user-3", "charles@example.com")
+	record := &database.ErasureRecord{ID: "erasure-1", ApplicationID: "app-1", UserID: user.ID, EmailHash: "hash", ErasedBy: "dev-1"}
+	if err := s.db.EraseUser(record); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveAs(s.handleGetErasureRecords, "/api/applications/{id}/erasures", http.MethodGet,
+		"/api/applications/app-1/erasures", "", "dev-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"erasure-1"`) || !strings.Contains(w.Body.String(), `"count":1`) {
+		t.Errorf("expected the erasure record to be listed; got %s", w.Body.String())
+	}
+}
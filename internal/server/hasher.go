@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher hashes passwords into a self-describing encoded string that
+// records the algorithm and parameters used, so hashes produced with older
+// settings can still be verified.
+type PasswordHasher interface {
+	// Name is the algorithm identifier, e.g. "argon2id"
+	Name() string
+	// Hash returns the encoded hash of password
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// Recognizes reports whether encoded was produced by this algorithm
+	Recognizes(encoded string) bool
+	// NeedsRehash reports whether encoded uses parameters other than the
+	// hasher's current ones
+	NeedsRehash(encoded string) bool
+}
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+// newPasswordHasher returns the hasher for the named algorithm with its
+// recommended parameters
+func newPasswordHasher(name string) (PasswordHasher, error) {
+	switch name {
+	case "", "argon2id":
+		return defaultArgon2idHasher, nil
+	case "scrypt":
+		return defaultScryptHasher, nil
+	case "bcrypt":
+		return defaultBcryptHasher, nil
+	}
+	return nil, fmt.Errorf("unsupported password hash algorithm %q", name)
+}
+
+var (
+	defaultArgon2idHasher = &argon2idHasher{time: 3, memory: 64 * 1024, threads: 2, keyLen: 32, saltLen: 16}
+	defaultScryptHasher   = &scryptHasher{logN: 15, r: 8, p: 1, keyLen: 32, saltLen: 16}
+	defaultBcryptHasher   = &bcryptHasher{cost: bcrypt.DefaultCost}
+
+	// knownHashers are consulted in order to verify stored hashes
+	knownHashers = []PasswordHasher{defaultArgon2idHasher, defaultScryptHasher, defaultBcryptHasher}
+)
+
+// hashPassword hashes password with the server's default hasher
+func (s *Server) hashPassword(password string) (string, error) {
+	return s.hasher.Hash(password)
+}
+
+// verifyPassword checks password against an encoded hash of any known or
+// imported algorithm. rehash is true when the password matched but the hash
+// should be replaced with one from the default hasher.
+func (s *Server) verifyPassword(password, encoded string) (ok, rehash bool, err error) {
+	for _, h := range knownHashers {
+		if !h.Recognizes(encoded) {
+			continue
+		}
+		ok, err := h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		rehash = h.Name() != s.hasher.Name() || s.hasher.NeedsRehash(encoded)
+		return true, rehash, nil
+	}
+	for _, v := range importedHashVerifiers {
+		if !v.Recognizes(encoded) {
+			continue
+		}
+		ok, err := v.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+	return false, false, errUnknownHashFormat
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// phcEncoding is the unpadded base64 used by the PHC string format
+var phcEncoding = base64.RawStdEncoding
+
+// argon2idHasher produces PHC strings such as
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+func (h *argon2idHasher) Name() string { return "argon2id" }
+
+func (h *argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.saltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// decode parses an encoded hash into its parameters, salt and key
+func (h *argon2idHasher) decode(encoded string) (params argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	if salt, err = phcEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, err
+	}
+	if key, err = phcEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, err
+	}
+	params.keyLen = uint32(len(key))
+	params.saltLen = len(salt)
+	return params, salt, key, nil
+}
+
+func (h *argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.decode(encoded)
+	return err != nil || params != *h
+}
+
+// scryptHasher produces PHC strings such as $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+type scryptHasher struct {
+	logN    int
+	r       int
+	p       int
+	keyLen  int
+	saltLen int
+}
+
+func (h *scryptHasher) Name() string { return "scrypt" }
+
+func (h *scryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+func (h *scryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.saltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.logN, h.r, h.p, h.keyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.logN, h.r, h.p,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+func (h *scryptHasher) decode(encoded string) (params scryptHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.logN, &params.r, &params.p); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid scrypt parameters: %w", err)
+	}
+	if params.logN < 1 || params.logN > 30 {
+		return params, nil, nil, fmt.Errorf("invalid scrypt cost ln=%d", params.logN)
+	}
+	if salt, err = phcEncoding.DecodeString(parts[3]); err != nil {
+		return params, nil, nil, err
+	}
+	if key, err = phcEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, err
+	}
+	params.keyLen = len(key)
+	params.saltLen = len(salt)
+	return params, salt, key, nil
+}
+
+func (h *scryptHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<params.logN, params.r, params.p, params.keyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *scryptHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.decode(encoded)
+	return err != nil || params != *h
+}
+
+// bcryptHasher uses bcrypt's own modular crypt format, which already records
+// the cost
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Name() string { return "bcrypt" }
+
+func (h *bcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (h *bcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
@@ -0,0 +1,62 @@
+package server
+
+import "testing"
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := []PasswordHasher{
+		&argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16},
+		&scryptHasher{logN: 10, r: 8, p: 1, keyLen: 32, saltLen: 16},
+		&bcryptHasher{cost: 4},
+	}
+	for _, h := range hashers {
+		encoded, err := h.Hash("hunter22")
+		if err != nil {
+			t.Fatalf("%s: error hashing password. Err: %v", h.Name(), err)
+		}
+		if !h.Recognizes(encoded) {
+			t.Errorf("%s: does not recognize its own hash %q", h.Name(), encoded)
+		}
+		if ok, err := h.Verify("hunter22", encoded); err != nil || !ok {
+			t.Errorf("%s: expected password to verify; got %v, %v", h.Name(), ok, err)
+		}
+		if ok, _ := h.Verify("hunter23", encoded); ok {
+			t.Errorf("%s: expected wrong password to fail", h.Name())
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%s: fresh hash should not need rehashing", h.Name())
+		}
+	}
+}
+
+func TestVerifyPasswordRehash(t *testing.T) {
+	s := &Server{hasher: &argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16}}
+
+	legacy, err := (&bcryptHasher{cost: 4}).Hash("hunter22")
+	if err != nil {
+		t.Fatalf("error hashing password. Err: %v", err)
+	}
+	ok, rehash, err := s.verifyPassword("hunter22", legacy)
+	if err != nil || !ok || !rehash {
+		t.Errorf("expected bcrypt hash to verify and need rehash; got %v, %v, %v", ok, rehash, err)
+	}
+
+	weaker, err := (&argon2idHasher{time: 1, memory: 512, threads: 1, keyLen: 32, saltLen: 16}).Hash("hunter22")
+	if err != nil {
+		t.Fatalf("error hashing password. Err: %v", err)
+	}
+	if _, rehash, _ := s.verifyPassword("hunter22", weaker); !rehash {
+		t.Error("expected argon2id hash with outdated parameters to need rehash")
+	}
+
+	current, err := s.hashPassword("hunter22")
+	if err != nil {
+		t.Fatalf("error hashing password. Err: %v", err)
+	}
+	if _, rehash, _ := s.verifyPassword("hunter22", current); rehash {
+		t.Error("expected current hash not to need rehash")
+	}
+
+	if _, _, err := s.verifyPassword("hunter22", "plaintext"); err != errUnknownHashFormat {
+		t.Errorf("expected errUnknownHashFormat; got %v", err)
+	}
+}
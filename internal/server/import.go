@@ -0,0 +1,142 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxImportBatch caps the number of users accepted by one import request;
+// larger migrations are split into batches by the import CLI
+const maxImportBatch = 1000
+
+type importUserRecord struct {
+	Email     string           `json:"email"`
+	FirstName string           `json:"firstName"`
+	LastName  string           `json:"lastName"`
+	Password  importedPassword `json:"password"`
+}
+
+type importUsersRequest struct {
+	Users    []importUserRecord    `json:"users"`
+	Firebase *firebaseScryptConfig `json:"firebase,omitempty"`
+}
+
+// importUserError reports why the user at Index was not imported
+type importUserError struct {
+	Index   int    `json:"index"`
+	Email   string `json:"email"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type importUsersResult struct {
+	Imported int               `json:"imported"`
+	Skipped  int               `json:"skipped"`
+	Errors   []importUserError `json:"errors,omitempty"`
+}
+
+func (r importUsersRequest) validate() []FieldError {
+	var v validator
+	if len(r.Users) == 0 {
+		v.add("users", codeRequired, "users is required")
+	}
+	if len(r.Users) > maxImportBatch {
+		v.add("users", codeTooLong, "at most "+strconv.Itoa(maxImportBatch)+" users can be imported per request")
+	}
+	return v.errors
+}
+
+// validate checks a single record; imported users may lack names
+func (r importUserRecord) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	v.maxLength("firstName", r.FirstName, maxNameLength)
+	v.maxLength("lastName", r.LastName, maxNameLength)
+	return v.errors
+}
+
+// handleImportUsers creates users with password hashes exported from another
+// system. Hashes in foreign formats are replaced on each user's first login.
+func (s *Server) handleImportUsers(w http.ResponseWriter, r *http.Request) {
+	var req importUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	// First verify the app belongs to this developer
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	var result importUsersResult
+	var users []database.User
+	var indexes []int
+	seen := make(map[string]bool)
+
+	for i, rec := range req.Users {
+		if errs := rec.validate(); len(errs) > 0 {
+			result.Errors = append(result.Errors, importUserError{
+				Index: i, Email: rec.Email, Code: errs[0].Code, Message: errs[0].Message,
+			})
+			continue
+		}
+		key := strings.ToLower(rec.Email)
+		if seen[key] {
+			result.Errors = append(result.Errors, importUserError{
+				Index: i, Email: rec.Email, Code: errEmailTaken.Code, Message: "Duplicate email in import",
+			})
+			continue
+		}
+		seen[key] = true
+
+		hash, err := encodeImportedPassword(rec.Password, req.Firebase)
+		if err != nil {
+			result.Errors = append(result.Errors, importUserError{
+				Index: i, Email: rec.Email, Code: "invalid_password_hash", Message: err.Error(),
+			})
+			continue
+		}
+
+		users = append(users, database.User{
+			ID:            uuid.New().String(),
+			ApplicationID: app.ID,
+			Email:         rec.Email,
+			FirstName:     rec.FirstName,
+			LastName:      rec.LastName,
+			PasswordHash:  hash,
+		})
+		indexes = append(indexes, i)
+	}
+
+	if len(users) > 0 {
+		inserted, err := s.db.ImportUsers(users)
+		if err != nil {
+			writeError(w, r, internalError("Failed to import users"))
+			return
+		}
+		for i, ok := range inserted {
+			if ok {
+				result.Imported++
+				continue
+			}
+			result.Errors = append(result.Errors, importUserError{
+				Index: indexes[i], Email: users[i].Email, Code: errEmailTaken.Code, Message: errEmailTaken.Message,
+			})
+		}
+	}
+
+	result.Skipped = len(req.Users) - result.Imported
+	auditAfter(r, map[string]interface{}{"imported": result.Imported, "skipped": result.Skipped})
+	writeData(w, http.StatusOK, result)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// passwordVerifier checks passwords against hashes it cannot produce. Hashes
+// imported from other systems are stored in these formats and replaced with a
+// native hash the first time the user logs in.
+type passwordVerifier interface {
+	Recognizes(encoded string) bool
+	Verify(password, encoded string) (bool, error)
+}
+
+// importedHashVerifiers are consulted after knownHashers
+var importedHashVerifiers = []passwordVerifier{
+	pbkdf2Verifier{},
+	saltedSHAVerifier{},
+	firebaseScryptVerifier{},
+}
+
+// digestFuncs maps the digest names accepted on import to their constructors
+var digestFuncs = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// importedPassword describes an existing password hash supplied on import.
+// Hash and salt are base64 unless Encoding is "hex".
+type importedPassword struct {
+	Algorithm    string `json:"algorithm"`
+	Hash         string `json:"hash"`
+	Salt         string `json:"salt,omitempty"`
+	Iterations   int    `json:"iterations,omitempty"`
+	SaltPosition string `json:"saltPosition,omitempty"`
+	Encoding     string `json:"encoding,omitempty"`
+}
+
+// firebaseScryptConfig holds the project-wide parameters of Firebase's
+// modified scrypt, found in the Firebase console's password hash settings
+type firebaseScryptConfig struct {
+	SignerKey     string `json:"signerKey"`
+	SaltSeparator string `json:"saltSeparator"`
+	Rounds        int    `json:"rounds"`
+	MemCost       int    `json:"memCost"`
+}
+
+// Upper bounds on imported hash parameters. Verifying a hash costs time and
+// memory in proportion to them, so larger values would let one import make
+// every login attempt against it expensive.
+const (
+	maxPBKDF2Iterations = 10_000_000
+	// maxFirebaseMemCost is log2 of scrypt's N
+	maxFirebaseMemCost = 17
+	maxFirebaseRounds  = 32
+)
+
+// minFirebaseSignerKeyLength rejects truncated signer keys; Firebase's own
+// are 64 bytes
+const minFirebaseSignerKeyLength = 16
+
+var (
+	errMissingFirebaseConfig = errors.New("firebase scrypt hashes require the firebase hash configuration")
+	errHashLength            = errors.New("hash has the wrong length for its algorithm")
+)
+
+// checkKeyLength rejects a stored key that is not size bytes long. An empty
+// key would otherwise compare equal to an empty derived key and accept any
+// password.
+func checkKeyLength(key []byte, size int) error {
+	if size == 0 || len(key) != size {
+		return errHashLength
+	}
+	return nil
+}
+
+// decodeImportBytes decodes a hash or salt in the given encoding. Base64 may
+// be standard or URL-safe, padded or not.
+func decodeImportBytes(value, encoding string) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(value)
+	case "", "base64":
+		value = strings.TrimRight(value, "=")
+		if b, err := base64.RawStdEncoding.DecodeString(value); err == nil {
+			return b, nil
+		}
+		return base64.RawURLEncoding.DecodeString(value)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// encodeImportedPassword converts an imported hash into the encoded form
+// stored in password_hash
+func encodeImportedPassword(p importedPassword, firebase *firebaseScryptConfig) (string, error) {
+	if p.Hash == "" {
+		return "", errors.New("hash is required")
+	}
+
+	algorithm := strings.ToLower(p.Algorithm)
+	switch {
+	case algorithm == "bcrypt":
+		if _, err := bcrypt.Cost([]byte(p.Hash)); err != nil || !defaultBcryptHasher.Recognizes(p.Hash) {
+			return "", errors.New("not a bcrypt hash")
+		}
+		return p.Hash, nil
+
+	case strings.HasPrefix(algorithm, "pbkdf2-"):
+		digest := strings.TrimPrefix(algorithm, "pbkdf2-")
+		if digestFuncs[digest] == nil {
+			return "", fmt.Errorf("unsupported pbkdf2 digest %q", digest)
+		}
+		if p.Iterations < 1 {
+			return "", errors.New("iterations is required for pbkdf2")
+		}
+		if p.Iterations > maxPBKDF2Iterations {
+			return "", fmt.Errorf("iterations must be at most %d", maxPBKDF2Iterations)
+		}
+		salt, key, err := decodeSaltAndHash(p)
+		if err != nil {
+			return "", err
+		}
+		if err := checkKeyLength(key, digestFuncs[digest]().Size()); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$pbkdf2-%s$i=%d$%s$%s", digest, p.Iterations,
+			phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+
+	case digestFuncs[algorithm] != nil:
+		position := p.SaltPosition
+		if position == "" {
+			position = "prefix"
+		}
+		if position != "prefix" && position != "suffix" {
+			return "", fmt.Errorf("saltPosition must be prefix or suffix, got %q", position)
+		}
+		salt, key, err := decodeSaltAndHash(p)
+		if err != nil {
+			return "", err
+		}
+		if err := checkKeyLength(key, digestFuncs[algorithm]().Size()); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$salted-%s$pos=%s$%s$%s", algorithm, position,
+			phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+
+	case algorithm == "scrypt-firebase":
+		if firebase == nil || firebase.SignerKey == "" || firebase.Rounds < 1 || firebase.MemCost < 1 {
+			return "", errMissingFirebaseConfig
+		}
+		if firebase.MemCost > maxFirebaseMemCost || firebase.Rounds > maxFirebaseRounds {
+			return "", fmt.Errorf("firebase memCost must be at most %d and rounds at most %d",
+				maxFirebaseMemCost, maxFirebaseRounds)
+		}
+		signer, err := decodeImportBytes(firebase.SignerKey, "base64")
+		if err != nil {
+			return "", fmt.Errorf("invalid firebase signer key: %w", err)
+		}
+		if len(signer) < minFirebaseSignerKeyLength {
+			return "", fmt.Errorf("firebase signer key must be at least %d bytes", minFirebaseSignerKeyLength)
+		}
+		separator, err := decodeImportBytes(firebase.SaltSeparator, "base64")
+		if err != nil {
+			return "", fmt.Errorf("invalid firebase salt separator: %w", err)
+		}
+		salt, key, err := decodeSaltAndHash(p)
+		if err != nil {
+			return "", err
+		}
+		if err := checkKeyLength(key, len(signer)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$firebase-scrypt$ln=%d,r=%d$%s$%s$%s$%s", firebase.MemCost, firebase.Rounds,
+			phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(separator),
+			phcEncoding.EncodeToString(signer), phcEncoding.EncodeToString(key)), nil
+	}
+
+	return "", fmt.Errorf("unsupported hash algorithm %q", p.Algorithm)
+}
+
+func decodeSaltAndHash(p importedPassword) (salt, key []byte, err error) {
+	if salt, err = decodeImportBytes(p.Salt, p.Encoding); err != nil {
+		return nil, nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	if key, err = decodeImportBytes(p.Hash, p.Encoding); err != nil {
+		return nil, nil, fmt.Errorf("invalid hash: %w", err)
+	}
+	return salt, key, nil
+}
+
+// decodePHCFields splits an encoded hash and base64-decodes the fields
+// after the parameter section
+func decodePHCFields(encoded string, n int) (params []string, fields [][]byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 3+n {
+		return nil, nil, errUnknownHashFormat
+	}
+	for _, part := range parts[len(parts)-n:] {
+		b, err := phcEncoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, b)
+	}
+	return parts[1 : len(parts)-n], fields, nil
+}
+
+// pbkdf2Verifier checks $pbkdf2-<digest>$i=<iterations>$<salt>$<hash>
+type pbkdf2Verifier struct{}
+
+func (pbkdf2Verifier) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$pbkdf2-")
+}
+
+func (pbkdf2Verifier) Verify(password, encoded string) (bool, error) {
+	params, fields, err := decodePHCFields(encoded, 2)
+	if err != nil || len(params) != 2 {
+		return false, errUnknownHashFormat
+	}
+	digest := digestFuncs[strings.TrimPrefix(params[0], "pbkdf2-")]
+	var iterations int
+	if _, err := fmt.Sscanf(params[1], "i=%d", &iterations); err != nil || digest == nil ||
+		iterations < 1 || iterations > maxPBKDF2Iterations {
+		return false, errUnknownHashFormat
+	}
+	salt, key := fields[0], fields[1]
+	if checkKeyLength(key, digest().Size()) != nil {
+		return false, errUnknownHashFormat
+	}
+	other := pbkdf2.Key([]byte(password), salt, iterations, len(key), digest)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// saltedSHAVerifier checks $salted-<digest>$pos=<prefix|suffix>$<salt>$<hash>,
+// a single digest over the salt and password concatenated
+type saltedSHAVerifier struct{}
+
+func (saltedSHAVerifier) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$salted-")
+}
+
+func (saltedSHAVerifier) Verify(password, encoded string) (bool, error) {
+	params, fields, err := decodePHCFields(encoded, 2)
+	if err != nil || len(params) != 2 {
+		return false, errUnknownHashFormat
+	}
+	digest := digestFuncs[strings.TrimPrefix(params[0], "salted-")]
+	if digest == nil {
+		return false, errUnknownHashFormat
+	}
+	salt, key := fields[0], fields[1]
+	if checkKeyLength(key, digest().Size()) != nil {
+		return false, errUnknownHashFormat
+	}
+
+	h := digest()
+	switch params[1] {
+	case "pos=prefix":
+		h.Write(salt)
+		h.Write([]byte(password))
+	case "pos=suffix":
+		h.Write([]byte(password))
+		h.Write(salt)
+	default:
+		return false, errUnknownHashFormat
+	}
+	return subtle.ConstantTimeCompare(key, h.Sum(nil)) == 1, nil
+}
+
+// firebaseScryptVerifier checks Firebase's modified scrypt, stored as
+// $firebase-scrypt$ln=<mem cost>,r=<rounds>$<salt>$<separator>$<signer key>$<hash>
+type firebaseScryptVerifier struct{}
+
+func (firebaseScryptVerifier) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$firebase-scrypt$")
+}
+
+func (firebaseScryptVerifier) Verify(password, encoded string) (bool, error) {
+	params, fields, err := decodePHCFields(encoded, 4)
+	if err != nil || len(params) != 2 {
+		return false, errUnknownHashFormat
+	}
+	var memCost, rounds int
+	if _, err := fmt.Sscanf(params[1], "ln=%d,r=%d", &memCost, &rounds); err != nil ||
+		memCost < 1 || memCost > maxFirebaseMemCost || rounds < 1 || rounds > maxFirebaseRounds {
+		return false, errUnknownHashFormat
+	}
+	salt, separator, signer, key := fields[0], fields[1], fields[2], fields[3]
+	if len(signer) < minFirebaseSignerKeyLength || checkKeyLength(key, len(signer)) != nil {
+		return false, errUnknownHashFormat
+	}
+
+	derived, err := scrypt.Key([]byte(password), append(salt, separator...), 1<<memCost, rounds, 1, 32)
+	if err != nil {
+		return false, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return false, err
+	}
+	other := make([]byte, len(signer))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(other, signer)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestImportedPasswordHashes(t *testing.T) {
+	s := &Server{hasher: defaultBcryptHasher}
+
+	salt := []byte("0123456789abcdef")
+	pbkdf2Key := pbkdf2.Key([]byte("hunter22"), salt, 1000, 32, sha256.New)
+	saltedSum := sha256.Sum256(append([]byte("hunter22"), salt...))
+
+	tests := []struct {
+		name     string
+		password importedPassword
+		firebase *firebaseScryptConfig
+		plain    string
+	}{
+		{
+			name: "pbkdf2",
+			password: importedPassword{
+				Algorithm:  "pbkdf2-sha256",
+				Hash:       base64.StdEncoding.EncodeToString(pbkdf2Key),
+				Salt:       base64.StdEncoding.EncodeToString(salt),
+				Iterations: 1000,
+			},
+			plain: "hunter22",
+		},
+		{
+			name: "salted sha256 hex",
+			password: importedPassword{
+				Algorithm:    "sha256",
+				Hash:         hex.EncodeToString(saltedSum[:]),
+				Salt:         hex.EncodeToString(salt),
+				SaltPosition: "suffix",
+				Encoding:     "hex",
+			},
+			plain: "hunter22",
+		},
+		{
+			// Example from the Firebase scrypt reference implementation
+			name: "firebase scrypt",
+			password: importedPassword{
+				Algorithm: "scrypt-firebase",
+				Hash:      "lSrfV15cpx95/sZS2W9c9Kp6i/LVgQNDNC/qzrCnh1SAyZvqmZqAjTdn3aoItz+VHjoZilo78198JAdRuid5lQ==",
+				Salt:      "42xEC+ixf3L2lw==",
+			},
+			firebase: &firebaseScryptConfig{
+				SignerKey:     "jxspr8Ki0RYycVU8zykbdLGjFQ3McFUH0uiiTvC8pVMXAn210wjLNmdZJzxUECKbm0QsEmYUSDzZvpjeJ9WmXA==",
+				SaltSeparator: "Bw==",
+				Rounds:        8,
+				MemCost:       14,
+			},
+			plain: "user1password",
+		},
+	}
+	for _, tt := range tests {
+		encoded, err := encodeImportedPassword(tt.password, tt.firebase)
+		if err != nil {
+			t.Fatalf("%s: error encoding imported hash. Err: %v", tt.name, err)
+		}
+		ok, rehash, err := s.verifyPassword(tt.plain, encoded)
+		if err != nil || !ok || !rehash {
+			t.Errorf("%s: expected password to verify and need rehash; got %v, %v, %v", tt.name, ok, rehash, err)
+		}
+		if ok, _, _ := s.verifyPassword("wrong password", encoded); ok {
+			t.Errorf("%s: expected wrong password to fail", tt.name)
+		}
+	}
+}
+
+func TestEncodeImportedPasswordErrors(t *testing.T) {
+	tests := []importedPassword{
+		{Algorithm: "md5", Hash: "abc"},
+		{Algorithm: "bcrypt", Hash: "not-bcrypt"},
+		{Algorithm: "pbkdf2-sha256", Hash: "YWJj", Salt: "YWJj"},
+		{Algorithm: "scrypt-firebase", Hash: "YWJj", Salt: "YWJj"},
+	}
+	for _, p := range tests {
+		if _, err := encodeImportedPassword(p, nil); err == nil {
+			t.Errorf("expected an error for %+v", p)
+		}
+	}
+}
+
+func TestImportedHashParameterLimits(t *testing.T) {
+	key32 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	key64 := base64.StdEncoding.EncodeToString(make([]byte, 64))
+
+	pbkdf2 := importedPassword{Algorithm: "pbkdf2-sha256", Hash: key32, Salt: "YWJj", Iterations: maxPBKDF2Iterations + 1}
+	if _, err := encodeImportedPassword(pbkdf2, nil); err == nil {
+		t.Error("expected too many pbkdf2 iterations to be rejected on import")
+	}
+
+	firebase := importedPassword{Algorithm: "scrypt-firebase", Hash: key64, Salt: "YWJj"}
+	configs := []firebaseScryptConfig{
+		{SignerKey: key64, MemCost: maxFirebaseMemCost + 1, Rounds: 8},
+		{SignerKey: key64, MemCost: 14, Rounds: maxFirebaseRounds + 1},
+	}
+	for _, config := range configs {
+		if _, err := encodeImportedPassword(firebase, &config); err == nil {
+			t.Errorf("expected %+v to be rejected on import", config)
+		}
+	}
+
+	// Stored hashes are checked too, in case they were written some other way
+	phc32 := phcEncoding.EncodeToString(make([]byte, 32))
+	phc64 := phcEncoding.EncodeToString(make([]byte, 64))
+	stored := []string{
+		"$pbkdf2-sha256$i=10000001$YWJj$" + phc32,
+		"$firebase-scrypt$ln=18,r=8$YWJj$YWJj$" + phc64 + "$" + phc64,
+		"$firebase-scrypt$ln=14,r=33$YWJj$YWJj$" + phc64 + "$" + phc64,
+		"$firebase-scrypt$ln=14,r=0$YWJj$YWJj$" + phc64 + "$" + phc64,
+	}
+	s := &Server{}
+	for _, encoded := range stored {
+		if ok, _, err := s.verifyPassword("password", encoded); ok || err == nil {
+			t.Errorf("expected %s to be refused; got %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestImportedHashKeyLength(t *testing.T) {
+	key64 := base64.StdEncoding.EncodeToString(make([]byte, 64))
+	firebase := &firebaseScryptConfig{SignerKey: key64, SaltSeparator: "Bw==", Rounds: 8, MemCost: 14}
+
+	imports := []struct {
+		name     string
+		password importedPassword
+		firebase *firebaseScryptConfig
+	}{
+		{"empty pbkdf2 hash", importedPassword{Algorithm: "pbkdf2-sha256", Hash: "=", Salt: "YWJj", Iterations: 1000}, nil},
+		{"short pbkdf2 hash", importedPassword{Algorithm: "pbkdf2-sha256", Hash: "YWJj", Salt: "YWJj", Iterations: 1000}, nil},
+		{"short salted hash", importedPassword{Algorithm: "sha1", Hash: "YWJj", Salt: "YWJj"}, nil},
+		{"empty firebase hash", importedPassword{Algorithm: "scrypt-firebase", Hash: "=", Salt: "YWJj"}, firebase},
+		{"empty firebase signer", importedPassword{Algorithm: "scrypt-firebase", Hash: "=", Salt: "YWJj"},
+			&firebaseScryptConfig{SignerKey: "=", Rounds: 8, MemCost: 14}},
+		{"bcrypt prefix only", importedPassword{Algorithm: "bcrypt", Hash: "$2a$"}, nil},
+		{"truncated bcrypt", importedPassword{Algorithm: "bcrypt", Hash: "$2a$10$abcdefghijklmnopqrstuv"}, nil},
+	}
+	for _, tt := range imports {
+		if encoded, err := encodeImportedPassword(tt.password, tt.firebase); err == nil {
+			t.Errorf("%s: expected the import to be rejected; got %s", tt.name, encoded)
+		}
+	}
+
+	// An empty key must not verify every password
+	stored := []string{
+		"$pbkdf2-sha256$i=1000$YWJj$",
+		"$salted-sha256$pos=prefix$YWJj$",
+		"$firebase-scrypt$ln=14,r=8$YWJj$Bw$$",
+	}
+	s := &Server{}
+	for _, encoded := range stored {
+		if ok, _, err := s.verifyPassword("anything", encoded); ok || err == nil {
+			t.Errorf("expected %s to be refused; got %v, %v", encoded, ok, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+const janitorInterval = time.Hour
+
+// janitorTask deletes expired rows, returning how many it deleted
+type janitorTask struct {
+	name string
+	run  func() (int, error)
+}
+
+// janitor runs its tasks on start and then every janitorInterval, until
+// stopped
+type janitor struct {
+	tasks   []janitorTask
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newJanitor(tasks ...janitorTask) *janitor {
+	return &janitor{
+		tasks:   tasks,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// stop ends run after the task in progress, if any
+func (j *janitor) stop() {
+	close(j.done)
+	<-j.stopped
+}
+
+func (j *janitor) run() {
+	defer close(j.stopped)
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, task := range j.tasks {
+			if n, err := task.run(); err != nil {
+				log.Printf("failed to clean up %s: %v", task.name, err)
+			} else if n > 0 {
+				log.Printf("cleaned up %d %s", n, task.name)
+			}
+		}
+
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
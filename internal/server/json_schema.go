@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Schema violation codes returned in FieldError.Code
+const (
+	codeInvalidType     = "invalid_type"
+	codeNotInEnum       = "not_in_enum"
+	codeTooShort        = "too_short"
+	codePatternMismatch = "pattern_mismatch"
+	codeUnknownProperty = "unknown_property"
+)
+
+// jsonSchema is the subset of JSON Schema supported for validating user
+// metadata: type, enum, properties, required, additionalProperties, items,
+// minLength, maxLength, pattern, minimum, maximum, minItems and maxItems.
+// Annotation keywords such as title are accepted and ignored; any other
+// keyword is rejected so a schema never silently checks less than it says.
+type jsonSchema struct {
+	types                []string
+	enum                 []interface{}
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	noAdditional         bool
+	items                *jsonSchema
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+	minItems, maxItems   *int
+}
+
+// schemaAnnotations are keywords that carry no validation meaning
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true,
+	"title": true, "description": true, "default": true, "examples": true,
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// compileSchema parses a JSON Schema document
+func compileSchema(raw json.RawMessage) (*jsonSchema, error) {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keywords); err != nil {
+		return nil, fmt.Errorf("schema must be a JSON object")
+	}
+
+	s := &jsonSchema{}
+	for key, value := range keywords {
+		var err error
+		switch key {
+		case "type":
+			err = s.parseType(value)
+		case "enum":
+			err = json.Unmarshal(value, &s.enum)
+		case "properties":
+			var props map[string]json.RawMessage
+			if err = json.Unmarshal(value, &props); err != nil {
+				break
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, prop := range props {
+				if s.properties[name], err = compileSchema(prop); err != nil {
+					err = fmt.Errorf("properties.%s: %w", name, err)
+					break
+				}
+			}
+		case "required":
+			err = json.Unmarshal(value, &s.required)
+		case "additionalProperties":
+			var allowed bool
+			if json.Unmarshal(value, &allowed) == nil {
+				s.noAdditional = !allowed
+			} else {
+				s.additionalProperties, err = compileSchema(value)
+			}
+		case "items":
+			s.items, err = compileSchema(value)
+		case "minLength":
+			s.minLength, err = parseNonNegative(value)
+		case "maxLength":
+			s.maxLength, err = parseNonNegative(value)
+		case "minItems":
+			s.minItems, err = parseNonNegative(value)
+		case "maxItems":
+			s.maxItems, err = parseNonNegative(value)
+		case "pattern":
+			var pattern string
+			if err = json.Unmarshal(value, &pattern); err == nil {
+				s.pattern, err = regexp.Compile(pattern)
+			}
+		case "minimum":
+			err = json.Unmarshal(value, &s.minimum)
+		case "maximum":
+			err = json.Unmarshal(value, &s.maximum)
+		default:
+			if !schemaAnnotations[key] {
+				err = fmt.Errorf("unsupported keyword")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *jsonSchema) parseType(value json.RawMessage) error {
+	var single string
+	if json.Unmarshal(value, &single) == nil {
+		s.types = []string{single}
+	} else if err := json.Unmarshal(value, &s.types); err != nil {
+		return fmt.Errorf("must be a string or an array of strings")
+	}
+	for _, t := range s.types {
+		if !schemaTypes[t] {
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+	return nil
+}
+
+func parseNonNegative(value json.RawMessage) (*int, error) {
+	var n int
+	if err := json.Unmarshal(value, &n); err != nil || n < 0 {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	return &n, nil
+}
+
+// jsonType names the JSON Schema type of a value decoded by encoding/json
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// validate checks value against the schema, reporting violations with field
+// names rooted at path
+func (s *jsonSchema) validate(path string, value interface{}) []FieldError {
+	var v validator
+
+	if len(s.types) > 0 {
+		actual := jsonType(value)
+		matched := false
+		for _, t := range s.types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.add(path, codeInvalidType, fmt.Sprintf("%s must be of type %s", path, s.types[0]))
+			return v.errors
+		}
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.add(path, codeNotInEnum, path+" is not one of the allowed values")
+		}
+	}
+
+	switch val := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(val)
+		if s.minLength != nil && length < *s.minLength {
+			v.add(path, codeTooShort, fmt.Sprintf("%s must be at least %d characters", path, *s.minLength))
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			v.add(path, codeTooLong, fmt.Sprintf("%s must be at most %d characters", path, *s.maxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			v.add(path, codePatternMismatch, path+" does not match the required pattern")
+		}
+	case float64:
+		if s.minimum != nil && val < *s.minimum {
+			v.add(path, codeOutOfRange, fmt.Sprintf("%s must be at least %v", path, *s.minimum))
+		}
+		if s.maximum != nil && val > *s.maximum {
+			v.add(path, codeOutOfRange, fmt.Sprintf("%s must be at most %v", path, *s.maximum))
+		}
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			v.add(path, codeTooShort, fmt.Sprintf("%s must have at least %d items", path, *s.minItems))
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			v.add(path, codeTooLong, fmt.Sprintf("%s must have at most %d items", path, *s.maxItems))
+		}
+		if s.items != nil {
+			for i, item := range val {
+				v.errors = append(v.errors, s.items.validate(path+"["+strconv.Itoa(i)+"]", item)...)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				v.add(path+"."+name, codeRequired, path+"."+name+" is required")
+			}
+		}
+		// Sorted so the order of errors is stable
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := path + "." + name
+			if prop, ok := s.properties[name]; ok {
+				v.errors = append(v.errors, prop.validate(field, val[name])...)
+			} else if s.noAdditional {
+				v.add(field, codeUnknownProperty, field+" is not an allowed property")
+			} else if s.additionalProperties != nil {
+				v.errors = append(v.errors, s.additionalProperties.validate(field, val[name])...)
+			}
+		}
+	}
+
+	return v.errors
+}
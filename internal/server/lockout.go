@@ -0,0 +1,398 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"container/list"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// lockoutPolicy governs how failed logins to one account slow down and then
+// lock further attempts
+type lockoutPolicy struct {
+	// FreeAttempts failures are allowed before delays start
+	FreeAttempts int
+	// Each failure past FreeAttempts doubles the delay from BaseDelay, up
+	// to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockAfter failures lock the account for LockDuration
+	LockAfter    int
+	LockDuration time.Duration
+	// ResetAfter without failures forgets earlier ones
+	ResetAfter time.Duration
+}
+
+var defaultLockoutPolicy = lockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockAfter:    10,
+	LockDuration: 15 * time.Minute,
+	ResetAfter:   time.Hour,
+}
+
+// delay returns how long to wait after the given number of failures
+func (p lockoutPolicy) delay(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	shift := failures - p.FreeAttempts - 1
+	if shift > 30 {
+		return p.MaxDelay
+	}
+	d := p.BaseDelay << shift
+	if d > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return d
+}
+
+// stale reports whether l no longer counts: its lock has expired, or no
+// failure happened within ResetAfter
+func (p lockoutPolicy) stale(l *database.AccountLockout, now time.Time) bool {
+	if l.LockedUntil != nil {
+		return !now.Before(*l.LockedUntil)
+	}
+	return now.Sub(l.LastFailedAt) >= p.ResetAfter
+}
+
+// retryAfter reports how long the account must wait before another login
+// attempt, and whether that is because it is locked
+func (p lockoutPolicy) retryAfter(l *database.AccountLockout, now time.Time) (time.Duration, bool) {
+	if l == nil || p.stale(l, now) {
+		return 0, false
+	}
+	if l.LockedUntil != nil {
+		return l.LockedUntil.Sub(now), true
+	}
+	// Attempts still being checked can reach LockAfter before one of them
+	// fails and sets the lock
+	if l.FailedAttempts >= p.LockAfter {
+		return p.MaxDelay, false
+	}
+	wait := l.LastFailedAt.Add(p.delay(l.FailedAttempts)).Sub(now)
+	if wait < 0 {
+		return 0, false
+	}
+	return wait, false
+}
+
+// Failed logins allowed per client IP within loginThrottleWindow
+const (
+	loginThrottleLimit  = 50
+	loginThrottleWindow = 15 * time.Minute
+)
+
+// ipThrottle limits failed logins per client IP across all accounts, using
+// a fixed window per IP
+type ipThrottle struct {
+	limit  int
+	window time.Duration
+	// max bounds how many IPs are tracked
+	max int
+
+	mu       sync.Mutex
+	failures map[string]*list.Element
+	// order holds the *ipFailures in order of window start, oldest first
+	order *list.List
+}
+
+type ipFailures struct {
+	ip    string
+	count int
+	start time.Time
+}
+
+// maxTrackedIPs bounds the throttle's memory. Once it is reached the IPs
+// whose windows started longest ago are forgotten first.
+const maxTrackedIPs = 100000
+
+func newIPThrottle(limit int, window time.Duration) *ipThrottle {
+	return &ipThrottle{
+		limit:    limit,
+		window:   window,
+		max:      maxTrackedIPs,
+		failures: make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// retryAfter returns how long ip must wait before trying again, or zero
+func (t *ipThrottle) retryAfter(ip string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.failures[ip]
+	if !ok {
+		return 0
+	}
+	f := e.Value.(*ipFailures)
+	if now.Sub(f.start) >= t.window || f.count < t.limit {
+		return 0
+	}
+	return f.start.Add(t.window).Sub(now)
+}
+
+func (t *ipThrottle) fail(ip string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.failures[ip]; ok {
+		f := e.Value.(*ipFailures)
+		if now.Sub(f.start) < t.window {
+			f.count++
+			return
+		}
+		f.count, f.start = 1, now
+		t.order.MoveToBack(e)
+		return
+	}
+
+	t.sweep(now)
+	for t.order.Len() >= t.max {
+		t.evict(t.order.Front())
+	}
+	t.failures[ip] = t.order.PushBack(&ipFailures{ip: ip, count: 1, start: now})
+}
+
+// sweep drops expired windows; t.mu must be held
+func (t *ipThrottle) sweep(now time.Time) {
+	for e := t.order.Front(); e != nil && now.Sub(e.Value.(*ipFailures).start) >= t.window; e = t.order.Front() {
+		t.evict(e)
+	}
+}
+
+// evict forgets the IP of e; t.mu must be held
+func (t *ipThrottle) evict(e *list.Element) {
+	delete(t.failures, t.order.Remove(e).(*ipFailures).ip)
+}
+
+// lockoutEvent describes an account that was just locked
+type lockoutEvent struct {
+	SubjectType   string
+	SubjectID     string
+	ApplicationID string
+	Email         string
+	IP            string
+	LockedUntil   time.Time
+}
+
+// lockoutSubject identifies the account a login attempt is for
+type lockoutSubject struct {
+	Type          string
+	ID            string
+	ApplicationID string
+	Email         string
+}
+
+func userLockoutSubject(user *database.User) *lockoutSubject {
+	return &lockoutSubject{
+		Type:          database.LockoutSubjectUser,
+		ID:            user.ID,
+		ApplicationID: user.ApplicationID,
+		Email:         user.Email,
+	}
+}
+
+func developerLockoutSubject(dev *database.Developer) *lockoutSubject {
+	return &lockoutSubject{
+		Type:  database.LockoutSubjectDeveloper,
+		ID:    dev.ID,
+		Email: dev.Email,
+	}
+}
+
+// setRetryAfter sets the Retry-After header, rounding up to whole seconds
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// checkLoginThrottle writes an error response and returns false if the
+// client IP has failed too many logins recently
+func (s *Server) checkLoginThrottle(w http.ResponseWriter, r *http.Request) bool {
+	if wait := s.loginThrottle.retryAfter(s.clientIP(r), time.Now()); wait > 0 {
+		setRetryAfter(w, wait)
+		writeError(w, r, errTooManyAttempts)
+		return false
+	}
+	return true
+}
+
+// checkAccountLockout reserves a login attempt for subject, writing an
+// error response and returning false if it may not attempt a login now
+func (s *Server) checkAccountLockout(w http.ResponseWriter, r *http.Request, subject *lockoutSubject) (*database.AccountLockout, bool) {
+	lockout, rejected := s.accountLockout(w, subject)
+	if rejected != nil {
+		writeError(w, r, rejected)
+		return nil, false
+	}
+	return lockout, true
+}
+
+// accountLockout reserves a login attempt for subject, returning the error
+// to respond with if it may not attempt a login now. The attempt counts as
+// failed until loginSucceeded, so that concurrent guesses cannot all pass
+// the check before any of them is counted. Retry-After is set when the
+// attempt is only delayed or locked.
+func (s *Server) accountLockout(w http.ResponseWriter, subject *lockoutSubject) (*database.AccountLockout, *apiError) {
+	now := time.Now()
+	var wait time.Duration
+	var locked bool
+	lockout, err := s.db.ReserveLoginAttempt(&database.AccountLockout{
+		SubjectID:     subject.ID,
+		SubjectType:   subject.Type,
+		ApplicationID: subject.ApplicationID,
+		LastFailedAt:  now,
+	}, now.Add(-s.lockout.ResetAfter), func(before *database.AccountLockout) bool {
+		wait, locked = s.lockout.retryAfter(before, now)
+		return wait <= 0
+	})
+	if err != nil {
+		return nil, internalError("Failed to check account lockout")
+	}
+	if lockout == nil {
+		setRetryAfter(w, wait)
+		if locked {
+			return nil, errAccountLocked
+		}
+		return nil, errTooManyAttempts
+	}
+	return lockout, nil
+}
+
+// loginFailed records a failed login against the client IP and, when the
+// account is known, settles the attempt reserved for subject as failed,
+// running the lockout hooks if this failure locked it
+func (s *Server) loginFailed(r *http.Request, subject *lockoutSubject) {
+	now := time.Now()
+	ip := s.clientIP(r)
+	s.loginThrottle.fail(ip, now)
+	if subject == nil {
+		return
+	}
+
+	// The event is only recorded if this failure turns out to lock the
+	// account
+	lockedUntil := now.Add(s.lockout.LockDuration)
+	var events []database.OutboxEvent
+	if subject.Type == database.LockoutSubjectUser {
+		events = append(events, newEvent(subject.ApplicationID, eventUserLocked, map[string]interface{}{
+			"userId":      subject.ID,
+			"ip":          ip,
+			"lockedUntil": lockedUntil,
+		}))
+	}
+	_, locked, err := s.db.RecordFailedLogin(&database.AccountLockout{
+		SubjectID:     subject.ID,
+		SubjectType:   subject.Type,
+		ApplicationID: subject.ApplicationID,
+		LastFailedAt:  now,
+	}, s.lockout.LockAfter, lockedUntil, events...)
+	if err != nil {
+		log.Printf("failed to record failed login for %s %s: %v", subject.Type, subject.ID, err)
+		return
+	}
+
+	if locked {
+		event := lockoutEvent{
+			SubjectType:   subject.Type,
+			SubjectID:     subject.ID,
+			ApplicationID: subject.ApplicationID,
+			Email:         subject.Email,
+			IP:            ip,
+			LockedUntil:   lockedUntil,
+		}
+		for _, hook := range s.lockoutHooks {
+			go hook(event)
+		}
+	}
+}
+
+// loginSucceeded forgets the failures of the account, including the attempt
+// reserved by checkAccountLockout, given the state it returned
+func (s *Server) loginSucceeded(lockout *database.AccountLockout) {
+	if lockout == nil {
+		return
+	}
+	if err := s.db.DeleteAccountLockout(lockout.SubjectID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("failed to clear lockout for %s: %v", lockout.SubjectID, err)
+	}
+}
+
+// emailLockoutNotice is the default lockout hook, telling the account holder
+// that their account was locked
+func (s *Server) emailLockoutNotice(e lockoutEvent) {
+	body := "Your account was temporarily locked after too many failed login attempts" +
+		" (last attempt from " + e.IP + ").\n\nYou can try again after " +
+		e.LockedUntil.UTC().Format(time.RFC1123) + ". If this wasn't you, consider changing your password."
+	if err := s.mailer.Send(e.Email, "Your account was locked", body); err != nil {
+		log.Printf("failed to send lockout notice to %s %s: %v", e.SubjectType, e.SubjectID, err)
+	}
+}
+
+func (s *Server) handleGetLockouts(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	lockouts, err := s.db.GetApplicationLockouts(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch lockouts"))
+		return
+	}
+
+	// Only report accounts whose failures still count
+	now := time.Now()
+	active := []database.AccountLockout{}
+	for _, l := range lockouts {
+		if !s.lockout.stale(&l, now) {
+			active = append(active, l)
+		}
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"lockouts": active,
+		"count":    len(active),
+	})
+}
+
+// handleClearLockout unlocks a user and forgets their failed logins
+func (s *Server) handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	userID := chi.URLParam(r, "userId")
+	lockout, err := s.db.GetAccountLockout(userID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch lockout"))
+		return
+	}
+	if lockout == nil || lockout.ApplicationID != app.ID {
+		writeError(w, r, errLockoutNotFound)
+		return
+	}
+	auditBefore(r, lockout)
+
+	if err := s.db.DeleteAccountLockout(userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errLockoutNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to clear lockout"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
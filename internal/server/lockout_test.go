@@ -0,0 +1,200 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	p := defaultLockoutPolicy
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{7, 8 * time.Second},
+		{9, 32 * time.Second},
+		{20, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := p.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutPolicyRetryAfter(t *testing.T) {
+	p := defaultLockoutPolicy
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lockedUntil := now.Add(p.LockDuration)
+
+	tests := []struct {
+		name    string
+		lockout *database.AccountLockout
+		at      time.Time
+		wait    time.Duration
+		locked  bool
+	}{
+		{"none", nil, now, 0, false},
+		{"free attempts", &database.AccountLockout{FailedAttempts: p.FreeAttempts, LastFailedAt: now}, now, 0, false},
+		{"delayed", &database.AccountLockout{FailedAttempts: p.LockAfter - 1, LastFailedAt: now}, now, p.delay(p.LockAfter - 1), false},
+		{"locked", &database.AccountLockout{FailedAttempts: p.LockAfter, LastFailedAt: now, LockedUntil: &lockedUntil}, now.Add(time.Minute), p.LockDuration - time.Minute, true},
+		{"lock expired", &database.AccountLockout{FailedAttempts: p.LockAfter, LastFailedAt: now, LockedUntil: &lockedUntil}, lockedUntil, 0, false},
+		{"old failures", &database.AccountLockout{FailedAttempts: 8, LastFailedAt: now.Add(-p.ResetAfter)}, now, 0, false},
+		{"attempts in progress", &database.AccountLockout{FailedAttempts: p.LockAfter, LastFailedAt: now.Add(-10 * time.Minute)}, now, p.MaxDelay, false},
+	}
+	for _, tt := range tests {
+		wait, locked := p.retryAfter(tt.lockout, tt.at)
+		if wait != tt.wait || locked != tt.locked {
+			t.Errorf("%s: retryAfter() = %v, %v; want %v, %v", tt.name, wait, locked, tt.wait, tt.locked)
+		}
+	}
+}
+
+func TestLoginFailedRunsHooksOnLock(t *testing.T) {
+	s := newTestServer(t)
+	s.lockout = lockoutPolicy{FreeAttempts: 5, LockAfter: 2, LockDuration: 15 * time.Minute, ResetAfter: time.Hour}
+	locked := make(chan lockoutEvent, 1)
+	s.lockoutHooks = []func(lockoutEvent){func(e lockoutEvent) { locked <- e }}
+	subject := &lockoutSubject{Type: database.LockoutSubjectUser, ID: "user-1", ApplicationID: "app-1"}
+	fail := func() {
+		t.Helper()
+		if _, rejected := s.accountLockout(httptest.NewRecorder(), subject); rejected != nil {
+			t.Fatalf("expected the attempt to be allowed; got %s", rejected.Code)
+		}
+		s.loginFailed(httptest.NewRequest("POST", "/", nil), subject)
+	}
+
+	before := time.Now()
+	fail()
+	select {
+	case e := <-locked:
+		t.Fatalf("expected no hook before the lock; got %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if events := pendingEvents(t, s); len(events) != 0 {
+		t.Errorf("expected no event before the lock; got %s", eventTypes(events))
+	}
+
+	fail()
+	select {
+	case e := <-locked:
+		if e.SubjectID != "user-1" || e.LockedUntil.Before(before.Add(s.lockout.LockDuration)) {
+			t.Errorf("unexpected lockout event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the lockout hook to run")
+	}
+	if got := eventTypes(pendingEvents(t, s)); got != eventUserLocked {
+		t.Errorf("expected a user.locked event; got %s", got)
+	}
+
+	w := httptest.NewRecorder()
+	if _, rejected := s.accountLockout(w, subject); rejected != errAccountLocked || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected the account to be locked; got %v", rejected)
+	}
+}
+
+func TestAccountLockoutReservesConcurrentAttempts(t *testing.T) {
+	s := newTestServer(t)
+	subject := &lockoutSubject{Type: database.LockoutSubjectDeveloper, ID: "dev-1"}
+
+	// None of the attempts has been checked yet, so only those the policy
+	// allows without a delay may go ahead
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, rejected := s.accountLockout(httptest.NewRecorder(), subject); rejected == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := int(allowed.Load()); got != s.lockout.FreeAttempts+1 {
+		t.Errorf("expected %d attempts to be allowed; got %d", s.lockout.FreeAttempts+1, got)
+	}
+
+	// A successful attempt forgets them all
+	lockout, _ := s.db.GetAccountLockout("dev-1")
+	s.loginSucceeded(lockout)
+	if _, rejected := s.accountLockout(httptest.NewRecorder(), subject); rejected != nil {
+		t.Errorf("expected an attempt after a success to be allowed; got %s", rejected.Code)
+	}
+}
+
+func TestIPThrottle(t *testing.T) {
+	th := newIPThrottle(3, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if wait := th.retryAfter("1.2.3.4", now); wait != 0 {
+			t.Fatalf("throttled after %d failures", i)
+		}
+		th.fail("1.2.3.4", now)
+	}
+	if wait := th.retryAfter("1.2.3.4", now.Add(10*time.Second)); wait != 50*time.Second {
+		t.Errorf("expected 50s wait; got %v", wait)
+	}
+	if wait := th.retryAfter("5.6.7.8", now); wait != 0 {
+		t.Errorf("expected other IPs to be unaffected; got %v", wait)
+	}
+	if wait := th.retryAfter("1.2.3.4", now.Add(time.Minute)); wait != 0 {
+		t.Errorf("expected the window to expire; got %v", wait)
+	}
+}
+
+func TestIPThrottleBounded(t *testing.T) {
+	th := newIPThrottle(1, time.Minute)
+	th.max = 2
+	now := time.Now()
+
+	th.fail("1.1.1.1", now)
+	th.fail("2.2.2.2", now.Add(time.Second))
+	th.fail("3.3.3.3", now.Add(2*time.Second))
+	if len(th.failures) != 2 || th.order.Len() != 2 {
+		t.Fatalf("expected 2 tracked IPs; got %d", len(th.failures))
+	}
+	if wait := th.retryAfter("1.1.1.1", now.Add(2*time.Second)); wait != 0 {
+		t.Errorf("expected the oldest IP to be evicted; got %v", wait)
+	}
+	for _, ip := range []string{"2.2.2.2", "3.3.3.3"} {
+		if wait := th.retryAfter(ip, now.Add(2*time.Second)); wait == 0 {
+			t.Errorf("expected %s to still be throttled", ip)
+		}
+	}
+
+	// Expired windows go before ones that still count
+	th.fail("4.4.4.4", now.Add(time.Minute+time.Second))
+	if _, ok := th.failures["3.3.3.3"]; !ok || len(th.failures) != 2 {
+		t.Errorf("expected only the expired window to be dropped; got %d tracked", len(th.failures))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/users/login", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7")
+
+	s := &Server{}
+	if got := s.clientIP(r); got != "10.0.0.1" {
+		t.Errorf("expected X-Forwarded-For to be ignored; got %s", got)
+	}
+	s.trustProxy = true
+	if got := s.clientIP(r); got != "203.0.113.7" {
+		t.Errorf("expected the address appended by the proxy; got %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultLoginHistoryRetentionDays = 90
+	defaultLoginHistoryMaxPerUser    = 500
+	maxLoginHistoryRetentionDays     = 730
+	maxLoginHistoryMaxPerUser        = 10000
+
+	defaultSecurityEventPageSize = 50
+	maxSecurityEventPageSize     = 200
+)
+
+// effectiveLoginHistoryPolicy fills in the server defaults for the limits
+// policy leaves unset
+func effectiveLoginHistoryPolicy(policy *database.LoginHistoryPolicy) database.LoginHistoryPolicy {
+	effective := database.LoginHistoryPolicy{
+		RetentionDays: defaultLoginHistoryRetentionDays,
+		MaxPerUser:    defaultLoginHistoryMaxPerUser,
+	}
+	if policy != nil {
+		if policy.RetentionDays > 0 {
+			effective.RetentionDays = policy.RetentionDays
+		}
+		if policy.MaxPerUser > 0 {
+			effective.MaxPerUser = policy.MaxPerUser
+		}
+	}
+	return effective
+}
+
+func validateLoginHistoryPolicy(policy *database.LoginHistoryPolicy) []FieldError {
+	var v validator
+	if policy.RetentionDays < 0 || policy.RetentionDays > maxLoginHistoryRetentionDays {
+		v.add("retentionDays", codeOutOfRange,
+			"retentionDays must be between 0 and "+strconv.Itoa(maxLoginHistoryRetentionDays))
+	}
+	if policy.MaxPerUser < 0 || policy.MaxPerUser > maxLoginHistoryMaxPerUser {
+		v.add("maxPerUser", codeOutOfRange,
+			"maxPerUser must be between 0 and "+strconv.Itoa(maxLoginHistoryMaxPerUser))
+	}
+	return v.errors
+}
+
+// newLoginAttempt starts the login history entry of an attempt to log in as
+// user with method
+func (s *Server) newLoginAttempt(r *http.Request, user *database.User, method string) *database.LoginAttempt {
+	return &database.LoginAttempt{
+		ApplicationID: user.ApplicationID,
+		UserID:        user.ID,
+		Method:        method,
+		IP:            s.clientIP(r),
+		UserAgent:     truncate(r.UserAgent(), maxUserAgentBytes),
+	}
+}
+
+// recordLoginAttempt stores attempt in the user's login history. Failing to
+// record it does not fail the login.
+func (s *Server) recordLoginAttempt(app *database.Application, attempt *database.LoginAttempt) {
+	policy := effectiveLoginHistoryPolicy(app.LoginHistoryPolicy)
+	if err := s.db.RecordLoginAttempt(attempt, policy.MaxPerUser); err != nil {
+		log.Printf("failed to record login attempt for user %s: %v", attempt.UserID, err)
+	}
+}
+
+// rejectLogin records attempt as failed with e and writes e
+func (s *Server) rejectLogin(w http.ResponseWriter, r *http.Request, app *database.Application, attempt *database.LoginAttempt, e *apiError) {
+	attempt.Success = false
+	attempt.FailureReason = e.Code
+	s.recordLoginAttempt(app, attempt)
+	writeError(w, r, e)
+}
+
+// writeSecurityEvents responds with a page of the user's login history,
+// read from the limit and before (the nextBefore of the previous page)
+// query parameters
+func (s *Server) writeSecurityEvents(w http.ResponseWriter, r *http.Request, user *database.User) {
+	var v validator
+	q := r.URL.Query()
+	limit := defaultSecurityEventPageSize
+	if str := q.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 || n > maxSecurityEventPageSize {
+			v.add("limit", codeOutOfRange, "limit must be between 1 and "+strconv.Itoa(maxSecurityEventPageSize))
+		}
+		limit = n
+	}
+	var before int64
+	if str := q.Get("before"); str != "" {
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || n < 1 {
+			v.add("before", "invalid_cursor", "before must be the nextBefore of a previous page")
+		}
+		before = n
+	}
+	if len(v.errors) > 0 {
+		writeError(w, r, validationError(v.errors))
+		return
+	}
+
+	events, err := s.db.GetLoginAttempts(user.ID, before, limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch security events"))
+		return
+	}
+
+	var nextBefore int64
+	if len(events) == limit {
+		nextBefore = events[len(events)-1].Seq
+	}
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"events":     events,
+		"count":      len(events),
+		"nextBefore": nextBefore,
+	})
+}
+
+// handleGetMySecurityEvents returns the login history of the session's user
+func (s *Server) handleGetMySecurityEvents(w http.ResponseWriter, r *http.Request) {
+	s.writeSecurityEvents(w, r, r.Context().Value("user").(*database.User))
+}
+
+func (s *Server) handleGetUserSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+
+	s.writeSecurityEvents(w, r, user)
+}
+
+// handleUpdateLoginHistoryPolicy sets how long and how many login attempts
+// are kept per user, returning the limits that now apply. A null body
+// restores the defaults. Shorter retention applies to existing history at
+// the next cleanup.
+func (s *Server) handleUpdateLoginHistoryPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy *database.LoginHistoryPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if policy != nil {
+		if errs := validateLoginHistoryPolicy(policy); len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, app.LoginHistoryPolicy)
+
+	if err := s.db.UpdateApplicationLoginHistoryPolicy(app.ID, app.DeveloperID, policy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update login history policy"))
+		return
+	}
+	auditAfter(r, policy)
+
+	writeData(w, http.StatusOK, effectiveLoginHistoryPolicy(policy))
+}
@@ -0,0 +1,123 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEffectiveLoginHistoryPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *database.LoginHistoryPolicy
+		want   database.LoginHistoryPolicy
+	}{
+		{"defaults", nil, database.LoginHistoryPolicy{RetentionDays: defaultLoginHistoryRetentionDays, MaxPerUser: defaultLoginHistoryMaxPerUser}},
+		{"retention only", &database.LoginHistoryPolicy{RetentionDays: 30}, database.LoginHistoryPolicy{RetentionDays: 30, MaxPerUser: defaultLoginHistoryMaxPerUser}},
+		{"both", &database.LoginHistoryPolicy{RetentionDays: 7, MaxPerUser: 20}, database.LoginHistoryPolicy{RetentionDays: 7, MaxPerUser: 20}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := effectiveLoginHistoryPolicy(tt.policy); got != tt.want {
+				t.Errorf("effectiveLoginHistoryPolicy() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateLoginHistoryPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy database.LoginHistoryPolicy
+		valid  bool
+	}{
+		{"zero", database.LoginHistoryPolicy{}, true},
+		{"in range", database.LoginHistoryPolicy{RetentionDays: 365, MaxPerUser: 100}, true},
+		{"negative", database.LoginHistoryPolicy{RetentionDays: -1}, false},
+		{"too long", database.LoginHistoryPolicy{RetentionDays: maxLoginHistoryRetentionDays + 1}, false},
+		{"too many", database.LoginHistoryPolicy{MaxPerUser: maxLoginHistoryMaxPerUser + 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateLoginHistoryPolicy(&tt.policy)
+			if (len(errs) == 0) != tt.valid {
+				t.Errorf("validateLoginHistoryPolicy() = %v; want valid=%v", errs, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRejectLogin(t *testing.T) {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-1", "dev-1")
+	user := seedUser(t, s, "app-1", "user-1", "ada@example.com")
+	if err := s.db.UpdateApplicationLoginHistoryPolicy("app-1", "dev-1", &database.LoginHistoryPolicy{MaxPerUser: 2}); err != nil {
+		t.Fatal(err)
+	}
+	app, err := s.db.GetApplicationByID("app-1", "dev-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.db.RecordLoginAttempt(&database.LoginAttempt{ApplicationID: "app-1", UserID: "user-1", Success: true,
+			Method: database.LoginMethodPassword}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/users/login", nil)
+	r.RemoteAddr = "203.0.113.7:5000"
+	r.Header.Set("User-Agent", "test-agent")
+	w := httptest.NewRecorder()
+
+	attempt := s.newLoginAttempt(r, user, database.LoginMethodPassword)
+	s.rejectLogin(w, r, app, attempt, errInvalidCredentials)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401; got %d", w.Code)
+	}
+	attempts, err := s.db.GetLoginAttempts("user-1", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected the history to be kept to 2 attempts; got %+v", attempts)
+	}
+	a := attempts[0]
+	if a.Success || a.FailureReason != errInvalidCredentials.Code || a.UserID != "user-1" ||
+		a.ApplicationID != "app-1" || a.IP != "203.0.113.7" || a.UserAgent != "test-agent" ||
+		a.Method != database.LoginMethodPassword {
+		t.Errorf("unexpected attempt %+v", a)
+	}
+}
+
+func TestWriteSecurityEventsValidatesParams(t *testing.T) {
+	s := &Server{}
+	for _, query := range []string{"limit=0", "limit=1000", "limit=x", "before=0", "before=x"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/users/me/security-events?"+query, nil)
+		w := httptest.NewRecorder()
+		s.writeSecurityEvents(w, r, &database.User{ID: "user-1"})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status 422; got %d", query, w.Code)
+		}
+	}
+}
+
+func TestJanitorRunsTasks(t *testing.T) {
+	ran := make(chan string, 2)
+	j := newJanitor(
+		janitorTask{name: "a", run: func() (int, error) { ran <- "a"; return 1, nil }},
+		janitorTask{name: "b", run: func() (int, error) { ran <- "b"; return 0, nil }},
+	)
+	go j.run()
+	if first, second := <-ran, <-ran; first != "a" || second != "b" {
+		t.Errorf("expected tasks to run in order; got %s, %s", first, second)
+	}
+	j.stop()
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// maxMetadataSize caps each of a user's metadata objects, in bytes
+const maxMetadataSize = 8 * 1024
+
+// selfView is the user as shown to the user themselves, without the
+// developer-only private metadata
+func selfView(user *database.User) *database.User {
+	u := *user
+	u.PrivateMetadata = nil
+	return &u
+}
+
+// checkMetadata validates a metadata write to field against schema, which may
+// be empty. It returns the compacted object to store; JSON null resets the
+// metadata to an empty object.
+func checkMetadata(field string, raw, schema json.RawMessage) (json.RawMessage, []FieldError) {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return json.RawMessage("{}"), nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, []FieldError{{Field: field, Code: codeInvalidType, Message: field + " must be valid JSON"}}
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return nil, []FieldError{{Field: field, Code: codeInvalidType, Message: field + " must be an object"}}
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return nil, []FieldError{{Field: field, Code: codeInvalidType, Message: field + " must be valid JSON"}}
+	}
+	if compact.Len() > maxMetadataSize {
+		return nil, []FieldError{{Field: field, Code: codeTooLong, Message: field + " must be at most 8 KiB"}}
+	}
+
+	if len(schema) > 0 {
+		compiled, err := compileSchema(schema)
+		if err != nil {
+			// Schemas are checked when saved, so this only happens if the
+			// stored schema was edited by hand
+			return nil, []FieldError{{Field: field, Code: "invalid_schema", Message: "The application's metadata schema is invalid"}}
+		}
+		if errs := compiled.validate(field, value); len(errs) > 0 {
+			return nil, errs
+		}
+	}
+
+	return json.RawMessage(compact.Bytes()), nil
+}
+
+// applyMetadata validates and sets whichever of public and private are
+// present on user, using the application's schemas
+func applyMetadata(app *database.Application, user *database.User, public, private json.RawMessage) []FieldError {
+	var schema database.MetadataSchema
+	if app.MetadataSchema != nil {
+		schema = *app.MetadataSchema
+	}
+
+	var errs []FieldError
+	if public != nil {
+		value, fieldErrs := checkMetadata("publicMetadata", public, schema.Public)
+		errs = append(errs, fieldErrs...)
+		user.PublicMetadata = value
+	}
+	if private != nil {
+		value, fieldErrs := checkMetadata("privateMetadata", private, schema.Private)
+		errs = append(errs, fieldErrs...)
+		user.PrivateMetadata = value
+	}
+	return errs
+}
+
+func validateMetadataSchema(schema *database.MetadataSchema) []FieldError {
+	var v validator
+	if len(schema.Public) > 0 {
+		if _, err := compileSchema(schema.Public); err != nil {
+			v.add("public", "invalid_schema", "public: "+err.Error())
+		}
+	}
+	if len(schema.Private) > 0 {
+		if _, err := compileSchema(schema.Private); err != nil {
+			v.add("private", "invalid_schema", "private: "+err.Error())
+		}
+	}
+	return v.errors
+}
+
+// handleUpdateMetadataSchema sets the schemas that user metadata writes must
+// satisfy. A null body removes them. Existing metadata is not revalidated.
+func (s *Server) handleUpdateMetadataSchema(w http.ResponseWriter, r *http.Request) {
+	var schema *database.MetadataSchema
+	if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if schema != nil {
+		if errs := validateMetadataSchema(schema); len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, app.MetadataSchema)
+
+	if err := s.db.UpdateApplicationMetadataSchema(app.ID, app.DeveloperID, schema); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update metadata schema"))
+		return
+	}
+	auditAfter(r, schema)
+
+	writeData(w, http.StatusOK, schema)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testMetadataSchema = `{
+	"type": "object",
+	"properties": {
+		"plan": {"type": "string", "enum": ["free", "pro"]},
+		"locale": {"type": "string", "pattern": "^[a-z]{2}(-[A-Z]{2})?$"},
+		"seats": {"type": "integer", "minimum": 1, "maximum": 100},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "maxLength": 5}}
+	},
+	"required": ["plan"],
+	"additionalProperties": false
+}`
+
+func TestCheckMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		wantFields []string
+		wantCode   string
+	}{
+		{"valid", `{"plan": "pro", "locale": "en-GB", "seats": 3, "tags": ["a"]}`, nil, ""},
+		{"null resets", `null`, nil, ""},
+		{"not an object", `["plan"]`, []string{"publicMetadata"}, codeInvalidType},
+		{"missing required", `{"seats": 1}`, []string{"publicMetadata.plan"}, codeRequired},
+		{"not in enum", `{"plan": "enterprise"}`, []string{"publicMetadata.plan"}, codeNotInEnum},
+		{"pattern", `{"plan": "free", "locale": "english"}`, []string{"publicMetadata.locale"}, codePatternMismatch},
+		{"not an integer", `{"plan": "free", "seats": 1.5}`, []string{"publicMetadata.seats"}, codeInvalidType},
+		{"out of range", `{"plan": "free", "seats": 0}`, []string{"publicMetadata.seats"}, codeOutOfRange},
+		{"item too long", `{"plan": "free", "tags": ["abcdef"]}`, []string{"publicMetadata.tags[0]"}, codeTooLong},
+		{"unknown property", `{"plan": "free", "avatar": "x"}`, []string{"publicMetadata.avatar"}, codeUnknownProperty},
+		{"too large", `{"plan": "free", "x": "` + strings.Repeat("a", maxMetadataSize) + `"}`, []string{"publicMetadata"}, codeTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, errs := checkMetadata("publicMetadata", json.RawMessage(tt.value), json.RawMessage(testMetadataSchema))
+			if len(errs) != len(tt.wantFields) {
+				t.Fatalf("expected %d errors; got %v", len(tt.wantFields), errs)
+			}
+			for i, e := range errs {
+				if e.Field != tt.wantFields[i] || e.Code != tt.wantCode {
+					t.Errorf("expected %s %s; got %s %s", tt.wantFields[i], tt.wantCode, e.Field, e.Code)
+				}
+			}
+			if len(errs) == 0 && value == nil {
+				t.Error("expected a value to store")
+			}
+		})
+	}
+}
+
+func TestCheckMetadataWithoutSchema(t *testing.T) {
+	value, errs := checkMetadata("privateMetadata", json.RawMessage(`{ "anything": [1, 2] }`), nil)
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors; got %v", errs)
+	}
+	if string(value) != `{"anything":[1,2]}` {
+		t.Errorf("expected compacted metadata; got %s", value)
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	tests := []string{
+		`"object"`,
+		`{"type": "date"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"oneOf": []}`,
+		`{"properties": {"a": {"format": "email"}}}`,
+	}
+
+	for _, schema := range tests {
+		if _, err := compileSchema(json.RawMessage(schema)); err == nil {
+			t.Errorf("expected %s to be rejected", schema)
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package server
 
 import (
+	"auth-server/internal/database"
 	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -17,7 +20,7 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			writeError(w, r, errAuthRequired)
 			return
 		}
 
@@ -25,7 +28,13 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 		// Format: "Bearer <token>"
 		bearerToken := strings.Split(authHeader, " ")
 		if len(bearerToken) != 2 || bearerToken[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+			writeError(w, r, errInvalidAuthHeader)
+			return
+		}
+
+		// Developer API tokens are not JWTs
+		if strings.HasPrefix(bearerToken[1], apiTokenPrefix) {
+			s.authenticateAPIToken(w, r, next, bearerToken[1])
 			return
 		}
 
@@ -39,20 +48,58 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 		})
 
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			writeError(w, r, errInvalidToken)
+			return
+		}
+
+		// Extract claims; access tokens name their session and have an ID
+		// but no type, which only challenge tokens have
+		claims, _ := token.Claims.(jwt.MapClaims)
+		developerID, _ := claims["sub"].(string)
+		tokenID, _ := claims["jti"].(string)
+		sessionID, _ := claims["sid"].(string)
+		exp, err := claims.GetExpirationTime()
+		if developerID == "" || tokenID == "" || sessionID == "" || claims["typ"] != nil || err != nil || exp == nil {
+			writeError(w, r, errInvalidClaims)
 			return
 		}
 
-		// Extract claims and add developer ID to context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if developerID, ok := claims["sub"].(string); ok {
-				ctx := context.WithValue(r.Context(), "developerID", developerID)
-				next.ServeHTTP(w, r.WithContext(ctx))
-				return
+		// Tokens of ended sessions are denied until they expire
+		revoked, err := s.db.IsTokenRevoked(tokenID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check token"))
+			return
+		}
+		if revoked {
+			writeError(w, r, errTokenRevoked)
+			return
+		}
+
+		var methods []string
+		if amr, ok := claims["amr"].([]interface{}); ok {
+			for _, m := range amr {
+				if method, ok := m.(string); ok {
+					methods = append(methods, method)
+				}
 			}
 		}
 
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+		// Tokens without a sign-in time never count as recently signed in
+		var authTime time.Time
+		if t, ok := claims["auth_time"].(float64); ok {
+			authTime = time.Unix(int64(t), 0)
+		}
+
+		// Add the developer ID and token to context
+		ctx := context.WithValue(r.Context(), "developerID", developerID)
+		ctx = context.WithValue(ctx, "developerToken", &developerToken{
+			ID:          tokenID,
+			SessionID:   sessionID,
+			AuthMethods: methods,
+			AuthTime:    authTime,
+			ExpiresAt:   exp.Time,
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
@@ -63,14 +110,18 @@ func (s *Server) apiKeyAuthMiddleware(next http.Handler) http.Handler {
 		timestamp := r.Header.Get("X-Timestamp")
 
 		if publicKey == "" || signature == "" || timestamp == "" {
-			http.Error(w, "Missing authentication headers", http.StatusUnauthorized)
+			writeError(w, r, errMissingAuthHeaders)
 			return
 		}
 
 		// Get application by public key
 		app, err := s.db.GetApplicationByPublicKey(publicKey)
-		if err != nil || app == nil {
-			http.Error(w, "Invalid public key", http.StatusUnauthorized)
+		if err != nil {
+			writeError(w, r, internalError("Failed to look up application"))
+			return
+		}
+		if app == nil {
+			writeError(w, r, errInvalidPublicKey)
 			return
 		}
 
@@ -83,7 +134,7 @@ func (s *Server) apiKeyAuthMiddleware(next http.Handler) http.Handler {
 		expectedSignature := generateHMAC(payload, app.SecretKey)
 
 		if !hmac.Equal([]byte(signature), []byte(expectedSignature)) {
-			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			writeError(w, r, errInvalidSignature)
 			return
 		}
 
@@ -93,6 +144,75 @@ func (s *Server) apiKeyAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// userSessionMiddleware requires a valid X-Session-Token belonging to a user
+// of the application authenticated by apiKeyAuthMiddleware, and adds the
+// session and user to the request context
+func (s *Server) userSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app := r.Context().Value("application").(*database.Application)
+
+		sessionToken := r.Header.Get("X-Session-Token")
+		if sessionToken == "" {
+			writeError(w, r, errSessionRequired)
+			return
+		}
+
+		// Get session by token; sessions of other applications are not valid here
+		session, err := s.db.GetSessionByToken(sessionToken)
+		if err != nil {
+			writeError(w, r, internalError("Failed to look up session"))
+			return
+		}
+		if session == nil || session.ApplicationID != app.ID {
+			writeError(w, r, errInvalidSession)
+			return
+		}
+
+		// Check if session is expired
+		if session.ExpiresAt.Before(time.Now()) {
+			writeError(w, r, errSessionExpired)
+			return
+		}
+
+		user, err := s.db.GetUserByID(session.UserID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to fetch user"))
+			return
+		}
+		if user == nil {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		if user.Status != database.UserStatusActive {
+			writeError(w, r, errAccountDisabled)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "session", session)
+		ctx = context.WithValue(ctx, "user", user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the address of the client. Behind a reverse proxy, set
+// TRUST_PROXY=true to use the last address the proxy appended to
+// X-Forwarded-For; otherwise the header is ignored since clients can forge it.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func generateHMAC(payload, secret string) string {
 	h := hmac.New(sha256.New, []byte(secret))
 	h.Write([]byte(payload))
@@ -0,0 +1,664 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const maxSlugLength = 50
+
+// organizationInviteTTL is how long an organization invitation can be accepted
+const organizationInviteTTL = 7 * 24 * time.Hour
+
+type organizationRequest struct {
+	Name string `json:"name"`
+	// Slug is derived from Name when empty
+	Slug string `json:"slug"`
+}
+
+type organizationInvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type organizationMemberRequest struct {
+	Role string `json:"role"`
+}
+
+type acceptInvitationRequest struct {
+	Token string `json:"token"`
+}
+
+type activeOrganizationRequest struct {
+	// OrganizationID is the organization to act in; empty clears it
+	OrganizationID string `json:"organizationId"`
+}
+
+func (r organizationRequest) validate() []FieldError {
+	var v validator
+	v.name("name", r.Name)
+	if r.Slug != "" && !isValidSlug(r.Slug) {
+		v.add("slug", "invalid_slug", "slug must be 1 to 50 lowercase letters, digits or hyphens")
+	}
+	return v.errors
+}
+
+func (r organizationInvitationRequest) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	if r.Role != "" && !isValidOrgRole(r.Role) {
+		v.add("role", "invalid_role", "role must be admin or member")
+	}
+	return v.errors
+}
+
+func (r organizationMemberRequest) validate() []FieldError {
+	var v validator
+	if v.required("role", r.Role) && !isValidOrgRole(r.Role) {
+		v.add("role", "invalid_role", "role must be admin or member")
+	}
+	return v.errors
+}
+
+func (r acceptInvitationRequest) validate() []FieldError {
+	var v validator
+	v.required("token", r.Token)
+	return v.errors
+}
+
+func isValidOrgRole(role string) bool {
+	return role == database.OrgRoleAdmin || role == database.OrgRoleMember
+}
+
+func isValidSlug(slug string) bool {
+	if slug == "" || len(slug) > maxSlugLength || slug[0] == '-' || slug[len(slug)-1] == '-' {
+		return false
+	}
+	for _, c := range slug {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// slugify derives a slug from an organization name, such as "acme-inc" from
+// "Acme, Inc.". It returns "" if name has no letters or digits.
+func slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+	}
+	return strings.TrimRight(slug, "-")
+}
+
+// applicationOrganization loads the {orgId} organization of app, writing an
+// error response and returning false if it does not exist
+func (s *Server) applicationOrganization(w http.ResponseWriter, r *http.Request, app *database.Application) (*database.Organization, bool) {
+	org, err := s.db.GetOrganization(app.ID, chi.URLParam(r, "orgId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch organization"))
+		return nil, false
+	}
+	if org == nil {
+		writeError(w, r, errOrganizationNotFound)
+		return nil, false
+	}
+	return org, true
+}
+
+// organizationSlug returns the slug to use for req, writing an error
+// response and returning false if it is unusable or taken by another
+// organization of the application
+func (s *Server) organizationSlug(w http.ResponseWriter, r *http.Request, appID string, req organizationRequest, exceptID string) (string, bool) {
+	slug := req.Slug
+	if slug == "" {
+		slug = slugify(req.Name)
+	}
+	if slug == "" {
+		writeError(w, r, validationError([]FieldError{{
+			Field: "slug", Code: codeRequired, Message: "slug is required when name has no letters or digits",
+		}}))
+		return "", false
+	}
+
+	existing, err := s.db.GetOrganizationBySlug(appID, slug)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check organization slug"))
+		return "", false
+	}
+	if existing != nil && existing.ID != exceptID {
+		writeError(w, r, errSlugTaken)
+		return "", false
+	}
+	return slug, true
+}
+
+// createOrganization stores a new organization, with creator as its admin
+// when not nil
+func (s *Server) createOrganization(w http.ResponseWriter, r *http.Request, app *database.Application, creator *database.User) {
+	var req organizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	slug, ok := s.organizationSlug(w, r, app.ID, req, "")
+	if !ok {
+		return
+	}
+
+	org := &database.Organization{
+		ID:            uuid.New().String(),
+		ApplicationID: app.ID,
+		Name:          req.Name,
+		Slug:          slug,
+	}
+	var member *database.OrganizationMember
+	if creator != nil {
+		member = &database.OrganizationMember{
+			OrganizationID: org.ID,
+			UserID:         creator.ID,
+			ApplicationID:  app.ID,
+			Role:           database.OrgRoleAdmin,
+		}
+	}
+	if err := s.db.CreateOrganization(org, member); err != nil {
+		writeError(w, r, internalError("Failed to create organization"))
+		return
+	}
+
+	auditAfter(r, org)
+	writeData(w, http.StatusCreated, org)
+}
+
+// inviteToOrganization emails an invitation to join org. invitedBy is the
+// inviting user's ID, or "developer".
+func (s *Server) inviteToOrganization(w http.ResponseWriter, r *http.Request, app *database.Application, org *database.Organization, invitedBy string) {
+	var req organizationInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	if req.Role == "" {
+		req.Role = database.OrgRoleMember
+	}
+
+	invitee, err := s.db.GetUserByEmail(app.ID, req.Email)
+	if err != nil {
+		writeError(w, r, internalError("Error checking for existing user"))
+		return
+	}
+	if invitee != nil {
+		member, err := s.db.GetOrganizationMember(org.ID, invitee.ID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check membership"))
+			return
+		}
+		if member != nil {
+			writeError(w, r, errAlreadyMember)
+			return
+		}
+	}
+
+	token, err := generateKey("", 32)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate token"))
+		return
+	}
+	invitation := &database.OrganizationInvitation{
+		ID:             uuid.New().String(),
+		OrganizationID: org.ID,
+		ApplicationID:  app.ID,
+		Email:          req.Email,
+		Role:           req.Role,
+		TokenHash:      hashToken(token),
+		InvitedBy:      invitedBy,
+		ExpiresAt:      time.Now().Add(organizationInviteTTL),
+	}
+	if err := s.db.CreateOrganizationInvitation(invitation); err != nil {
+		writeError(w, r, internalError("Failed to create invitation"))
+		return
+	}
+
+	link := appURL(app, "/accept-invitation", url.Values{"token": {token}})
+	body := "You have been invited to join " + org.Name + " on " + app.Name + ":\n\n" + link +
+		"\n\nThe invitation expires in 7 days."
+	if err := s.mailer.Send(req.Email, "You're invited to join "+org.Name, body); err != nil {
+		log.Printf("failed to send invitation %s: %v", invitation.ID, err)
+		writeError(w, r, internalError("Failed to send invitation email"))
+		return
+	}
+
+	auditAfter(r, invitation)
+	writeData(w, http.StatusCreated, invitation)
+}
+
+func (s *Server) handleGetOrganizations(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	orgs, err := s.db.GetOrganizations(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch organizations"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"organizations": orgs,
+		"count":         len(orgs),
+	})
+}
+
+func (s *Server) handleCreateOrganization(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	s.createOrganization(w, r, app, nil)
+}
+
+func (s *Server) handleGetOrganization(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+
+	writeData(w, http.StatusOK, org)
+}
+
+func (s *Server) handleUpdateOrganization(w http.ResponseWriter, r *http.Request) {
+	var req organizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, org)
+	auditAfter(r, org)
+
+	// Keep the existing slug unless a new one is given
+	if req.Slug == "" {
+		req.Slug = org.Slug
+	}
+	slug, ok := s.organizationSlug(w, r, app.ID, req, org.ID)
+	if !ok {
+		return
+	}
+
+	org.Name = req.Name
+	org.Slug = slug
+	if err := s.db.UpdateOrganization(org); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errOrganizationNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update organization"))
+		return
+	}
+
+	writeData(w, http.StatusOK, org)
+}
+
+func (s *Server) handleDeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, org)
+
+	if err := s.db.DeleteOrganization(app.ID, org.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errOrganizationNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete organization"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleGetOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+
+	members, err := s.db.GetOrganizationMembers(org.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch members"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"members": members,
+		"count":   len(members),
+	})
+}
+
+// handleSetOrganizationMember adds a user to an organization directly, or
+// changes their role if they are already a member
+func (s *Server) handleSetOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	var req organizationMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+
+	existing, err := s.db.GetOrganizationMember(org.ID, user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch member"))
+		return
+	}
+	auditBefore(r, existing)
+
+	member := &database.OrganizationMember{
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+		ApplicationID:  app.ID,
+		Role:           req.Role,
+	}
+	if err := s.db.SetOrganizationMember(member); err != nil {
+		writeError(w, r, internalError("Failed to set member"))
+		return
+	}
+	auditAfter(r, member)
+
+	writeData(w, http.StatusOK, member)
+}
+
+func (s *Server) handleRemoveOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteOrganizationMember(org.ID, chi.URLParam(r, "userId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errNotOrganizationMember)
+			return
+		}
+		writeError(w, r, internalError("Failed to remove member"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleCreateOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+	s.inviteToOrganization(w, r, app, org, "developer")
+}
+
+func (s *Server) handleGetOrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+
+	invitations, err := s.db.GetOrganizationInvitations(org.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch invitations"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"invitations": invitations,
+		"count":       len(invitations),
+	})
+}
+
+func (s *Server) handleRevokeOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteOrganizationInvitation(org.ID, chi.URLParam(r, "invitationId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvitationNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to revoke invitation"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleGetMyOrganizations(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*database.User)
+
+	orgs, err := s.db.GetUserOrganizations(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch organizations"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"organizations": orgs,
+		"count":         len(orgs),
+	})
+}
+
+// handleCreateMyOrganization creates an organization with the session's
+// user as its admin
+func (s *Server) handleCreateMyOrganization(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("application").(*database.Application)
+	user := r.Context().Value("user").(*database.User)
+	s.createOrganization(w, r, app, user)
+}
+
+// handleInviteToMyOrganization lets an organization admin invite others
+func (s *Server) handleInviteToMyOrganization(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("application").(*database.Application)
+	user := r.Context().Value("user").(*database.User)
+
+	org, ok := s.applicationOrganization(w, r, app)
+	if !ok {
+		return
+	}
+	member, err := s.db.GetOrganizationMember(org.ID, user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check membership"))
+		return
+	}
+	if member == nil {
+		writeError(w, r, errNotOrganizationMember)
+		return
+	}
+	if member.Role != database.OrgRoleAdmin {
+		writeError(w, r, errOrganizationAdminRequired)
+		return
+	}
+
+	s.inviteToOrganization(w, r, app, org, user.ID)
+}
+
+// handleAcceptInvitation adds the session's user to the organization of an
+// invitation sent to their email address
+func (s *Server) handleAcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var req acceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+	user := r.Context().Value("user").(*database.User)
+
+	invitation, err := s.db.GetOrganizationInvitationByToken(hashToken(req.Token))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up invitation"))
+		return
+	}
+	if invitation == nil || invitation.ApplicationID != app.ID || invitation.Accepted ||
+		invitation.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidInvitation)
+		return
+	}
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		writeError(w, r, errInvitationEmailMismatch)
+		return
+	}
+
+	if err := s.db.AcceptOrganizationInvitation(invitation, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvalidInvitation)
+			return
+		}
+		writeError(w, r, internalError("Failed to accept invitation"))
+		return
+	}
+
+	member, err := s.db.GetOrganizationMember(invitation.OrganizationID, user.ID)
+	if err != nil || member == nil {
+		writeError(w, r, internalError("Failed to fetch membership"))
+		return
+	}
+
+	writeData(w, http.StatusOK, member)
+}
+
+// handleSetActiveOrganization selects the organization the session acts in
+// and returns a new access token carrying it
+func (s *Server) handleSetActiveOrganization(w http.ResponseWriter, r *http.Request) {
+	var req activeOrganizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+	session := r.Context().Value("session").(*database.Session)
+	user := r.Context().Value("user").(*database.User)
+
+	if req.OrganizationID != "" {
+		member, err := s.db.GetOrganizationMember(req.OrganizationID, user.ID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check membership"))
+			return
+		}
+		if member == nil || member.ApplicationID != app.ID {
+			writeError(w, r, errNotOrganizationMember)
+			return
+		}
+	}
+
+	if err := s.db.SetSessionActiveOrganization(session.ID, req.OrganizationID); err != nil {
+		writeError(w, r, internalError("Failed to set active organization"))
+		return
+	}
+	session.ActiveOrganizationID = req.OrganizationID
+
+	s.writeSession(w, r, http.StatusOK, app, user, session)
+}
+
+// activeOrganization returns the session's active organization among orgs,
+// or nil if it has none or the user has since left it
+func activeOrganization(session *database.Session, orgs []database.UserOrganization) *database.UserOrganization {
+	for i := range orgs {
+		if orgs[i].ID == session.ActiveOrganizationID {
+			return &orgs[i]
+		}
+	}
+	return nil
+}
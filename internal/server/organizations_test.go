@@ -0,0 +1,70 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Acme", "acme"},
+		{"Acme, Inc.", "acme-inc"},
+		{"  Big   Co 2  ", "big-co-2"},
+		{"Ünïcode Ltd", "n-code-ltd"},
+		{"!!!", ""},
+		{strings.Repeat("ab ", 30), strings.TrimRight(strings.Repeat("ab-", 17)[:50], "-")},
+	}
+
+	for _, tt := range tests {
+		got := slugify(tt.name)
+		if got != tt.want {
+			t.Errorf("slugify(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+		if got != "" && !isValidSlug(got) {
+			t.Errorf("slugify(%q) = %q is not a valid slug", tt.name, got)
+		}
+	}
+}
+
+func TestIsValidSlug(t *testing.T) {
+	tests := []struct {
+		slug string
+		want bool
+	}{
+		{"acme", true},
+		{"acme-inc-2", true},
+		{"", false},
+		{"-acme", false},
+		{"acme-", false},
+		{"Acme", false},
+		{"acme_inc", false},
+		{strings.Repeat("a", 51), false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidSlug(tt.slug); got != tt.want {
+			t.Errorf("isValidSlug(%q) = %v; want %v", tt.slug, got, tt.want)
+		}
+	}
+}
+
+func TestActiveOrganization(t *testing.T) {
+	orgs := []database.UserOrganization{
+		{Organization: database.Organization{ID: "o1"}, Role: database.OrgRoleMember},
+		{Organization: database.Organization{ID: "o2"}, Role: database.OrgRoleAdmin},
+	}
+
+	if got := activeOrganization(&database.Session{ActiveOrganizationID: "o2"}, orgs); got == nil || got.Role != database.OrgRoleAdmin {
+		t.Errorf("expected o2 as admin; got %+v", got)
+	}
+	if got := activeOrganization(&database.Session{ActiveOrganizationID: "gone"}, orgs); got != nil {
+		t.Errorf("expected nil for an organization the user left; got %+v", got)
+	}
+	if got := activeOrganization(&database.Session{}, orgs); got != nil {
+		t.Errorf("expected nil without an active organization; got %+v", got)
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	outboxPollInterval = time.Second
+	outboxBatch        = 200
+	maxOutboxAttempts  = 20
+	outboxBaseRetry    = time.Second
+	outboxMaxRetry     = 10 * time.Minute
+	outboxRetention    = 7 * 24 * time.Hour
+)
+
+// eventEnvelope is the JSON form of an event as sinks receive it
+type eventEnvelope struct {
+	ID            string      `json:"id"`
+	Type          string      `json:"type"`
+	ApplicationID string      `json:"applicationId"`
+	CreatedAt     time.Time   `json:"createdAt"`
+	Data          interface{} `json:"data"`
+}
+
+// newEvent builds an outbox event, to be passed to the database method that
+// makes the change it describes
+func newEvent(applicationID, eventType string, data interface{}) database.OutboxEvent {
+	envelope := eventEnvelope{
+		ID:            "evt_" + uuid.New().String(),
+		Type:          eventType,
+		ApplicationID: applicationID,
+		CreatedAt:     time.Now().UTC(),
+		Data:          data,
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		log.Printf("failed to encode data of %s event %s: %v", eventType, envelope.ID, err)
+		envelope.Data = nil
+		payload, _ = json.Marshal(envelope)
+	}
+	return database.OutboxEvent{
+		ID:            envelope.ID,
+		ApplicationID: applicationID,
+		Type:          eventType,
+		Payload:       payload,
+	}
+}
+
+// EventSink receives the events drained from the outbox. An event may be
+// sent again after a failure of any sink or a restart, so sinks must
+// tolerate duplicates. Events of one application arrive in the order they
+// were recorded.
+type EventSink interface {
+	Name() string
+	Send(event *database.OutboxEvent) error
+}
+
+// MessagePublisher is implemented by message queue clients. The key is the
+// application ID, so queues that partition by key keep each application's
+// events in order.
+type MessagePublisher interface {
+	Publish(topic, key string, body []byte) error
+}
+
+// queueSink publishes events to a message queue. No client is bundled; a
+// deployment adds one by passing its MessagePublisher to newQueueSink.
+type queueSink struct {
+	topic     string
+	publisher MessagePublisher
+}
+
+func newQueueSink(topic string, publisher MessagePublisher) *queueSink {
+	return &queueSink{topic: topic, publisher: publisher}
+}
+
+func (q *queueSink) Name() string { return "queue:" + q.topic }
+
+func (q *queueSink) Send(e *database.OutboxEvent) error {
+	return q.publisher.Publish(q.topic, e.ApplicationID, e.Payload)
+}
+
+// writerSink writes each event as a line of JSON
+type writerSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func (s *writerSink) Name() string { return s.name }
+
+func (s *writerSink) Send(e *database.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := append(append([]byte{}, e.Payload...), '\n')
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	// Make sure the event is on disk before it is marked dispatched
+	if f, ok := s.w.(interface{ Sync() error }); ok && s.w != os.Stdout {
+		return f.Sync()
+	}
+	return nil
+}
+
+// webhookSink queues a delivery of each event to the application's webhook
+// endpoints subscribed to it
+type webhookSink struct {
+	db       database.Service
+	webhooks *webhookDispatcher
+}
+
+func (s *webhookSink) Name() string { return "webhooks" }
+
+func (s *webhookSink) Send(e *database.OutboxEvent) error {
+	endpoints, err := s.db.GetWebhookEndpoints(e.ApplicationID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	var deliveries []database.WebhookDelivery
+	for i := range endpoints {
+		if !subscribed(&endpoints[i], e.Type) {
+			continue
+		}
+		deliveries = append(deliveries, database.WebhookDelivery{
+			ID:            uuid.New().String(),
+			EndpointID:    endpoints[i].ID,
+			ApplicationID: e.ApplicationID,
+			EventID:       e.ID,
+			EventType:     e.Type,
+			Payload:       e.Payload,
+			Status:        database.WebhookDeliveryPending,
+			NextAttemptAt: &now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	if err := s.db.CreateWebhookDeliveries(deliveries); err != nil {
+		return err
+	}
+	s.webhooks.wake()
+	return nil
+}
+
+// newEventSinks builds the sinks named in a comma separated list: webhooks,
+// stdout, or file, which appends to the file at filePath
+func newEventSinks(names, filePath string, db database.Service, webhooks *webhookDispatcher) ([]EventSink, error) {
+	var sinks []EventSink
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "webhooks":
+			sinks = append(sinks, &webhookSink{db: db, webhooks: webhooks})
+		case "stdout":
+			sinks = append(sinks, &writerSink{name: "stdout", w: os.Stdout})
+		case "file":
+			if filePath == "" {
+				return nil, fmt.Errorf("the file event sink needs EVENT_SINK_FILE")
+			}
+			f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, &writerSink{name: "file", w: f})
+		default:
+			return nil, fmt.Errorf("unknown event sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
+// outboxRetryDelay returns how long to wait before dispatching an event
+// again after it failed attempts times
+func outboxRetryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	shift := attempts - 1
+	if shift > 20 {
+		return outboxMaxRetry
+	}
+	d := outboxBaseRetry << shift
+	if d > outboxMaxRetry {
+		return outboxMaxRetry
+	}
+	return d
+}
+
+// outboxDispatcher drains the outbox to its sinks. Each event is sent to
+// every sink and marked dispatched once all of them accepted it, giving
+// at-least-once delivery. An event that is waiting for a retry holds back
+// the later events of its application, keeping them in order, until it
+// succeeds or is given up on after maxOutboxAttempts.
+type outboxDispatcher struct {
+	db      database.Service
+	sinks   []EventSink
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newOutboxDispatcher(db database.Service, sinks []EventSink) *outboxDispatcher {
+	return &outboxDispatcher{
+		db:      db,
+		sinks:   sinks,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// stop ends run after the event in progress, if any
+func (d *outboxDispatcher) stop() {
+	close(d.done)
+	<-d.stopped
+}
+
+func (d *outboxDispatcher) run() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+
+	for {
+		if time.Since(lastPrune) >= time.Hour {
+			lastPrune = time.Now()
+			if _, err := d.db.DeleteDispatchedOutboxEvents(lastPrune.Add(-outboxRetention)); err != nil {
+				log.Printf("failed to prune outbox: %v", err)
+			}
+		}
+		d.dispatchPending()
+
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchPending sends due events until none are left. Applications
+// whose earliest event waits for a retry are left out by the query, so
+// they cannot fill a batch and hold back the others.
+func (d *outboxDispatcher) dispatchPending() {
+	for {
+		now := time.Now()
+		events, err := d.db.GetDueOutboxEvents(now, outboxBatch)
+		if err != nil {
+			log.Printf("failed to fetch outbox events: %v", err)
+			return
+		}
+
+		blocked := make(map[string]bool)
+		progressed := false
+		for i := range events {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+
+			e := &events[i]
+			if blocked[e.ApplicationID] {
+				continue
+			}
+			sent, recorded := d.dispatch(e, now)
+			if recorded {
+				progressed = true
+			}
+			if !sent {
+				blocked[e.ApplicationID] = true
+			}
+		}
+
+		if len(events) < outboxBatch || !progressed {
+			return
+		}
+	}
+}
+
+// dispatch sends e to every sink and records the outcome. It reports
+// whether the later events of the application may follow, which they may
+// not while e is to be retried, and whether the outcome was recorded.
+func (d *outboxDispatcher) dispatch(e *database.OutboxEvent, now time.Time) (sent, recorded bool) {
+	var failure error
+	for _, sink := range d.sinks {
+		if err := sink.Send(e); err != nil {
+			failure = fmt.Errorf("%s: %w", sink.Name(), err)
+			break
+		}
+	}
+
+	e.Attempts++
+	retry := false
+	switch {
+	case failure == nil:
+		e.Status = database.OutboxDispatched
+		e.NextAttemptAt = nil
+		e.LastError = ""
+		e.DispatchedAt = &now
+	case e.Attempts >= maxOutboxAttempts:
+		log.Printf("giving up on %s event %s after %d attempts: %v", e.Type, e.ID, e.Attempts, failure)
+		e.Status = database.OutboxFailed
+		e.NextAttemptAt = nil
+		e.LastError = failure.Error()
+	default:
+		next := now.Add(outboxRetryDelay(e.Attempts))
+		e.NextAttemptAt = &next
+		e.LastError = failure.Error()
+		retry = true
+	}
+
+	if err := d.db.UpdateOutboxEvent(e); err != nil {
+		// The event stays pending and will be sent again
+		log.Printf("failed to record dispatch of event %s: %v", e.ID, err)
+		return false, false
+	}
+	return !retry, true
+}
@@ -0,0 +1,235 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedEvents records events with the given IDs for the user's application,
+// in order
+func seedEvents(t *testing.T, s *Server, user *database.User, ids ...string) {
+	t.Helper()
+	var events []database.OutboxEvent
+	for _, id := range ids {
+		e := newEvent(user.ApplicationID, eventUserUpdated, nil)
+		e.ID = id
+		events = append(events, e)
+	}
+	if err := s.db.UpdateUserProfile(user, events...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pendingEvent returns the pending event with the given ID, or nil
+func pendingEvent(t *testing.T, s *Server, id string) *database.OutboxEvent {
+	t.Helper()
+	for _, e := range pendingEvents(t, s) {
+		if e.ID == id {
+			return &e
+		}
+	}
+	return nil
+}
+
+// newOutboxServer seeds app-a and app-b, each with one user
+func newOutboxServer(t *testing.T) (s *Server, a, b *database.User) {
+	s = newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-a", "dev-1")
+	seedApplication(t, s, "app-b", "dev-1")
+	return s, seedUser(t, s, "app-a", "user-a", "a@example.com"), seedUser(t, s, "app-b", "user-b", "b@example.com")
+}
+
+// recordingSink remembers the events it was sent and fails those in fail
+type recordingSink struct {
+	sent []string
+	fail map[string]bool
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Send(e *database.OutboxEvent) error {
+	if s.fail[e.ID] {
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, e.ID)
+	return nil
+}
+
+func TestOutboxDispatchKeepsApplicationOrder(t *testing.T) {
+	s, a, b := newOutboxServer(t)
+	seedEvents(t, s, a, "a1")
+	seedEvents(t, s, b, "b1")
+	seedEvents(t, s, a, "a2")
+	seedEvents(t, s, b, "b2")
+	sink := &recordingSink{fail: map[string]bool{"a1": true}}
+	d := newOutboxDispatcher(s.db, []EventSink{sink})
+
+	d.dispatchPending()
+	if got := strings.Join(sink.sent, ","); got != "b1,b2" {
+		t.Fatalf("expected only app-b events to be sent while a1 fails; sent %s", got)
+	}
+	a1 := pendingEvent(t, s, "a1")
+	if a1 == nil || a1.Attempts != 1 || a1.NextAttemptAt == nil || a1.LastError == "" {
+		t.Fatalf("expected a1 to be scheduled for a retry; got %+v", a1)
+	}
+
+	// a1 is not retried before it is due
+	delete(sink.fail, "a1")
+	d.dispatchPending()
+	if len(sink.sent) != 2 {
+		t.Fatalf("expected a1 to wait for its retry; sent %v", sink.sent)
+	}
+
+	// Once a1 succeeds, a2 follows it
+	past := time.Now().Add(-time.Second)
+	a1.NextAttemptAt = &past
+	if err := s.db.UpdateOutboxEvent(a1); err != nil {
+		t.Fatal(err)
+	}
+	d.dispatchPending()
+	if got := strings.Join(sink.sent, ","); got != "b1,b2,a1,a2" {
+		t.Fatalf("expected a1 then a2 to be sent; sent %s", got)
+	}
+	if pending := pendingEvents(t, s); len(pending) != 0 {
+		t.Errorf("expected every event to be dispatched; %s left", eventTypes(pending))
+	}
+}
+
+func TestOutboxDispatchSkipsWaitingApplications(t *testing.T) {
+	s, a, b := newOutboxServer(t)
+	// More events of app-a than fit a batch, queued behind one that waits
+	ids := []string{"a0"}
+	for i := 1; i <= outboxBatch; i++ {
+		ids = append(ids, "a"+strconv.Itoa(i))
+	}
+	seedEvents(t, s, a, ids...)
+	seedEvents(t, s, b, "b1")
+
+	a0 := pendingEvent(t, s, "a0")
+	later := time.Now().Add(time.Hour)
+	a0.Attempts, a0.NextAttemptAt, a0.LastError = 1, &later, "unavailable"
+	if err := s.db.UpdateOutboxEvent(a0); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	newOutboxDispatcher(s.db, []EventSink{sink}).dispatchPending()
+	if got := strings.Join(sink.sent, ","); got != "b1" {
+		t.Errorf("expected app-b to be dispatched past app-a's backlog; sent %s", got)
+	}
+}
+
+func TestOutboxDispatchGivesUp(t *testing.T) {
+	s, a, _ := newOutboxServer(t)
+	seedEvents(t, s, a, "a1", "a2")
+	a1 := pendingEvent(t, s, "a1")
+	a1.Attempts = maxOutboxAttempts - 1
+	if err := s.db.UpdateOutboxEvent(a1); err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{fail: map[string]bool{"a1": true}}
+	d := newOutboxDispatcher(s.db, []EventSink{sink})
+
+	d.dispatchPending()
+	if pendingEvent(t, s, "a1") != nil {
+		t.Error("expected a1 to fail for good")
+	}
+	if len(sink.sent) != 1 || sink.sent[0] != "a2" {
+		t.Errorf("expected a2 to be sent after a1 was given up on; sent %v", sink.sent)
+	}
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{4, 8 * time.Second},
+		{10, 512 * time.Second},
+		{11, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := outboxRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("outboxRetryDelay(%d) = %v; want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	e := newEvent("app-1", eventSessionRevoked, sessionRevokedData{UserID: "u1", Reason: revokedPasswordChanged})
+
+	var envelope struct {
+		ID            string             `json:"id"`
+		Type          string             `json:"type"`
+		ApplicationID string             `json:"applicationId"`
+		Data          sessionRevokedData `json:"data"`
+	}
+	if err := json.Unmarshal(e.Payload, &envelope); err != nil {
+		t.Fatalf("payload is not valid JSON: %v", err)
+	}
+	if envelope.ID != e.ID || envelope.Type != e.Type || envelope.ApplicationID != "app-1" || envelope.Data.UserID != "u1" {
+		t.Errorf("payload %s does not match event %+v", e.Payload, e)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &writerSink{name: "test", w: &buf}
+	for _, payload := range []string{`{"id":"1"}`, `{"id":"2"}`} {
+		if err := sink.Send(&database.OutboxEvent{Payload: json.RawMessage(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := buf.String(); got != "{\"id\":\"1\"}\n{\"id\":\"2\"}\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestNewEventSinks(t *testing.T) {
+	sinks, err := newEventSinks("webhooks, stdout", "", nil, nil)
+	if err != nil || len(sinks) != 2 || sinks[0].Name() != "webhooks" || sinks[1].Name() != "stdout" {
+		t.Errorf("newEventSinks() = %v, %v", sinks, err)
+	}
+	if _, err := newEventSinks("file", "", nil, nil); err == nil {
+		t.Error("expected the file sink to require a path")
+	}
+	if _, err := newEventSinks("kafka", "", nil, nil); err == nil {
+		t.Error("expected an unknown sink to be rejected")
+	}
+}
+
+type fakePublisher struct {
+	topic, key string
+	body       []byte
+}
+
+func (p *fakePublisher) Publish(topic, key string, body []byte) error {
+	p.topic, p.key, p.body = topic, key, body
+	return nil
+}
+
+func TestQueueSinkKeysByApplication(t *testing.T) {
+	publisher := &fakePublisher{}
+	sink := newQueueSink("auth-events", publisher)
+	e := &database.OutboxEvent{ApplicationID: "app-1", Payload: json.RawMessage(`{"id":"1"}`)}
+
+	if err := sink.Send(e); err != nil {
+		t.Fatal(err)
+	}
+	if publisher.topic != "auth-events" || publisher.key != "app-1" || string(publisher.body) != `{"id":"1"}` {
+		t.Errorf("unexpected publish %+v", publisher)
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy violation codes returned in FieldError.Code
+const (
+	codePasswordTooShort      = "password_too_short"
+	codePasswordTooLong       = "password_too_long"
+	codePasswordNoUppercase   = "password_missing_uppercase"
+	codePasswordNoLowercase   = "password_missing_lowercase"
+	codePasswordNoDigit       = "password_missing_digit"
+	codePasswordNoSymbol      = "password_missing_symbol"
+	codePasswordContainsEmail = "password_contains_email"
+	codePasswordBreached      = "password_breached"
+	codePasswordReused        = "password_reused"
+	codeOutOfRange            = "out_of_range"
+)
+
+// defaultPasswordPolicy applies to developers and to applications that have
+// not configured their own policy
+var defaultPasswordPolicy = database.PasswordPolicy{
+	MinLength:     8,
+	MaxLength:     maxPasswordLength,
+	DisallowEmail: true,
+	CheckBreached: true,
+}
+
+// effectivePasswordPolicy fills in defaults for a possibly nil or partial policy
+func effectivePasswordPolicy(p *database.PasswordPolicy) database.PasswordPolicy {
+	if p == nil {
+		return defaultPasswordPolicy
+	}
+	policy := *p
+	if policy.MinLength == 0 {
+		policy.MinLength = defaultPasswordPolicy.MinLength
+	}
+	if policy.MaxLength == 0 {
+		policy.MaxLength = defaultPasswordPolicy.MaxLength
+	}
+	return policy
+}
+
+// checkPassword returns the policy violations for password, or nil
+func (s *Server) checkPassword(p *database.PasswordPolicy, email, password string) []FieldError {
+	policy := effectivePasswordPolicy(p)
+	var v validator
+
+	if n := utf8.RuneCountInString(password); n < policy.MinLength {
+		v.add("password", codePasswordTooShort, "password must be at least "+strconv.Itoa(policy.MinLength)+" characters")
+	}
+	// The maximum is measured in bytes since that is what bcrypt truncates
+	if len(password) > policy.MaxLength {
+		v.add("password", codePasswordTooLong, "password must be at most "+strconv.Itoa(policy.MaxLength)+" bytes")
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if policy.RequireUppercase && !upper {
+		v.add("password", codePasswordNoUppercase, "password must contain an uppercase letter")
+	}
+	if policy.RequireLowercase && !lower {
+		v.add("password", codePasswordNoLowercase, "password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		v.add("password", codePasswordNoDigit, "password must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		v.add("password", codePasswordNoSymbol, "password must contain a symbol")
+	}
+
+	if policy.DisallowEmail && containsEmail(password, email) {
+		v.add("password", codePasswordContainsEmail, "password must not contain the email address")
+	}
+
+	if policy.CheckBreached && s.breached != nil && s.breached.contains(password) {
+		v.add("password", codePasswordBreached, "password has appeared in a data breach")
+	}
+
+	return v.errors
+}
+
+// containsEmail reports whether password contains the email address or its
+// local part (when that is long enough to be meaningful)
+func containsEmail(password, email string) bool {
+	if email == "" {
+		return false
+	}
+	password = strings.ToLower(password)
+	email = strings.ToLower(email)
+	if strings.Contains(password, email) {
+		return true
+	}
+	local, _, _ := strings.Cut(email, "@")
+	return len(local) >= 4 && strings.Contains(password, local)
+}
+
+// breachedPasswordList is a set of SHA-1 password hashes grouped by their
+// five-character prefix, the same k-anonymity layout as the Have I Been Pwned
+// range files. A list loaded from a directory of range files reads only the
+// file for the prefix being checked; one loaded from a single file is held
+// in ranges.
+type breachedPasswordList struct {
+	dir    string
+	ranges map[string]map[string]struct{}
+}
+
+// loadBreachedPasswords reads a breached password file from path. If path
+// is a directory, it is used as a directory of range files instead.
+func loadBreachedPasswords(path string) (*breachedPasswordList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &breachedPasswordList{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBreachedPasswords(f)
+}
+
+// parseBreachedPasswords reads lines of the form "<sha1 hex>[:count]". Blank
+// lines and lines starting with # are ignored.
+func parseBreachedPasswords(r io.Reader) (*breachedPasswordList, error) {
+	list := &breachedPasswordList{ranges: make(map[string]map[string]struct{})}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("line %d: expected a 40 character SHA-1 hash", line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefix, suffix := hash[:5], hash[5:]
+		if list.ranges[prefix] == nil {
+			list.ranges[prefix] = make(map[string]struct{})
+		}
+		list.ranges[prefix][suffix] = struct{}{}
+	}
+	return list, scanner.Err()
+}
+
+// contains reports whether password is on the list. A range file that
+// cannot be read is logged and treated as not listing the password, so that
+// a broken mirror does not block sign-ups.
+func (l *breachedPasswordList) contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if l.dir == "" {
+		_, ok := l.ranges[hash[:5]][hash[5:]]
+		return ok
+	}
+
+	found, err := searchBreachedRange(l.dir, hash[:5], hash[5:])
+	if err != nil {
+		log.Printf("failed to check breached password range %s: %v", hash[:5], err)
+	}
+	return found
+}
+
+// searchBreachedRange looks for suffix in the range file of prefix in dir,
+// named "<prefix>.txt" as the HIBP downloader writes them, or just
+// "<prefix>". Each line is a 35 character hash suffix, optionally followed by
+// ":count". A prefix without a file has no breached passwords.
+func searchBreachedRange(dir, prefix, suffix string) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(dir, prefix))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if len(line) == len(suffix) && strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// validatePasswordPolicy checks a policy sent by a developer. A length of 0
+// leaves the default in place.
+func validatePasswordPolicy(p *database.PasswordPolicy) []FieldError {
+	var v validator
+	if p.MinLength < 0 || p.MinLength > maxPasswordLength {
+		v.add("minLength", codeOutOfRange, "minLength must be between 1 and "+strconv.Itoa(maxPasswordLength)+", or 0 for the default")
+	}
+	if p.MaxLength < 0 || p.MaxLength > maxPasswordLength {
+		v.add("maxLength", codeOutOfRange, "maxLength must be between 1 and "+strconv.Itoa(maxPasswordLength)+", or 0 for the default")
+	}
+	if policy := effectivePasswordPolicy(p); policy.MaxLength < policy.MinLength {
+		v.add("maxLength", codeOutOfRange, "maxLength must not be less than minLength")
+	}
+	return v.errors
+}
+
+// handleUpdatePasswordPolicy replaces the application's password policy.
+// Sending null resets it to the server defaults.
+func (s *Server) handleUpdatePasswordPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy *database.PasswordPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if policy != nil {
+		if errs := validatePasswordPolicy(policy); len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, app.PasswordPolicy)
+
+	if err := s.db.UpdateApplicationPasswordPolicy(app.ID, app.DeveloperID, policy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update password policy"))
+		return
+	}
+	auditAfter(r, policy)
+
+	writeData(w, http.StatusOK, effectivePasswordPolicy(policy))
+}
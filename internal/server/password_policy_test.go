@@ -0,0 +1,117 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	// SHA-1 of "password123"
+	breached, err := parseBreachedPasswords(strings.NewReader("# test list\nCBFDAC6008F9CAB4083784CBD1874F76618D2A97:1\n"))
+	if err != nil {
+		t.Fatalf("error parsing breached passwords. Err: %v", err)
+	}
+	s := &Server{breached: breached}
+
+	strict := &database.PasswordPolicy{
+		MinLength:        10,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowEmail:    true,
+		CheckBreached:    true,
+	}
+
+	tests := []struct {
+		name     string
+		policy   *database.PasswordPolicy
+		password string
+		want     []string
+	}{
+		{"default ok", nil, "correct horse battery", nil},
+		{"default too short", nil, "short", []string{codePasswordTooShort}},
+		{"default breached", nil, "password123", []string{codePasswordBreached}},
+		{"contains email", nil, "janedoe-rules", []string{codePasswordContainsEmail}},
+		{"strict ok", strict, "Tr0ub4dor&3xyz", nil},
+		{"strict missing classes", strict, "abcdefghijkl", []string{codePasswordNoUppercase, codePasswordNoDigit, codePasswordNoSymbol}},
+	}
+	for _, tt := range tests {
+		errs := s.checkPassword(tt.policy, "janedoe@example.com", tt.password)
+		var got []string
+		for _, e := range errs {
+			got = append(got, e.Code)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: expected %v; got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestParseBreachedPasswordsRejectsMalformedLines(t *testing.T) {
+	if _, err := parseBreachedPasswords(strings.NewReader("not-a-hash\n")); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestBreachedPasswordRangeFiles(t *testing.T) {
+	dir := t.TempDir()
+	// The range of "password123", whose SHA-1 is CBFDAC6008F9CAB4083784CBD1874F76618D2A97
+	body := "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\nC6008F9CAB4083784CBD1874F76618D2A97:2254650\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "CBFDA.txt"), []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := loadBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.ranges != nil {
+		t.Error("expected a directory of range files not to be loaded into memory")
+	}
+	for password, want := range map[string]bool{
+		"password123":           true,
+		"correct horse battery": false,
+	} {
+		if got := list.contains(password); got != want {
+			t.Errorf("contains(%q) = %v; want %v", password, got, want)
+		}
+	}
+
+	// Suffixes other than the password's in its range file do not match
+	if found, err := searchBreachedRange(dir, "CBFDA", "0018A45C4D1DEF81644B54AB7F969B88D66"); found || err != nil {
+		t.Errorf("expected no match; got %v, %v", found, err)
+	}
+}
+
+func TestValidatePasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy database.PasswordPolicy
+		field  string
+	}{
+		{"defaults", database.PasswordPolicy{}, ""},
+		{"full range", database.PasswordPolicy{MinLength: 1, MaxLength: maxPasswordLength}, ""},
+		{"only maxLength", database.PasswordPolicy{MaxLength: 8}, ""},
+		{"negative minLength", database.PasswordPolicy{MinLength: -1}, "minLength"},
+		{"maxLength too long", database.PasswordPolicy{MaxLength: maxPasswordLength + 1}, "maxLength"},
+		{"maxLength below default minLength", database.PasswordPolicy{MaxLength: 7}, "maxLength"},
+		{"maxLength below minLength", database.PasswordPolicy{MinLength: 20, MaxLength: 10}, "maxLength"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validatePasswordPolicy(&tt.policy)
+			if tt.field == "" {
+				if len(errs) != 0 {
+					t.Errorf("expected the policy to be valid; got %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Code != codeOutOfRange {
+				t.Errorf("expected %s to be out of range; got %v", tt.field, errs)
+			}
+		})
+	}
+}
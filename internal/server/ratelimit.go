@@ -0,0 +1,329 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Route groups that are rate limited separately
+const (
+	// rateLimitDeveloperAuth covers developer login and registration, limited
+	// per client IP
+	rateLimitDeveloperAuth = "developer_auth"
+	// rateLimitDeveloperAPI covers the JWT protected management API, limited
+	// per developer
+	rateLimitDeveloperAPI = "developer_api"
+	// rateLimitUserAuth covers user registration, login and the token flows,
+	// limited per application
+	rateLimitUserAuth = "user_auth"
+	// rateLimitUserAPI covers the remaining API key routes, limited per
+	// application
+	rateLimitUserAPI = "user_api"
+	// rateLimitAPIKeyAuth covers every API key route before the key is
+	// looked up, limited per public key and client IP
+	rateLimitAPIKeyAuth = "api_key_auth"
+)
+
+// defaultRateLimits apply to every route group unless an application
+// overrides the limit of one of its groups
+var defaultRateLimits = map[string]database.RateLimit{
+	rateLimitDeveloperAuth: {Requests: 20, Window: 60},
+	rateLimitDeveloperAPI:  {Requests: 600, Window: 60},
+	rateLimitUserAuth:      {Requests: 600, Window: 60},
+	rateLimitUserAPI:       {Requests: 3000, Window: 60},
+	rateLimitAPIKeyAuth:    {Requests: 600, Window: 60},
+}
+
+// clientIPRateLimits limit each client IP within the groups that are
+// otherwise counted per application or per public key, so that one client
+// cannot use up an application's whole allowance. The api_key_auth limit
+// also stops one client from cycling through made-up public keys.
+var clientIPRateLimits = map[string]database.RateLimit{
+	rateLimitUserAuth:   {Requests: 120, Window: 60},
+	rateLimitUserAPI:    {Requests: 600, Window: 60},
+	rateLimitAPIKeyAuth: {Requests: 1200, Window: 60},
+}
+
+// applicationRateLimitGroups are the groups an application may set its own
+// limits for
+var applicationRateLimitGroups = []string{rateLimitUserAuth, rateLimitUserAPI}
+
+const (
+	maxRateLimitRequests = 100000
+	maxRateLimitWindow   = 86400
+)
+
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available, when not Allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// TokenBucket is the state of one rate limit bucket. It holds up to
+// limit.Requests tokens and refills at limit.Requests per limit.Window.
+type TokenBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills b for the time elapsed since it was last updated and removes
+// a token if one is available. A zero bucket starts out full.
+func (b *TokenBucket) Take(limit database.RateLimit, now time.Time) RateLimitResult {
+	capacity := float64(limit.Requests)
+	rate := capacity / float64(limit.Window) // tokens per second
+
+	if b.Updated.IsZero() {
+		b.Tokens = capacity
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+	}
+	b.Updated = now
+
+	result := RateLimitResult{Allowed: b.Tokens >= 1}
+	if result.Allowed {
+		b.Tokens--
+	} else {
+		result.RetryAfter = secondsDuration((1 - b.Tokens) / rate)
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = secondsDuration((capacity - b.Tokens) / rate)
+	return result
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimitStore holds the token buckets of the rate limiter. The in-memory
+// store only limits requests within one instance; deployments running
+// several instances can plug in a store shared between them.
+type RateLimitStore interface {
+	// Take takes a token from the bucket named key under limit
+	Take(key string, limit database.RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// maxRateLimitBuckets bounds the memory store. Once it is reached the
+// buckets used least recently are dropped first.
+const maxRateLimitBuckets = 100000
+
+type memoryBucket struct {
+	TokenBucket
+	key    string
+	window time.Duration
+}
+
+type memoryRateLimitStore struct {
+	// max bounds how many buckets are kept
+	max int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// order holds the *memoryBucket, least recently used first
+	order *list.List
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		max:     maxRateLimitBuckets,
+		buckets: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (m *memoryRateLimitStore) Take(key string, limit database.RateLimit, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.buckets[key]
+	if ok {
+		m.order.MoveToBack(e)
+	} else {
+		m.sweep(now)
+		for m.order.Len() >= m.max {
+			m.evict(m.order.Front())
+		}
+		e = m.order.PushBack(&memoryBucket{key: key})
+		m.buckets[key] = e
+	}
+	b := e.Value.(*memoryBucket)
+	b.window = time.Duration(limit.Window) * time.Second
+	return b.Take(limit, now), nil
+}
+
+// sweep drops the least recently used buckets while they are full again, as
+// they are equivalent to new ones; m.mu must be held
+func (m *memoryRateLimitStore) sweep(now time.Time) {
+	for e := m.order.Front(); e != nil; e = m.order.Front() {
+		if b := e.Value.(*memoryBucket); now.Sub(b.Updated) < b.window {
+			return
+		}
+		m.evict(e)
+	}
+}
+
+// evict drops the bucket of e; m.mu must be held
+func (m *memoryRateLimitStore) evict(e *list.Element) {
+	delete(m.buckets, m.order.Remove(e).(*memoryBucket).key)
+}
+
+// rateLimitFor returns the limit of group for app, which may be nil
+func rateLimitFor(group string, app *database.Application) database.RateLimit {
+	if app != nil {
+		if limit, ok := app.RateLimits[group]; ok {
+			return limit
+		}
+	}
+	return defaultRateLimits[group]
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers describing result
+func setRateLimitHeaders(w http.ResponseWriter, limit database.RateLimit, result RateLimitResult) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+	h.Set("RateLimit-Policy", strconv.Itoa(limit.Requests)+";w="+strconv.Itoa(limit.Window))
+}
+
+// rateLimitBucket is a bucket a request takes a token from
+type rateLimitBucket struct {
+	key   string
+	limit database.RateLimit
+}
+
+// rateLimitBuckets returns the buckets a request to group takes from.
+// Requests are counted per application when one was authenticated by
+// apiKeyAuthMiddleware, per developer after authMiddleware, per public key
+// in api_key_auth, and per client IP otherwise. Groups in
+// clientIPRateLimits are also counted per client IP.
+func (s *Server) rateLimitBuckets(group string, r *http.Request) []rateLimitBucket {
+	ip := s.clientIP(r)
+	app, _ := r.Context().Value("application").(*database.Application)
+	developerID, _ := r.Context().Value("developerID").(string)
+	limit := rateLimitFor(group, app)
+
+	var buckets []rateLimitBucket
+	if ipLimit, ok := clientIPRateLimits[group]; ok {
+		scope := ""
+		if app != nil {
+			scope = ":app:" + app.ID
+		}
+		buckets = append(buckets, rateLimitBucket{group + scope + ":ip:" + ip, ipLimit})
+	}
+
+	switch {
+	case app != nil:
+		buckets = append(buckets, rateLimitBucket{group + ":app:" + app.ID, limit})
+	case developerID != "":
+		buckets = append(buckets, rateLimitBucket{group + ":dev:" + developerID, limit})
+	case group == rateLimitAPIKeyAuth:
+		key := group + ":key:" + r.Header.Get("X-Public-Key") + ":ip:" + ip
+		buckets = append(buckets, rateLimitBucket{key, limit})
+	default:
+		buckets = append(buckets, rateLimitBucket{group + ":ip:" + ip, limit})
+	}
+	return buckets
+}
+
+// rateLimit limits the requests of a route group, taking a token from each
+// of its buckets. The RateLimit-* headers describe the bucket closest to
+// running out.
+func (s *Server) rateLimit(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			var tightest *RateLimitResult
+			for _, b := range s.rateLimitBuckets(group, r) {
+				result, err := s.rateLimits.Take(b.key, b.limit, now)
+				if err != nil {
+					// Fail open rather than take the API down with the store
+					log.Printf("rate limit store failed for %s: %v", b.key, err)
+					continue
+				}
+				if tightest == nil || !result.Allowed || result.Remaining < tightest.Remaining {
+					tightest = &result
+					setRateLimitHeaders(w, b.limit, result)
+				}
+				if !result.Allowed {
+					setRetryAfter(w, result.RetryAfter)
+					writeError(w, r, errRateLimited)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validateRateLimits checks an application's rate limit overrides
+func validateRateLimits(limits map[string]database.RateLimit) []FieldError {
+	var v validator
+	for group, limit := range limits {
+		known := false
+		for _, g := range applicationRateLimitGroups {
+			known = known || g == group
+		}
+		if !known {
+			v.add(group, "unknown_group", "rate limits can only be set for user_auth and user_api")
+			continue
+		}
+		if limit.Requests < 1 || limit.Requests > maxRateLimitRequests {
+			v.add(group+".requests", codeOutOfRange, "requests must be between 1 and 100000")
+		}
+		if limit.Window < 1 || limit.Window > maxRateLimitWindow {
+			v.add(group+".window", codeOutOfRange, "window must be between 1 and 86400 seconds")
+		}
+	}
+	return v.errors
+}
+
+// handleUpdateRateLimits sets the application's rate limit overrides and
+// returns the limits that now apply to it. A null or empty body restores
+// the defaults.
+func (s *Server) handleUpdateRateLimits(w http.ResponseWriter, r *http.Request) {
+	var limits map[string]database.RateLimit
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := validateRateLimits(limits); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, app.RateLimits)
+
+	if err := s.db.UpdateApplicationRateLimits(app.ID, app.DeveloperID, limits); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update rate limits"))
+		return
+	}
+
+	auditAfter(r, limits)
+	app.RateLimits = limits
+	effective := make(map[string]database.RateLimit)
+	for _, group := range applicationRateLimitGroups {
+		effective[group] = rateLimitFor(group, app)
+	}
+	writeData(w, http.StatusOK, effective)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	limit := database.RateLimit{Requests: 3, Window: 3} // one token per second
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var b TokenBucket
+
+	tests := []struct {
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}{
+		{0, true, 2, 0, time.Second},
+		{0, true, 1, 0, 2 * time.Second},
+		{0, true, 0, 0, 3 * time.Second},
+		{0, false, 0, time.Second, 3 * time.Second},
+		{500 * time.Millisecond, false, 0, 500 * time.Millisecond, 2500 * time.Millisecond},
+		{time.Second, true, 0, 0, 3 * time.Second},
+		// Refilling stops at the bucket's capacity
+		{time.Minute, true, 2, 0, time.Second},
+	}
+
+	for i, tt := range tests {
+		got := b.Take(limit, start.Add(tt.at))
+		if got.Allowed != tt.allowed || got.Remaining != tt.remaining ||
+			got.RetryAfter != tt.retryAfter || got.Reset != tt.reset {
+			t.Errorf("take %d at %v = %+v; want allowed=%v remaining=%d retryAfter=%v reset=%v",
+				i, tt.at, got, tt.allowed, tt.remaining, tt.retryAfter, tt.reset)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreKeys(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	limit := database.RateLimit{Requests: 1, Window: 60}
+	now := time.Now()
+
+	if r, _ := store.Take("a", limit, now); !r.Allowed {
+		t.Fatal("expected the first request for a to be allowed")
+	}
+	if r, _ := store.Take("a", limit, now); r.Allowed {
+		t.Error("expected the second request for a to be limited")
+	}
+	if r, _ := store.Take("b", limit, now); !r.Allowed {
+		t.Error("expected b to have its own bucket")
+	}
+
+	// Full buckets are swept
+	store.sweep(now.Add(time.Minute))
+	if len(store.buckets) != 0 {
+		t.Errorf("expected refilled buckets to be swept; %d left", len(store.buckets))
+	}
+}
+
+func TestMemoryRateLimitStoreBounded(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	store.max = 2
+	limit := database.RateLimit{Requests: 1, Window: 60}
+	now := time.Now()
+
+	store.Take("a", limit, now)
+	store.Take("b", limit, now)
+	store.Take("a", limit, now.Add(time.Second))
+	store.Take("c", limit, now.Add(2*time.Second))
+	if len(store.buckets) != 2 || store.order.Len() != 2 {
+		t.Fatalf("expected 2 buckets; got %d", len(store.buckets))
+	}
+	if _, ok := store.buckets["b"]; ok {
+		t.Error("expected the least recently used bucket to be dropped")
+	}
+	if r, _ := store.Take("a", limit, now.Add(3*time.Second)); r.Allowed {
+		t.Error("expected a to keep its bucket")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s := &Server{rateLimits: newMemoryRateLimitStore()}
+	h := s.rateLimit(rateLimitDeveloperAuth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	limit := defaultRateLimits[rateLimitDeveloperAuth]
+	for i := 0; i < limit.Requests; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/auth/login", nil))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d: got status %d", i, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/auth/login", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429; got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "3" || rec.Header().Get("RateLimit-Remaining") != "0" ||
+		rec.Header().Get("RateLimit-Limit") != "20" {
+		t.Errorf("unexpected headers %v", rec.Header())
+	}
+}
+
+func TestRateLimitUserRoutesPerClientIP(t *testing.T) {
+	s := &Server{rateLimits: newMemoryRateLimitStore()}
+	h := s.rateLimit(rateLimitUserAuth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	app := &database.Application{ID: "app-1"}
+	request := func(ip string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/users/login", nil)
+		r.RemoteAddr = ip + ":1234"
+		r = r.WithContext(context.WithValue(r.Context(), "application", app))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	limit := clientIPRateLimits[rateLimitUserAuth]
+	for i := 0; i < limit.Requests; i++ {
+		if code := request("203.0.113.7"); code != http.StatusNoContent {
+			t.Fatalf("request %d: got status %d", i, code)
+		}
+	}
+	if code := request("203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("expected one client IP to be limited; got %d", code)
+	}
+	if code := request("203.0.113.8"); code != http.StatusNoContent {
+		t.Errorf("expected other clients of the application to be allowed; got %d", code)
+	}
+}
+
+func TestRateLimitBeforeAPIKeyLookup(t *testing.T) {
+	s := &Server{rateLimits: newMemoryRateLimitStore()}
+	h := s.rateLimit(rateLimitAPIKeyAuth)(s.apiKeyAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	request := func(publicKey, ip string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/users/login", nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("X-Public-Key", publicKey)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// Requests are counted before apiKeyAuthMiddleware refuses them
+	limit := defaultRateLimits[rateLimitAPIKeyAuth]
+	for i := 0; i < limit.Requests; i++ {
+		if code := request("pk_1", "203.0.113.7"); code != http.StatusUnauthorized {
+			t.Fatalf("request %d: got status %d", i, code)
+		}
+	}
+	if code := request("pk_1", "203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the public key and client IP to be limited; got %d", code)
+	}
+	if code := request("pk_1", "203.0.113.8"); code != http.StatusUnauthorized {
+		t.Errorf("expected other clients of the key to be allowed; got %d", code)
+	}
+
+	// One client cycling through keys runs into the per-IP limit
+	ipLimit := clientIPRateLimits[rateLimitAPIKeyAuth]
+	for i := limit.Requests + 1; i < ipLimit.Requests; i++ {
+		request("pk_other_"+strconv.Itoa(i), "203.0.113.7")
+	}
+	if code := request("pk_new", "203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the client IP to be limited across keys; got %d", code)
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits map[string]database.RateLimit
+		valid  bool
+	}{
+		{"empty", nil, true},
+		{"user groups", map[string]database.RateLimit{
+			rateLimitUserAuth: {Requests: 100, Window: 60},
+			rateLimitUserAPI:  {Requests: 1000, Window: 3600},
+		}, true},
+		{"developer group", map[string]database.RateLimit{rateLimitDeveloperAPI: {Requests: 100, Window: 60}}, false},
+		{"zero requests", map[string]database.RateLimit{rateLimitUserAuth: {Requests: 0, Window: 60}}, false},
+		{"window too long", map[string]database.RateLimit{rateLimitUserAPI: {Requests: 10, Window: 86401}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateRateLimits(tt.limits)
+			if (len(errs) == 0) != tt.valid {
+				t.Errorf("validateRateLimits() = %v; want valid=%v", errs, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// recentAuthMaxAge is how long after logging in or re-authenticating a
+// user may perform sensitive operations
+const recentAuthMaxAge = 5 * time.Minute
+
+// strongAuthMethods are the methods that prove more than knowledge of the
+// password
+var strongAuthMethods = []string{database.AuthMethodTOTP, database.AuthMethodPasskey, database.AuthMethodRecoveryCode}
+
+type reauthenticateRequest struct {
+	Password string `json:"password"`
+}
+
+func (r reauthenticateRequest) validate() []FieldError {
+	var v validator
+	v.required("password", r.Password)
+	return v.errors
+}
+
+// hasStrongAuth reports whether methods include a second factor
+func hasStrongAuth(methods []string) bool {
+	for _, method := range methods {
+		if slices.Contains(strongAuthMethods, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRecentAuth rejects requests whose session's user has not
+// authenticated within maxAge, or, if strong is set, did so without a
+// second factor. Clients recover by calling handleReauthenticate and
+// retrying. It must run after userSessionMiddleware.
+func (s *Server) requireRecentAuth(maxAge time.Duration, strong bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := r.Context().Value("session").(*database.Session)
+
+			if strong && !hasStrongAuth(session.AuthMethods) {
+				writeError(w, r, errStrongAuthenticationRequired)
+				return
+			}
+			if time.Since(session.AuthTime) > maxAge {
+				writeError(w, r, errReauthenticationRequired)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleReauthenticate checks the session's user's password again, making
+// the session's authentication recent. Failures count towards the account
+// lockout like failed logins.
+func (s *Server) handleReauthenticate(w http.ResponseWriter, r *http.Request) {
+	var req reauthenticateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	session := r.Context().Value("session").(*database.Session)
+	user := r.Context().Value("user").(*database.User)
+
+	lockout, rejected := s.accountLockout(w, userLockoutSubject(user))
+	if rejected != nil {
+		writeError(w, r, rejected)
+		return
+	}
+	ok, _, err := s.verifyPassword(req.Password, user.PasswordHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify password"))
+		return
+	}
+	if !ok {
+		s.loginFailed(r, userLockoutSubject(user))
+		writeError(w, r, errInvalidCredentials)
+		return
+	}
+	s.loginSucceeded(lockout)
+
+	authTime := time.Now()
+	methods := []string{database.AuthMethodPassword}
+	if err := s.db.UpdateSessionAuth(session.ID, authTime, methods); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvalidSession)
+			return
+		}
+		writeError(w, r, internalError("Failed to update session"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"authTime":    authTime.UTC().Format(time.RFC3339),
+		"authMethods": methods,
+	})
+}
@@ -0,0 +1,95 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireRecentAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		authTime time.Duration
+		methods  []string
+		strong   bool
+		want     int
+		code     string
+	}{
+		{"recent", time.Minute, []string{database.AuthMethodPassword}, false, http.StatusOK, ""},
+		{"stale", 10 * time.Minute, []string{database.AuthMethodPassword}, false, http.StatusUnauthorized, "reauthentication_required"},
+		{"strong required", time.Minute, []string{database.AuthMethodPassword}, true, http.StatusUnauthorized, "strong_authentication_required"},
+		{"strong", time.Minute, []string{database.AuthMethodPassword, database.AuthMethodTOTP}, true, http.StatusOK, ""},
+		{"strong but stale", time.Hour, []string{database.AuthMethodPasskey}, true, http.StatusUnauthorized, "reauthentication_required"},
+	}
+
+	s := &Server{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &database.Session{ID: "session-1", AuthTime: time.Now().Add(-tt.authTime), AuthMethods: tt.methods}
+			r := httptest.NewRequest(http.MethodDelete, "/api/users/me", nil)
+			r = r.WithContext(context.WithValue(r.Context(), "session", session))
+			w := httptest.NewRecorder()
+
+			h := s.requireRecentAuth(5*time.Minute, tt.strong)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("expected status %d; got %d", tt.want, w.Code)
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected error %s; got %s", tt.code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-1", "dev-1")
+	user := seedUser(t, s, "app-1", "user-1", "ada@example.com")
+	session := seedSession(t, s, user, "session-1")
+	if err := s.db.UpdateSessionAuth(session.ID, time.Now().Add(-time.Hour), []string{database.AuthMethodPassword, database.AuthMethodTOTP}); err != nil {
+		t.Fatal(err)
+	}
+	reauthenticate := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/users/me/reauthenticate",
+			strings.NewReader(`{"password":"`+password+`"}`))
+		ctx := context.WithValue(r.Context(), "session", session)
+		r = r.WithContext(context.WithValue(ctx, "user", user))
+		w := httptest.NewRecorder()
+		s.handleReauthenticate(w, r)
+		return w
+	}
+
+	if w := reauthenticate("wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401; got %d: %s", w.Code, w.Body.String())
+	}
+	if lockout, _ := s.db.GetAccountLockout("user-1"); lockout == nil || lockout.FailedAttempts != 1 {
+		t.Errorf("expected the failure to count towards the lockout; got %+v", lockout)
+	}
+
+	before := time.Now().Add(-time.Second)
+	if w := reauthenticate(testPassword); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	stored, err := s.db.GetSessionByToken(session.Token)
+	if err != nil || stored == nil {
+		t.Fatalf("loading the session: %v", err)
+	}
+	if stored.AuthTime.Before(before) || !reflect.DeepEqual(stored.AuthMethods, []string{database.AuthMethodPassword}) {
+		t.Errorf("expected a recent password authentication; got %v %v", stored.AuthTime, stored.AuthMethods)
+	}
+	if lockout, _ := s.db.GetAccountLockout("user-1"); lockout != nil {
+		t.Errorf("expected the success to clear the failures; got %+v", lockout)
+	}
+}
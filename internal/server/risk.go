@@ -0,0 +1,558 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Signals that make a login suspicious
+const (
+	riskSignalNewDevice        = "new_device"
+	riskSignalNewIP            = "new_ip"
+	riskSignalImpossibleTravel = "impossible_travel"
+	riskSignalFailureSpike     = "failure_spike"
+)
+
+// Actions an application can take on a suspicious login, from least to most
+// severe. challenge holds the login until the user confirms it from a link
+// sent to their email address.
+const (
+	riskActionAllow     = "allow"
+	riskActionNotify    = "notify"
+	riskActionChallenge = "challenge"
+	riskActionBlock     = "block"
+)
+
+var riskActionSeverity = map[string]int{
+	riskActionAllow:     0,
+	riskActionNotify:    1,
+	riskActionChallenge: 2,
+	riskActionBlock:     3,
+}
+
+var defaultRiskPolicy = database.RiskPolicy{
+	NewDevice:        riskActionNotify,
+	NewIP:            riskActionAllow,
+	ImpossibleTravel: riskActionNotify,
+	FailureSpike:     riskActionNotify,
+}
+
+const (
+	// The device ID identifies the client across logins. Browsers keep it in
+	// a cookie; other clients send and store the X-Device-Id header.
+	deviceIDHeader      = "X-Device-Id"
+	deviceCookieName    = "auth_device"
+	deviceCookieMaxAge  = 365 * 24 * time.Hour
+	maxDeviceIDLength   = 128
+	maxDevicesPerUser   = 50
+	riskHistorySize     = 200
+	loginChallengeTTL   = 15 * time.Minute
+	failureSpikeCount   = 5
+	failureSpikeWindow  = time.Hour
+	maxTravelSpeedKmh   = 1000
+	minTravelDistanceKm = 300
+)
+
+// effectiveRiskPolicy fills in the default action for each signal policy
+// leaves unset
+func effectiveRiskPolicy(policy *database.RiskPolicy) database.RiskPolicy {
+	effective := defaultRiskPolicy
+	if policy != nil {
+		if policy.NewDevice != "" {
+			effective.NewDevice = policy.NewDevice
+		}
+		if policy.NewIP != "" {
+			effective.NewIP = policy.NewIP
+		}
+		if policy.ImpossibleTravel != "" {
+			effective.ImpossibleTravel = policy.ImpossibleTravel
+		}
+		if policy.FailureSpike != "" {
+			effective.FailureSpike = policy.FailureSpike
+		}
+	}
+	return effective
+}
+
+func validateRiskPolicy(policy *database.RiskPolicy) []FieldError {
+	var v validator
+	for _, f := range []struct{ field, action string }{
+		{"newDevice", policy.NewDevice},
+		{"newIp", policy.NewIP},
+		{"impossibleTravel", policy.ImpossibleTravel},
+		{"failureSpike", policy.FailureSpike},
+	} {
+		if _, ok := riskActionSeverity[f.action]; f.action != "" && !ok {
+			v.add(f.field, "invalid_action", f.field+" must be allow, notify, challenge or block")
+		}
+	}
+	return v.errors
+}
+
+// riskAction returns the most severe action policy takes for any of signals
+func riskAction(policy database.RiskPolicy, signals []string) string {
+	action := riskActionAllow
+	for _, signal := range signals {
+		var a string
+		switch signal {
+		case riskSignalNewDevice:
+			a = policy.NewDevice
+		case riskSignalNewIP:
+			a = policy.NewIP
+		case riskSignalImpossibleTravel:
+			a = policy.ImpossibleTravel
+		case riskSignalFailureSpike:
+			a = policy.FailureSpike
+		}
+		if riskActionSeverity[a] > riskActionSeverity[action] {
+			action = a
+		}
+	}
+	return action
+}
+
+// deviceID returns the device ID the client presented, or a new one if it
+// presented none, and asks the client to keep it
+func deviceID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(deviceIDHeader)
+	if id == "" {
+		if cookie, err := r.Cookie(deviceCookieName); err == nil {
+			id = cookie.Value
+		}
+	}
+	if id == "" || len(id) > maxDeviceIDLength {
+		id = "dev_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+
+	w.Header().Set(deviceIDHeader, id)
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(deviceCookieMaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	return id
+}
+
+// geoLocation is where an IP address is, as precisely as the GeoIP
+// database knows
+type geoLocation struct {
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+type geoIPRange struct {
+	start, end netip.Addr
+	location   geoLocation
+}
+
+// geoIPDatabase maps IP address ranges to locations. Ranges are sorted and
+// do not overlap.
+type geoIPDatabase struct {
+	ranges []geoIPRange
+}
+
+// loadGeoIP reads a GeoIP database file from path
+func loadGeoIP(path string) (*geoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseGeoIP(f)
+}
+
+// parseGeoIP reads lines of the form
+// "<start ip>,<end ip>,<country>,<latitude>,<longitude>". Blank lines and
+// lines starting with # are ignored.
+func parseGeoIP(r io.Reader) (*geoIPDatabase, error) {
+	db := &geoIPDatabase{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("line %d: expected start ip, end ip, country, latitude and longitude", line)
+		}
+		start, err := netip.ParseAddr(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		start, end = start.Unmap(), end.Unmap()
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", line, start, end)
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
+		if err != nil || lat < -90 || lat > 90 {
+			return nil, fmt.Errorf("line %d: invalid latitude", line)
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(fields[4]), 64)
+		if err != nil || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("line %d: invalid longitude", line)
+		}
+		db.ranges = append(db.ranges, geoIPRange{
+			start:    start,
+			end:      end,
+			location: geoLocation{Country: strings.TrimSpace(fields[2]), Latitude: lat, Longitude: lon},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	for i := 1; i < len(db.ranges); i++ {
+		if !db.ranges[i-1].end.Less(db.ranges[i].start) {
+			return nil, fmt.Errorf("ranges starting at %s and %s overlap", db.ranges[i-1].start, db.ranges[i].start)
+		}
+	}
+	return db, nil
+}
+
+// lookup returns the location of ip, if the database knows it
+func (db *geoIPDatabase) lookup(ip string) (geoLocation, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return geoLocation{}, false
+	}
+	addr = addr.Unmap()
+	// The first range ending at or after addr is the only one that can hold it
+	i := sort.Search(len(db.ranges), func(i int) bool { return !db.ranges[i].end.Less(addr) })
+	if i == len(db.ranges) || addr.Less(db.ranges[i].start) {
+		return geoLocation{}, false
+	}
+	return db.ranges[i].location, true
+}
+
+// distanceKm is the great-circle distance between a and b
+func distanceKm(a, b geoLocation) float64 {
+	const earthRadiusKm = 6371
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLon := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// loginContext is what is known about a login when assessing its risk.
+// History is the user's login history, newest first.
+type loginContext struct {
+	DeviceHash string
+	IP         string
+	Now        time.Time
+	Devices    []database.KnownDevice
+	History    []database.LoginAttempt
+}
+
+// assessLoginRisk returns the risk signals of a login with the correct
+// password. geo may be nil, in which case travel is not checked.
+func assessLoginRisk(c loginContext, geo *geoIPDatabase) []string {
+	signals := []string{}
+
+	// A user's first device is not suspicious, having no others to compare to
+	if len(c.Devices) > 0 {
+		known := false
+		for _, d := range c.Devices {
+			if d.DeviceHash == c.DeviceHash {
+				known = true
+				break
+			}
+		}
+		if !known {
+			signals = append(signals, riskSignalNewDevice)
+		}
+	}
+
+	var lastSuccess *database.LoginAttempt
+	seenIP := false
+	failures := 0
+	for i := range c.History {
+		a := &c.History[i]
+		if a.Success {
+			if lastSuccess == nil {
+				lastSuccess = a
+			}
+			if a.IP == c.IP {
+				seenIP = true
+			}
+		} else if a.FailureReason == errInvalidCredentials.Code && c.Now.Sub(a.CreatedAt) <= failureSpikeWindow {
+			failures++
+		}
+	}
+
+	if lastSuccess != nil && !seenIP {
+		signals = append(signals, riskSignalNewIP)
+	}
+
+	if geo != nil && lastSuccess != nil && lastSuccess.IP != c.IP {
+		from, okFrom := geo.lookup(lastSuccess.IP)
+		to, okTo := geo.lookup(c.IP)
+		if okFrom && okTo {
+			distance := distanceKm(from, to)
+			hours := c.Now.Sub(lastSuccess.CreatedAt).Hours()
+			if distance >= minTravelDistanceKm && (hours <= 0 || distance/hours > maxTravelSpeedKmh) {
+				signals = append(signals, riskSignalImpossibleTravel)
+			}
+		}
+	}
+
+	if failures >= failureSpikeCount {
+		signals = append(signals, riskSignalFailureSpike)
+	}
+	return signals
+}
+
+// assessLogin looks up the user's devices and login history and returns the
+// risk signals of their login from r on the device with deviceHash
+func (s *Server) assessLogin(r *http.Request, user *database.User, deviceHash string) ([]string, error) {
+	devices, err := s.db.GetKnownDevices(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.db.GetLoginAttempts(user.ID, 0, riskHistorySize)
+	if err != nil {
+		return nil, err
+	}
+	return assessLoginRisk(loginContext{
+		DeviceHash: deviceHash,
+		IP:         s.clientIP(r),
+		Now:        time.Now().UTC(),
+		Devices:    devices,
+		History:    history,
+	}, s.geoIP), nil
+}
+
+// rememberDevice marks the device as known to the user after a successful
+// login. Failing to remember it does not fail the login.
+func (s *Server) rememberDevice(user *database.User, deviceHash, ip, userAgent string) {
+	err := s.db.SaveKnownDevice(&database.KnownDevice{
+		UserID:        user.ID,
+		ApplicationID: user.ApplicationID,
+		DeviceHash:    deviceHash,
+		LastIP:        ip,
+		UserAgent:     userAgent,
+		LastSeenAt:    time.Now(),
+	}, maxDevicesPerUser)
+	if err != nil {
+		log.Printf("failed to remember device for user %s: %v", user.ID, err)
+	}
+}
+
+// loginChallenge is the payload of a login challenge token: the login
+// waiting for confirmation
+type loginChallenge struct {
+	DeviceHash string   `json:"deviceHash"`
+	IP         string   `json:"ip"`
+	UserAgent  string   `json:"userAgent"`
+	Signals    []string `json:"signals"`
+}
+
+// challengeLogin emails the user a link to confirm the login of attempt
+// from the device with deviceHash, and rejects the login until then
+func (s *Server) challengeLogin(w http.ResponseWriter, r *http.Request, app *database.Application, user *database.User, attempt *database.LoginAttempt, deviceHash string) {
+	token, err := generateKey("", 32)
+	if err != nil {
+		s.rejectLogin(w, r, app, attempt, internalError("Failed to generate token"))
+		return
+	}
+	payload, err := json.Marshal(loginChallenge{
+		DeviceHash: deviceHash,
+		IP:         attempt.IP,
+		UserAgent:  attempt.UserAgent,
+		Signals:    attempt.RiskSignals,
+	})
+	if err != nil {
+		s.rejectLogin(w, r, app, attempt, internalError("Failed to create login challenge"))
+		return
+	}
+	err = s.db.CreateVerificationToken(&database.VerificationToken{
+		ID:            uuid.New().String(),
+		UserID:        user.ID,
+		ApplicationID: app.ID,
+		Purpose:       database.TokenPurposeLoginChallenge,
+		TokenHash:     hashToken(token),
+		Payload:       string(payload),
+		ExpiresAt:     time.Now().Add(loginChallengeTTL),
+	})
+	if err != nil {
+		s.rejectLogin(w, r, app, attempt, internalError("Failed to create login challenge"))
+		return
+	}
+
+	link := appURL(app, "/verify-login", url.Values{"token": {token}})
+	body := "Someone signed in to your " + app.Name + " account from " + attempt.IP +
+		" (" + attempt.UserAgent + ").\n\nIf this was you, confirm the sign-in:\n\n" + link +
+		"\n\nThe link expires in 15 minutes. If this wasn't you, change your password."
+	if err := s.mailer.Send(user.Email, "Confirm your sign-in", body); err != nil {
+		log.Printf("failed to send login challenge for user %s: %v", user.ID, err)
+		s.rejectLogin(w, r, app, attempt, internalError("Failed to send confirmation email"))
+		return
+	}
+
+	s.rejectLogin(w, r, app, attempt, errLoginChallengeRequired)
+}
+
+// emailSignInNotice tells the user about a suspicious login that was
+// allowed
+func (s *Server) emailSignInNotice(app *database.Application, user *database.User, attempt *database.LoginAttempt) {
+	body := "Your " + app.Name + " account was signed in to from " + attempt.IP +
+		" (" + attempt.UserAgent + ") at " + time.Now().UTC().Format(time.RFC1123) +
+		".\n\nIf this wasn't you, change your password."
+	if err := s.mailer.Send(user.Email, "New sign-in to your account", body); err != nil {
+		log.Printf("failed to send sign-in notice for user %s: %v", user.ID, err)
+	}
+}
+
+type verifyLoginRequest struct {
+	Token string `json:"token"`
+}
+
+func (r verifyLoginRequest) validate() []FieldError {
+	var v validator
+	v.required("token", r.Token)
+	return v.errors
+}
+
+// handleVerifyLogin completes a challenged login using the token from the
+// confirmation link, starting a session for the user
+func (s *Server) handleVerifyLogin(w http.ResponseWriter, r *http.Request) {
+	var req verifyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+
+	token, err := s.db.ConsumeVerificationToken(database.TokenPurposeLoginChallenge, hashToken(req.Token))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up token"))
+		return
+	}
+	if token == nil || token.ApplicationID != app.ID || token.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidVerificationToken)
+		return
+	}
+	var challenge loginChallenge
+	if err := json.Unmarshal([]byte(token.Payload), &challenge); err != nil {
+		writeError(w, r, internalError("Failed to read login challenge"))
+		return
+	}
+
+	user, err := s.db.GetApplicationUser(app.ID, token.UserID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user"))
+		return
+	}
+	if user == nil {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	attempt := &database.LoginAttempt{
+		ApplicationID: app.ID,
+		UserID:        user.ID,
+		Method:        database.LoginMethodPassword,
+		MFA:           true,
+		IP:            challenge.IP,
+		UserAgent:     challenge.UserAgent,
+		RiskSignals:   challenge.Signals,
+		RiskAction:    riskActionChallenge,
+	}
+
+	// The account may have changed since the login was challenged
+	if user.Status == database.UserStatusPending {
+		s.rejectLogin(w, r, app, attempt, errAccountPending)
+		return
+	}
+	if user.Status != database.UserStatusActive {
+		s.rejectLogin(w, r, app, attempt, errAccountDisabled)
+		return
+	}
+	if user.PasswordResetRequired {
+		s.rejectLogin(w, r, app, attempt, errPasswordResetRequired)
+		return
+	}
+
+	session := newUserSession(user, database.AuthMethodPassword, database.AuthMethodEmail)
+	event := newEvent(app.ID, eventUserLogin, loginEventData{User: user, SessionID: session.ID, IP: challenge.IP})
+	if err := s.db.CreateSession(session, event); err != nil {
+		writeError(w, r, internalError("Failed to create session"))
+		return
+	}
+	attempt.Success = true
+	attempt.SessionID = session.ID
+	s.recordLoginAttempt(app, attempt)
+	s.rememberDevice(user, challenge.DeviceHash, challenge.IP, challenge.UserAgent)
+
+	s.writeNewSession(w, r, http.StatusOK, app, user, session)
+}
+
+// handleUpdateRiskPolicy sets the action taken on each risk signal,
+// returning the actions that now apply. A null body restores the defaults.
+func (s *Server) handleUpdateRiskPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy *database.RiskPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if policy != nil {
+		if errs := validateRiskPolicy(policy); len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, app.RiskPolicy)
+
+	if err := s.db.UpdateApplicationRiskPolicy(app.ID, app.DeveloperID, policy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update risk policy"))
+		return
+	}
+	auditAfter(r, policy)
+
+	writeData(w, http.StatusOK, effectiveRiskPolicy(policy))
+}
@@ -0,0 +1,292 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGeoIP = `# start,end,country,latitude,longitude
+81.2.69.0,81.2.69.255,GB,51.5,-0.12
+1.0.0.0,1.0.0.255,AU,-33.87,151.21
+2001:db8::,2001:db8::ffff,US,40.71,-74.0
+`
+
+func TestParseGeoIP(t *testing.T) {
+	geo, err := parseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatalf("parseGeoIP() error = %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		country string
+		found   bool
+	}{
+		{"81.2.69.1", "GB", true},
+		{"81.2.69.255", "GB", true},
+		{"1.0.0.0", "AU", true},
+		{"::ffff:1.0.0.7", "AU", true},
+		{"2001:db8::1", "US", true},
+		{"81.2.70.0", "", false},
+		{"0.0.0.1", "", false},
+		{"not an ip", "", false},
+	}
+	for _, tt := range tests {
+		loc, found := geo.lookup(tt.ip)
+		if found != tt.found || loc.Country != tt.country {
+			t.Errorf("lookup(%q) = %+v, %v; want %q, %v", tt.ip, loc, found, tt.country, tt.found)
+		}
+	}
+}
+
+func TestParseGeoIPRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]string{
+		"missing fields": "1.0.0.0,1.0.0.255,AU\n",
+		"bad address":    "1.0.0,1.0.0.255,AU,0,0\n",
+		"reversed range": "1.0.0.255,1.0.0.0,AU,0,0\n",
+		"mixed families": "1.0.0.0,2001:db8::,AU,0,0\n",
+		"bad latitude":   "1.0.0.0,1.0.0.255,AU,91,0\n",
+		"overlap":        "1.0.0.0,1.0.0.255,AU,0,0\n1.0.0.128,1.0.1.0,AU,0,0\n",
+	}
+	for name, file := range tests {
+		if _, err := parseGeoIP(strings.NewReader(file)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDistanceKm(t *testing.T) {
+	london := geoLocation{Latitude: 51.5, Longitude: -0.12}
+	sydney := geoLocation{Latitude: -33.87, Longitude: 151.21}
+	if d := distanceKm(london, sydney); d < 16900 || d > 17100 {
+		t.Errorf("distanceKm(London, Sydney) = %.0f; want about 17000", d)
+	}
+	if d := distanceKm(london, london); d != 0 {
+		t.Errorf("distanceKm(London, London) = %f; want 0", d)
+	}
+}
+
+func TestAssessLoginRisk(t *testing.T) {
+	geo, err := parseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	devices := []database.KnownDevice{{DeviceHash: "known"}}
+	success := func(ip string, ago time.Duration) database.LoginAttempt {
+		return database.LoginAttempt{Success: true, IP: ip, CreatedAt: now.Add(-ago)}
+	}
+	failure := func(ago time.Duration) database.LoginAttempt {
+		return database.LoginAttempt{FailureReason: errInvalidCredentials.Code, IP: "81.2.69.1", CreatedAt: now.Add(-ago)}
+	}
+	failures := func(n int, ago time.Duration) []database.LoginAttempt {
+		var history []database.LoginAttempt
+		for i := 0; i < n; i++ {
+			history = append(history, failure(ago))
+		}
+		return history
+	}
+
+	tests := []struct {
+		name string
+		ctx  loginContext
+		want []string
+	}{
+		{
+			name: "first login",
+			ctx:  loginContext{DeviceHash: "new", IP: "81.2.69.1"},
+			want: []string{},
+		},
+		{
+			name: "known device and ip",
+			ctx: loginContext{DeviceHash: "known", IP: "81.2.69.1", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", time.Hour)}},
+			want: []string{},
+		},
+		{
+			name: "new device",
+			ctx: loginContext{DeviceHash: "new", IP: "81.2.69.1", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", time.Hour)}},
+			want: []string{riskSignalNewDevice},
+		},
+		{
+			name: "new ip nearby",
+			ctx: loginContext{DeviceHash: "known", IP: "81.2.69.2", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", time.Hour)}},
+			want: []string{riskSignalNewIP},
+		},
+		{
+			name: "ip used before the last login",
+			ctx: loginContext{DeviceHash: "known", IP: "1.0.0.1", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", 48*time.Hour), success("1.0.0.1", 96*time.Hour)}},
+			want: []string{},
+		},
+		{
+			name: "impossible travel",
+			ctx: loginContext{DeviceHash: "known", IP: "1.0.0.1", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", time.Hour)}},
+			want: []string{riskSignalNewIP, riskSignalImpossibleTravel},
+		},
+		{
+			name: "possible travel",
+			ctx: loginContext{DeviceHash: "known", IP: "1.0.0.1", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", 48*time.Hour)}},
+			want: []string{riskSignalNewIP},
+		},
+		{
+			name: "unknown location",
+			ctx: loginContext{DeviceHash: "known", IP: "192.0.2.1", Devices: devices,
+				History: []database.LoginAttempt{success("81.2.69.1", time.Minute)}},
+			want: []string{riskSignalNewIP},
+		},
+		{
+			name: "failure spike",
+			ctx: loginContext{DeviceHash: "known", IP: "81.2.69.1", Devices: devices,
+				History: append(failures(failureSpikeCount, time.Minute), success("81.2.69.1", 2*time.Hour))},
+			want: []string{riskSignalFailureSpike},
+		},
+		{
+			name: "old failures",
+			ctx: loginContext{DeviceHash: "known", IP: "81.2.69.1", Devices: devices,
+				History: append(failures(failureSpikeCount, 2*time.Hour), success("81.2.69.1", 3*time.Hour))},
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ctx.Now = now
+			if got := assessLoginRisk(tt.ctx, geo); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assessLoginRisk() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssessLoginRiskWithoutGeoIP(t *testing.T) {
+	now := time.Now()
+	ctx := loginContext{IP: "1.0.0.1", Now: now,
+		History: []database.LoginAttempt{{Success: true, IP: "81.2.69.1", CreatedAt: now}}}
+	if got := assessLoginRisk(ctx, nil); !reflect.DeepEqual(got, []string{riskSignalNewIP}) {
+		t.Errorf("assessLoginRisk() = %v; want only new_ip", got)
+	}
+}
+
+func TestRiskAction(t *testing.T) {
+	policy := effectiveRiskPolicy(&database.RiskPolicy{NewIP: riskActionChallenge, FailureSpike: riskActionBlock})
+
+	tests := []struct {
+		signals []string
+		want    string
+	}{
+		{nil, riskActionAllow},
+		{[]string{riskSignalNewDevice}, riskActionNotify},
+		{[]string{riskSignalNewDevice, riskSignalNewIP}, riskActionChallenge},
+		{[]string{riskSignalNewIP, riskSignalFailureSpike}, riskActionBlock},
+		{[]string{"unknown"}, riskActionAllow},
+	}
+	for _, tt := range tests {
+		if got := riskAction(policy, tt.signals); got != tt.want {
+			t.Errorf("riskAction(%v) = %s; want %s", tt.signals, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRiskPolicy(t *testing.T) {
+	if errs := validateRiskPolicy(&database.RiskPolicy{NewDevice: riskActionBlock}); len(errs) != 0 {
+		t.Errorf("expected a valid policy; got %v", errs)
+	}
+	errs := validateRiskPolicy(&database.RiskPolicy{NewIP: "deny", FailureSpike: "Block"})
+	if len(errs) != 2 || errs[0].Field != "newIp" || errs[1].Field != "failureSpike" {
+		t.Errorf("expected newIp and failureSpike errors; got %v", errs)
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   string
+	}{
+		{"header", "dev_header", "dev_cookie", "dev_header"},
+		{"cookie", "", "dev_cookie", "dev_cookie"},
+		{"too long", strings.Repeat("x", maxDeviceIDLength+1), "", ""},
+		{"none", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/users/login", nil)
+			if tt.header != "" {
+				r.Header.Set(deviceIDHeader, tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: deviceCookieName, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+
+			id := deviceID(w, r)
+			if tt.want != "" && id != tt.want {
+				t.Errorf("deviceID() = %q; want %q", id, tt.want)
+			}
+			if tt.want == "" && (!strings.HasPrefix(id, "dev_") || len(id) > maxDeviceIDLength) {
+				t.Errorf("deviceID() = %q; want a new device ID", id)
+			}
+			if got := w.Header().Get(deviceIDHeader); got != id {
+				t.Errorf("expected %s header %q; got %q", deviceIDHeader, id, got)
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Value != id || !cookies[0].HttpOnly {
+				t.Errorf("expected an HttpOnly device cookie %q; got %v", id, cookies)
+			}
+		})
+	}
+}
+
+func TestChallengedLoginIsConfirmed(t *testing.T) {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-1", "dev-1")
+	user := seedUser(t, s, "app-1", "user-1", "ada@example.com")
+	if err := s.db.UpdateApplicationRiskPolicy("app-1", "dev-1", &database.RiskPolicy{NewDevice: riskActionChallenge}); err != nil {
+		t.Fatal(err)
+	}
+	s.rememberDevice(user, hashToken("known-device"), "192.0.2.1", "test")
+	app, _ := s.db.GetApplicationByPublicKey("pk_app-1")
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"email":"ada@example.com","password":"`+testPassword+`"}`))
+	r.Header.Set(deviceIDHeader, "new-device")
+	r = r.WithContext(context.WithValue(r.Context(), "application", app))
+	w := httptest.NewRecorder()
+	s.handleUserLogin(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "login_challenge_required") {
+		t.Fatalf("expected the login to be challenged; got %d: %s", w.Code, w.Body.String())
+	}
+	if events := pendingEvents(t, s); len(events) != 0 {
+		t.Fatalf("expected no events before the login is confirmed; got %s", eventTypes(events))
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"token":"`+sentMail(s).token(t)+`"}`))
+	r = r.WithContext(context.WithValue(r.Context(), "application", app))
+	w = httptest.NewRecorder()
+	s.handleVerifyLogin(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "sessionToken") {
+		t.Fatalf("expected the confirmed login to start a session; got %d: %s", w.Code, w.Body.String())
+	}
+	events := pendingEvents(t, s)
+	if eventTypes(events) != eventUserLogin {
+		t.Fatalf("expected a user.login event; got %s", eventTypes(events))
+	}
+	if ids := sessionIDs(t, s, "user-1"); len(ids) != 1 || !strings.Contains(string(events[0].Payload), ids[0]) {
+		t.Errorf("expected the event to name the new session %v; got %s", ids, events[0].Payload)
+	}
+}
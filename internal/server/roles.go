@@ -0,0 +1,448 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	maxRoleNameLength        = 50
+	maxRoleDescriptionLength = 500
+	maxPermissionLength      = 100
+	maxRolePermissions       = 100
+)
+
+// userAccessTokenDuration is how long an access token issued to an
+// application user is valid. It is short because the roles it carries are
+// not revoked when they change.
+const userAccessTokenDuration = 15 * time.Minute
+
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type permissionCheckRequest struct {
+	UserID     string `json:"userId"`
+	Permission string `json:"permission"`
+}
+
+type permissionCheckResponse struct {
+	Allowed bool `json:"allowed"`
+	// GrantedBy names the user's roles that include the permission
+	GrantedBy []string `json:"grantedBy"`
+}
+
+// meResponse is the session's user together with their authorization
+type meResponse struct {
+	*database.User
+	Roles              []string                    `json:"roles"`
+	Permissions        []string                    `json:"permissions"`
+	Organizations      []database.UserOrganization `json:"organizations"`
+	ActiveOrganization *database.UserOrganization  `json:"activeOrganization"`
+}
+
+func (r roleRequest) validate() []FieldError {
+	var v validator
+	v.required("name", r.Name)
+	v.maxLength("name", r.Name, maxRoleNameLength)
+	v.maxLength("description", r.Description, maxRoleDescriptionLength)
+	if len(r.Permissions) > maxRolePermissions {
+		v.add("permissions", codeTooLong, "A role can have at most 100 permissions")
+	}
+	for _, p := range r.Permissions {
+		if !isValidPermission(p) {
+			v.add("permissions", "invalid_permission",
+				"Permissions must be 1 to 100 characters without whitespace")
+			break
+		}
+	}
+	return v.errors
+}
+
+func (r permissionCheckRequest) validate() []FieldError {
+	var v validator
+	v.required("userId", r.UserID)
+	v.required("permission", r.Permission)
+	return v.errors
+}
+
+func isValidPermission(p string) bool {
+	return p != "" && len(p) <= maxPermissionLength && !strings.ContainsAny(p, " \t\r\n")
+}
+
+// normalizePermissions removes duplicates and sorts permissions
+func normalizePermissions(permissions []string) []string {
+	seen := make(map[string]bool, len(permissions))
+	result := []string{}
+	for _, p := range permissions {
+		if !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// rolePermissions returns the role names and the union of their permissions
+func rolePermissions(roles []database.Role) (names, permissions []string) {
+	names = []string{}
+	var all []string
+	for _, role := range roles {
+		names = append(names, role.Name)
+		all = append(all, role.Permissions...)
+	}
+	return names, normalizePermissions(all)
+}
+
+// issueAccessToken signs a JWT describing the user's session, roles and
+// active organization with the application's secret key, so the
+// application's backend can verify it without calling us
+func (s *Server) issueAccessToken(app *database.Application, user *database.User, session *database.Session) (string, time.Time, error) {
+	roles, err := s.db.GetUserRoles(user.ID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	names, permissions := rolePermissions(roles)
+
+	now := time.Now()
+	expiresAt := now.Add(userAccessTokenDuration)
+	if session.ExpiresAt.Before(expiresAt) {
+		expiresAt = session.ExpiresAt
+	}
+	claims := jwt.MapClaims{
+		"sub":         user.ID,
+		"aud":         app.ID,
+		"sid":         session.ID,
+		"roles":       names,
+		"permissions": permissions,
+		"auth_time":   session.AuthTime.Unix(),
+		"amr":         session.AuthMethods,
+		"iat":         now.Unix(),
+		"exp":         expiresAt.Unix(),
+	}
+	if session.ActiveOrganizationID != "" {
+		member, err := s.db.GetOrganizationMember(session.ActiveOrganizationID, user.ID)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if member != nil {
+			claims["org_id"] = member.OrganizationID
+			claims["org_role"] = member.Role
+		}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString([]byte(app.SecretKey))
+	return signed, expiresAt, err
+}
+
+// writeSession writes the tokens of session with a fresh access token
+func (s *Server) writeSession(w http.ResponseWriter, r *http.Request, status int, app *database.Application, user *database.User, session *database.Session) {
+	accessToken, accessExpiresAt, err := s.issueAccessToken(app, user, session)
+	if err != nil {
+		writeError(w, r, internalError("Failed to issue access token"))
+		return
+	}
+	writeData(w, status, newUserResponse(session, accessToken, accessExpiresAt))
+}
+
+// writeNewSession writes the tokens of a session just started for user. If
+// no access token can be issued the session is deleted again, since the
+// client never learns its token and could not sign it out.
+func (s *Server) writeNewSession(w http.ResponseWriter, r *http.Request, status int, app *database.Application, user *database.User, session *database.Session) {
+	accessToken, accessExpiresAt, err := s.issueAccessToken(app, user, session)
+	if err != nil {
+		if err := s.db.DeleteSession(session.ID); err != nil {
+			log.Printf("failed to delete session %s without an access token: %v", session.ID, err)
+		}
+		writeError(w, r, internalError("Failed to issue access token"))
+		return
+	}
+	writeData(w, status, newUserResponse(session, accessToken, accessExpiresAt))
+}
+
+func newUserResponse(session *database.Session, accessToken string, accessExpiresAt time.Time) userResponse {
+	return userResponse{
+		SessionToken:         session.Token,
+		ExpiresAt:            session.ExpiresAt.Format(time.RFC3339),
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: accessExpiresAt.Format(time.RFC3339),
+	}
+}
+
+// handleRefreshAccessToken issues a new access token for the current session,
+// reflecting any role changes since the last one
+func (s *Server) handleRefreshAccessToken(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("application").(*database.Application)
+	session := r.Context().Value("session").(*database.Session)
+	user := r.Context().Value("user").(*database.User)
+
+	s.writeSession(w, r, http.StatusOK, app, user, session)
+}
+
+// applicationRole loads the {roleId} role of app, writing an error response
+// and returning false if it does not exist
+func (s *Server) applicationRole(w http.ResponseWriter, r *http.Request, app *database.Application) (*database.Role, bool) {
+	role, err := s.db.GetRole(app.ID, chi.URLParam(r, "roleId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch role"))
+		return nil, false
+	}
+	if role == nil {
+		writeError(w, r, errRoleNotFound)
+		return nil, false
+	}
+	return role, true
+}
+
+func (s *Server) handleGetRoles(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := s.db.GetRoles(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch roles"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"roles": roles,
+		"count": len(roles),
+	})
+}
+
+func (s *Server) handleCreateRole(w http.ResponseWriter, r *http.Request) {
+	var req roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	role := &database.Role{
+		ID:            uuid.New().String(),
+		ApplicationID: app.ID,
+		Name:          req.Name,
+		Description:   req.Description,
+		Permissions:   normalizePermissions(req.Permissions),
+	}
+	if err := s.db.CreateRole(role); err != nil {
+		if errors.Is(err, database.ErrRoleExists) {
+			writeError(w, r, errRoleExists)
+			return
+		}
+		writeError(w, r, internalError("Failed to create role"))
+		return
+	}
+
+	auditAfter(r, role)
+	writeData(w, http.StatusCreated, role)
+}
+
+// handleUpdateRole replaces a role's name, description and permissions.
+// Access tokens already issued keep the old permissions until they expire.
+func (s *Server) handleUpdateRole(w http.ResponseWriter, r *http.Request) {
+	var req roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	role, ok := s.applicationRole(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, role)
+	auditAfter(r, role)
+
+	role.Name = req.Name
+	role.Description = req.Description
+	role.Permissions = normalizePermissions(req.Permissions)
+	if err := s.db.UpdateRole(role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errRoleNotFound)
+			return
+		}
+		if errors.Is(err, database.ErrRoleExists) {
+			writeError(w, r, errRoleExists)
+			return
+		}
+		writeError(w, r, internalError("Failed to update role"))
+		return
+	}
+
+	writeData(w, http.StatusOK, role)
+}
+
+func (s *Server) handleDeleteRole(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	role, ok := s.applicationRole(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, role)
+
+	if err := s.db.DeleteRole(app.ID, role.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errRoleNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete role"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleGetUserRoles(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+
+	s.writeUserRoles(w, r, user)
+}
+
+func (s *Server) handleAssignRole(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+	role, ok := s.applicationRole(w, r, app)
+	if !ok {
+		return
+	}
+
+	if err := s.db.AssignRole(app.ID, user.ID, role.ID); err != nil {
+		writeError(w, r, internalError("Failed to assign role"))
+		return
+	}
+
+	s.writeUserRoles(w, r, user)
+}
+
+func (s *Server) handleUnassignRole(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+
+	if err := s.db.UnassignRole(app.ID, user.ID, chi.URLParam(r, "roleId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errRoleNotAssigned)
+			return
+		}
+		writeError(w, r, internalError("Failed to unassign role"))
+		return
+	}
+
+	s.writeUserRoles(w, r, user)
+}
+
+// writeUserRoles responds with the user's roles and resulting permissions
+func (s *Server) writeUserRoles(w http.ResponseWriter, r *http.Request, user *database.User) {
+	roles, err := s.db.GetUserRoles(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user roles"))
+		return
+	}
+	_, permissions := rolePermissions(roles)
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"roles":       roles,
+		"permissions": permissions,
+	})
+}
+
+// handleCheckPermission answers whether a user of the calling application
+// holds a permission. Users who are not active hold none.
+func (s *Server) handleCheckPermission(w http.ResponseWriter, r *http.Request) {
+	var req permissionCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+
+	user, err := s.db.GetApplicationUser(app.ID, req.UserID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user"))
+		return
+	}
+	if user == nil {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	roles, err := s.db.GetUserRoles(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user roles"))
+		return
+	}
+
+	resp := permissionCheckResponse{GrantedBy: []string{}}
+	if user.Status == database.UserStatusActive {
+		for _, role := range roles {
+			for _, p := range role.Permissions {
+				if p == req.Permission {
+					resp.GrantedBy = append(resp.GrantedBy, role.Name)
+					break
+				}
+			}
+		}
+	}
+	resp.Allowed = len(resp.GrantedBy) > 0
+
+	writeData(w, http.StatusOK, resp)
+}
@@ -0,0 +1,101 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	roles := []database.Role{
+		{Name: "editor", Permissions: []string{"posts:write", "posts:read"}},
+		{Name: "viewer", Permissions: []string{"posts:read"}},
+	}
+
+	names, permissions := rolePermissions(roles)
+	if !reflect.DeepEqual(names, []string{"editor", "viewer"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+	if !reflect.DeepEqual(permissions, []string{"posts:read", "posts:write"}) {
+		t.Errorf("unexpected permissions %v", permissions)
+	}
+
+	names, permissions = rolePermissions(nil)
+	if names == nil || permissions == nil || len(names)+len(permissions) != 0 {
+		t.Errorf("expected empty, non-nil slices; got %v %v", names, permissions)
+	}
+}
+
+func TestRoleRequestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        roleRequest
+		wantFields []string
+	}{
+		{"valid", roleRequest{Name: "admin", Permissions: []string{"users:*", "billing:read"}}, nil},
+		{"missing name", roleRequest{}, []string{"name"}},
+		{"permission with space", roleRequest{Name: "admin", Permissions: []string{"read users"}}, []string{"permissions"}},
+		{"empty permission", roleRequest{Name: "admin", Permissions: []string{""}}, []string{"permissions"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.req.validate()
+			if len(errs) != len(tt.wantFields) {
+				t.Fatalf("expected %d errors; got %v", len(tt.wantFields), errs)
+			}
+			for i, e := range errs {
+				if e.Field != tt.wantFields[i] {
+					t.Errorf("expected error on %s; got %s", tt.wantFields[i], e.Field)
+				}
+			}
+		})
+	}
+}
+
+// failingRolesDB fails to load roles, so no access token can be issued
+type failingRolesDB struct {
+	database.Service
+}
+
+func (failingRolesDB) GetUserRoles(userID string) ([]database.Role, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestNewSessionWithoutAccessTokenIsDeleted(t *testing.T) {
+	s := newUserAdminServer(t)
+	app, _ := s.db.GetApplicationByPublicKey("pk_app-1")
+	if err := s.db.SetPasswordResetRequired("app-1", "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendPasswordResetLink(app, loadUser(t, s, "user-2")); err != nil {
+		t.Fatal(err)
+	}
+	s.db = failingRolesDB{s.db}
+
+	w := userRequest(s, s.handleCompletePasswordReset,
+		`{"token":"`+sentMail(s).token(t)+`","newPassword":"Another-Long-Passphrase-42"}`)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500; got %d: %s", w.Code, w.Body.String())
+	}
+	if got := sessionIDs(t, s, "user-2"); len(got) != 0 {
+		t.Errorf("expected the session to be deleted; got %v", got)
+	}
+
+	// Refreshing an existing session must not end it
+	ctx := context.WithValue(context.Background(), "application", app)
+	ctx = context.WithValue(ctx, "session", &database.Session{ID: "session-1", UserID: "user-1"})
+	ctx = context.WithValue(ctx, "user", loadUser(t, s, "user-1"))
+	w = httptest.NewRecorder()
+	s.handleRefreshAccessToken(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("")).WithContext(ctx))
+	if got := sessionIDs(t, s, "user-1"); w.Code != http.StatusInternalServerError || len(got) != 2 {
+		t.Errorf("expected the refresh to fail and keep the session; got %d %v", w.Code, got)
+	}
+}
@@ -25,36 +25,172 @@ func (s *Server) RegisterRoutes() http.Handler {
 			"X-Timestamp",
 			"X-Signature",
 			"X-Session-Token",
-		}, AllowCredentials: true,
-		MaxAge: 300,
+			deviceIDHeader,
+		},
+		ExposedHeaders:   []string{deviceIDHeader},
+		AllowCredentials: true,
+		MaxAge:           300,
 	}))
 
 	// Developer auth routes
-	r.Post("/api/auth/register", s.handleRegister)
-	r.Post("/api/auth/login", s.handleLogin)
+	r.Group(func(r chi.Router) {
+		r.Use(s.rateLimit(rateLimitDeveloperAuth))
+
+		r.Post("/api/auth/register", s.handleRegister)
+		r.Post("/api/auth/login", s.handleLogin)
+		r.Post("/api/auth/login/mfa", s.handleVerifyDeveloperMFA)
+		r.Post("/api/auth/login/passkey/begin", s.handleBeginPasskeyLogin)
+		r.Post("/api/auth/login/passkey/finish", s.handleFinishPasskeyLogin)
+		r.Post("/api/auth/refresh", s.handleRefreshDeveloperToken)
+	})
 
 	// Application user auth routes
 	r.Group(func(r chi.Router) {
+		r.Use(s.rateLimit(rateLimitAPIKeyAuth))
 		r.Use(s.apiKeyAuthMiddleware)
 
-		r.Post("/api/users/register", s.handleUserRegister)
-		r.Post("/api/users/login", s.handleUserLogin)
-		r.Get("/api/users/me", s.handleGetUserDetails) // New endpoint for user details
+		r.Group(func(r chi.Router) {
+			r.Use(s.rateLimit(rateLimitUserAuth))
+
+			r.Post("/api/users/register", s.handleUserRegister)
+			r.Post("/api/users/login", s.handleUserLogin)
+			r.Post("/api/users/login/verify", s.handleVerifyLogin)
+			r.Post("/api/users/password-reset/complete", s.handleCompletePasswordReset)
+			r.Post("/api/users/email-change/confirm", s.handleConfirmEmailChange)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.rateLimit(rateLimitUserAPI))
+
+			r.Post("/api/authz/check", s.handleCheckPermission)
+
+			// Routes acting on the user of the X-Session-Token session
+			r.Group(func(r chi.Router) {
+				r.Use(s.userSessionMiddleware)
+
+				r.Get("/api/users/me", s.handleGetUserDetails) // New endpoint for user details
+				r.Patch("/api/users/me", s.handleUpdateProfile)
+				r.With(s.requireRecentAuth(recentAuthMaxAge, false)).Delete("/api/users/me", s.handleDeleteAccount)
+				r.Post("/api/users/me/password", s.handleChangePassword)
+				r.With(s.requireRecentAuth(recentAuthMaxAge, false)).Post("/api/users/me/email", s.handleRequestEmailChange)
+				r.Post("/api/users/me/reauthenticate", s.handleReauthenticate)
+				r.Post("/api/users/me/token", s.handleRefreshAccessToken)
+				r.Get("/api/users/me/security-events", s.handleGetMySecurityEvents)
+				r.Get("/api/users/me/organizations", s.handleGetMyOrganizations)
+				r.Post("/api/users/me/organizations", s.handleCreateMyOrganization)
+				r.Post("/api/users/me/organizations/{orgId}/invitations", s.handleInviteToMyOrganization)
+				r.Post("/api/users/me/invitations/accept", s.handleAcceptInvitation)
+				r.Put("/api/users/me/active-organization", s.handleSetActiveOrganization)
+			})
+		})
 	})
 
 	r.Get("/api", s.HelloWorldHandler)
 	r.Get("/api/health", s.healthHandler)
 
-	// Application routes (protected by JWT)
+	// Application routes (protected by JWT or developer API token)
 	r.Group(func(r chi.Router) {
 		r.Use(s.authMiddleware)
+		r.Use(s.rateLimit(rateLimitDeveloperAPI))
+		r.Use(s.auditMiddleware)
+
+		r.Get("/api/auth/me", s.handleGetDeveloperAccount)
+		r.Patch("/api/auth/me", s.handleUpdateDeveloperAccount)
+		r.Post("/api/auth/me/email/confirm", s.handleConfirmDeveloperEmailChange)
+		r.Post("/api/auth/me/password", s.handleChangeDeveloperPassword)
+		r.Post("/api/auth/me/deletion", s.handleScheduleDeveloperDeletion)
+		r.Delete("/api/auth/me/deletion", s.handleCancelDeveloperDeletion)
+		r.Post("/api/auth/logout", s.handleDeveloperLogout)
+		r.Get("/api/auth/sessions", s.handleGetDeveloperSessions)
+		r.Delete("/api/auth/sessions/{sessionId}", s.handleRevokeDeveloperSession)
+		r.Get("/api/auth/mfa", s.handleGetDeveloperMFA)
+		r.Post("/api/auth/mfa/totp/setup", s.handleSetupTOTP)
+		r.Post("/api/auth/mfa/totp/enable", s.handleEnableTOTP)
+		r.Post("/api/auth/mfa/totp/disable", s.handleDisableTOTP)
+		r.Post("/api/auth/mfa/recovery-codes", s.handleRegenerateRecoveryCodes)
+		r.Get("/api/auth/passkeys", s.handleGetDeveloperPasskeys)
+		r.Post("/api/auth/passkeys/register/begin", s.handleBeginPasskeyRegistration)
+		r.Post("/api/auth/passkeys/register/finish", s.handleFinishPasskeyRegistration)
+		r.Delete("/api/auth/passkeys/{passkeyId}", s.handleDeleteDeveloperPasskey)
+		r.Get("/api/auth/tokens", s.handleGetAPITokens)
+		r.Post("/api/auth/tokens", s.handleCreateAPIToken)
+		r.Delete("/api/auth/tokens/{tokenId}", s.handleDeleteAPIToken)
+
+		r.Get("/api/audit-log", s.handleGetAuditLog)
+		r.Get("/api/audit-log/export", s.handleExportAuditLog)
+		r.Get("/api/audit-log/verify", s.handleVerifyAuditLog)
 
 		r.Post("/api/applications", s.handleCreateApplication)
 		r.Get("/api/applications", s.handleGetApplications)
 		r.Get("/api/applications/{id}", s.handleGetApplication)
 		r.Put("/api/applications/{id}", s.handleUpdateApplication)
 		r.Delete("/api/applications/{id}", s.handleDeleteApplication)
+		r.Post("/api/applications/{id}/keys/rotate", s.handleRotateApplicationKeys)
 		r.Get("/api/applications/{id}/users", s.handleGetApplicationUsers) // New route
+		r.Post("/api/applications/{id}/users/import", s.handleImportUsers)
+		r.Get("/api/applications/{id}/users/export", s.handleExportUsers)
+		r.Post("/api/applications/{id}/users", s.handleAdminCreateUser)
+		r.Get("/api/applications/{id}/users/{userId}", s.handleGetApplicationUser)
+		r.Patch("/api/applications/{id}/users/{userId}", s.handleUpdateApplicationUser)
+		r.Delete("/api/applications/{id}/users/{userId}", s.handleEraseUser)
+		r.Post("/api/applications/{id}/users/{userId}/disable", s.handleDisableUser)
+		r.Post("/api/applications/{id}/users/{userId}/enable", s.handleEnableUser)
+		r.Post("/api/applications/{id}/users/{userId}/require-password-reset", s.handleRequirePasswordReset)
+		r.Get("/api/applications/{id}/users/{userId}/export", s.handleExportUser)
+		r.Get("/api/applications/{id}/users/{userId}/security-events", s.handleGetUserSecurityEvents)
+		r.Get("/api/applications/{id}/erasures", s.handleGetErasureRecords)
+		r.Get("/api/applications/{id}/audit-log", s.handleGetApplicationAuditLog)
+		r.Put("/api/applications/{id}/password-policy", s.handleUpdatePasswordPolicy)
+		r.Put("/api/applications/{id}/metadata-schema", s.handleUpdateMetadataSchema)
+		r.Put("/api/applications/{id}/signup-policy", s.handleUpdateSignupPolicy)
+		r.Put("/api/applications/{id}/rate-limits", s.handleUpdateRateLimits)
+		r.Put("/api/applications/{id}/login-history-policy", s.handleUpdateLoginHistoryPolicy)
+		r.Put("/api/applications/{id}/risk-policy", s.handleUpdateRiskPolicy)
+		r.Get("/api/applications/{id}/invite-codes", s.handleGetInviteCodes)
+		r.Post("/api/applications/{id}/invite-codes", s.handleCreateInviteCode)
+		r.Delete("/api/applications/{id}/invite-codes/{codeId}", s.handleDeleteInviteCode)
+		r.Post("/api/applications/{id}/users/{userId}/approve", s.handleApproveUser)
+		r.Get("/api/applications/{id}/lockouts", s.handleGetLockouts)
+		r.Delete("/api/applications/{id}/users/{userId}/lockout", s.handleClearLockout)
+		r.Get("/api/applications/{id}/webhooks", s.handleGetWebhooks)
+		r.Post("/api/applications/{id}/webhooks", s.handleCreateWebhook)
+		r.Get("/api/applications/{id}/webhooks/{webhookId}", s.handleGetWebhook)
+		r.Patch("/api/applications/{id}/webhooks/{webhookId}", s.handleUpdateWebhook)
+		r.Delete("/api/applications/{id}/webhooks/{webhookId}", s.handleDeleteWebhook)
+		r.Get("/api/applications/{id}/webhooks/{webhookId}/deliveries", s.handleGetWebhookDeliveries)
+		r.Post("/api/applications/{id}/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", s.handleRedeliverWebhook)
+		r.Get("/api/applications/{id}/roles", s.handleGetRoles)
+		r.Post("/api/applications/{id}/roles", s.handleCreateRole)
+		r.Put("/api/applications/{id}/roles/{roleId}", s.handleUpdateRole)
+		r.Delete("/api/applications/{id}/roles/{roleId}", s.handleDeleteRole)
+		r.Get("/api/applications/{id}/users/{userId}/roles", s.handleGetUserRoles)
+		r.Put("/api/applications/{id}/users/{userId}/roles/{roleId}", s.handleAssignRole)
+		r.Delete("/api/applications/{id}/users/{userId}/roles/{roleId}", s.handleUnassignRole)
+		r.Get("/api/applications/{id}/organizations", s.handleGetOrganizations)
+		r.Post("/api/applications/{id}/organizations", s.handleCreateOrganization)
+		r.Get("/api/applications/{id}/organizations/{orgId}", s.handleGetOrganization)
+		r.Patch("/api/applications/{id}/organizations/{orgId}", s.handleUpdateOrganization)
+		r.Delete("/api/applications/{id}/organizations/{orgId}", s.handleDeleteOrganization)
+		r.Get("/api/applications/{id}/organizations/{orgId}/members", s.handleGetOrganizationMembers)
+		r.Put("/api/applications/{id}/organizations/{orgId}/members/{userId}", s.handleSetOrganizationMember)
+		r.Delete("/api/applications/{id}/organizations/{orgId}/members/{userId}", s.handleRemoveOrganizationMember)
+		r.Get("/api/applications/{id}/organizations/{orgId}/invitations", s.handleGetOrganizationInvitations)
+		r.Post("/api/applications/{id}/organizations/{orgId}/invitations", s.handleCreateOrganizationInvitation)
+		r.Delete("/api/applications/{id}/organizations/{orgId}/invitations/{invitationId}", s.handleRevokeOrganizationInvitation)
+		r.Put("/api/applications/{id}/team", s.handleSetApplicationTeam)
+		r.Post("/api/teams", s.handleCreateTeam)
+		r.Get("/api/teams", s.handleGetTeams)
+		r.Post("/api/teams/invitations/accept", s.handleAcceptTeamInvitation)
+		r.Get("/api/teams/{teamId}", s.handleGetTeam)
+		r.Patch("/api/teams/{teamId}", s.handleUpdateTeam)
+		r.Delete("/api/teams/{teamId}", s.handleDeleteTeam)
+		r.Get("/api/teams/{teamId}/audit-log", s.handleGetTeamAuditLog)
+		r.Get("/api/teams/{teamId}/members", s.handleGetTeamMembers)
+		r.Put("/api/teams/{teamId}/members/{developerId}", s.handleSetTeamMember)
+		r.Delete("/api/teams/{teamId}/members/{developerId}", s.handleRemoveTeamMember)
+		r.Get("/api/teams/{teamId}/invitations", s.handleGetTeamInvitations)
+		r.Post("/api/teams/{teamId}/invitations", s.handleCreateTeamInvitation)
+		r.Delete("/api/teams/{teamId}/invitations/{invitationId}", s.handleRevokeTeamInvitation)
 	})
 
 	return r
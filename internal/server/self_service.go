@@ -0,0 +1,332 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// emailChangeTTL is how long an email change confirmation link stays valid
+const emailChangeTTL = 24 * time.Hour
+
+type updateProfileRequest struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type changeEmailRequest struct {
+	NewEmail string `json:"newEmail"`
+}
+
+type confirmEmailChangeRequest struct {
+	Token string `json:"token"`
+}
+
+func (r updateProfileRequest) validate() []FieldError {
+	var v validator
+	if r.FirstName != nil {
+		v.name("firstName", *r.FirstName)
+	}
+	if r.LastName != nil {
+		v.name("lastName", *r.LastName)
+	}
+	return v.errors
+}
+
+func (r changePasswordRequest) validate() []FieldError {
+	var v validator
+	v.required("currentPassword", r.CurrentPassword)
+	v.password("newPassword", r.NewPassword)
+	return v.errors
+}
+
+func (r changeEmailRequest) validate() []FieldError {
+	var v validator
+	v.email("newEmail", r.NewEmail)
+	return v.errors
+}
+
+func (r confirmEmailChangeRequest) validate() []FieldError {
+	var v validator
+	v.required("token", r.Token)
+	return v.errors
+}
+
+// confirmPassword checks password against the user's current hash,
+// writing an error response and returning false if it does not match.
+// Failures count towards the IP throttle and account lockout like failed
+// logins.
+func (s *Server) confirmPassword(w http.ResponseWriter, r *http.Request, user *database.User, password string) bool {
+	if !s.checkLoginThrottle(w, r) {
+		return false
+	}
+	lockout, ok := s.checkAccountLockout(w, r, userLockoutSubject(user))
+	if !ok {
+		return false
+	}
+	ok, _, err := s.verifyPassword(password, user.PasswordHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify password"))
+		return false
+	}
+	if !ok {
+		s.loginFailed(r, userLockoutSubject(user))
+		writeError(w, r, errInvalidCredentials)
+		return false
+	}
+	s.loginSucceeded(lockout)
+	return true
+}
+
+// hashToken returns the hex SHA-256 of a bearer token for storage; the
+// plaintext token is only ever shown to its recipient
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// appURL builds a link into the application's own domain
+func appURL(app *database.Application, path string, query url.Values) string {
+	base := app.Domain
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+	return strings.TrimRight(base, "/") + path + "?" + query.Encode()
+}
+
+func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var req updateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	user := r.Context().Value("user").(*database.User)
+	if req.FirstName != nil {
+		user.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		user.LastName = *req.LastName
+	}
+
+	if err := s.db.UpdateUserProfile(user, newEvent(user.ApplicationID, eventUserUpdated, user)); err != nil {
+		writeError(w, r, internalError("Failed to update profile"))
+		return
+	}
+
+	writeData(w, http.StatusOK, selfView(user))
+}
+
+// handleChangePassword sets a new password after checking the current one,
+// and ends every other session of the user
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+	session := r.Context().Value("session").(*database.Session)
+	user := r.Context().Value("user").(*database.User)
+
+	if !s.confirmPassword(w, r, user, req.CurrentPassword) {
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		writeError(w, r, validationError([]FieldError{{
+			Field: "newPassword", Code: codePasswordReused, Message: "newPassword must differ from the current password",
+		}}))
+		return
+	}
+	if errs := s.checkPassword(app.PasswordPolicy, user.Email, req.NewPassword); len(errs) > 0 {
+		for i := range errs {
+			errs[i].Field = "newPassword"
+		}
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	hash, err := s.hashPassword(req.NewPassword)
+	if err != nil {
+		writeError(w, r, internalError("Failed to hash password"))
+		return
+	}
+
+	// The event is only recorded if other sessions end
+	event := newEvent(app.ID, eventSessionRevoked, sessionRevokedData{UserID: user.ID, Reason: revokedPasswordChanged})
+	revoked, err := s.db.ChangeUserPassword(user.ID, hash, session.ID, event)
+	if err != nil {
+		writeError(w, r, internalError("Failed to update password"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]int{"sessionsRevoked": revoked})
+}
+
+// handleRequestEmailChange emails a confirmation link to the new address.
+// The email is only changed once the link is followed. Routes require a
+// recent authentication first.
+func (s *Server) handleRequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req changeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+	user := r.Context().Value("user").(*database.User)
+
+	existingUser, err := s.db.GetUserByEmail(app.ID, req.NewEmail)
+	if err != nil {
+		writeError(w, r, internalError("Error checking for existing user"))
+		return
+	}
+	if existingUser != nil {
+		writeError(w, r, errEmailTaken)
+		return
+	}
+
+	token, err := generateKey("", 32)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate token"))
+		return
+	}
+	expiresAt := time.Now().Add(emailChangeTTL)
+	err = s.db.CreateVerificationToken(&database.VerificationToken{
+		ID:            uuid.New().String(),
+		UserID:        user.ID,
+		ApplicationID: app.ID,
+		Purpose:       database.TokenPurposeEmailChange,
+		TokenHash:     hashToken(token),
+		Payload:       req.NewEmail,
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		writeError(w, r, internalError("Failed to create email change"))
+		return
+	}
+
+	link := appURL(app, "/verify-email", url.Values{"token": {token}})
+	body := "Confirm that you want to use this address for your " + app.Name + " account:\n\n" + link +
+		"\n\nThe link expires in 24 hours. If you did not request this change, ignore this email."
+	if err := s.mailer.Send(req.NewEmail, "Confirm your new email address", body); err != nil {
+		log.Printf("failed to send email change confirmation for user %s: %v", user.ID, err)
+		writeError(w, r, internalError("Failed to send confirmation email"))
+		return
+	}
+
+	writeData(w, http.StatusAccepted, map[string]string{
+		"pendingEmail": req.NewEmail,
+		"expiresAt":    expiresAt.Format(time.RFC3339),
+	})
+}
+
+// handleConfirmEmailChange applies an email change using the token from the
+// confirmation link. It needs no session since the link may be opened on
+// another device.
+func (s *Server) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req confirmEmailChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app := r.Context().Value("application").(*database.Application)
+
+	token, err := s.db.ConsumeVerificationToken(database.TokenPurposeEmailChange, hashToken(req.Token))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up token"))
+		return
+	}
+	if token == nil || token.ApplicationID != app.ID || token.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidVerificationToken)
+		return
+	}
+
+	user, err := s.db.GetApplicationUser(app.ID, token.UserID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user"))
+		return
+	}
+	if user == nil {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	// The address may have been claimed since the change was requested
+	existingUser, err := s.db.GetUserByEmail(app.ID, token.Payload)
+	if err != nil {
+		writeError(w, r, internalError("Error checking for existing user"))
+		return
+	}
+	if existingUser != nil && existingUser.ID != user.ID {
+		writeError(w, r, errEmailTaken)
+		return
+	}
+
+	user.Email = token.Payload
+	user.EmailVerified = true
+	if err := s.db.UpdateUserProfile(user, newEvent(app.ID, eventUserUpdated, user)); err != nil {
+		writeError(w, r, internalError("Failed to update email"))
+		return
+	}
+
+	writeData(w, http.StatusOK, selfView(user))
+}
+
+// handleDeleteAccount erases the session's user, leaving an erasure record
+// behind. Routes require a recent authentication first.
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	app := r.Context().Value("application").(*database.Application)
+	user := r.Context().Value("user").(*database.User)
+
+	record := &database.ErasureRecord{
+		ID:            uuid.New().String(),
+		ApplicationID: app.ID,
+		UserID:        user.ID,
+		EmailHash:     emailHash(user.Email),
+		ErasedBy:      "self",
+	}
+	if err := s.db.EraseUser(record, newEvent(app.ID, eventUserDeleted, newUserDeletedData(record))); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete account"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
@@ -0,0 +1,226 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSelfServiceServer seeds app-1 with Ada, user-1, who is signed in on
+// session-1 to session-3, and Grace, user-2
+func newSelfServiceServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-1", "dev-1")
+	ada := seedUser(t, s, "app-1", "user-1", "ada@example.com")
+	for _, id := range []string{"session-1", "session-2", "session-3"} {
+		seedSession(t, s, ada, id)
+	}
+	seedUser(t, s, "app-1", "user-2", "grace@example.com")
+	return s
+}
+
+// selfRequest serves handler as user-1 signed in to app-1 with session-1
+func selfRequest(s *Server, handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	app, _ := s.db.GetApplicationByPublicKey("pk_app-1")
+	user, _ := s.db.GetUserByID("user-1")
+	ctx := context.WithValue(context.Background(), "application", app)
+	ctx = context.WithValue(ctx, "session", &database.Session{ID: "session-1", UserID: "user-1"})
+	ctx = context.WithValue(ctx, "user", user)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		code    string
+		revoked bool
+	}{
+		{"changed", `{"currentPassword":"` + testPassword + `","newPassword":"a different passphrase"}`, http.StatusOK, "", true},
+		{"wrong current password", `{"currentPassword":"wrong","newPassword":"a different passphrase"}`, http.StatusUnauthorized, "invalid_credentials", false},
+		{"same password", `{"currentPassword":"` + testPassword + `","newPassword":"` + testPassword + `"}`, http.StatusUnprocessableEntity, "password_reused", false},
+		{"too short", `{"currentPassword":"` + testPassword + `","newPassword":"short"}`, http.StatusUnprocessableEntity, "validation_failed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSelfServiceServer(t)
+			oldHash := loadUser(t, s, "user-1").PasswordHash
+
+			w := selfRequest(s, s.handleChangePassword, tt.body)
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+				t.Fatalf("expected %d %s; got %d: %s", tt.want, tt.code, w.Code, w.Body.String())
+			}
+			events := pendingEvents(t, s)
+			if !tt.revoked {
+				if loadUser(t, s, "user-1").PasswordHash != oldHash || len(sessionIDs(t, s, "user-1")) != 3 || len(events) != 0 {
+					t.Error("expected the password and sessions to be left alone")
+				}
+				return
+			}
+
+			if ok, _, _ := s.verifyPassword("a different passphrase", loadUser(t, s, "user-1").PasswordHash); !ok {
+				t.Error("expected the new password to be stored")
+			}
+			if got := sessionIDs(t, s, "user-1"); len(got) != 1 || got[0] != "session-1" {
+				t.Errorf("expected only the current session to be kept; got %v", got)
+			}
+			if !strings.Contains(w.Body.String(), `"sessionsRevoked":2`) {
+				t.Errorf("expected two sessions to be revoked; got %s", w.Body.String())
+			}
+			if len(events) != 1 || events[0].Type != eventSessionRevoked ||
+				!strings.Contains(string(events[0].Payload), revokedPasswordChanged) {
+				t.Errorf("expected a session.revoked event; got %+v", events)
+			}
+		})
+	}
+}
+
+func TestChangePasswordCountsFailures(t *testing.T) {
+	s := newSelfServiceServer(t)
+	wrong := `{"currentPassword":"wrong","newPassword":"a different passphrase"}`
+	failures := s.lockout.FreeAttempts + 1
+	for i := 0; i < failures; i++ {
+		if w := selfRequest(s, s.handleChangePassword, wrong); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401; got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	lockout, err := s.db.GetAccountLockout("user-1")
+	if err != nil || lockout == nil || lockout.FailedAttempts != failures {
+		t.Fatalf("expected %d failed attempts; got %+v %v", failures, lockout, err)
+	}
+
+	// Even the right password now has to wait
+	w := selfRequest(s, s.handleChangePassword, `{"currentPassword":"`+testPassword+`","newPassword":"a different passphrase"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected the attempt to be delayed; got %d: %s", w.Code, w.Body.String())
+	}
+	if ok, _, _ := s.verifyPassword(testPassword, loadUser(t, s, "user-1").PasswordHash); !ok {
+		t.Error("expected the password to be left alone")
+	}
+}
+
+func TestChangePasswordOnlySession(t *testing.T) {
+	s := newSelfServiceServer(t)
+	for _, id := range []string{"session-2", "session-3"} {
+		if err := s.db.DeleteSession(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := selfRequest(s, s.handleChangePassword, `{"currentPassword":"`+testPassword+`","newPassword":"a different passphrase"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sessionsRevoked":0`) {
+		t.Fatalf("expected no sessions to be revoked; got %d: %s", w.Code, w.Body.String())
+	}
+	if events := pendingEvents(t, s); len(events) != 0 {
+		t.Errorf("expected no session.revoked event; got %s", eventTypes(events))
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	s := newSelfServiceServer(t)
+	mailer := sentMail(s)
+
+	w := selfRequest(s, s.handleRequestEmailChange, `{"newEmail":"countess@example.com"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", w.Code, w.Body.String())
+	}
+	if len(mailer.to) != 1 || mailer.to[0] != "countess@example.com" {
+		t.Fatalf("expected the link to go to the new address; got %v", mailer.to)
+	}
+	if loadUser(t, s, "user-1").Email != "ada@example.com" {
+		t.Error("expected the email to stay until the link is followed")
+	}
+	token := mailer.token(t)
+	if vt, _ := s.db.GetVerificationToken(database.TokenPurposeEmailChange, token); vt != nil {
+		t.Error("expected only the hash of the token to be stored")
+	}
+
+	w = selfRequest(s, s.handleConfirmEmailChange, `{"token":"`+token+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if u := loadUser(t, s, "user-1"); u.Email != "countess@example.com" || !u.EmailVerified {
+		t.Errorf("expected the new email to be set and verified; got %s verified=%v", u.Email, u.EmailVerified)
+	}
+	if got := eventTypes(pendingEvents(t, s)); got != eventUserUpdated {
+		t.Errorf("expected a user.updated event; got %s", got)
+	}
+
+	w = selfRequest(s, s.handleConfirmEmailChange, `{"token":"`+token+`"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_verification_token") {
+		t.Errorf("expected a used token to be rejected; got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestConfirmEmailChangeRejected(t *testing.T) {
+	// replaceToken stores token again with changes made by fn
+	replaceToken := func(t *testing.T, s *Server, token string, fn func(vt *database.VerificationToken)) {
+		vt := &database.VerificationToken{ID: "vt-2", UserID: "user-1", ApplicationID: "app-1",
+			Purpose: database.TokenPurposeEmailChange, TokenHash: hashToken(token), Payload: "countess@example.com",
+			ExpiresAt: time.Now().Add(time.Hour)}
+		fn(vt)
+		if err := s.db.CreateVerificationToken(vt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *Server, token string)
+		want  int
+		code  string
+	}{
+		{"expired", func(t *testing.T, s *Server, token string) {
+			replaceToken(t, s, token, func(vt *database.VerificationToken) { vt.ExpiresAt = time.Now().Add(-time.Minute) })
+		}, http.StatusBadRequest, "invalid_verification_token"},
+		{"other application", func(t *testing.T, s *Server, token string) {
+			replaceToken(t, s, token, func(vt *database.VerificationToken) { vt.ApplicationID = "app-2" })
+		}, http.StatusBadRequest, "invalid_verification_token"},
+		{"replaced by a newer request", func(t *testing.T, s *Server, token string) {
+			replaceToken(t, s, "newer", func(vt *database.VerificationToken) {})
+		}, http.StatusBadRequest, "invalid_verification_token"},
+		{"address claimed since", func(t *testing.T, s *Server, token string) {
+			seedUser(t, s, "app-1", "user-3", "countess@example.com")
+		}, http.StatusConflict, "email_taken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSelfServiceServer(t)
+			if w := selfRequest(s, s.handleRequestEmailChange, `{"newEmail":"countess@example.com"}`); w.Code != http.StatusAccepted {
+				t.Fatalf("expected status 202; got %d: %s", w.Code, w.Body.String())
+			}
+			token := sentMail(s).token(t)
+			tt.setup(t, s, token)
+
+			w := selfRequest(s, s.handleConfirmEmailChange, `{"token":"`+token+`"}`)
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected %d %s; got %d: %s", tt.want, tt.code, w.Code, w.Body.String())
+			}
+			if loadUser(t, s, "user-1").Email != "ada@example.com" || len(pendingEvents(t, s)) != 0 {
+				t.Error("expected the email to be left alone")
+			}
+		})
+	}
+}
+
+func TestRequestEmailChangeTaken(t *testing.T) {
+	s := newSelfServiceServer(t)
+	w := selfRequest(s, s.handleRequestEmailChange, `{"newEmail":"grace@example.com"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "email_taken") {
+		t.Errorf("expected a taken address to be rejected; got %d: %s", w.Code, w.Body.String())
+	}
+	if mailer := sentMail(s); len(mailer.to) != 0 {
+		t.Error("expected no confirmation to be sent")
+	}
+}
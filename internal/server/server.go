@@ -21,20 +21,112 @@ type Server struct {
 		secret []byte
 		exp    time.Duration
 	}
+	breached *breachedPasswordList
+	geoIP    *geoIPDatabase
+	hasher   PasswordHasher
+	mailer   Mailer
+	// dashboardURL is the developer dashboard that team invitations link to
+	dashboardURL string
+	// webauthn configures developer passkeys
+	webauthn webAuthnConfig
+
+	// trustProxy makes clientIP believe X-Forwarded-For
+	trustProxy    bool
+	lockout       lockoutPolicy
+	loginThrottle *ipThrottle
+	// lockoutHooks run in their own goroutine whenever an account is locked
+	lockoutHooks []func(lockoutEvent)
+	rateLimits   RateLimitStore
+	webhooks     *webhookDispatcher
+	outbox       *outboxDispatcher
+	janitor      *janitor
 }
 
 func NewServer() *http.Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 
+	db := database.New()
 	srv := &Server{
 		port:      port,
-		db:        database.New(),
+		db:        db,
 		jwtSecret: []byte(os.Getenv("JWT_SECRET")),
+		mailer:    newMailer(),
+
+		trustProxy:    os.Getenv("TRUST_PROXY") == "true",
+		lockout:       defaultLockoutPolicy,
+		loginThrottle: newIPThrottle(loginThrottleLimit, loginThrottleWindow),
+		rateLimits:    newMemoryRateLimitStore(),
+		webhooks:      newWebhookDispatcher(db),
 	}
+	srv.lockoutHooks = append(srv.lockoutHooks, srv.emailLockoutNotice)
 
 	// Configure JWT
 	srv.jwt.secret = []byte(os.Getenv("JWT_SECRET"))
-	srv.jwt.exp = 24 * time.Hour
+	srv.jwt.exp = developerAccessTokenDuration
+
+	// Select the algorithm used for new password hashes
+	hasher, err := newPasswordHasher(os.Getenv("PASSWORD_HASH_ALGORITHM"))
+	if err != nil {
+		log.Fatalf("failed to configure password hashing: %v", err)
+	}
+	srv.hasher = hasher
+
+	srv.dashboardURL = os.Getenv("DASHBOARD_URL")
+
+	// Configure developer passkeys and authenticator apps
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "Auth Server"
+	}
+	srv.webauthn, err = newWebAuthnConfig(os.Getenv("WEBAUTHN_RP_ID"), os.Getenv("WEBAUTHN_ORIGINS"), srv.dashboardURL, issuer)
+	if err != nil {
+		log.Fatalf("failed to configure passkeys: %v", err)
+	}
+
+	// Load the breached password list used by password policies, if
+	// configured. It is either one file of hashes or a directory of HIBP
+	// range files.
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		list, err := loadBreachedPasswords(path)
+		if err != nil {
+			log.Fatalf("failed to load breached passwords from %s: %v", path, err)
+		}
+		srv.breached = list
+	}
+
+	// Load the GeoIP database used to detect impossible travel, if configured
+	if path := os.Getenv("GEOIP_DATABASE_FILE"); path != "" {
+		geo, err := loadGeoIP(path)
+		if err != nil {
+			log.Fatalf("failed to load GeoIP database from %s: %v", path, err)
+		}
+		srv.geoIP = geo
+	}
+
+	// Drain the event outbox to the configured sinks
+	sinkNames := os.Getenv("EVENT_SINKS")
+	if sinkNames == "" {
+		sinkNames = "webhooks"
+	}
+	sinks, err := newEventSinks(sinkNames, os.Getenv("EVENT_SINK_FILE"), db, srv.webhooks)
+	if err != nil {
+		log.Fatalf("failed to configure event sinks: %v", err)
+	}
+	srv.outbox = newOutboxDispatcher(db, sinks)
+
+	srv.janitor = newJanitor(janitorTask{
+		name: "expired login attempts",
+		run:  func() (int, error) { return db.DeleteExpiredLoginAttempts(defaultLoginHistoryRetentionDays) },
+	}, janitorTask{
+		name: "expired developer sessions",
+		run:  db.DeleteExpiredDeveloperSessions,
+	}, janitorTask{
+		name: "expired revoked tokens",
+		run:  db.DeleteExpiredRevokedTokens,
+	}, janitorTask{
+		name: "developers due for deletion",
+		run:  srv.deleteDueDevelopers,
+	})
 
 	// Initialize database schema
 	if err := srv.db.InitSchema(); err != nil {
@@ -50,5 +142,14 @@ func NewServer() *http.Server {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Dispatch events, deliver webhooks and delete expired data in the
+	// background until the server shuts down
+	go srv.outbox.run()
+	go srv.webhooks.run()
+	go srv.janitor.run()
+	server.RegisterOnShutdown(srv.outbox.stop)
+	server.RegisterOnShutdown(srv.webhooks.stop)
+	server.RegisterOnShutdown(srv.janitor.stop)
+
 	return server
 }
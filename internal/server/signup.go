@@ -0,0 +1,315 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	maxSignupDomains    = 500
+	maxInviteCodeUses   = 10000
+	maxInviteCodeLength = 100
+	inviteCodePrefix    = "inv_"
+	inviteCodeLength    = 12
+)
+
+type inviteCodeRequest struct {
+	// Email restricts the code to one address when set
+	Email string `json:"email"`
+	// MaxUses defaults to a single use
+	MaxUses int `json:"maxUses"`
+	// ExpiresInHours makes the code expire; zero means it never does
+	ExpiresInHours int `json:"expiresInHours"`
+}
+
+func (r inviteCodeRequest) validate() []FieldError {
+	var v validator
+	if r.Email != "" {
+		v.email("email", r.Email)
+	}
+	if r.MaxUses < 0 || r.MaxUses > maxInviteCodeUses {
+		v.add("maxUses", codeOutOfRange, "maxUses must be between 1 and 10000")
+	}
+	if r.ExpiresInHours < 0 {
+		v.add("expiresInHours", codeOutOfRange, "expiresInHours must not be negative")
+	}
+	return v.errors
+}
+
+// effectiveSignupMode returns the mode of a possibly nil policy
+func effectiveSignupMode(p *database.SignupPolicy) string {
+	if p == nil || p.Mode == "" {
+		return database.SignupModeOpen
+	}
+	return p.Mode
+}
+
+// emailDomainAllowed checks the domain of email against the policy's lists.
+// A listed domain also covers its subdomains.
+func emailDomainAllowed(p *database.SignupPolicy, email string) bool {
+	if p == nil {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	domain := strings.ToLower(email[at+1:])
+
+	matches := func(list []string) bool {
+		for _, d := range list {
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if matches(p.BlockedDomains) {
+		return false
+	}
+	return len(p.AllowedDomains) == 0 || matches(p.AllowedDomains)
+}
+
+// validateSignupPolicy checks the mode and normalizes the domain lists to
+// lowercase
+func validateSignupPolicy(p *database.SignupPolicy) []FieldError {
+	var v validator
+	switch p.Mode {
+	case database.SignupModeOpen, database.SignupModeDisabled,
+		database.SignupModeInviteOnly, database.SignupModeWaitlist:
+	default:
+		v.add("mode", "invalid_mode", "mode must be open, disabled, invite_only or waitlist")
+	}
+
+	for _, list := range []struct {
+		field   string
+		domains []string
+	}{{"allowedDomains", p.AllowedDomains}, {"blockedDomains", p.BlockedDomains}} {
+		if len(list.domains) > maxSignupDomains {
+			v.add(list.field, codeTooLong, list.field+" can have at most 500 entries")
+			continue
+		}
+		for i, d := range list.domains {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if !isValidHostname(d) {
+				v.add(list.field, codeInvalidDomain, list.field+" must contain only domain names")
+				break
+			}
+			list.domains[i] = d
+		}
+	}
+	return v.errors
+}
+
+// checkSignup applies the application's signup policy to a registration,
+// checking inviteCode when signup is invite-only. It returns the status the
+// new user should get and the ID of the invite code to redeem along with
+// the user, or writes an error response and returns false.
+func (s *Server) checkSignup(w http.ResponseWriter, r *http.Request, app *database.Application, email, inviteCode string) (string, string, bool) {
+	policy := app.SignupPolicy
+
+	switch effectiveSignupMode(policy) {
+	case database.SignupModeDisabled:
+		writeError(w, r, errSignupDisabled)
+		return "", "", false
+	case database.SignupModeWaitlist:
+		if !emailDomainAllowed(policy, email) {
+			writeError(w, r, errEmailDomainNotAllowed)
+			return "", "", false
+		}
+		return database.UserStatusPending, "", true
+	case database.SignupModeInviteOnly:
+		if !emailDomainAllowed(policy, email) {
+			writeError(w, r, errEmailDomainNotAllowed)
+			return "", "", false
+		}
+		if inviteCode == "" {
+			writeError(w, r, errInviteCodeRequired)
+			return "", "", false
+		}
+		code, err := s.db.GetInviteCodeByHash(app.ID, hashToken(inviteCode))
+		if err != nil {
+			writeError(w, r, internalError("Failed to look up invite code"))
+			return "", "", false
+		}
+		if code == nil || code.Uses >= code.MaxUses ||
+			(code.ExpiresAt != nil && code.ExpiresAt.Before(time.Now())) ||
+			(code.Email != "" && !strings.EqualFold(code.Email, email)) {
+			writeError(w, r, errInvalidInviteCode)
+			return "", "", false
+		}
+		return database.UserStatusActive, code.ID, true
+	default:
+		if !emailDomainAllowed(policy, email) {
+			writeError(w, r, errEmailDomainNotAllowed)
+			return "", "", false
+		}
+		return database.UserStatusActive, "", true
+	}
+}
+
+func (s *Server) handleUpdateSignupPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy *database.SignupPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if policy != nil {
+		if errs := validateSignupPolicy(policy); len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	auditBefore(r, app.SignupPolicy)
+
+	if err := s.db.UpdateApplicationSignupPolicy(app.ID, app.DeveloperID, policy); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update signup policy"))
+		return
+	}
+	auditAfter(r, policy)
+
+	if policy == nil {
+		policy = &database.SignupPolicy{Mode: database.SignupModeOpen}
+	}
+	writeData(w, http.StatusOK, policy)
+}
+
+func (s *Server) handleGetInviteCodes(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := s.db.GetInviteCodes(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch invite codes"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"inviteCodes": codes,
+		"count":       len(codes),
+	})
+}
+
+// handleCreateInviteCode generates an invite code. The code itself is only
+// returned here; it is stored hashed.
+func (s *Server) handleCreateInviteCode(w http.ResponseWriter, r *http.Request) {
+	var req inviteCodeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, errInvalidRequest)
+			return
+		}
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	plain, err := generateKey(inviteCodePrefix, inviteCodeLength)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate invite code"))
+		return
+	}
+	code := &database.InviteCode{
+		ID:            uuid.New().String(),
+		ApplicationID: app.ID,
+		Code:          plain,
+		CodeHash:      hashToken(plain),
+		Email:         req.Email,
+		MaxUses:       req.MaxUses,
+	}
+	if code.MaxUses == 0 {
+		code.MaxUses = 1
+	}
+	if req.ExpiresInHours > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInHours) * time.Hour).UTC()
+		code.ExpiresAt = &expiresAt
+	}
+
+	if err := s.db.CreateInviteCode(code); err != nil {
+		writeError(w, r, internalError("Failed to create invite code"))
+		return
+	}
+	auditAfter(r, code)
+
+	writeData(w, http.StatusCreated, code)
+}
+
+func (s *Server) handleDeleteInviteCode(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteInviteCode(app.ID, chi.URLParam(r, "codeId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInviteCodeNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete invite code"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// handleApproveUser activates a user waiting on the waitlist and lets them
+// know by email. Rejected registrations are removed with the erase endpoint.
+func (s *Server) handleApproveUser(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+	if user.Status != database.UserStatusPending {
+		writeError(w, r, errUserNotPending)
+		return
+	}
+	auditBefore(r, user)
+	auditAfter(r, user)
+
+	user.Status = database.UserStatusActive
+	user.StatusReason = ""
+	event := newEvent(app.ID, eventUserUpdated, user)
+	if err := s.db.SetUserStatus(app.ID, user.ID, user.Status, "", event); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to approve user"))
+		return
+	}
+
+	body := "Your " + app.Name + " account has been approved. You can now log in."
+	if err := s.mailer.Send(user.Email, "Your account has been approved", body); err != nil {
+		log.Printf("failed to send approval email to user %s: %v", user.ID, err)
+	}
+
+	writeData(w, http.StatusOK, user)
+}
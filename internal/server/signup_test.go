@@ -0,0 +1,74 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"testing"
+)
+
+func TestEmailDomainAllowed(t *testing.T) {
+	policy := &database.SignupPolicy{
+		AllowedDomains: []string{"example.com", "partner.org"},
+		BlockedDomains: []string{"contractors.example.com"},
+	}
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"jane@example.com", true},
+		{"jane@EXAMPLE.com", true},
+		{"jane@eng.example.com", true},
+		{"jane@partner.org", true},
+		{"jane@contractors.example.com", false},
+		{"jane@notexample.com", false},
+		{"jane@gmail.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := emailDomainAllowed(policy, tt.email); got != tt.want {
+			t.Errorf("emailDomainAllowed(%q) = %v; want %v", tt.email, got, tt.want)
+		}
+	}
+
+	blockOnly := &database.SignupPolicy{BlockedDomains: []string{"mailinator.com"}}
+	if !emailDomainAllowed(blockOnly, "jane@gmail.com") || emailDomainAllowed(blockOnly, "x@mailinator.com") {
+		t.Error("expected a blocklist alone to allow every other domain")
+	}
+	if !emailDomainAllowed(nil, "jane@gmail.com") {
+		t.Error("expected a nil policy to allow every domain")
+	}
+}
+
+func TestValidateSignupPolicy(t *testing.T) {
+	policy := &database.SignupPolicy{
+		Mode:           database.SignupModeInviteOnly,
+		AllowedDomains: []string{" Example.COM "},
+	}
+	if errs := validateSignupPolicy(policy); len(errs) != 0 {
+		t.Fatalf("expected no errors; got %v", errs)
+	}
+	if policy.AllowedDomains[0] != "example.com" {
+		t.Errorf("expected domains to be normalized; got %q", policy.AllowedDomains[0])
+	}
+
+	errs := validateSignupPolicy(&database.SignupPolicy{
+		Mode:           "closed",
+		BlockedDomains: []string{"not a domain"},
+	})
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	if !fields["mode"] || !fields["blockedDomains"] {
+		t.Errorf("expected errors on mode and blockedDomains; got %v", errs)
+	}
+}
+
+func TestEffectiveSignupMode(t *testing.T) {
+	if got := effectiveSignupMode(nil); got != database.SignupModeOpen {
+		t.Errorf("expected open for nil policy; got %s", got)
+	}
+	if got := effectiveSignupMode(&database.SignupPolicy{Mode: database.SignupModeWaitlist}); got != database.SignupModeWaitlist {
+		t.Errorf("expected waitlist; got %s", got)
+	}
+}
@@ -0,0 +1,593 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// teamInviteTTL is how long a team invitation can be accepted
+const teamInviteTTL = 7 * 24 * time.Hour
+
+// teamRoleRank orders team roles, higher being more privileged. Unknown
+// roles rank below every real one.
+var teamRoleRank = map[string]int{
+	database.TeamRoleReadOnly: 1,
+	database.TeamRoleMember:   2,
+	database.TeamRoleAdmin:    3,
+	database.TeamRoleOwner:    4,
+}
+
+type teamRequest struct {
+	Name string `json:"name"`
+}
+
+type teamMemberRequest struct {
+	Role string `json:"role"`
+}
+
+type teamInvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type applicationTeamRequest struct {
+	// TeamID is the team to move the application into; empty moves it to
+	// the requesting developer's personal applications
+	TeamID string `json:"teamId"`
+}
+
+func (r teamRequest) validate() []FieldError {
+	var v validator
+	v.name("name", r.Name)
+	return v.errors
+}
+
+func (r teamMemberRequest) validate() []FieldError {
+	var v validator
+	if v.required("role", r.Role) && teamRoleRank[r.Role] == 0 {
+		v.add("role", "invalid_role", "role must be owner, admin, member or read_only")
+	}
+	return v.errors
+}
+
+func (r teamInvitationRequest) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	if r.Role != "" && teamRoleRank[r.Role] == 0 {
+		v.add("role", "invalid_role", "role must be owner, admin, member or read_only")
+	}
+	return v.errors
+}
+
+// teamRoleAtLeast reports whether role is min or a more privileged one
+func teamRoleAtLeast(role, min string) bool {
+	return teamRoleRank[role] >= teamRoleRank[min]
+}
+
+// dashboardLink builds a link into the developer dashboard, or returns ""
+// if DASHBOARD_URL is not configured
+func (s *Server) dashboardLink(path string, query url.Values) string {
+	if s.dashboardURL == "" {
+		return ""
+	}
+	return strings.TrimRight(s.dashboardURL, "/") + path + "?" + query.Encode()
+}
+
+// developerTeam loads the {teamId} team and the authenticated developer's
+// membership of it, writing an error response and returning false if they
+// are not a member with at least minRole. Teams of other developers are
+// reported as not found.
+func (s *Server) developerTeam(w http.ResponseWriter, r *http.Request, minRole string) (*database.Team, *database.TeamMember, bool) {
+	developerID := r.Context().Value("developerID").(string)
+	teamID := chi.URLParam(r, "teamId")
+
+	member, err := s.db.GetTeamMember(teamID, developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to check team membership"))
+		return nil, nil, false
+	}
+	if member == nil {
+		writeError(w, r, errTeamNotFound)
+		return nil, nil, false
+	}
+	if !teamRoleAtLeast(member.Role, minRole) {
+		writeError(w, r, errTeamRoleRequired)
+		return nil, nil, false
+	}
+
+	team, err := s.db.GetTeam(teamID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch team"))
+		return nil, nil, false
+	}
+	if team == nil {
+		writeError(w, r, errTeamNotFound)
+		return nil, nil, false
+	}
+	return team, member, true
+}
+
+// keepsTeamOwner writes an error response and returns false if changing
+// member's role to role, or removing them when role is "", would leave the
+// team without an owner
+func (s *Server) keepsTeamOwner(w http.ResponseWriter, r *http.Request, member *database.TeamMember, role string) bool {
+	if member.Role != database.TeamRoleOwner || role == database.TeamRoleOwner {
+		return true
+	}
+	owners, err := s.db.CountTeamOwners(member.TeamID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to count team owners"))
+		return false
+	}
+	if owners <= 1 {
+		writeError(w, r, errLastTeamOwner)
+		return false
+	}
+	return true
+}
+
+// handleCreateTeam creates a team with the developer as its owner
+func (s *Server) handleCreateTeam(w http.ResponseWriter, r *http.Request) {
+	var req teamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	developerID := r.Context().Value("developerID").(string)
+
+	team := &database.Team{ID: uuid.New().String(), Name: req.Name}
+	owner := &database.TeamMember{TeamID: team.ID, DeveloperID: developerID, Role: database.TeamRoleOwner}
+	if err := s.db.CreateTeam(team, owner); err != nil {
+		writeError(w, r, internalError("Failed to create team"))
+		return
+	}
+	auditAfter(r, team)
+
+	writeData(w, http.StatusCreated, database.DeveloperTeam{Team: *team, Role: owner.Role})
+}
+
+func (s *Server) handleGetTeams(w http.ResponseWriter, r *http.Request) {
+	developerID := r.Context().Value("developerID").(string)
+
+	teams, err := s.db.GetDeveloperTeams(developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch teams"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"teams": teams,
+		"count": len(teams),
+	})
+}
+
+func (s *Server) handleGetTeam(w http.ResponseWriter, r *http.Request) {
+	team, member, ok := s.developerTeam(w, r, database.TeamRoleReadOnly)
+	if !ok {
+		return
+	}
+
+	writeData(w, http.StatusOK, database.DeveloperTeam{Team: *team, Role: member.Role})
+}
+
+func (s *Server) handleUpdateTeam(w http.ResponseWriter, r *http.Request) {
+	var req teamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	team, member, ok := s.developerTeam(w, r, database.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+	auditBefore(r, team)
+
+	team.Name = req.Name
+	if err := s.db.UpdateTeam(team); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errTeamNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update team"))
+		return
+	}
+	auditAfter(r, team)
+
+	writeData(w, http.StatusOK, database.DeveloperTeam{Team: *team, Role: member.Role})
+}
+
+// handleDeleteTeam deletes a team that owns no applications; they must be
+// moved or deleted first
+func (s *Server) handleDeleteTeam(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := s.developerTeam(w, r, database.TeamRoleOwner)
+	if !ok {
+		return
+	}
+
+	apps, err := s.db.CountTeamApplications(team.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to count team applications"))
+		return
+	}
+	if apps > 0 {
+		writeError(w, r, errTeamHasApplications)
+		return
+	}
+	auditBefore(r, team)
+
+	if err := s.db.DeleteTeam(team.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errTeamNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete team"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleGetTeamMembers(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := s.developerTeam(w, r, database.TeamRoleReadOnly)
+	if !ok {
+		return
+	}
+
+	members, err := s.db.GetTeamMembers(team.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch team members"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"members": members,
+		"count":   len(members),
+	})
+}
+
+// handleSetTeamMember changes the role of a team member. Only owners can
+// make or change owners, and the last owner cannot be demoted. Developers
+// join teams by accepting an invitation.
+func (s *Server) handleSetTeamMember(w http.ResponseWriter, r *http.Request) {
+	var req teamMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	team, actor, ok := s.developerTeam(w, r, database.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+
+	member, err := s.db.GetTeamMember(team.ID, chi.URLParam(r, "developerId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch team member"))
+		return
+	}
+	if member == nil {
+		writeError(w, r, errTeamMemberNotFound)
+		return
+	}
+	if (member.Role == database.TeamRoleOwner || req.Role == database.TeamRoleOwner) &&
+		actor.Role != database.TeamRoleOwner {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+	if !s.keepsTeamOwner(w, r, member, req.Role) {
+		return
+	}
+	auditBefore(r, member)
+
+	member.Role = req.Role
+	if err := s.db.SetTeamMember(member); err != nil {
+		writeError(w, r, internalError("Failed to update team member"))
+		return
+	}
+	auditAfter(r, member)
+
+	writeData(w, http.StatusOK, member)
+}
+
+// handleRemoveTeamMember removes a developer from a team. Admins can remove
+// others, owners can remove owners, and any member can leave; the last owner
+// cannot.
+func (s *Server) handleRemoveTeamMember(w http.ResponseWriter, r *http.Request) {
+	team, actor, ok := s.developerTeam(w, r, database.TeamRoleReadOnly)
+	if !ok {
+		return
+	}
+
+	member, err := s.db.GetTeamMember(team.ID, chi.URLParam(r, "developerId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch team member"))
+		return
+	}
+	if member == nil {
+		writeError(w, r, errTeamMemberNotFound)
+		return
+	}
+	if member.DeveloperID != actor.DeveloperID {
+		required := database.TeamRoleAdmin
+		if member.Role == database.TeamRoleOwner {
+			required = database.TeamRoleOwner
+		}
+		if !teamRoleAtLeast(actor.Role, required) {
+			writeError(w, r, errTeamRoleRequired)
+			return
+		}
+	}
+	if !s.keepsTeamOwner(w, r, member, "") {
+		return
+	}
+	auditBefore(r, member)
+
+	if err := s.db.DeleteTeamMember(team.ID, member.DeveloperID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errTeamMemberNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to remove team member"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// handleCreateTeamInvitation emails an invitation to join a team to a
+// developer, who may not have an account yet. Only owners can invite owners.
+func (s *Server) handleCreateTeamInvitation(w http.ResponseWriter, r *http.Request) {
+	var req teamInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+	if req.Role == "" {
+		req.Role = database.TeamRoleMember
+	}
+
+	team, actor, ok := s.developerTeam(w, r, database.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+	if req.Role == database.TeamRoleOwner && actor.Role != database.TeamRoleOwner {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+
+	invitee, err := s.db.GetDeveloperByEmail(req.Email)
+	if err != nil {
+		writeError(w, r, internalError("Error checking for existing developer"))
+		return
+	}
+	if invitee != nil {
+		member, err := s.db.GetTeamMember(team.ID, invitee.ID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check team membership"))
+			return
+		}
+		if member != nil {
+			writeError(w, r, errAlreadyTeamMember)
+			return
+		}
+	}
+
+	token, err := generateKey("", 32)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate token"))
+		return
+	}
+	invitation := &database.TeamInvitation{
+		ID:        uuid.New().String(),
+		TeamID:    team.ID,
+		Email:     req.Email,
+		Role:      req.Role,
+		TokenHash: hashToken(token),
+		InvitedBy: actor.DeveloperID,
+		ExpiresAt: time.Now().Add(teamInviteTTL),
+	}
+	if err := s.db.CreateTeamInvitation(invitation); err != nil {
+		writeError(w, r, internalError("Failed to create invitation"))
+		return
+	}
+
+	accept := "accept it in the developer dashboard with this code:\n\n" + token
+	if link := s.dashboardLink("/teams/accept-invitation", url.Values{"token": {token}}); link != "" {
+		accept = "accept it here:\n\n" + link
+	}
+	body := "You have been invited to join the " + team.Name + " team. Sign in or register, then " + accept +
+		"\n\nThe invitation expires in 7 days."
+	if err := s.mailer.Send(req.Email, "You're invited to join "+team.Name, body); err != nil {
+		log.Printf("failed to send team invitation %s: %v", invitation.ID, err)
+		writeError(w, r, internalError("Failed to send invitation email"))
+		return
+	}
+	auditAfter(r, invitation)
+
+	writeData(w, http.StatusCreated, invitation)
+}
+
+func (s *Server) handleGetTeamInvitations(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := s.developerTeam(w, r, database.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+
+	invitations, err := s.db.GetTeamInvitations(team.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch invitations"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"invitations": invitations,
+		"count":       len(invitations),
+	})
+}
+
+func (s *Server) handleRevokeTeamInvitation(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := s.developerTeam(w, r, database.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteTeamInvitation(team.ID, chi.URLParam(r, "invitationId")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvitationNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to revoke invitation"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// handleAcceptTeamInvitation adds the developer to the team of an
+// invitation sent to their email address
+func (s *Server) handleAcceptTeamInvitation(w http.ResponseWriter, r *http.Request) {
+	var req acceptInvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	developerID := r.Context().Value("developerID").(string)
+	developer, err := s.db.GetDeveloperByID(developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch developer"))
+		return
+	}
+	if developer == nil {
+		writeError(w, r, errInvalidClaims)
+		return
+	}
+
+	invitation, err := s.db.GetTeamInvitationByToken(hashToken(req.Token))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up invitation"))
+		return
+	}
+	if invitation == nil || invitation.Accepted || invitation.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidInvitation)
+		return
+	}
+	if !strings.EqualFold(invitation.Email, developer.Email) {
+		writeError(w, r, errInvitationEmailMismatch)
+		return
+	}
+
+	if err := s.db.AcceptTeamInvitation(invitation, developer.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvalidInvitation)
+			return
+		}
+		writeError(w, r, internalError("Failed to accept invitation"))
+		return
+	}
+
+	member, err := s.db.GetTeamMember(invitation.TeamID, developer.ID)
+	if err != nil || member == nil {
+		writeError(w, r, internalError("Failed to fetch team membership"))
+		return
+	}
+	auditAfter(r, member)
+
+	writeData(w, http.StatusOK, member)
+}
+
+// handleSetApplicationTeam moves an application into a team, or into the
+// developer's personal applications. It takes admin rights over the
+// application and, when moving into a team, over that team. Taking an
+// application out of a team makes the caller its sole owner, so it takes
+// ownership of the team it leaves.
+func (s *Server) handleSetApplicationTeam(w http.ResponseWriter, r *http.Request) {
+	var req applicationTeamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+
+	developerID := r.Context().Value("developerID").(string)
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	if !teamRoleAtLeast(app.Role, database.TeamRoleAdmin) {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+
+	ownerID := developerID
+	if req.TeamID == "" && app.TeamID != "" && app.Role != database.TeamRoleOwner {
+		writeError(w, r, errTeamRoleRequired)
+		return
+	}
+	if req.TeamID != "" {
+		member, err := s.db.GetTeamMember(req.TeamID, developerID)
+		if err != nil {
+			writeError(w, r, internalError("Failed to check team membership"))
+			return
+		}
+		if member == nil {
+			writeError(w, r, errTeamNotFound)
+			return
+		}
+		if !teamRoleAtLeast(member.Role, database.TeamRoleAdmin) {
+			writeError(w, r, errTeamRoleRequired)
+			return
+		}
+		ownerID = app.DeveloperID
+	}
+	auditBefore(r, map[string]string{"developerId": app.DeveloperID, "teamId": app.TeamID})
+
+	if err := s.db.SetApplicationOwner(app.ID, ownerID, req.TeamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errAppNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to move application"))
+		return
+	}
+	auditAfter(r, map[string]string{"developerId": ownerID, "teamId": req.TeamID})
+
+	moved, err := s.db.GetApplicationByID(app.ID, developerID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch application"))
+		return
+	}
+	writeData(w, http.StatusOK, moved)
+}
@@ -0,0 +1,310 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTeamRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role, min string
+		want      bool
+	}{
+		{database.TeamRoleOwner, database.TeamRoleAdmin, true},
+		{database.TeamRoleAdmin, database.TeamRoleAdmin, true},
+		{database.TeamRoleMember, database.TeamRoleAdmin, false},
+		{database.TeamRoleReadOnly, database.TeamRoleReadOnly, true},
+		{database.TeamRoleReadOnly, database.TeamRoleMember, false},
+		{"", database.TeamRoleReadOnly, false},
+	}
+	for _, tt := range tests {
+		if got := teamRoleAtLeast(tt.role, tt.min); got != tt.want {
+			t.Errorf("teamRoleAtLeast(%q, %q) = %v; want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+}
+
+// teamDevelopers are the members of team-1 seeded by newTeamServer, each
+// named after their role. "stranger" is not a member.
+var teamDevelopers = map[string]string{
+	"owner":  database.TeamRoleOwner,
+	"admin":  database.TeamRoleAdmin,
+	"member": database.TeamRoleMember,
+	"reader": database.TeamRoleReadOnly,
+}
+
+// newTeamServer seeds team-1 with teamDevelopers and app-1, an application
+// of the team created by its owner
+func newTeamServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	for _, id := range []string{"owner", "admin", "member", "reader", "stranger"} {
+		seedDeveloper(t, s, id, id+"@example.com")
+	}
+	err := s.db.CreateTeam(&database.Team{ID: "team-1", Name: "Team"},
+		&database.TeamMember{TeamID: "team-1", DeveloperID: "owner", Role: database.TeamRoleOwner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, role := range teamDevelopers {
+		if err := s.db.SetTeamMember(&database.TeamMember{TeamID: "team-1", DeveloperID: id, Role: role}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seedApplication(t, s, "app-1", "owner")
+	if err := s.db.SetApplicationOwner("app-1", "owner", "team-1"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// teamMembers maps the developers of team-1 to their roles
+func teamMembers(t *testing.T, s *Server) map[string]string {
+	t.Helper()
+	members, err := s.db.GetTeamMembers("team-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := map[string]string{}
+	for _, m := range members {
+		roles[m.DeveloperID] = m.Role
+	}
+	return roles
+}
+
+func TestOwnedApplicationTeamRoles(t *testing.T) {
+	tests := []struct {
+		developer string
+		method    string
+		want      int
+	}{
+		{"reader", http.MethodGet, http.StatusOK},
+		{"reader", http.MethodPut, http.StatusForbidden},
+		{"member", http.MethodPut, http.StatusOK},
+		{"owner", http.MethodDelete, http.StatusOK},
+		{"stranger", http.MethodGet, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.developer+" "+tt.method, func(t *testing.T) {
+			s := newTeamServer(t)
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := s.ownedApplication(w, r); ok {
+					w.WriteHeader(http.StatusOK)
+				}
+			}
+
+			w := serveAs(handler, "/api/applications/{id}", tt.method, "/api/applications/app-1", "", tt.developer)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetApplicationRedactsSecretForReadOnly(t *testing.T) {
+	s := newTeamServer(t)
+	for _, developer := range []string{"reader", "member"} {
+		w := serveAs(s.handleGetApplication, "/api/applications/{id}", http.MethodGet, "/api/applications/app-1", "", developer)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200; got %d", developer, w.Code)
+		}
+		if leaked := strings.Contains(w.Body.String(), "sk_app-1"); leaked != (developer != "reader") {
+			t.Errorf("%s: secret key in response = %v", developer, leaked)
+		}
+	}
+}
+
+func TestSetApplicationTeamLeavingTeamNeedsOwner(t *testing.T) {
+	tests := []struct {
+		developer string
+		want      int
+	}{
+		{"admin", http.StatusForbidden},
+		{"owner", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.developer, func(t *testing.T) {
+			s := newTeamServer(t)
+			// app-1 was created by another member of the team
+			if err := s.db.SetApplicationOwner("app-1", "member", "team-1"); err != nil {
+				t.Fatal(err)
+			}
+
+			w := serveAs(s.handleSetApplicationTeam, "/api/applications/{id}/team", http.MethodPut,
+				"/api/applications/app-1/team", `{"teamId":""}`, tt.developer)
+			if w.Code != tt.want {
+				t.Fatalf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			app, err := s.db.GetApplicationByID("app-1", tt.developer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != http.StatusOK && (app.TeamID != "team-1" || app.DeveloperID != "member") {
+				t.Errorf("expected the application to stay in the team; got %+v", app)
+			}
+			if tt.want == http.StatusOK && (app.TeamID != "" || app.DeveloperID != tt.developer) {
+				t.Errorf("expected the owner to take the application; got %+v", app)
+			}
+		})
+	}
+}
+
+func TestSetTeamMember(t *testing.T) {
+	tests := []struct {
+		name   string
+		actor  string
+		target string
+		role   string
+		want   int
+	}{
+		{"admin promotes member", "admin", "member", database.TeamRoleAdmin, http.StatusOK},
+		{"admin cannot make owners", "admin", "member", database.TeamRoleOwner, http.StatusForbidden},
+		{"admin cannot demote owners", "admin", "owner", database.TeamRoleMember, http.StatusForbidden},
+		{"member cannot change roles", "member", "reader", database.TeamRoleMember, http.StatusForbidden},
+		{"owner cannot demote the last owner", "owner", "owner", database.TeamRoleAdmin, http.StatusConflict},
+		{"unknown member", "owner", "stranger", database.TeamRoleMember, http.StatusNotFound},
+		{"invalid role", "owner", "member", "superuser", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTeamServer(t)
+
+			w := serveAs(s.handleSetTeamMember, "/api/teams/{teamId}/members/{developerId}", http.MethodPut,
+				"/api/teams/team-1/members/"+tt.target, `{"role":"`+tt.role+`"}`, tt.actor)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if changed := teamMembers(t, s)[tt.target] == tt.role; changed != (tt.want == http.StatusOK) {
+				t.Errorf("expected %s's role changed = %v; got %s", tt.target, tt.want == http.StatusOK, teamMembers(t, s)[tt.target])
+			}
+		})
+	}
+}
+
+func TestRemoveTeamMember(t *testing.T) {
+	tests := []struct {
+		name   string
+		actor  string
+		target string
+		want   int
+	}{
+		{"member leaves", "member", "member", http.StatusOK},
+		{"member cannot remove others", "member", "reader", http.StatusForbidden},
+		{"admin removes member", "admin", "member", http.StatusOK},
+		{"admin cannot remove owners", "admin", "owner", http.StatusForbidden},
+		{"last owner cannot leave", "owner", "owner", http.StatusConflict},
+		{"non-member", "stranger", "member", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTeamServer(t)
+
+			w := serveAs(s.handleRemoveTeamMember, "/api/teams/{teamId}/members/{developerId}", http.MethodDelete,
+				"/api/teams/team-1/members/"+tt.target, "", tt.actor)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if _, kept := teamMembers(t, s)[tt.target]; kept == (tt.want == http.StatusOK) {
+				t.Errorf("expected %s removed = %v", tt.target, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+// serveAudited serves a request like serveAs, through the audit middleware
+func serveAudited(s *Server, handler http.HandlerFunc, pattern, method, path, body, developerID string) *httptest.ResponseRecorder {
+	return serveAs(func(w http.ResponseWriter, r *http.Request) {
+		s.auditMiddleware(handler).ServeHTTP(w, r)
+	}, pattern, method, path, body, developerID)
+}
+
+func TestTeamAuditLog(t *testing.T) {
+	s := newTeamServer(t)
+	seedApplication(t, s, "app-2", "member")
+
+	// Members of the team act on it, its application and a personal one
+	for _, req := range []struct {
+		handler                           http.HandlerFunc
+		pattern, method, path, body, from string
+	}{
+		{s.handleUpdateTeam, "/api/teams/{teamId}", http.MethodPatch, "/api/teams/team-1", `{"name":"Renamed"}`, "admin"},
+		{s.handleUpdateApplication, "/api/applications/{id}", http.MethodPut, "/api/applications/app-1",
+			`{"name":"Team App","domain":"team.example.com"}`, "member"},
+		{s.handleUpdateApplication, "/api/applications/{id}", http.MethodPut, "/api/applications/app-2",
+			`{"name":"Own App","domain":"own.example.com"}`, "member"},
+	} {
+		if w := serveAudited(s, req.handler, req.pattern, req.method, req.path, req.body, req.from); w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected status 200; got %d: %s", req.method, req.path, w.Code, w.Body.String())
+		}
+	}
+
+	actions := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		var page struct {
+			Data struct {
+				Entries []database.AuditEntry `json:"entries"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range page.Data.Entries {
+			got = append(got, e.ActorID+" "+e.Action)
+		}
+		return strings.Join(got, ",")
+	}
+
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		pattern   string
+		path      string
+		developer string
+		want      int
+		actions   string
+	}{
+		{"team admin", s.handleGetTeamAuditLog, "/api/teams/{teamId}/audit-log", "/api/teams/team-1/audit-log", "admin",
+			http.StatusOK, "member application.update,admin team.update"},
+		{"team admin filtering by application", s.handleGetTeamAuditLog, "/api/teams/{teamId}/audit-log",
+			"/api/teams/team-1/audit-log?applicationId=app-1", "owner", http.StatusOK, "member application.update"},
+		{"team member", s.handleGetTeamAuditLog, "/api/teams/{teamId}/audit-log", "/api/teams/team-1/audit-log", "member",
+			http.StatusForbidden, ""},
+		{"not a member", s.handleGetTeamAuditLog, "/api/teams/{teamId}/audit-log", "/api/teams/team-1/audit-log", "stranger",
+			http.StatusNotFound, ""},
+		{"application admin", s.handleGetApplicationAuditLog, "/api/applications/{id}/audit-log",
+			"/api/applications/app-1/audit-log", "admin", http.StatusOK, "member application.update"},
+		{"application member", s.handleGetApplicationAuditLog, "/api/applications/{id}/audit-log",
+			"/api/applications/app-1/audit-log", "member", http.StatusForbidden, ""},
+		{"personal application", s.handleGetApplicationAuditLog, "/api/applications/{id}/audit-log",
+			"/api/applications/app-2/audit-log", "member", http.StatusOK, "member application.update"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(tt.handler, tt.pattern, http.MethodGet, tt.path, "", tt.developer)
+			if w.Code != tt.want {
+				t.Fatalf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.want == http.StatusOK {
+				if got := actions(w); got != tt.actions {
+					t.Errorf("expected entries %q; got %q", tt.actions, got)
+				}
+			}
+		})
+	}
+
+	// Each entry is still chained in the log of the developer who acted
+	var chain auditChain
+	err := s.db.StreamAuditEntries(database.AuditFilter{DeveloperID: "member"}, chain.check)
+	if err != nil || chain.count != 2 {
+		t.Errorf("expected member's chain of 2 entries to verify; got %d: %v", chain.count, err)
+	}
+}
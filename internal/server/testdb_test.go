@@ -0,0 +1,186 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"auth-server/internal/database/databasetest"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// testPassword is the password of every seeded developer and user
+const testPassword = "correct horse battery staple"
+
+// newTestServer returns a server backed by an empty in-memory database that
+// sends email to a recordingMailer, with a hasher cheap enough for tests
+func newTestServer(t *testing.T) *Server {
+	s := &Server{
+		db:            databasetest.New(t),
+		hasher:        &argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16},
+		mailer:        &recordingMailer{},
+		dashboardURL:  "https://dashboard.example.com",
+		lockout:       defaultLockoutPolicy,
+		loginThrottle: newIPThrottle(loginThrottleLimit, loginThrottleWindow),
+		rateLimits:    newMemoryRateLimitStore(),
+	}
+	s.jwtSecret = []byte("test-secret")
+	s.jwt.secret = s.jwtSecret
+	s.jwt.exp = developerAccessTokenDuration
+	return s
+}
+
+// sentMail returns the mailer of a server made by newTestServer
+func sentMail(s *Server) *recordingMailer {
+	return s.mailer.(*recordingMailer)
+}
+
+// recordingMailer keeps the messages it is asked to send
+type recordingMailer struct {
+	to   []string
+	body []string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.to = append(m.to, to)
+	m.body = append(m.body, body)
+	return nil
+}
+
+// token returns the token of the link in the last message sent
+func (m *recordingMailer) token(t *testing.T) string {
+	t.Helper()
+	if len(m.body) == 0 {
+		t.Fatal("expected an email to be sent")
+	}
+	body := m.body[len(m.body)-1]
+	start := strings.Index(body, "https://")
+	if start < 0 {
+		t.Fatalf("expected a link in %q", body)
+	}
+	link, err := url.Parse(strings.Fields(body[start:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func testPasswordHash(t *testing.T, s *Server) string {
+	t.Helper()
+	hash, err := s.hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// seedDeveloper creates a developer whose password is testPassword
+func seedDeveloper(t *testing.T, s *Server, id, email string) *database.Developer {
+	t.Helper()
+	dev := &database.Developer{ID: id, FirstName: "Ada", LastName: "Lovelace", Email: email, PasswordHash: testPasswordHash(t, s)}
+	if err := s.db.CreateDeveloper(dev); err != nil {
+		t.Fatal(err)
+	}
+	return dev
+}
+
+// seedApplication creates a personal application of developerID, whose
+// public key is "pk_" followed by its ID
+func seedApplication(t *testing.T, s *Server, id, developerID string) *database.Application {
+	t.Helper()
+	app := &database.Application{ID: id, DeveloperID: developerID, Name: "App", Domain: "app.example.com",
+		PublicKey: "pk_" + id, SecretKey: "sk_" + id}
+	if err := s.db.CreateApplication(app); err != nil {
+		t.Fatal(err)
+	}
+	app, err := s.db.GetApplicationByID(id, developerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// seedUser creates an active user of the application whose password is
+// testPassword
+func seedUser(t *testing.T, s *Server, applicationID, id, email string) *database.User {
+	t.Helper()
+	user := &database.User{ID: id, ApplicationID: applicationID, Email: email, FirstName: "Ada", LastName: "Lovelace",
+		PasswordHash: testPasswordHash(t, s), Status: database.UserStatusActive,
+		PublicMetadata: json.RawMessage("{}"), PrivateMetadata: json.RawMessage("{}")}
+	if err := s.db.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return loadUser(t, s, id)
+}
+
+// seedSession starts a session of user, authenticated now by password
+func seedSession(t *testing.T, s *Server, user *database.User, id string) *database.Session {
+	t.Helper()
+	session := &database.Session{ID: id, UserID: user.ID, ApplicationID: user.ApplicationID, Token: id + "-token",
+		ExpiresAt: time.Now().Add(time.Hour), AuthTime: time.Now(), AuthMethods: []string{database.AuthMethodPassword}}
+	if err := s.db.CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func loadUser(t *testing.T, s *Server, id string) *database.User {
+	t.Helper()
+	user, err := s.db.GetUserByID(id)
+	if err != nil || user == nil {
+		t.Fatalf("loading user %s: %v", id, err)
+	}
+	return user
+}
+
+// sessionIDs lists the IDs of the user's sessions
+func sessionIDs(t *testing.T, s *Server, userID string) []string {
+	t.Helper()
+	sessions, err := s.db.GetSessionsByUserID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	return ids
+}
+
+// pendingEvents returns the events waiting in the outbox, oldest first
+func pendingEvents(t *testing.T, s *Server) []database.OutboxEvent {
+	t.Helper()
+	events, err := s.db.GetPendingOutboxEvents(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func eventTypes(events []database.OutboxEvent) string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return strings.Join(types, ",")
+}
+
+// serveAs serves a request to handler, routed by pattern, as developerID
+func serveAs(handler http.HandlerFunc, pattern, method, path, body, developerID string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.MethodFunc(method, pattern, handler)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), "developerID", developerID))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
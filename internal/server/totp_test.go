@@ -0,0 +1,87 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors in base32
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// The last six digits of the RFC 6238 SHA-1 test vectors
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode([]byte("12345678901234567890"), tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s; want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+
+	tests := []struct {
+		name string
+		code string
+		at   time.Time
+		ok   bool
+	}{
+		{"current", "081804", now, true},
+		{"previous step", "081804", now.Add(totpPeriod * time.Second), true},
+		{"too old", "081804", now.Add(2 * totpPeriod * time.Second), false},
+		{"wrong", "123456", now, false},
+		{"wrong length", "81804", now, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(rfc6238Secret, tt.code, tt.at)
+		if ok != tt.ok {
+			t.Errorf("%s: verifyTOTP() = %v; want %v", tt.name, ok, tt.ok)
+		}
+		if ok && step != now.Unix()/totpPeriod {
+			t.Errorf("%s: step = %d; want %d", tt.name, step, now.Unix()/totpPeriod)
+		}
+	}
+
+	if _, ok := verifyTOTP(strings.ToLower(rfc6238Secret), "081804", now); !ok {
+		t.Error("expected a lowercase secret to work")
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("expected %d codes; got %d and %d hashes", recoveryCodeCount, len(codes), len(hashes))
+	}
+
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q is not in xxxxx-xxxxx form", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q is repeated", code)
+		}
+		seen[code] = true
+		if hashRecoveryCode(code) != hashes[i] {
+			t.Errorf("hash of %q does not match", code)
+		}
+		typed := strings.ToUpper(strings.ReplaceAll(code, "-", " "))
+		if hashRecoveryCode(typed) != hashes[i] {
+			t.Errorf("hash of %q as typed %q does not match", code, typed)
+		}
+	}
+}
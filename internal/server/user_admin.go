@@ -0,0 +1,314 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const maxStatusReasonLength = 500
+
+type adminCreateUserRequest struct {
+	Email                string `json:"email"`
+	Password             string `json:"password"`
+	FirstName            string `json:"firstName"`
+	LastName             string `json:"lastName"`
+	EmailVerified        bool   `json:"emailVerified"`
+	RequirePasswordReset bool   `json:"requirePasswordReset"`
+
+	PublicMetadata  json.RawMessage `json:"publicMetadata"`
+	PrivateMetadata json.RawMessage `json:"privateMetadata"`
+}
+
+// adminUpdateUserRequest only changes the fields that are present
+type adminUpdateUserRequest struct {
+	Email         *string `json:"email"`
+	FirstName     *string `json:"firstName"`
+	LastName      *string `json:"lastName"`
+	EmailVerified *bool   `json:"emailVerified"`
+
+	// Metadata objects are replaced as a whole; null resets them to {}
+	PublicMetadata  json.RawMessage `json:"publicMetadata"`
+	PrivateMetadata json.RawMessage `json:"privateMetadata"`
+}
+
+type disableUserRequest struct {
+	Reason string `json:"reason"`
+	// Ban marks the account as banned rather than merely disabled
+	Ban bool `json:"ban"`
+}
+
+func (r adminCreateUserRequest) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	v.password("password", r.Password)
+	v.name("firstName", r.FirstName)
+	v.name("lastName", r.LastName)
+	return v.errors
+}
+
+func (r adminUpdateUserRequest) validate() []FieldError {
+	var v validator
+	if r.Email != nil {
+		v.email("email", *r.Email)
+	}
+	if r.FirstName != nil {
+		v.name("firstName", *r.FirstName)
+	}
+	if r.LastName != nil {
+		v.name("lastName", *r.LastName)
+	}
+	return v.errors
+}
+
+func (r disableUserRequest) validate() []FieldError {
+	var v validator
+	v.maxLength("reason", r.Reason, maxStatusReasonLength)
+	return v.errors
+}
+
+func (s *Server) handleGetApplicationUser(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+
+	writeData(w, http.StatusOK, user)
+}
+
+// handleAdminCreateUser creates a user on behalf of the application, without
+// starting a session for it
+func (s *Server) handleAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req adminCreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	if errs := s.checkPassword(app.PasswordPolicy, req.Email, req.Password); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	existingUser, err := s.db.GetUserByEmail(app.ID, req.Email)
+	if err != nil {
+		writeError(w, r, internalError("Error checking for existing user"))
+		return
+	}
+	if existingUser != nil {
+		writeError(w, r, errEmailTaken)
+		return
+	}
+
+	hash, err := s.hashPassword(req.Password)
+	if err != nil {
+		writeError(w, r, internalError("Failed to hash password"))
+		return
+	}
+
+	user := &database.User{
+		ID:                    uuid.New().String(),
+		ApplicationID:         app.ID,
+		Email:                 req.Email,
+		FirstName:             req.FirstName,
+		LastName:              req.LastName,
+		PasswordHash:          hash,
+		EmailVerified:         req.EmailVerified,
+		Status:                database.UserStatusActive,
+		PasswordResetRequired: req.RequirePasswordReset,
+	}
+	if errs := applyMetadata(app, user, req.PublicMetadata, req.PrivateMetadata); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	user.ApplyDefaults()
+
+	if err := s.db.CreateUser(user, newEvent(app.ID, eventUserCreated, user)); err != nil {
+		writeError(w, r, internalError("Failed to create user"))
+		return
+	}
+	auditAfter(r, user)
+
+	writeData(w, http.StatusCreated, user)
+}
+
+func (s *Server) handleUpdateApplicationUser(w http.ResponseWriter, r *http.Request) {
+	var req adminUpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, user)
+	auditAfter(r, user)
+
+	if req.Email != nil && !strings.EqualFold(*req.Email, user.Email) {
+		existingUser, err := s.db.GetUserByEmail(app.ID, *req.Email)
+		if err != nil {
+			writeError(w, r, internalError("Error checking for existing user"))
+			return
+		}
+		if existingUser != nil && existingUser.ID != user.ID {
+			writeError(w, r, errEmailTaken)
+			return
+		}
+		user.Email = *req.Email
+		// A new address is unverified unless the developer says otherwise
+		user.EmailVerified = false
+	}
+	if req.FirstName != nil {
+		user.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		user.LastName = *req.LastName
+	}
+	if req.EmailVerified != nil {
+		user.EmailVerified = *req.EmailVerified
+	}
+	if errs := applyMetadata(app, user, req.PublicMetadata, req.PrivateMetadata); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	// Metadata is only written when the request changes it, so that a
+	// profile update does not overwrite a concurrent metadata update
+	update := s.db.UpdateUserProfile
+	if req.PublicMetadata != nil || req.PrivateMetadata != nil {
+		update = s.db.UpdateUserProfileAndMetadata
+	}
+	if err := update(user, newEvent(app.ID, eventUserUpdated, user)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update user"))
+		return
+	}
+
+	writeData(w, http.StatusOK, user)
+}
+
+// handleDisableUser disables or bans a user, which blocks login and ends
+// all of their sessions
+func (s *Server) handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	var req disableUserRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, errInvalidRequest)
+			return
+		}
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	status := database.UserStatusDisabled
+	if req.Ban {
+		status = database.UserStatusBanned
+	}
+	s.setUserStatus(w, r, status, req.Reason)
+}
+
+func (s *Server) handleEnableUser(w http.ResponseWriter, r *http.Request) {
+	s.setUserStatus(w, r, database.UserStatusActive, "")
+}
+
+func (s *Server) setUserStatus(w http.ResponseWriter, r *http.Request, status, reason string) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, user)
+	auditAfter(r, user)
+
+	user.Status = status
+	user.StatusReason = reason
+	var events []database.OutboxEvent
+	if status == database.UserStatusActive {
+		events = append(events, newEvent(app.ID, eventUserEnabled, user))
+	} else {
+		events = append(events,
+			newEvent(app.ID, eventUserDisabled, user),
+			newEvent(app.ID, eventSessionRevoked, sessionRevokedData{UserID: user.ID, Reason: revokedUserDisabled}))
+	}
+
+	if err := s.db.SetUserStatus(app.ID, user.ID, status, reason, events...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update user status"))
+		return
+	}
+
+	writeData(w, http.StatusOK, user)
+}
+
+// handleRequirePasswordReset forces the user to choose a new password on
+// their next login and ends all of their sessions
+func (s *Server) handleRequirePasswordReset(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	user, ok := s.applicationUser(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, user)
+	auditAfter(r, user)
+
+	event := newEvent(app.ID, eventSessionRevoked, sessionRevokedData{UserID: user.ID, Reason: revokedPasswordResetRequired})
+	if err := s.db.SetPasswordResetRequired(app.ID, user.ID, event); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errUserNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to require password reset"))
+		return
+	}
+
+	user.PasswordResetRequired = true
+	if err := s.sendPasswordResetLink(app, user); err != nil {
+		// Signing in with the current password sends another link
+		log.Printf("failed to send password reset link to user %s: %v", user.ID, err)
+	}
+	writeData(w, http.StatusOK, user)
+}
@@ -0,0 +1,242 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newUserAdminServer seeds app-1 of dev-1 with Ada, user-1, who is signed
+// in on session-1 and session-2, and Grace, user-2
+func newUserAdminServer(t *testing.T) *Server {
+	s := newTestServer(t)
+	seedDeveloper(t, s, "dev-1", "dev@example.com")
+	seedApplication(t, s, "app-1", "dev-1")
+	ada := seedUser(t, s, "app-1", "user-1", "ada@example.com")
+	ada.EmailVerified = true
+	if err := s.db.UpdateUserProfile(ada); err != nil {
+		t.Fatal(err)
+	}
+	seedSession(t, s, ada, "session-1")
+	seedSession(t, s, ada, "session-2")
+	grace := seedUser(t, s, "app-1", "user-2", "grace@example.com")
+	grace.FirstName, grace.LastName = "Grace", "Hopper"
+	if err := s.db.UpdateUserProfile(grace); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// userRequest serves handler as an API key request of app-1
+func userRequest(s *Server, handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	app, _ := s.db.GetApplicationByPublicKey("pk_app-1")
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), "application", app))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestDisableUserRevokesSessionsAndBlocksLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status string
+	}{
+		{"disable", `{"reason":"chargeback"}`, database.UserStatusDisabled},
+		{"ban", `{"reason":"abuse","ban":true}`, database.UserStatusBanned},
+		{"no body", "", database.UserStatusDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUserAdminServer(t)
+			w := serveAs(s.handleDisableUser, "/api/applications/{id}/users/{userId}/disable", http.MethodPost,
+				"/api/applications/app-1/users/user-1/disable", tt.body, "dev-1")
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+			}
+			if loadUser(t, s, "user-1").Status != tt.status {
+				t.Errorf("expected status %s; got %s", tt.status, loadUser(t, s, "user-1").Status)
+			}
+			if len(sessionIDs(t, s, "user-1")) != 0 {
+				t.Errorf("expected the user's sessions to end; got %v", sessionIDs(t, s, "user-1"))
+			}
+			if got := eventTypes(pendingEvents(t, s)); got != eventUserDisabled+","+eventSessionRevoked {
+				t.Errorf("unexpected events %s", got)
+			}
+
+			w = userRequest(s, s.handleUserLogin, `{"email":"ada@example.com","password":"`+testPassword+`"}`)
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "account_disabled") {
+				t.Errorf("expected login to be refused; got %d: %s", w.Code, w.Body.String())
+			}
+			if len(sessionIDs(t, s, "user-1")) != 0 {
+				t.Error("expected no session to be started")
+			}
+		})
+	}
+}
+
+func TestDisableUserReasonTooLong(t *testing.T) {
+	s := newUserAdminServer(t)
+	body := `{"reason":"` + strings.Repeat("x", maxStatusReasonLength+1) + `"}`
+	w := serveAs(s.handleDisableUser, "/api/applications/{id}/users/{userId}/disable", http.MethodPost,
+		"/api/applications/app-1/users/user-1/disable", body, "dev-1")
+	if w.Code != http.StatusUnprocessableEntity || loadUser(t, s, "user-1").Status != database.UserStatusActive {
+		t.Errorf("expected the request to be rejected; got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEnableUser(t *testing.T) {
+	s := newUserAdminServer(t)
+	if err := s.db.SetUserStatus("app-1", "user-1", database.UserStatusBanned, "abuse"); err != nil {
+		t.Fatal(err)
+	}
+	seedSession(t, s, loadUser(t, s, "user-1"), "session-3")
+
+	w := serveAs(s.handleEnableUser, "/api/applications/{id}/users/{userId}/enable", http.MethodPost,
+		"/api/applications/app-1/users/user-1/enable", "", "dev-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if u := loadUser(t, s, "user-1"); u.Status != database.UserStatusActive || u.StatusReason != "" {
+		t.Errorf("expected the user to be active without a reason; got %s %q", u.Status, u.StatusReason)
+	}
+	if got := eventTypes(pendingEvents(t, s)); got != eventUserEnabled {
+		t.Errorf("unexpected events %s", got)
+	}
+	if len(sessionIDs(t, s, "user-1")) != 1 {
+		t.Errorf("expected enabling to leave sessions alone; got %v", sessionIDs(t, s, "user-1"))
+	}
+}
+
+func TestRequirePasswordResetThenComplete(t *testing.T) {
+	s := newUserAdminServer(t)
+	mailer := sentMail(s)
+
+	w := serveAs(s.handleRequirePasswordReset, "/api/applications/{id}/users/{userId}/require-password-reset", http.MethodPost,
+		"/api/applications/app-1/users/user-1/require-password-reset", "", "dev-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if !loadUser(t, s, "user-1").PasswordResetRequired || len(sessionIDs(t, s, "user-1")) != 0 {
+		t.Fatalf("expected a reset to be required and sessions to end; got %+v %v", loadUser(t, s, "user-1"), sessionIDs(t, s, "user-1"))
+	}
+	if got := eventTypes(pendingEvents(t, s)); got != eventSessionRevoked {
+		t.Errorf("unexpected events %s", got)
+	}
+	if len(mailer.to) != 1 || mailer.to[0] != "ada@example.com" {
+		t.Fatalf("expected a reset link to be emailed to the user; got %v", mailer.to)
+	}
+	firstToken := mailer.token(t)
+
+	// Signing in sends a new link in place of the first
+	w = userRequest(s, s.handleUserLogin, `{"email":"ada@example.com","password":"`+testPassword+`"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "password_reset_required") {
+		t.Fatalf("expected login to require a reset; got %d: %s", w.Code, w.Body.String())
+	}
+	if len(mailer.to) != 2 {
+		t.Fatalf("expected a second reset link; got %v", mailer.to)
+	}
+	token := mailer.token(t)
+
+	w = userRequest(s, s.handleCompletePasswordReset, `{"token":"`+firstToken+`","newPassword":"Another-Long-Passphrase-42"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_verification_token") {
+		t.Errorf("expected the replaced link to be refused; got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = userRequest(s, s.handleCompletePasswordReset, `{"token":"`+token+`","newPassword":"`+testPassword+`"}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), codePasswordReused) {
+		t.Errorf("expected the same password to be refused; got %d: %s", w.Code, w.Body.String())
+	}
+
+	oldHash := loadUser(t, s, "user-1").PasswordHash
+	w = userRequest(s, s.handleCompletePasswordReset, `{"token":"`+token+`","newPassword":"Another-Long-Passphrase-42"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "sessionToken") {
+		t.Fatalf("expected the reset to log the user in; got %d: %s", w.Code, w.Body.String())
+	}
+	if u := loadUser(t, s, "user-1"); u.PasswordResetRequired || u.PasswordHash == oldHash {
+		t.Errorf("expected a new password and the flag cleared; got %+v", u)
+	}
+	if len(sessionIDs(t, s, "user-1")) != 1 {
+		t.Errorf("expected one new session; got %v", sessionIDs(t, s, "user-1"))
+	}
+	if got := eventTypes(pendingEvents(t, s)); got != eventSessionRevoked+","+eventUserLogin {
+		t.Errorf("expected a user.login event; got %s", got)
+	}
+
+	w = userRequest(s, s.handleCompletePasswordReset, `{"token":"`+token+`","newPassword":"Yet-Another-Passphrase-43"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_verification_token") {
+		t.Errorf("expected a used link to be refused; got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpdateApplicationUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		want     int
+		code     string
+		email    string
+		verified bool
+	}{
+		{"names", `{"firstName":"Augusta"}`, http.StatusOK, "", "ada@example.com", true},
+		{"new email is unverified", `{"email":"countess@example.com"}`, http.StatusOK, "", "countess@example.com", false},
+		{"new email verified by the developer", `{"email":"countess@example.com","emailVerified":true}`, http.StatusOK, "", "countess@example.com", true},
+		{"same email in other case", `{"email":"ADA@example.com"}`, http.StatusOK, "", "ada@example.com", true},
+		{"invalid email", `{"email":"not-an-email"}`, http.StatusUnprocessableEntity, "validation_failed", "ada@example.com", true},
+		{"empty first name", `{"firstName":""}`, http.StatusUnprocessableEntity, "validation_failed", "ada@example.com", true},
+		{"email taken", `{"email":"grace@example.com"}`, http.StatusConflict, "", "ada@example.com", true},
+		{"metadata not an object", `{"publicMetadata":[1,2]}`, http.StatusUnprocessableEntity, "validation_failed", "ada@example.com", true},
+		{"malformed body", `{"email":`, http.StatusBadRequest, "invalid_request", "ada@example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUserAdminServer(t)
+			w := serveAs(s.handleUpdateApplicationUser, "/api/applications/{id}/users/{userId}", http.MethodPatch,
+				"/api/applications/app-1/users/user-1", tt.body, "dev-1")
+			if w.Code != tt.want {
+				t.Fatalf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("expected error %s; got %s", tt.code, w.Body.String())
+			}
+			if u := loadUser(t, s, "user-1"); u.Email != tt.email || u.EmailVerified != tt.verified {
+				t.Errorf("expected %s verified=%v; got %s verified=%v", tt.email, tt.verified, u.Email, u.EmailVerified)
+			}
+			if tt.want == http.StatusOK && eventTypes(pendingEvents(t, s)) != eventUserUpdated {
+				t.Errorf("expected one user.updated event; got %s", eventTypes(pendingEvents(t, s)))
+			}
+		})
+	}
+}
+
+func TestUpdateApplicationUserProfileAndMetadata(t *testing.T) {
+	s := newUserAdminServer(t)
+	w := serveAs(s.handleUpdateApplicationUser, "/api/applications/{id}/users/{userId}", http.MethodPatch,
+		"/api/applications/app-1/users/user-1", `{"firstName":"Augusta","publicMetadata":{"plan":"pro"}}`, "dev-1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", w.Code, w.Body.String())
+	}
+	if u := loadUser(t, s, "user-1"); u.FirstName != "Augusta" || string(u.PublicMetadata) != `{"plan":"pro"}` {
+		t.Errorf("expected the name and metadata to be saved; got %s %s", u.FirstName, u.PublicMetadata)
+	}
+	if got := eventTypes(pendingEvents(t, s)); got != eventUserUpdated {
+		t.Errorf("expected one user.updated event; got %s", got)
+	}
+}
+
+func TestUserAdminUnknownUser(t *testing.T) {
+	s := newUserAdminServer(t)
+	for _, handler := range []http.HandlerFunc{s.handleDisableUser, s.handleEnableUser, s.handleRequirePasswordReset} {
+		w := serveAs(handler, "/api/applications/{id}/users/{userId}/action", http.MethodPost,
+			"/api/applications/app-1/users/user-9/action", "", "dev-1")
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "user_not_found") {
+			t.Errorf("expected 404 user_not_found; got %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
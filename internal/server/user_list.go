@@ -0,0 +1,133 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// userSortParams maps the ?sort= values to database sort columns
+var userSortParams = map[string]database.UserSort{
+	"createdAt": database.UserSortCreatedAt,
+	"email":     database.UserSortEmail,
+	"firstName": database.UserSortFirstName,
+	"lastName":  database.UserSortLastName,
+}
+
+// userPageCursor is the opaque ?cursor= value. It records the ordering it was
+// issued for so it cannot be replayed against a different one.
+type userPageCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	database.UserCursor
+}
+
+func encodeUserCursor(c userPageCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s string) (userPageCursor, bool) {
+	var c userPageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID == "" {
+		return c, false
+	}
+	return c, true
+}
+
+// parseTimeParam accepts RFC 3339 timestamps or plain YYYY-MM-DD dates
+func parseTimeParam(value string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// parseUserFilter reads the user listing query parameters:
+//
+//	limit, cursor, q (email/name prefix), createdAfter, createdBefore,
+//	verified (true|false), status, sort (createdAt|email|firstName|lastName),
+//	order (asc|desc)
+func parseUserFilter(appID string, q url.Values) (database.UserFilter, string, string, []FieldError) {
+	var v validator
+	filter := database.UserFilter{
+		ApplicationID: appID,
+		Search:        strings.TrimSpace(q.Get("q")),
+		Status:        q.Get("status"),
+		Limit:         defaultUserPageSize,
+	}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxUserPageSize {
+			v.add("limit", codeOutOfRange, "limit must be between 1 and "+strconv.Itoa(maxUserPageSize))
+		} else {
+			filter.Limit = n
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"createdAfter", &filter.CreatedAfter}, {"createdBefore", &filter.CreatedBefore}} {
+		if s := q.Get(p.name); s != "" {
+			t, ok := parseTimeParam(s)
+			if !ok {
+				v.add(p.name, "invalid_time", p.name+" must be an RFC 3339 timestamp or YYYY-MM-DD date")
+			}
+			*p.dst = t
+		}
+	}
+
+	if s := q.Get("verified"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			v.add("verified", "invalid_boolean", "verified must be true or false")
+		} else {
+			filter.EmailVerified = &b
+		}
+	}
+
+	sort := q.Get("sort")
+	if sort == "" {
+		sort = "createdAt"
+	}
+	if col, ok := userSortParams[sort]; ok {
+		filter.SortBy = col
+	} else {
+		v.add("sort", "invalid_sort", "sort must be one of createdAt, email, firstName, lastName")
+	}
+
+	order := strings.ToLower(q.Get("order"))
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		v.add("order", "invalid_order", "order must be asc or desc")
+	}
+	filter.Descending = order == "desc"
+
+	if s := q.Get("cursor"); s != "" {
+		c, ok := decodeUserCursor(s)
+		if !ok || c.Sort != sort || c.Order != order {
+			v.add("cursor", "invalid_cursor", "cursor is malformed or was issued for a different sort order")
+		} else {
+			filter.After = &c.UserCursor
+		}
+	}
+
+	return filter, sort, order, v.errors
+}
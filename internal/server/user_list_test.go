@@ -0,0 +1,66 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"net/url"
+	"testing"
+)
+
+func TestParseUserFilter(t *testing.T) {
+	cursor := encodeUserCursor(userPageCursor{
+		Sort:       "email",
+		Order:      "desc",
+		UserCursor: database.UserCursor{SortValue: "m@example.com", ID: "u1"},
+	})
+	q := url.Values{
+		"limit":        {"25"},
+		"q":            {" jan "},
+		"verified":     {"true"},
+		"createdAfter": {"2024-01-01"},
+		"sort":         {"email"},
+		"order":        {"desc"},
+		"cursor":       {cursor},
+	}
+
+	filter, sort, order, errs := parseUserFilter("app1", q)
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors; got %v", errs)
+	}
+	if filter.ApplicationID != "app1" || filter.Limit != 25 || filter.Search != "jan" {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+	if filter.EmailVerified == nil || !*filter.EmailVerified {
+		t.Error("expected verified filter to be true")
+	}
+	if filter.CreatedAfter.IsZero() {
+		t.Error("expected createdAfter to be parsed")
+	}
+	if sort != "email" || order != "desc" || filter.SortBy != database.UserSortEmail || !filter.Descending {
+		t.Errorf("unexpected ordering %s %s %+v", sort, order, filter)
+	}
+	if filter.After == nil || filter.After.ID != "u1" || filter.After.SortValue != "m@example.com" {
+		t.Errorf("unexpected cursor %+v", filter.After)
+	}
+}
+
+func TestParseUserFilterErrors(t *testing.T) {
+	cursor := encodeUserCursor(userPageCursor{Sort: "createdAt", Order: "asc", UserCursor: database.UserCursor{ID: "u1"}})
+	q := url.Values{
+		"limit":    {"1000"},
+		"verified": {"maybe"},
+		"sort":     {"password"},
+		"order":    {"up"},
+		"cursor":   {cursor},
+	}
+
+	_, _, _, errs := parseUserFilter("app1", q)
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	for _, f := range []string{"limit", "verified", "sort", "order", "cursor"} {
+		if !fields[f] {
+			t.Errorf("expected an error for %s; got %v", f, errs)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package server
 
 import (
 	"auth-server/internal/database"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type userRegisterRequest struct {
@@ -15,6 +18,8 @@ type userRegisterRequest struct {
 	Password  string `json:"password"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
+	// InviteCode is required when the application's signup is invite-only
+	InviteCode string `json:"inviteCode"`
 }
 
 type userLoginRequest struct {
@@ -25,45 +30,96 @@ type userLoginRequest struct {
 type userResponse struct {
 	SessionToken string `json:"sessionToken"`
 	ExpiresAt    string `json:"expiresAt"`
+	// AccessToken is a short-lived JWT signed with the application's secret
+	// key that carries the user's roles and permissions
+	AccessToken          string `json:"accessToken"`
+	AccessTokenExpiresAt string `json:"accessTokenExpiresAt"`
+}
+
+// completePasswordResetRequest carries the token of the link emailed by
+// sendPasswordResetLink
+type completePasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// passwordResetTTL is how long a password reset link can be used
+const passwordResetTTL = 24 * time.Hour
+
+// userSessionDuration is how long an application user session lasts
+const userSessionDuration = 24 * time.Hour
+
+// loginEventData is the data of a user.login event
+type loginEventData struct {
+	User      *database.User `json:"user"`
+	SessionID string         `json:"sessionId"`
+	IP        string         `json:"ip"`
+}
+
+// newUserSession returns a new, unsaved session for user, who just
+// authenticated with methods
+func newUserSession(user *database.User, methods ...string) *database.Session {
+	now := time.Now()
+	return &database.Session{
+		ID:            uuid.New().String(),
+		UserID:        user.ID,
+		ApplicationID: user.ApplicationID,
+		Token:         uuid.New().String(),
+		ExpiresAt:     now.Add(userSessionDuration),
+		AuthTime:      now,
+		AuthMethods:   methods,
+	}
+}
+
+// startUserSession creates and stores a new session for user, who just
+// authenticated with methods
+func (s *Server) startUserSession(user *database.User, methods ...string) (*database.Session, error) {
+	session := newUserSession(user, methods...)
+	if err := s.db.CreateSession(session); err != nil {
+		return nil, err
+	}
+	return session, nil
 }
 
 func (s *Server) handleUserRegister(w http.ResponseWriter, r *http.Request) {
 	var req userRegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid request format",
-		})
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
 		return
 	}
 
 	app := r.Context().Value("application").(*database.Application)
 
+	if errs := s.checkPassword(app.PasswordPolicy, req.Email, req.Password); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
 	// Check if user already exists
 	existingUser, err := s.db.GetUserByEmail(app.ID, req.Email)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Error checking for existing user",
-		})
+		writeError(w, r, internalError("Error checking for existing user"))
 		return
 	}
 
 	if existingUser != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "User with this email already exists",
-		})
+		writeError(w, r, errEmailTaken)
+		return
+	}
+
+	status, inviteCodeID, ok := s.checkSignup(w, r, app, req.Email, req.InviteCode)
+	if !ok {
 		return
 	}
 
 	// Hash password
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := s.hashPassword(req.Password)
 	if err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to hash password",
-		})
+		writeError(w, r, internalError("Failed to hash password"))
 		return
 	}
 
@@ -74,143 +130,301 @@ func (s *Server) handleUserRegister(w http.ResponseWriter, r *http.Request) {
 		Email:         req.Email,
 		FirstName:     req.FirstName,
 		LastName:      req.LastName,
-		PasswordHash:  string(hash),
+		PasswordHash:  hash,
+		Status:        status,
 	}
 
-	if err := s.db.CreateUser(user); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to create user",
-		})
+	user.ApplyDefaults()
+
+	event := newEvent(app.ID, eventUserCreated, user)
+	if inviteCodeID != "" {
+		err = s.db.CreateInvitedUser(user, inviteCodeID, event)
+	} else {
+		err = s.db.CreateUser(user, event)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvalidInviteCode)
+			return
+		}
+		writeError(w, r, internalError("Failed to create user"))
 		return
 	}
 
-	// Create session
-	expiresAt := time.Now().Add(24 * time.Hour)
-	session := &database.Session{
-		ID:            uuid.New().String(),
-		UserID:        user.ID,
-		ApplicationID: app.ID,
-		Token:         uuid.New().String(),
-		ExpiresAt:     expiresAt,
+	// Waitlisted users get no session until the developer approves them
+	if user.Status == database.UserStatusPending {
+		writeData(w, http.StatusAccepted, map[string]string{"status": user.Status})
+		return
 	}
 
-	if err := s.db.CreateSession(session); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to create session",
-		})
+	// Create session
+	session, err := s.startUserSession(user, database.AuthMethodPassword)
+	if err != nil {
+		writeError(w, r, internalError("Failed to create session"))
 		return
 	}
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data: userResponse{
-			SessionToken: session.Token,
-			ExpiresAt:    expiresAt.Format(time.RFC3339),
-		},
-	})
+	s.writeNewSession(w, r, http.StatusCreated, app, user, session)
 }
 
 func (s *Server) handleUserLogin(w http.ResponseWriter, r *http.Request) {
 	var req userLoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid request format",
-		})
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
 		return
 	}
 
 	app := r.Context().Value("application").(*database.Application)
 
+	if !s.checkLoginThrottle(w, r) {
+		return
+	}
+
 	// Find user
 	user, err := s.db.GetUserByEmail(app.ID, req.Email)
-	if err != nil || user == nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid credentials",
-		})
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up user"))
+		return
+	}
+	if user == nil {
+		s.loginFailed(r, nil)
+		writeError(w, r, errInvalidCredentials)
+		return
+	}
+
+	attempt := s.newLoginAttempt(r, user, database.LoginMethodPassword)
+	lockout, rejected := s.accountLockout(w, userLockoutSubject(user))
+	if rejected != nil {
+		s.rejectLogin(w, r, app, attempt, rejected)
 		return
 	}
 
 	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid credentials",
-		})
+	ok, rehash, err := s.verifyPassword(req.Password, user.PasswordHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify password"))
+		return
+	}
+	if !ok {
+		s.loginFailed(r, userLockoutSubject(user))
+		s.rejectLogin(w, r, app, attempt, errInvalidCredentials)
+		return
+	}
+	s.loginSucceeded(lockout)
+
+	// Waitlisted, disabled and banned users cannot log in
+	if user.Status == database.UserStatusPending {
+		s.rejectLogin(w, r, app, attempt, errAccountPending)
+		return
+	}
+	if user.Status != database.UserStatusActive {
+		s.rejectLogin(w, r, app, attempt, errAccountDisabled)
 		return
 	}
 
+	// The user must choose a new password via handleCompletePasswordReset,
+	// with a new link in case the one sent before has expired
+	if user.PasswordResetRequired {
+		if err := s.sendPasswordResetLink(app, user); err != nil {
+			log.Printf("failed to send password reset link to user %s: %v", user.ID, err)
+		}
+		s.rejectLogin(w, r, app, attempt, errPasswordResetRequired)
+		return
+	}
+
+	// Act on signs that someone other than the user is logging in
+	deviceHash := hashToken(deviceID(w, r))
+	signals, err := s.assessLogin(r, user, deviceHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to assess login"))
+		return
+	}
+	attempt.RiskSignals = signals
+	attempt.RiskAction = riskAction(effectiveRiskPolicy(app.RiskPolicy), signals)
+	switch attempt.RiskAction {
+	case riskActionBlock:
+		s.rejectLogin(w, r, app, attempt, errLoginBlocked)
+		return
+	case riskActionChallenge:
+		s.challengeLogin(w, r, app, user, attempt, deviceHash)
+		return
+	}
+
+	// Upgrade the stored hash if it uses an outdated algorithm or parameters
+	if rehash {
+		if hash, err := s.hashPassword(req.Password); err == nil {
+			if err := s.db.UpdateUserPasswordHash(user.ID, hash); err != nil {
+				log.Printf("failed to rehash password for user %s: %v", user.ID, err)
+			}
+		}
+	}
+
 	// Create session
-	expiresAt := time.Now().Add(24 * time.Hour)
-	session := &database.Session{
+	session := newUserSession(user, database.AuthMethodPassword)
+	event := newEvent(app.ID, eventUserLogin, loginEventData{User: user, SessionID: session.ID, IP: s.clientIP(r)})
+	if err := s.db.CreateSession(session, event); err != nil {
+		writeError(w, r, internalError("Failed to create session"))
+		return
+	}
+	attempt.Success = true
+	attempt.SessionID = session.ID
+	s.recordLoginAttempt(app, attempt)
+	s.rememberDevice(user, deviceHash, attempt.IP, attempt.UserAgent)
+	if attempt.RiskAction == riskActionNotify {
+		go s.emailSignInNotice(app, user, attempt)
+	}
+
+	s.writeNewSession(w, r, http.StatusOK, app, user, session)
+}
+
+// handleGetUserDetails returns the user of the session validated by
+// userSessionMiddleware, with their roles, permissions and organizations
+func (s *Server) handleGetUserDetails(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*database.Session)
+	user := r.Context().Value("user").(*database.User)
+
+	roles, err := s.db.GetUserRoles(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user roles"))
+		return
+	}
+	names, permissions := rolePermissions(roles)
+
+	orgs, err := s.db.GetUserOrganizations(user.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch organizations"))
+		return
+	}
+
+	writeData(w, http.StatusOK, meResponse{
+		User:               selfView(user),
+		Roles:              names,
+		Permissions:        permissions,
+		Organizations:      orgs,
+		ActiveOrganization: activeOrganization(session, orgs),
+	})
+}
+
+// sendPasswordResetLink emails user a link to handleCompletePasswordReset,
+// replacing any link sent before
+func (s *Server) sendPasswordResetLink(app *database.Application, user *database.User) error {
+	token, err := generateKey("", 32)
+	if err != nil {
+		return err
+	}
+	err = s.db.CreateVerificationToken(&database.VerificationToken{
 		ID:            uuid.New().String(),
 		UserID:        user.ID,
 		ApplicationID: app.ID,
-		Token:         uuid.New().String(),
-		ExpiresAt:     expiresAt,
+		Purpose:       database.TokenPurposePasswordReset,
+		TokenHash:     hashToken(token),
+		ExpiresAt:     time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
 	}
 
-	if err := s.db.CreateSession(session); err != nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Failed to create session",
-		})
+	link := appURL(app, "/reset-password", url.Values{"token": {token}})
+	body := "You need to choose a new password for your " + app.Name + " account before you can sign in again:\n\n" + link +
+		"\n\nThe link expires in 24 hours. Signing in with your current password sends a new one."
+	return s.mailer.Send(user.Email, "Choose a new password", body)
+}
+
+// handleCompletePasswordReset sets a new password for a user who must reset
+// theirs, using the token from the emailed link, and signs them in
+func (s *Server) handleCompletePasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req completePasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
 		return
 	}
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data: userResponse{
-			SessionToken: session.Token,
-			ExpiresAt:    expiresAt.Format(time.RFC3339),
-		},
-	})
-}
+	app := r.Context().Value("application").(*database.Application)
 
-func (s *Server) handleGetUserDetails(w http.ResponseWriter, r *http.Request) {
-	sessionToken := r.Header.Get("X-Session-Token")
-	if sessionToken == "" {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Session token required",
-		})
+	// The token is only used up with the new password, so that a password
+	// the policy rejects can be corrected
+	token, err := s.db.GetVerificationToken(database.TokenPurposePasswordReset, hashToken(req.Token))
+	if err != nil {
+		writeError(w, r, internalError("Failed to look up token"))
+		return
+	}
+	if token == nil || token.ApplicationID != app.ID || token.ExpiresAt.Before(time.Now()) {
+		writeError(w, r, errInvalidVerificationToken)
 		return
 	}
 
-	// Get session by token
-	session, err := s.db.GetSessionByToken(sessionToken)
-	if err != nil || session == nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Invalid session",
-		})
+	user, err := s.db.GetApplicationUser(app.ID, token.UserID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch user"))
+		return
+	}
+	if user == nil {
+		writeError(w, r, errUserNotFound)
 		return
 	}
 
-	// Check if session is expired
-	if session.ExpiresAt.Before(time.Now()) {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "Session expired",
-		})
+	attempt := s.newLoginAttempt(r, user, database.LoginMethodPasswordReset)
+	if user.Status != database.UserStatusActive {
+		s.rejectLogin(w, r, app, attempt, errAccountDisabled)
+		return
+	}
+	if !user.PasswordResetRequired {
+		writeError(w, r, errPasswordResetNotRequired)
 		return
 	}
 
-	// Get user by ID
-	user, err := s.db.GetUserByID(session.UserID)
-	if err != nil || user == nil {
-		json.NewEncoder(w).Encode(APIResponse{
-			Success: false,
-			Error:   "User not found",
-		})
+	reused, _, err := s.verifyPassword(req.NewPassword, user.PasswordHash)
+	if err != nil {
+		writeError(w, r, internalError("Failed to verify password"))
+		return
+	}
+	if reused {
+		writeError(w, r, validationError([]FieldError{{
+			Field: "newPassword", Code: codePasswordReused, Message: "newPassword must differ from the current password",
+		}}))
+		return
+	}
+	if errs := s.checkPassword(app.PasswordPolicy, user.Email, req.NewPassword); len(errs) > 0 {
+		for i := range errs {
+			errs[i].Field = "newPassword"
+		}
+		writeError(w, r, validationError(errs))
 		return
 	}
 
-	json.NewEncoder(w).Encode(APIResponse{
-		Success: true,
-		Data:    user,
-	})
+	hash, err := s.hashPassword(req.NewPassword)
+	if err != nil {
+		writeError(w, r, internalError("Failed to hash password"))
+		return
+	}
+	if err := s.db.CompletePasswordReset(token, hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errInvalidVerificationToken)
+			return
+		}
+		writeError(w, r, internalError("Failed to update password"))
+		return
+	}
+	user.PasswordResetRequired = false
+
+	session := newUserSession(user, database.AuthMethodPassword, database.AuthMethodEmail)
+	event := newEvent(app.ID, eventUserLogin, loginEventData{User: user, SessionID: session.ID, IP: s.clientIP(r)})
+	if err := s.db.CreateSession(session, event); err != nil {
+		writeError(w, r, internalError("Failed to create session"))
+		return
+	}
+	attempt.Success = true
+	attempt.MFA = true
+	attempt.SessionID = session.ID
+	s.recordLoginAttempt(app, attempt)
+
+	s.writeNewSession(w, r, http.StatusOK, app, user, session)
 }
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validation error codes returned in FieldError.Code
+const (
+	codeRequired      = "required"
+	codeTooLong       = "too_long"
+	codeInvalidEmail  = "invalid_email"
+	codeInvalidDomain = "invalid_domain"
+)
+
+const (
+	maxNameLength     = 100
+	maxEmailLength    = 254
+	maxDomainLength   = 253
+	maxPasswordLength = 72 // bcrypt ignores anything past 72 bytes
+)
+
+// FieldError describes a single invalid field in a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validator collects field errors while checking a request
+type validator struct {
+	errors []FieldError
+}
+
+func (v *validator) add(field, code, message string) {
+	v.errors = append(v.errors, FieldError{Field: field, Code: code, Message: message})
+}
+
+// required reports whether value is non-blank, recording an error if not
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, codeRequired, field+" is required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) maxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		v.add(field, codeTooLong, field+" must be at most "+strconv.Itoa(max)+" characters")
+	}
+}
+
+func (v *validator) name(field, value string) {
+	if v.required(field, value) {
+		v.maxLength(field, value, maxNameLength)
+	}
+}
+
+func (v *validator) email(field, value string) {
+	if !v.required(field, value) {
+		return
+	}
+	if len(value) > maxEmailLength {
+		v.add(field, codeTooLong, field+" must be at most "+strconv.Itoa(maxEmailLength)+" characters")
+		return
+	}
+	if !isValidEmail(value) {
+		v.add(field, codeInvalidEmail, field+" must be a valid email address")
+	}
+}
+
+func (v *validator) password(field, value string) {
+	if value == "" {
+		v.add(field, codeRequired, field+" is required")
+		return
+	}
+	if len(value) > maxPasswordLength {
+		v.add(field, codeTooLong, field+" must be at most "+strconv.Itoa(maxPasswordLength)+" bytes")
+	}
+}
+
+func (v *validator) domain(field, value string) {
+	if !v.required(field, value) {
+		return
+	}
+	if len(value) > maxDomainLength {
+		v.add(field, codeTooLong, field+" must be at most "+strconv.Itoa(maxDomainLength)+" characters")
+		return
+	}
+	if !isValidDomain(value) {
+		v.add(field, codeInvalidDomain, field+" must be a hostname or an http(s) URL")
+	}
+}
+
+// isValidEmail accepts a bare addr-spec such as "jane@example.com"
+func isValidEmail(value string) bool {
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		return false
+	}
+	at := strings.LastIndex(value, "@")
+	return at > 0 && isValidHostname(value[at+1:])
+}
+
+// isValidDomain accepts either a hostname (optionally with a port) or an
+// http(s) origin URL such as "https://app.example.com"
+func isValidDomain(value string) bool {
+	if strings.Contains(value, "://") {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return false
+		}
+		if u.User != nil || u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+			return false
+		}
+		return isValidHostname(u.Hostname())
+	}
+
+	host := value
+	if h, port, ok := strings.Cut(value, ":"); ok {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+		host = h
+	}
+	return isValidHostname(host)
+}
+
+func isValidHostname(host string) bool {
+	if host == "" || len(host) > maxDomainLength {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r registerRequest) validate() []FieldError {
+	var v validator
+	v.name("firstName", r.FirstName)
+	v.name("lastName", r.LastName)
+	v.email("email", r.Email)
+	v.password("password", r.Password)
+	return v.errors
+}
+
+func (r loginRequest) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	v.required("password", r.Password)
+	return v.errors
+}
+
+func (r userRegisterRequest) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	v.password("password", r.Password)
+	v.name("firstName", r.FirstName)
+	v.name("lastName", r.LastName)
+	v.maxLength("inviteCode", r.InviteCode, maxInviteCodeLength)
+	return v.errors
+}
+
+func (r userLoginRequest) validate() []FieldError {
+	var v validator
+	v.email("email", r.Email)
+	v.required("password", r.Password)
+	return v.errors
+}
+
+func (r completePasswordResetRequest) validate() []FieldError {
+	var v validator
+	v.required("token", r.Token)
+	v.password("newPassword", r.NewPassword)
+	return v.errors
+}
+
+func (r applicationRequest) validate() []FieldError {
+	var v validator
+	v.name("name", r.Name)
+	v.domain("domain", r.Domain)
+	return v.errors
+}
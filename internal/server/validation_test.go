@@ -0,0 +1,81 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"jane@example.com", true},
+		{"jane.doe+tag@sub.example.co", true},
+		{"", false},
+		{"jane", false},
+		{"jane@", false},
+		{"@example.com", false},
+		{"Jane <jane@example.com>", false},
+		{"jane@exa mple.com", false},
+		{"jane@-example.com", false},
+	}
+	for _, tt := range tests {
+		if got := isValidEmail(tt.email); got != tt.want {
+			t.Errorf("isValidEmail(%q) = %v; want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"localhost:3000", true},
+		{"https://app.example.com", true},
+		{"http://localhost:8080/", true},
+		{"ftp://example.com", false},
+		{"https://example.com/path", false},
+		{"https://user@example.com", false},
+		{"example.com:99999", false},
+		{"exa_mple.com", false},
+		{"not a domain", false},
+	}
+	for _, tt := range tests {
+		if got := isValidDomain(tt.domain); got != tt.want {
+			t.Errorf("isValidDomain(%q) = %v; want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterRequestValidate(t *testing.T) {
+	req := registerRequest{
+		FirstName: "",
+		LastName:  strings.Repeat("a", maxNameLength+1),
+		Email:     "not-an-email",
+		Password:  "",
+	}
+
+	errs := req.validate()
+	want := map[string]string{
+		"firstName": codeRequired,
+		"lastName":  codeTooLong,
+		"email":     codeInvalidEmail,
+		"password":  codeRequired,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d field errors; got %v", len(want), errs)
+	}
+	for _, e := range errs {
+		if want[e.Field] != e.Code {
+			t.Errorf("field %s: expected code %q; got %q", e.Field, want[e.Field], e.Code)
+		}
+	}
+
+	valid := registerRequest{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Password: "secret"}
+	if errs := valid.validate(); len(errs) != 0 {
+		t.Errorf("expected no field errors; got %v", errs)
+	}
+}
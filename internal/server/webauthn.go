@@ -0,0 +1,413 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// webAuthnConfig identifies this service to authenticators. Passkeys are
+// bound to rpID, and responses are only accepted from origins.
+type webAuthnConfig struct {
+	rpID    string
+	rpName  string
+	origins []string
+}
+
+// newWebAuthnConfig configures passkeys for rpID and the comma-separated
+// origins. Either defaults to that of dashboardURL; with neither, passkeys
+// are unavailable.
+func newWebAuthnConfig(rpID, origins, dashboardURL, rpName string) (webAuthnConfig, error) {
+	c := webAuthnConfig{rpID: rpID, rpName: rpName}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			c.origins = append(c.origins, strings.TrimRight(origin, "/"))
+		}
+	}
+	if dashboardURL != "" && (c.rpID == "" || len(c.origins) == 0) {
+		u, err := url.Parse(dashboardURL)
+		if err != nil || u.Host == "" {
+			return c, fmt.Errorf("invalid dashboard URL %q", dashboardURL)
+		}
+		if c.rpID == "" {
+			c.rpID = u.Hostname()
+		}
+		if len(c.origins) == 0 {
+			c.origins = []string{u.Scheme + "://" + u.Host}
+		}
+	}
+	return c, nil
+}
+
+func (c webAuthnConfig) enabled() bool {
+	return c.rpID != "" && len(c.origins) > 0
+}
+
+// COSE algorithms (RFC 9053) offered for new passkeys
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags
+const (
+	authDataUserPresent  = 0x01
+	authDataAttestedData = 0x40
+)
+
+// passkeyCredential is a PublicKeyCredential as serialized by its toJSON
+// method. Registration fills in AttestationObject, and authentication
+// AuthenticatorData and Signature.
+type passkeyCredential struct {
+	ID       string `json:"id"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+// collectedClientData is the part of the client data we check
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is parsed authenticator data. CredentialID and
+// PublicKey are only set on registration.
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// decodeBase64URL decodes base64url with or without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// checkClientData verifies the client data of a ceremony of type typ
+// answering challenge, returning its SHA-256 hash
+func (c webAuthnConfig) checkClientData(encoded, typ, challenge string) ([]byte, error) {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, errors.New("client data is not base64url")
+	}
+	var data collectedClientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, errors.New("client data is not JSON")
+	}
+	if data.Type != typ {
+		return nil, fmt.Errorf("client data type is %q", data.Type)
+	}
+	if data.Challenge != challenge {
+		return nil, errors.New("challenge does not match")
+	}
+	if !slices.Contains(c.origins, data.Origin) {
+		return nil, fmt.Errorf("origin %q is not allowed", data.Origin)
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+// parseAuthenticatorData parses authenticator data and checks it is for
+// rpID and the user was present
+func (c webAuthnConfig) parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	data := &authenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	if !bytes.Equal(data.RPIDHash, rpIDHash[:]) {
+		return nil, errors.New("authenticator data is for another relying party")
+	}
+	if data.Flags&authDataUserPresent == 0 {
+		return nil, errors.New("user was not present")
+	}
+
+	if data.Flags&authDataAttestedData != 0 {
+		// AAGUID, credential ID length and ID, then the COSE_Key
+		rest := b[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, errors.New("credential ID is truncated")
+		}
+		data.CredentialID, rest = rest[:n], rest[n:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("credential public key: %w", err)
+		}
+		data.PublicKey = rest[:len(rest)-len(after)]
+	}
+	return data, nil
+}
+
+// verifyRegistration checks the response to a passkey creation with
+// challenge, returning the new credential. Attestation statements are not
+// verified; we ask for none, since we only need the key.
+func (c webAuthnConfig) verifyRegistration(cred passkeyCredential, challenge string) (*authenticatorData, error) {
+	if _, err := c.checkClientData(cred.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	raw, err := decodeBase64URL(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, errors.New("attestation object is not base64url")
+	}
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("attestation object: %w", err)
+	}
+	object, _ := decoded.(map[interface{}]interface{})
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object has no authenticator data")
+	}
+
+	data, err := c.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if data.PublicKey == nil {
+		return nil, errors.New("authenticator data has no credential")
+	}
+	if base64.RawURLEncoding.EncodeToString(data.CredentialID) != strings.TrimRight(cred.ID, "=") {
+		return nil, errors.New("credential ID does not match")
+	}
+	if _, err := parseCOSEKey(data.PublicKey); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// verifyAssertion checks the response to a passkey sign-in with challenge
+// against the credential's COSE public key and last signature counter,
+// returning the new counter
+func (c webAuthnConfig) verifyAssertion(cred passkeyCredential, challenge string, publicKey []byte, signCount uint32) (uint32, error) {
+	clientDataHash, err := c.checkClientData(cred.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := decodeBase64URL(cred.Response.AuthenticatorData)
+	if err != nil {
+		return 0, errors.New("authenticator data is not base64url")
+	}
+	signature, err := decodeBase64URL(cred.Response.Signature)
+	if err != nil {
+		return 0, errors.New("signature is not base64url")
+	}
+
+	data, err := c.parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	if !key.verify(append(authData, clientDataHash...), signature) {
+		return 0, errors.New("signature is invalid")
+	}
+
+	// Authenticators that count signatures always increase the counter; a
+	// counter that did not suggests a cloned authenticator
+	if (data.SignCount != 0 || signCount != 0) && data.SignCount <= signCount {
+		return 0, errors.New("signature counter did not increase")
+	}
+	return data.SignCount, nil
+}
+
+// cosePublicKey is a passkey's public key
+type cosePublicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parseCOSEKey parses an ES256 (P-256) or RS256 COSE_Key
+func parseCOSEKey(b []byte) (*cosePublicKey, error) {
+	decoded, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("public key is not a COSE_Key")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("public key is not a P-256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("public key is not on P-256")
+		}
+		return &cosePublicKey{alg: alg, key: key}, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("public key is not a 2048-bit or larger RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		if exponent < 3 || exponent%2 == 0 {
+			return nil, errors.New("public key has an invalid RSA exponent")
+		}
+		return &cosePublicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+}
+
+func (k *cosePublicKey) verify(data, signature []byte) bool {
+	digest := sha256.Sum256(data)
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// cborMaxDepth bounds the nesting of decoded CBOR items
+const cborMaxDepth = 8
+
+// decodeCBOR decodes the first CBOR item (RFC 8949) in b, returning it and
+// the bytes after it. It supports what WebAuthn uses: integers as int64,
+// byte strings, text strings, arrays, maps with integer or text keys,
+// booleans and null. Tags are dropped; indefinite lengths and floats are
+// rejected.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		for _, c := range b[:size] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[size:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported length encoding %d", info)
+	}
+
+	switch major {
+	case 0, 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		if major == 1 {
+			return -1 - int64(n), b, nil
+		}
+		return int64(n), b, nil
+	case 2, 3:
+		if n > uint64(len(b)) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if major == 2 {
+			return b[:n], b[n:], nil
+		}
+		return string(b[:n]), b[n:], nil
+	case 4:
+		// Every item takes at least a byte
+		if n > uint64(len(b)) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			item, rest, err := decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, b = append(items, item), rest
+		}
+		return items, b, nil
+	case 5:
+		if n > uint64(len(b))/2 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key type")
+			}
+			value, rest, err := decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key], b = value, rest
+		}
+		return m, b, nil
+	default: // 6, a tag
+		return decodeCBORItem(b, depth+1)
+	}
+}
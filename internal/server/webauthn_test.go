@@ -0,0 +1,262 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Minimal CBOR encoding for building authenticator responses
+
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+func cborInt(n int) []byte {
+	if n < 0 {
+		return cborHead(1, -1-n)
+	}
+	return cborHead(0, n)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}
+
+// cborMap encodes alternating keys and values, already encoded
+func cborMap(pairs ...[]byte) []byte {
+	out := cborHead(5, len(pairs)/2)
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"small int", []byte{0x0a}, int64(10)},
+		{"uint16", []byte{0x19, 0x01, 0x00}, int64(256)},
+		{"negative", []byte{0x26}, int64(-7)},
+		{"negative uint16", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"bytes", []byte{0x42, 0x01, 0x02}, []byte{1, 2}},
+		{"text", []byte{0x63, 'f', 'm', 't'}, "fmt"},
+		{"array", []byte{0x82, 0x01, 0xf5}, []interface{}{int64(1), true}},
+		{"map", cborMap(cborInt(1), cborInt(2), cborText("a"), []byte{0xf6}),
+			map[interface{}]interface{}{int64(1): int64(2), "a": nil}},
+		{"tag", []byte{0xc1, 0x01}, int64(1)},
+	}
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(append(tt.in, 0xff))
+		if err != nil {
+			t.Errorf("%s: decodeCBOR() error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decodeCBOR() = %#v; want %#v", tt.name, got, tt.want)
+		}
+		if len(rest) != 1 || rest[0] != 0xff {
+			t.Errorf("%s: expected the trailing byte left over; got %x", tt.name, rest)
+		}
+	}
+}
+
+func TestDecodeCBORRejectsMalformedInput(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":             {},
+		"truncated length":  {0x19, 0x01},
+		"truncated bytes":   {0x45, 0x01},
+		"huge array":        {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"indefinite length": {0x5f},
+		"float":             {0xfa, 0, 0, 0, 0},
+		"array key":         cborMap([]byte{0x80}, cborInt(1)),
+		"too deep":          {0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x01},
+	}
+	for name, in := range tests {
+		if _, _, err := decodeCBOR(in); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// testAuthenticator is a software passkey for testing WebAuthn ceremonies
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	rpID         string
+	origin       string
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T, rpID, origin string) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{key: key, credentialID: []byte("credential-1"), rpID: rpID, origin: origin}
+}
+
+func (a *testAuthenticator) coseKey() []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	return cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(coseAlgES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(x),
+		cborInt(-3), cborBytes(y),
+	)
+}
+
+func (a *testAuthenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *testAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(collectedClientData{Type: typ, Challenge: challenge, Origin: a.origin})
+	return b
+}
+
+func (a *testAuthenticator) create(challenge string) passkeyCredential {
+	var cred passkeyCredential
+	cred.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	cred.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge))
+	object := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(a.authData(authDataUserPresent|authDataAttestedData, true)),
+	)
+	cred.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(object)
+	return cred
+}
+
+func (a *testAuthenticator) get(t *testing.T, challenge string) passkeyCredential {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authData(authDataUserPresent, false)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cred passkeyCredential
+	cred.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	cred.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	cred.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	cred.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	return cred
+}
+
+func TestNewWebAuthnConfig(t *testing.T) {
+	c, err := newWebAuthnConfig("", "", "https://dashboard.example.com:8443/app", "Example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.rpID != "dashboard.example.com" || !reflect.DeepEqual(c.origins, []string{"https://dashboard.example.com:8443"}) {
+		t.Errorf("expected defaults from the dashboard URL; got %+v", c)
+	}
+
+	c, err = newWebAuthnConfig("example.com", "https://a.example.com, https://b.example.com/", "", "Example")
+	if err != nil || c.rpID != "example.com" || len(c.origins) != 2 || c.origins[1] != "https://b.example.com" {
+		t.Errorf("expected the configured relying party; got %+v, %v", c, err)
+	}
+
+	if c, _ := newWebAuthnConfig("", "", "", "Example"); c.enabled() {
+		t.Error("expected passkeys to be disabled without configuration")
+	}
+}
+
+func TestPasskeyRegistrationAndAssertion(t *testing.T) {
+	c := webAuthnConfig{rpID: "example.com", origins: []string{"https://example.com"}}
+	a := newTestAuthenticator(t, "example.com", "https://example.com")
+
+	data, err := c.verifyRegistration(a.create("register-challenge"), "register-challenge")
+	if err != nil {
+		t.Fatalf("verifyRegistration() error = %v", err)
+	}
+	if string(data.CredentialID) != "credential-1" {
+		t.Errorf("expected credential-1; got %q", data.CredentialID)
+	}
+
+	count, err := c.verifyAssertion(a.get(t, "login-challenge"), "login-challenge", data.PublicKey, data.SignCount)
+	if err != nil {
+		t.Fatalf("verifyAssertion() error = %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected sign count 1; got %d", count)
+	}
+
+	if _, err := c.verifyAssertion(a.get(t, "login-challenge"), "login-challenge", data.PublicKey, 5); err == nil {
+		t.Error("expected a sign count that did not increase to be rejected")
+	}
+}
+
+func TestPasskeyVerificationFailures(t *testing.T) {
+	c := webAuthnConfig{rpID: "example.com", origins: []string{"https://example.com"}}
+	a := newTestAuthenticator(t, "example.com", "https://example.com")
+	data, err := c.verifyRegistration(a.create("challenge"), "challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.verifyRegistration(a.create("challenge"), "other"); err == nil {
+		t.Error("expected a wrong challenge to be rejected")
+	}
+
+	evil := newTestAuthenticator(t, "example.com", "https://evil.example")
+	if _, err := c.verifyRegistration(evil.create("challenge"), "challenge"); err == nil {
+		t.Error("expected a foreign origin to be rejected")
+	}
+
+	other := newTestAuthenticator(t, "other.com", "https://example.com")
+	if _, err := c.verifyRegistration(other.create("challenge"), "challenge"); err == nil {
+		t.Error("expected another relying party to be rejected")
+	}
+
+	tampered := a.get(t, "challenge")
+	tampered.Response.Signature = a.get(t, "other").Response.Signature
+	if _, err := c.verifyAssertion(tampered, "challenge", data.PublicKey, 0); err == nil {
+		t.Error("expected a signature over other client data to be rejected")
+	}
+
+	wrongKey := newTestAuthenticator(t, "example.com", "https://example.com")
+	if _, err := c.verifyAssertion(wrongKey.get(t, "challenge"), "challenge", data.PublicKey, 0); err == nil {
+		t.Error("expected a signature by another key to be rejected")
+	}
+
+	create := a.create("challenge")
+	if _, err := c.verifyAssertion(create, "challenge", data.PublicKey, 0); err == nil {
+		t.Error("expected a creation response to be rejected as an assertion")
+	}
+}
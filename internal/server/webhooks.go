@@ -0,0 +1,675 @@
+package server
+
+import (
+	"auth-server/internal/database"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Types of the events recorded in the outbox
+const (
+	eventUserCreated    = "user.created"
+	eventUserUpdated    = "user.updated"
+	eventUserDeleted    = "user.deleted"
+	eventUserLogin      = "user.login"
+	eventUserDisabled   = "user.disabled"
+	eventUserEnabled    = "user.enabled"
+	eventUserLocked     = "user.locked"
+	eventSessionRevoked = "session.revoked"
+)
+
+var webhookEventTypes = []string{
+	eventUserCreated, eventUserUpdated, eventUserDeleted, eventUserLogin,
+	eventUserDisabled, eventUserEnabled, eventUserLocked, eventSessionRevoked,
+}
+
+// webhookAllEvents subscribes an endpoint to every event type, including
+// ones added later
+const webhookAllEvents = "*"
+
+const (
+	maxWebhookURLLength      = 2048
+	maxWebhookEndpoints      = 20
+	webhookSecretPrefix      = "whsec_"
+	webhookSecretLength      = 32
+	webhookDeliveryPageSize  = 100
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+	maxWebhookAttempts       = 8
+	webhookBaseRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay     = 6 * time.Hour
+	webhookPollInterval      = 10 * time.Second
+	webhookDispatchBatch     = 50
+	webhookRequestTimeout    = 10 * time.Second
+	maxWebhookErrorLength    = 500
+	webhookResolveTimeout    = 5 * time.Second
+)
+
+// sessionRevokedData is the data of a session.revoked event
+type sessionRevokedData struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// userDeletedData is the data of a user.deleted event
+type userDeletedData struct {
+	UserID    string `json:"userId"`
+	EmailHash string `json:"emailHash"`
+	ErasedBy  string `json:"erasedBy"`
+}
+
+func newUserDeletedData(record *database.ErasureRecord) userDeletedData {
+	return userDeletedData{UserID: record.UserID, EmailHash: record.EmailHash, ErasedBy: record.ErasedBy}
+}
+
+// Reasons given in session.revoked events
+const (
+	revokedPasswordChanged       = "password_changed"
+	revokedUserDisabled          = "user_disabled"
+	revokedPasswordResetRequired = "password_reset_required"
+)
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+func (r webhookRequest) validate() []FieldError {
+	var v validator
+	if v.required("url", r.URL) {
+		v.webhookURL("url", r.URL)
+	}
+	v.webhookEvents("events", r.Events)
+	return v.errors
+}
+
+type updateWebhookRequest struct {
+	URL     *string  `json:"url"`
+	Events  []string `json:"events"`
+	Enabled *bool    `json:"enabled"`
+	// RotateSecret replaces the signing secret
+	RotateSecret bool `json:"rotateSecret"`
+}
+
+func (r updateWebhookRequest) validate() []FieldError {
+	var v validator
+	if r.URL != nil && v.required("url", *r.URL) {
+		v.webhookURL("url", *r.URL)
+	}
+	if r.Events != nil {
+		v.webhookEvents("events", r.Events)
+	}
+	return v.errors
+}
+
+func (v *validator) webhookURL(field, value string) {
+	if len(value) > maxWebhookURLLength {
+		v.add(field, codeTooLong, field+" must be at most 2048 characters")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(field, "invalid_url", field+" must be an absolute http or https URL")
+	}
+}
+
+// publicWebhookAddr reports whether webhooks may be sent to ip. Loopback,
+// private, link-local, multicast and unspecified addresses are refused so
+// that webhooks cannot reach the server's own network.
+func publicWebhookAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// resolveWebhookHost looks up the addresses of a webhook host
+var resolveWebhookHost = net.DefaultResolver.LookupNetIP
+
+// checkWebhookURL resolves the host of a validated webhook URL, returning a
+// field error unless every address it resolves to is public. The dispatcher
+// checks again when it connects, since DNS may change after this.
+func checkWebhookURL(ctx context.Context, field, value string) []FieldError {
+	u, err := url.Parse(value)
+	if err != nil {
+		return []FieldError{{Field: field, Code: "invalid_url", Message: field + " must be an absolute http or https URL"}}
+	}
+	ctx, cancel := context.WithTimeout(ctx, webhookResolveTimeout)
+	defer cancel()
+	ips, err := resolveWebhookHost(ctx, "ip", u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return []FieldError{{Field: field, Code: "unresolvable_host", Message: field + " host could not be resolved"}}
+	}
+	for _, ip := range ips {
+		if !publicWebhookAddr(ip) {
+			return []FieldError{{Field: field, Code: "disallowed_host", Message: field + " must not point to a private or local address"}}
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns the HTTP client webhooks are sent with. It only
+// connects to addresses allowed by allow, checked on the resolved address so
+// that DNS rebinding cannot get around it, and does not follow redirects.
+func newWebhookClient(allow func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allow(addrPort.Addr()) {
+				return fmt.Errorf("webhook destination %s is not a public address", addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   webhookRequestTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (v *validator) webhookEvents(field string, events []string) {
+	if len(events) == 0 {
+		v.add(field, codeRequired, field+" must list at least one event type")
+		return
+	}
+	for _, e := range events {
+		if !isWebhookEventType(e) {
+			v.add(field, "unknown_event", "unknown event type "+strconv.Quote(e))
+			return
+		}
+	}
+}
+
+func isWebhookEventType(e string) bool {
+	if e == webhookAllEvents {
+		return true
+	}
+	for _, t := range webhookEventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed reports whether endpoint should receive events of eventType
+func subscribed(endpoint *database.WebhookEndpoint, eventType string) bool {
+	if !endpoint.Enabled {
+		return false
+	}
+	for _, e := range endpoint.Events {
+		if e == eventType || e == webhookAllEvents {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookRetryDelay returns how long to wait before retrying a delivery that
+// has failed attempts times
+func webhookRetryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	shift := attempts - 1
+	if shift > 20 {
+		return webhookMaxRetryDelay
+	}
+	d := webhookBaseRetryDelay << shift
+	if d > webhookMaxRetryDelay {
+		return webhookMaxRetryDelay
+	}
+	return d
+}
+
+// signWebhook returns the signature of a webhook body sent at timestamp,
+// computed like the request signatures of the API: an HMAC-SHA256 of the
+// timestamp followed by the body, keyed with the endpoint's secret
+func signWebhook(secret, timestamp string, body []byte) string {
+	return generateHMAC(timestamp+string(body), secret)
+}
+
+// webhookDispatcher sends pending webhook deliveries in the background.
+// Deliveries are stored before they are sent, so pending ones survive a
+// restart; when several instances share a database an event may be sent
+// more than once, which receivers can detect by its id.
+type webhookDispatcher struct {
+	db      database.Service
+	client  *http.Client
+	wakeup  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newWebhookDispatcher(db database.Service) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:      db,
+		client:  newWebhookClient(publicWebhookAddr),
+		wakeup:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// wake makes the dispatcher look for due deliveries now rather than at its
+// next poll
+func (d *webhookDispatcher) wake() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends run after the delivery in progress, if any
+func (d *webhookDispatcher) stop() {
+	close(d.done)
+	<-d.stopped
+}
+
+func (d *webhookDispatcher) run() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+
+	for {
+		if time.Since(lastPrune) >= time.Hour {
+			lastPrune = time.Now()
+			if _, err := d.db.DeleteWebhookDeliveriesBefore(lastPrune.Add(-webhookDeliveryRetention)); err != nil {
+				log.Printf("failed to prune webhook deliveries: %v", err)
+			}
+		}
+		d.dispatchDue()
+
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		case <-d.wakeup:
+		}
+	}
+}
+
+// dispatchDue attempts due deliveries until none are left
+func (d *webhookDispatcher) dispatchDue() {
+	for {
+		due, err := d.db.GetDueWebhookDeliveries(time.Now(), webhookDispatchBatch)
+		if err != nil {
+			log.Printf("failed to fetch due webhook deliveries: %v", err)
+			return
+		}
+		for i := range due {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			d.attempt(&due[i])
+		}
+		if len(due) < webhookDispatchBatch {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery once and records the outcome, scheduling a retry
+// on failure until maxWebhookAttempts is reached
+func (d *webhookDispatcher) attempt(delivery *database.WebhookDelivery) {
+	endpoint, err := d.db.GetWebhookEndpoint(delivery.ApplicationID, delivery.EndpointID)
+	if err != nil {
+		log.Printf("failed to fetch webhook %s: %v", delivery.EndpointID, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.ResponseStatus = 0
+	delivery.LastError = ""
+	switch {
+	case endpoint == nil:
+		delivery.LastError = "webhook endpoint was deleted"
+	case !endpoint.Enabled:
+		delivery.LastError = "webhook endpoint is disabled"
+	default:
+		delivery.ResponseStatus, err = d.send(endpoint, delivery, now)
+		if err != nil {
+			delivery.LastError = err.Error()
+		}
+	}
+
+	switch {
+	case delivery.LastError == "":
+		delivery.Status = database.WebhookDeliverySucceeded
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+	case endpoint == nil || !endpoint.Enabled || delivery.Attempts >= maxWebhookAttempts:
+		delivery.Status = database.WebhookDeliveryFailed
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(webhookRetryDelay(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+	if len(delivery.LastError) > maxWebhookErrorLength {
+		delivery.LastError = delivery.LastError[:maxWebhookErrorLength]
+	}
+
+	if err := d.db.UpdateWebhookDelivery(delivery); err != nil {
+		log.Printf("failed to record webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// send posts the delivery's payload to endpoint, returning the response
+// status and an error unless it was 2xx. The response body is never kept,
+// since the endpoint may be anything the URL reaches.
+func (d *webhookDispatcher) send(endpoint *database.WebhookEndpoint, delivery *database.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "auth-server-webhooks")
+	req.Header.Set("X-Webhook-Id", delivery.EventID)
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(endpoint.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// applicationWebhook returns the webhook endpoint named by the webhookId URL
+// parameter, writing an error response and returning false if app has no
+// such endpoint
+func (s *Server) applicationWebhook(w http.ResponseWriter, r *http.Request, app *database.Application) (*database.WebhookEndpoint, bool) {
+	endpoint, err := s.db.GetWebhookEndpoint(app.ID, chi.URLParam(r, "webhookId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch webhook"))
+		return nil, false
+	}
+	if endpoint == nil {
+		writeError(w, r, errWebhookNotFound)
+		return nil, false
+	}
+	return endpoint, true
+}
+
+// redactWebhook hides the signing secret from read-only team members of
+// app, as redactApplication does for its secret key
+func redactWebhook(app *database.Application, endpoint *database.WebhookEndpoint) {
+	if app.Role == database.TeamRoleReadOnly {
+		endpoint.Secret = ""
+	}
+}
+
+func (s *Server) handleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+
+	endpoints, err := s.db.GetWebhookEndpoints(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch webhooks"))
+		return
+	}
+	for i := range endpoints {
+		redactWebhook(app, &endpoints[i])
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"webhooks":   endpoints,
+		"count":      len(endpoints),
+		"eventTypes": webhookEventTypes,
+	})
+}
+
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	if errs := checkWebhookURL(r.Context(), "url", req.URL); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	existing, err := s.db.GetWebhookEndpoints(app.ID)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch webhooks"))
+		return
+	}
+	if len(existing) >= maxWebhookEndpoints {
+		writeError(w, r, errTooManyWebhooks)
+		return
+	}
+
+	secret, err := generateKey(webhookSecretPrefix, webhookSecretLength)
+	if err != nil {
+		writeError(w, r, internalError("Failed to generate webhook secret"))
+		return
+	}
+	endpoint := &database.WebhookEndpoint{
+		ID:            uuid.New().String(),
+		ApplicationID: app.ID,
+		URL:           req.URL,
+		Secret:        secret,
+		Events:        req.Events,
+		Enabled:       req.Enabled == nil || *req.Enabled,
+	}
+
+	if err := s.db.CreateWebhookEndpoint(endpoint); err != nil {
+		writeError(w, r, internalError("Failed to create webhook"))
+		return
+	}
+	auditAfter(r, endpoint)
+
+	writeData(w, http.StatusCreated, endpoint)
+}
+
+func (s *Server) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	endpoint, ok := s.applicationWebhook(w, r, app)
+	if !ok {
+		return
+	}
+	redactWebhook(app, endpoint)
+
+	writeData(w, http.StatusOK, endpoint)
+}
+
+func (s *Server) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req updateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidRequest)
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return
+	}
+
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	endpoint, ok := s.applicationWebhook(w, r, app)
+	if !ok {
+		return
+	}
+	if req.URL != nil {
+		if errs := checkWebhookURL(r.Context(), "url", *req.URL); len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+	}
+	auditBefore(r, endpoint)
+	auditAfter(r, endpoint)
+
+	if req.URL != nil {
+		endpoint.URL = *req.URL
+	}
+	if req.Events != nil {
+		endpoint.Events = req.Events
+	}
+	if req.Enabled != nil {
+		endpoint.Enabled = *req.Enabled
+	}
+	if req.RotateSecret {
+		secret, err := generateKey(webhookSecretPrefix, webhookSecretLength)
+		if err != nil {
+			writeError(w, r, internalError("Failed to generate webhook secret"))
+			return
+		}
+		endpoint.Secret = secret
+	}
+
+	if err := s.db.UpdateWebhookEndpoint(endpoint); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errWebhookNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to update webhook"))
+		return
+	}
+
+	writeData(w, http.StatusOK, endpoint)
+}
+
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	endpoint, ok := s.applicationWebhook(w, r, app)
+	if !ok {
+		return
+	}
+	auditBefore(r, endpoint)
+
+	if err := s.db.DeleteWebhookEndpoint(app.ID, endpoint.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, r, errWebhookNotFound)
+			return
+		}
+		writeError(w, r, internalError("Failed to delete webhook"))
+		return
+	}
+
+	writeData(w, http.StatusOK, nil)
+}
+
+// handleGetWebhookDeliveries returns the latest deliveries to a webhook
+func (s *Server) handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	endpoint, ok := s.applicationWebhook(w, r, app)
+	if !ok {
+		return
+	}
+
+	deliveries, err := s.db.GetWebhookDeliveries(endpoint.ID, webhookDeliveryPageSize)
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch webhook deliveries"))
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// handleRedeliverWebhook queues the event of an earlier delivery again as a
+// new delivery, keeping the event id so receivers can deduplicate it
+func (s *Server) handleRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	app, ok := s.ownedApplication(w, r)
+	if !ok {
+		return
+	}
+	endpoint, ok := s.applicationWebhook(w, r, app)
+	if !ok {
+		return
+	}
+
+	original, err := s.db.GetWebhookDelivery(endpoint.ID, chi.URLParam(r, "deliveryId"))
+	if err != nil {
+		writeError(w, r, internalError("Failed to fetch webhook delivery"))
+		return
+	}
+	if original == nil {
+		writeError(w, r, errWebhookDeliveryNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	delivery := database.WebhookDelivery{
+		ID:            uuid.New().String(),
+		EndpointID:    endpoint.ID,
+		ApplicationID: app.ID,
+		EventID:       original.EventID,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		Status:        database.WebhookDeliveryPending,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}
+	if err := s.db.CreateWebhookDeliveries([]database.WebhookDelivery{delivery}); err != nil {
+		writeError(w, r, internalError("Failed to queue webhook delivery"))
+		return
+	}
+	s.webhooks.wake()
+
+	writeData(w, http.StatusAccepted, delivery)
+}
@@ -0,0 +1,224 @@
+//go:build cgo
+
+package server
+
+import (
+	"auth-server/internal/database"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := webhookRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("webhookRetryDelay(%d) = %v; want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookSubscribed(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint database.WebhookEndpoint
+		event    string
+		want     bool
+	}{
+		{"listed", database.WebhookEndpoint{Enabled: true, Events: []string{eventUserCreated}}, eventUserCreated, true},
+		{"not listed", database.WebhookEndpoint{Enabled: true, Events: []string{eventUserCreated}}, eventUserLogin, false},
+		{"wildcard", database.WebhookEndpoint{Enabled: true, Events: []string{webhookAllEvents}}, eventSessionRevoked, true},
+		{"disabled", database.WebhookEndpoint{Enabled: false, Events: []string{webhookAllEvents}}, eventUserCreated, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subscribed(&tt.endpoint, tt.event); got != tt.want {
+				t.Errorf("subscribed() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookRequestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   webhookRequest
+		valid bool
+	}{
+		{"valid", webhookRequest{URL: "https://example.com/hooks", Events: []string{eventUserCreated}}, true},
+		{"wildcard", webhookRequest{URL: "http://localhost:8080/hooks", Events: []string{webhookAllEvents}}, true},
+		{"missing url", webhookRequest{Events: []string{eventUserCreated}}, false},
+		{"relative url", webhookRequest{URL: "/hooks", Events: []string{eventUserCreated}}, false},
+		{"other scheme", webhookRequest{URL: "ftp://example.com", Events: []string{eventUserCreated}}, false},
+		{"no events", webhookRequest{URL: "https://example.com/hooks"}, false},
+		{"unknown event", webhookRequest{URL: "https://example.com/hooks", Events: []string{"user.exploded"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.req.validate()
+			if (len(errs) == 0) != tt.valid {
+				t.Errorf("validate() = %v; want valid=%v", errs, tt.valid)
+			}
+		})
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	endpoint := &database.WebhookEndpoint{Secret: "whsec_test"}
+	payload, _ := json.Marshal(eventEnvelope{ID: "evt_1", Type: eventUserCreated})
+	delivery := &database.WebhookDelivery{EventID: "evt_1", EventType: eventUserCreated, Payload: payload}
+	now := time.Unix(1700000000, 0)
+
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Webhook-Timestamp") != "1700000000" {
+			t.Errorf("unexpected timestamp %q", r.Header.Get("X-Webhook-Timestamp"))
+		}
+		if want := generateHMAC("1700000000"+string(body), endpoint.Secret); r.Header.Get("X-Webhook-Signature") != want {
+			t.Errorf("signature %q does not match %q", r.Header.Get("X-Webhook-Signature"), want)
+		}
+		if r.Header.Get("X-Webhook-Id") != "evt_1" || r.Header.Get("X-Webhook-Event") != eventUserCreated {
+			t.Errorf("unexpected event headers %v", r.Header)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	endpoint.URL = srv.URL
+
+	d := newWebhookDispatcher(nil)
+	if _, err := d.send(endpoint, delivery, now); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the loopback test server to be refused; got %v", err)
+	}
+
+	d.client = newWebhookClient(func(netip.Addr) bool { return true })
+	if code, err := d.send(endpoint, delivery, now); err != nil || code != http.StatusNoContent {
+		t.Errorf("send() = %d, %v; want 204 and no error", code, err)
+	}
+
+	status = http.StatusInternalServerError
+	if code, err := d.send(endpoint, delivery, now); err == nil || code != http.StatusInternalServerError {
+		t.Errorf("send() = %d, %v; want 500 and an error", code, err)
+	}
+}
+
+func TestWebhookSendDoesNotFollowRedirects(t *testing.T) {
+	followed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			followed = true
+			return
+		}
+		w.Header().Set("Location", "/internal")
+		w.WriteHeader(http.StatusFound)
+		w.Write([]byte("secret internal page"))
+	}))
+	defer srv.Close()
+
+	d := newWebhookDispatcher(nil)
+	d.client = newWebhookClient(func(netip.Addr) bool { return true })
+	endpoint := &database.WebhookEndpoint{URL: srv.URL + "/hook", Secret: "whsec_test"}
+	code, err := d.send(endpoint, &database.WebhookDelivery{Payload: []byte("{}")}, time.Now())
+	if code != http.StatusFound || err == nil || followed {
+		t.Fatalf("expected the redirect to be returned as a failure; got %d, %v, followed %v", code, err, followed)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected the response body to be left out of the error; got %v", err)
+	}
+}
+
+func TestPublicWebhookAddr(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.7", true},
+		{"2001:db8::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicWebhookAddr(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("publicWebhookAddr(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		code string
+	}{
+		{"https://203.0.113.7/hooks", ""},
+		{"https://[2001:db8::1]:8443/hooks", ""},
+		{"http://127.0.0.1:8080/hooks", "disallowed_host"},
+		{"http://169.254.169.254/latest/meta-data", "disallowed_host"},
+		{"http://[::1]/hooks", "disallowed_host"},
+		{"http://0.0.0.0/hooks", "disallowed_host"},
+	}
+	for _, tt := range tests {
+		errs := checkWebhookURL(context.Background(), "url", tt.url)
+		if tt.code == "" {
+			if len(errs) != 0 {
+				t.Errorf("checkWebhookURL(%s) = %v; want no errors", tt.url, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Code != tt.code {
+			t.Errorf("checkWebhookURL(%s) = %v; want %s", tt.url, errs, tt.code)
+		}
+	}
+}
+
+func TestGetWebhooksRedactsSecretForReadOnly(t *testing.T) {
+	s := newTeamServer(t)
+	err := s.db.CreateWebhookEndpoint(&database.WebhookEndpoint{ID: "hook-1", ApplicationID: "app-1",
+		URL: "https://app.example.com/hook", Secret: "whsec_secret", Events: []string{webhookAllEvents}, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, developer := range []string{"reader", "member"} {
+		for _, w := range []*httptest.ResponseRecorder{
+			serveAs(s.handleGetWebhooks, "/api/applications/{id}/webhooks", http.MethodGet, "/api/applications/app-1/webhooks", "", developer),
+			serveAs(s.handleGetWebhook, "/api/applications/{id}/webhooks/{webhookId}", http.MethodGet, "/api/applications/app-1/webhooks/hook-1", "", developer),
+		} {
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "hook-1") {
+				t.Fatalf("%s: expected the webhook; got %d: %s", developer, w.Code, w.Body.String())
+			}
+			if leaked := strings.Contains(w.Body.String(), "whsec_secret"); leaked != (developer != "reader") {
+				t.Errorf("%s: secret in response = %v", developer, leaked)
+			}
+		}
+	}
+}